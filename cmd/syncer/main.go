@@ -18,20 +18,89 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/logger"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 	metadatasyncer "sigs.k8s.io/vsphere-csi-driver/pkg/syncer"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/syncer/admissionhandler"
+)
+
+// leaderElectionLockName is the name of the Lease used for leader election among syncer replicas
+const leaderElectionLockName = "vsphere-syncer"
+
+var (
+	fullSyncInterval = flag.Duration("full-sync-interval", 0,
+		"interval between full syncs of volume metadata with CNS, overrides FULL_SYNC_INTERVAL_MINUTES")
+	enableLeaderElection    = flag.Bool("leader-election", false, "enable leader election, so that only one of multiple syncer replicas is active")
+	leaderElectionNamespace = flag.String("leader-election-namespace", "kube-system", "namespace of the Lease used for leader election")
+	metricsAddress          = flag.String("metrics-address", "", "address to serve Prometheus metrics on at /metrics, disabled if empty")
+	logFormat               = flag.String("log-format", logger.FormatJSON, "format of the logs, \"json\" or \"text\"")
+	orphanVolumeCleanupAge  = flag.Duration("orphan-volume-cleanup-age", 0,
+		"delete CNS volumes, including their disks, which never had a PV, for at least this long, disabled if 0")
+	orphanVolumeCleanupDryRun = flag.Bool("orphan-volume-cleanup-dry-run", true,
+		"only log the orphan volumes which would be deleted by --orphan-volume-cleanup-age")
+	webhookAddress = flag.String("webhook-address", "",
+		"address to serve the StorageClass and PVC validating admission webhook on at /validate, disabled if empty")
+	webhookCertFile = flag.String("webhook-cert-file", "/etc/webhook/tls.crt", "TLS certificate of the admission webhook")
+	webhookKeyFile  = flag.String("webhook-key-file", "/etc/webhook/tls.key", "TLS private key of the admission webhook")
 )
 
 // main is ignored when this package is built as a go plug-in.
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
+	if err := logger.Init(*logFormat); err != nil {
+		klog.Errorf("Failed to initialize logging. Err: %v", err)
+		os.Exit(1)
+	}
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+	// The webhook is served by all replicas, not only by the leader
+	if *webhookAddress != "" {
+		go serveWebhook(*webhookAddress)
+	}
 	metadataSyncer := metadatasyncer.NewInformer()
-	if err := metadataSyncer.Init(); err != nil {
-		klog.Errorf("Error initializing Metadata Syncer")
+	metadataSyncer.SetFullSyncInterval(*fullSyncInterval)
+	metadataSyncer.SetOrphanVolumeCleanup(*orphanVolumeCleanupAge, *orphanVolumeCleanupDryRun)
+	run := func() {
+		if err := metadataSyncer.Init(); err != nil {
+			klog.Errorf("Error initializing Metadata Syncer")
+			os.Exit(1)
+		}
+	}
+	if !*enableLeaderElection {
+		run()
+		return
+	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
 		os.Exit(1)
 	}
+	if err := k8s.RunWithLeaderElection(k8sclient, leaderElectionLockName, *leaderElectionNamespace, run); err != nil {
+		klog.Errorf("Error running Metadata Syncer with leader election")
+		os.Exit(1)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics of the syncer on address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Serving metrics on %s failed. Err: %v", address, err)
+	}
+}
+
+// serveWebhook serves the validating admission webhook on address
+func serveWebhook(address string) {
+	if err := admissionhandler.Serve(address, *webhookCertFile, *webhookKeyFile); err != nil {
+		klog.Errorf("Serving admission webhook on %s failed. Err: %v", address, err)
+	}
 }
@@ -19,18 +19,58 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
+	"os"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rexray/gocsi"
 	"k8s.io/klog"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/debug"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/logger"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/provider"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
 )
 
+var (
+	drain          = flag.Bool("drain", false, "unstage the volumes of this node which are no longer published and exit")
+	metricsAddress = flag.String("metrics-address", "", "address to serve Prometheus metrics on at /metrics, disabled if empty")
+	logFormat      = flag.String("log-format", logger.FormatJSON, "format of the logs, \"json\" or \"text\"")
+	debugPort      = flag.Int("debug-port", 0, "port on 127.0.0.1 to serve the operations in progress on at /debug/operations, disabled if 0")
+	registerDisks  = flag.String("register-disks", "", "register the VMDKs listed in the file, or on stdin if \"-\", as volumes, print the manifests of their PersistentVolumes and exit")
+)
+
 // main is ignored when this package is built as a go plug-in.
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
+	if err := logger.Init(*logFormat); err != nil {
+		klog.Errorf("Failed to initialize logging. Err: %v", err)
+		os.Exit(1)
+	}
+	logger.WatchVerbositySignals()
+	if *drain {
+		err := service.DrainNode(context.Background())
+		klog.Flush()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if *registerDisks != "" {
+		err := service.RegisterDisks(context.Background(), *registerDisks, os.Stdout)
+		klog.Flush()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+	if *debugPort != 0 {
+		go debug.Serve(*debugPort)
+	}
 	gocsi.Run(
 		context.Background(),
 		service.Name,
@@ -39,8 +79,48 @@ func main() {
 		provider.New())
 }
 
+// serveMetrics serves the Prometheus metrics of the driver on address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Serving metrics on %s failed. Err: %v", address, err)
+	}
+}
+
 const usage = `    VSPHERE_CSI_CONFIG
         Specifies the path to the csi-vsphere.conf file
 
         The default value is "/etc/cloud/csi-vsphere.conf"
+
+    CLUSTER_FLAVOR
+        Specifies the flavor of the driver, "VANILLA" or "GUEST_CLUSTER"
+
+        The "GUEST_CLUSTER" flavor provisions the volumes of a guest cluster
+        as PersistentVolumeClaims in its supervisor namespace. The GC section
+        of the config file configures the supervisor cluster, and the token,
+        ca.crt and namespace files of its service account are read from
+        VSPHERE_SUPERVISOR_CREDENTIALS_PATH, "/etc/cloud/pvcsi-provider" by
+        default
+
+        The default value is "VANILLA"
+
+    KUBELET_DIR
+        Specifies the root directory of the kubelet on the node
+
+        The default value is "/var/lib/kubelet"
+
+    VSPHERE_CSI_TLS_CERT_FILE, VSPHERE_CSI_TLS_KEY_FILE
+        Specify the certificate and private key the CSI endpoint is served
+        with over TLS
+
+        The endpoint is served without TLS by default
+
+    VSPHERE_TLS_MIN_VERSION
+        Specifies the minimum TLS version, e.g. "VersionTLS12", of the CSI
+        endpoint and of the connections to vCenter
+
+    VSPHERE_TLS_CIPHER_SUITES
+        Specifies the comma separated list of TLS cipher suites allowed for
+        the CSI endpoint and the connections to vCenter
 `
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+const (
+	// defaultAttachBatchWindow is how long attach requests for a VM are
+	// collected before they are sent to CNS as a single batch.
+	defaultAttachBatchWindow = 200 * time.Millisecond
+	// maxAttachBatchSize is the maximum number of volumes attached to a VM
+	// in a single CNS AttachVolume call.
+	maxAttachBatchSize = 16
+)
+
+// attachResult is the result of attaching a single volume.
+type attachResult struct {
+	diskUUID string
+	err      error
+}
+
+// attachBatch holds the pending attach requests for a VM.
+// Requests for the same volume are joined and share the result.
+type attachBatch struct {
+	vm        *cnsvsphere.VirtualMachine
+	volumeIDs []string
+	waiters   map[string][]chan *attachResult
+	full      chan struct{}
+}
+
+// attachBatcher coalesces concurrent attach requests targeting the same VM.
+type attachBatcher struct {
+	lock sync.Mutex
+	// batches maps VM UUID to the batch which is being collected for it
+	batches map[string]*attachBatch
+	window  time.Duration
+	attach  func(vm *cnsvsphere.VirtualMachine, volumeIDs []string) map[string]*attachResult
+}
+
+// newAttachBatcher returns an attachBatcher which attaches volumes using attach.
+func newAttachBatcher(attach func(vm *cnsvsphere.VirtualMachine, volumeIDs []string) map[string]*attachResult) *attachBatcher {
+	return &attachBatcher{
+		batches: make(map[string]*attachBatch),
+		window:  defaultAttachBatchWindow,
+		attach:  attach,
+	}
+}
+
+// enqueue adds a request to attach volumeID to vm to the batch for vm.
+// The returned channel receives the result once the batch is processed.
+func (b *attachBatcher) enqueue(vm *cnsvsphere.VirtualMachine, volumeID string) <-chan *attachResult {
+	resultCh := make(chan *attachResult, 1)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	batch, ok := b.batches[vm.UUID]
+	if !ok {
+		batch = &attachBatch{
+			vm:      vm,
+			waiters: make(map[string][]chan *attachResult),
+			full:    make(chan struct{}),
+		}
+		b.batches[vm.UUID] = batch
+		go b.run(batch)
+	}
+	if _, exists := batch.waiters[volumeID]; !exists {
+		batch.volumeIDs = append(batch.volumeIDs, volumeID)
+	} else {
+		klog.V(4).Infof("AttachVolume: joining pending attach request for volume %q on vm %q", volumeID, vm.String())
+	}
+	batch.waiters[volumeID] = append(batch.waiters[volumeID], resultCh)
+	if len(batch.volumeIDs) >= maxAttachBatchSize {
+		// Stop collecting requests for this batch and process it right away
+		delete(b.batches, vm.UUID)
+		close(batch.full)
+	}
+	return resultCh
+}
+
+// run waits for the batch window to expire, or for the batch to fill up,
+// and attaches all volumes in the batch.
+func (b *attachBatcher) run(batch *attachBatch) {
+	timer := time.NewTimer(b.window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		b.lock.Lock()
+		if b.batches[batch.vm.UUID] == batch {
+			delete(b.batches, batch.vm.UUID)
+		}
+		b.lock.Unlock()
+	case <-batch.full:
+	}
+	klog.V(4).Infof("AttachVolume: attaching %d volume(s) %q to vm %q", len(batch.volumeIDs), batch.volumeIDs, batch.vm.String())
+	results := b.attach(batch.vm, batch.volumeIDs)
+	for volumeID, waiters := range batch.waiters {
+		for _, resultCh := range waiters {
+			resultCh <- results[volumeID]
+		}
+	}
+}
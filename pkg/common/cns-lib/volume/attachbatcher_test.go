@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestAttachBatcher(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]string
+	b := newAttachBatcher(func(vm *cnsvsphere.VirtualMachine, volumeIDs []string) map[string]*attachResult {
+		lock.Lock()
+		batches = append(batches, volumeIDs)
+		lock.Unlock()
+		results := make(map[string]*attachResult)
+		for _, volumeID := range volumeIDs {
+			results[volumeID] = &attachResult{diskUUID: "disk-" + volumeID}
+		}
+		return results
+	})
+	vm := &cnsvsphere.VirtualMachine{UUID: "vm-uuid"}
+
+	// Requests for the same VM, including a duplicate, are coalesced into one batch
+	volumeIDs := []string{"vol-1", "vol-2", "vol-3", "vol-1"}
+	var resultChs []<-chan *attachResult
+	for _, volumeID := range volumeIDs {
+		resultChs = append(resultChs, b.enqueue(vm, volumeID))
+	}
+	for i, resultCh := range resultChs {
+		result := <-resultCh
+		if result.err != nil || result.diskUUID != "disk-"+volumeIDs[i] {
+			t.Fatalf("Unexpected result for volume %q: %+v", volumeIDs[i], result)
+		}
+	}
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Expected a single batch with 3 volumes, got %v", batches)
+	}
+
+	// A full batch is processed without waiting for the batch window
+	batches = nil
+	resultChs = nil
+	for i := 0; i < maxAttachBatchSize+1; i++ {
+		resultChs = append(resultChs, b.enqueue(vm, fmt.Sprintf("vol-%d", i)))
+	}
+	for _, resultCh := range resultChs {
+		<-resultCh
+	}
+	if len(batches) != 2 || len(batches[0]) != maxAttachBatchSize || len(batches[1]) != 1 {
+		t.Fatalf("Expected batches of %d and 1 volumes, got %v", maxAttachBatchSize, batches)
+	}
+}
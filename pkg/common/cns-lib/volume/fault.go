@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"reflect"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// faultDescriptions explains the faults of failed volume operations whose
+// localized message alone does not tell users what to fix.
+var faultDescriptions = map[string]string{
+	"NoDiskSpace":                "the datastore does not have enough free space for the volume",
+	"InsufficientStorageSpace":   "the datastore does not have enough free space for the volume",
+	"InaccessibleDatastore":      "the datastore is not accessible from the host of the VM",
+	"DatastoreNotWritableOnHost": "the datastore is not writable from the host of the VM",
+	"InvalidDatastore":           "the datastore can not be used for the volume",
+	"HostNotConnected":           "the host of the VM is not connected to vCenter",
+	"HostNotReachable":           "the host of the VM is not reachable from vCenter",
+	"FileLocked":                 "the disk of the volume is locked, it is in use by another VM",
+	"FileNotFound":               "the disk of the volume was not found on the datastore",
+	"TooManyDevices":             "the VM has no free slot for another disk",
+	"NoPermission":               "the vCenter user of the driver lacks a privilege for the operation",
+	"NotSupported":               "the operation is not supported by vCenter or the datastore",
+}
+
+// FaultError is the error of a volume operation which failed with a fault of CNS
+// or vCenter. Its message is meant to be shown to users in Kubernetes events.
+type FaultError struct {
+	// FaultType is the name of the fault, e.g. "NoDiskSpace". The fault wrapped
+	// in a CnsFault is named if there is one.
+	FaultType string
+	// Message is the localized message of the fault.
+	Message string
+}
+
+// Error returns the fault type, the description of the fault, if known, and its message.
+func (e *FaultError) Error() string {
+	if description, ok := faultDescriptions[e.FaultType]; ok {
+		return fmt.Sprintf("%s: %s: %s", e.FaultType, description, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.FaultType, e.Message)
+}
+
+// newFaultError returns the FaultError of the fault of a failed task.
+func newFaultError(fault *vimtypes.LocalizedMethodFault) error {
+	return &FaultError{
+		FaultType: faultTypeName(fault.Fault),
+		Message:   fault.LocalizedMessage,
+	}
+}
+
+// newCnsFaultError returns the FaultError of the fault of a volume in the result of a CNS task.
+func newCnsFaultError(fault *cnstypes.CnsFault) error {
+	faultErr := &FaultError{
+		FaultType: "CnsFault",
+		Message:   fault.LocalizedMessage,
+	}
+	if fault.Fault != nil && *fault.Fault != nil {
+		faultErr.FaultType = faultTypeName(*fault.Fault)
+	}
+	return faultErr
+}
+
+// faultTypeName returns the name of the type of fault, e.g. "NotFound".
+func faultTypeName(fault interface{}) string {
+	value := reflect.ValueOf(fault)
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return ""
+	}
+	return reflect.Indirect(value).Type().Name()
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+func TestFaultError(t *testing.T) {
+	noDiskSpace := vimtypes.BaseMethodFault(&vimtypes.NoDiskSpace{})
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			"cns fault with cause",
+			newCnsFaultError(&cnstypes.CnsFault{Fault: &noDiskSpace, LocalizedMessage: "Failed to create disk"}),
+			"NoDiskSpace: the datastore does not have enough free space for the volume: Failed to create disk",
+		},
+		{
+			"cns fault without cause",
+			newCnsFaultError(&cnstypes.CnsFault{LocalizedMessage: "Volume not found"}),
+			"CnsFault: Volume not found",
+		},
+		{
+			"task fault",
+			newFaultError(&vimtypes.LocalizedMethodFault{Fault: &vimtypes.FileLocked{}, LocalizedMessage: "Unable to access file"}),
+			"FileLocked: the disk of the volume is locked, it is in use by another VM: Unable to access file",
+		},
+	}
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
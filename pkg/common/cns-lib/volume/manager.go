@@ -19,16 +19,21 @@ package volume
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/vmware/govmomi/cns"
 	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
 	"github.com/vmware/govmomi/vim25/soap"
 	vimtypes "github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
 // Manager provides functionality to manage volumes.
@@ -43,34 +48,129 @@ type Manager interface {
 	DeleteVolume(volumeID string, deleteDisk bool) error
 	// UpdateVolumeMetadata updates a volume metadata given its spec.
 	UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpdateSpec) error
+	// UpdateVolumesMetadata updates the metadata of multiple volumes with a single CNS call.
+	UpdateVolumesMetadata(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error
 	// QueryVolume returns volumes matching the given filter.
 	QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
 	// QueryAllVolume returns all volumes matching the given filter and selection.
 	QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error)
 }
 
+// updateVolumeMetadataBatchKey is the task manager key of UpdateVolumeMetadata
+// tasks for more than one volume.
+const updateVolumeMetadataBatchKey = "UpdateVolumeMetadata"
+
 var (
-	// managerInstance is a Manager singleton.
-	managerInstance *volumeManager
-	// onceForManager is used for initializing the Manager singleton.
-	onceForManager sync.Once
+	// managerInstances maps virtual center hosts to their Manager.
+	managerInstances = make(map[string]*volumeManager)
+	// managerInstancesLock is used for initializing the Manager of a virtual center.
+	managerInstancesLock sync.Mutex
 )
 
-// GetManager returns the Manager singleton.
+// GetManager returns the Manager of the virtual center, there is one Manager per virtual center host.
 func GetManager(vc *cnsvsphere.VirtualCenter) Manager {
-	onceForManager.Do(func() {
-		klog.V(1).Infof("Initializing volume.volumeManager...")
-		managerInstance = &volumeManager{
-			virtualCenter: vc,
+	managerInstancesLock.Lock()
+	defer managerInstancesLock.Unlock()
+	var host string
+	var vcConfig *cnsvsphere.VirtualCenterConfig
+	maxInFlightTasks := 0
+	if vc != nil && vc.Config != nil {
+		host = vc.Config.Host
+		maxInFlightTasks = vc.Config.MaxInFlightTasks
+		vcConfig = vc.Config
+	}
+	if managerInstance, ok := managerInstances[host]; ok {
+		return managerInstance
+	}
+	klog.V(1).Infof("Initializing volume.volumeManager for vCenter %q...", host)
+	managerInstance := &volumeManager{
+		virtualCenter: vc,
+		tasks:         newTaskManager(maxInFlightTasks),
+		rateLimiters:  newRateLimiters(vcConfig),
+	}
+	managerInstance.attachBatcher = newAttachBatcher(managerInstance.attachVolumes)
+	managerInstances[host] = managerInstance
+	klog.V(1).Infof("volume.volumeManager initialized")
+	return managerInstance
+}
+
+// runTask starts a CNS task with start and waits for its completion. Starting the task
+// is retried with backoff if it fails with a retryable fault, and so is the task if it
+// fails with one. Errors while waiting for the task are not retried, as the outcome of
+// the task is unknown then. The nonIdempotentTasks are only started again if vCenter
+// rejected the start with a fault, never after connection errors or failed tasks, which
+// may have done part of their work. The in-flight task slot of key is held while the task runs.
+func (m *volumeManager) runTask(ctx context.Context, name string, key string,
+	start func(ctx context.Context) (*object.Task, error)) (*vimtypes.TaskInfo, error) {
+	var taskInfo *vimtypes.TaskInfo
+	var waitErr error
+	idempotent := !nonIdempotentTasks[name]
+	err := retryOnFault(name, func() error {
+		queued := time.Now()
+		if err := m.rateLimiters.wait(ctx, name); err != nil {
+			return err
+		}
+		release := m.tasks.acquire(key)
+		defer release()
+		observeSince(taskQueueDuration, name, m.virtualCenter.Config.Host, queued)
+		defer observeSince(vCenterDuration, name, m.virtualCenter.Config.Host, time.Now())
+		callCtx, cancelCall := m.virtualCenter.WithSOAPTimeout(ctx)
+		cnsTask, err := start(callCtx)
+		cancelCall()
+		if err != nil {
+			if !idempotent && !isCallFault(err) {
+				// The task may have been started before the connection failed
+				waitErr = err
+				return nil
+			}
+			return err
 		}
-		klog.V(1).Infof("volume.volumeManager initialized")
+		taskID := cnsTask.Reference().Value
+		m.tasks.started(PendingTask{
+			Operation: name,
+			Key:       key,
+			VCenter:   m.virtualCenter.Config.Host,
+			TaskID:    taskID,
+			StartTime: time.Now(),
+		})
+		taskInfo, waitErr = cns.GetTaskInfo(ctx, cnsTask)
+		m.tasks.completed(taskID)
+		if _, ok := waitErr.(task.Error); ok && idempotent {
+			// The task failed, it may be started again
+			return waitErr
+		}
+		return nil
 	})
-	return managerInstance
+	if err == nil {
+		err = waitErr
+	}
+	if taskErr, ok := err.(task.Error); ok {
+		return nil, newFaultError(taskErr.LocalizedMethodFault)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return taskInfo, nil
+}
+
+// GetPendingTasks returns the CNS tasks of all virtual centers which were started
+// and have not completed yet.
+func GetPendingTasks() []PendingTask {
+	managerInstancesLock.Lock()
+	defer managerInstancesLock.Unlock()
+	var tasks []PendingTask
+	for _, managerInstance := range managerInstances {
+		tasks = append(tasks, managerInstance.tasks.pendingTasks()...)
+	}
+	return tasks
 }
 
 // DefaultManager provides functionality to manage volumes.
 type volumeManager struct {
 	virtualCenter *cnsvsphere.VirtualCenter
+	attachBatcher *attachBatcher
+	tasks         *taskManager
+	rateLimiters  *rateLimiters
 }
 
 // CreateVolume creates a new volume given its spec.
@@ -102,17 +202,13 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	var cnsCreateSpecList []cnstypes.CnsVolumeCreateSpec
 	cnsCreateSpecList = append(cnsCreateSpecList, *spec)
 	// Call the CNS CreateVolume
-	task, err := m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
+	taskInfo, err := m.runTask(ctx, "CreateVolume", spec.Name, func(ctx context.Context) (*object.Task, error) {
+		return m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
+	})
 	if err != nil {
 		klog.Errorf("CNS CreateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
-	if err != nil {
-		klog.Errorf("Failed to get taskInfo for CreateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return nil, err
-	}
 	klog.V(2).Infof("CreateVolume: VolumeName: %q, opId: %q", spec.Name, taskInfo.ActivationId)
 	// Get the taskResult
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
@@ -130,7 +226,7 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
 	if volumeOperationRes.Fault != nil {
 		klog.Errorf("failed to create cns volume. createSpec: %q, fault: %q, opId: %q", spew.Sdump(spec), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
-		return nil, errors.New(volumeOperationRes.Fault.LocalizedMessage)
+		return nil, newCnsFaultError(volumeOperationRes.Fault)
 	}
 	klog.V(2).Infof("CreateVolume: Volume created successfully. VolumeName: %q, opId: %q, volumeID: %q", spec.Name, taskInfo.ActivationId, volumeOperationRes.VolumeId.Id)
 	return &cnstypes.CnsVolumeId{
@@ -139,73 +235,137 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 }
 
 // AttachVolume attaches a volume to a virtual machine given the spec.
+// Concurrent requests to attach volumes to the same virtual machine are
+// coalesced into a single CNS AttachVolume call.
 func (m *volumeManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
 	err := validateManager(m)
 	if err != nil {
 		return "", err
 	}
+	result := <-m.attachBatcher.enqueue(vm, volumeID)
+	return result.diskUUID, result.err
+}
+
+// attachVolumes attaches volumes to the virtual machine with a single CNS AttachVolume call.
+// SCSI controllers are added to the virtual machine first if the disks do not fit, the
+// device changes of the virtual machine are locked until the volumes are attached.
+// It returns the result of the attach operation for each volume.
+func (m *volumeManager) attachVolumes(vm *cnsvsphere.VirtualMachine, volumeIDs []string) map[string]*attachResult {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Set up the VC connection
-	err = m.virtualCenter.ConnectCNS(ctx)
+	err := m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
 		klog.Errorf("ConnectCNS failed with err: %+v", err)
-		return "", err
+		return getAttachErrors(volumeIDs, err)
+	}
+	unlock := vm.LockDeviceChanges()
+	defer unlock()
+	controllerType := m.virtualCenter.Config.AttachControllerType
+	if controllerType == "" {
+		controllerType = cnsconfig.DefaultAttachControllerType
+	}
+	if err := vm.EnsureFreeSCSISlots(ctx, controllerType, volumeIDs); err != nil {
+		klog.Errorf("Failed to find free SCSI slots for disks %q on VM %v. err: %+v", volumeIDs, vm, err)
+		return getAttachErrors(volumeIDs, err)
+	}
+	return m.attachVolumesLocked(ctx, vm, volumeIDs)
+}
+
+// getAttachErrors returns the result of failing to attach volumeIDs with err
+func getAttachErrors(volumeIDs []string, err error) map[string]*attachResult {
+	results := make(map[string]*attachResult)
+	for _, volumeID := range volumeIDs {
+		results[volumeID] = &attachResult{err: err}
+	}
+	return results
+}
+
+// attachVolumesLocked attaches volumes to the virtual machine with a single CNS AttachVolume call,
+// the caller must hold the lock of vm.LockDeviceChanges.
+func (m *volumeManager) attachVolumesLocked(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeIDs []string) map[string]*attachResult {
+	results := make(map[string]*attachResult)
+	setError := func(err error) map[string]*attachResult {
+		for _, volumeID := range volumeIDs {
+			results[volumeID] = &attachResult{err: err}
+		}
+		return results
 	}
 	// Construct the CNS AttachSpec list
 	var cnsAttachSpecList []cnstypes.CnsVolumeAttachDetachSpec
-	cnsAttachSpec := cnstypes.CnsVolumeAttachDetachSpec{
-		VolumeId: cnstypes.CnsVolumeId{
-			Id: volumeID,
-		},
-		Vm: vm.Reference(),
+	for _, volumeID := range volumeIDs {
+		cnsAttachSpec := cnstypes.CnsVolumeAttachDetachSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: volumeID,
+			},
+			Vm: vm.Reference(),
+		}
+		cnsAttachSpecList = append(cnsAttachSpecList, cnsAttachSpec)
 	}
-	cnsAttachSpecList = append(cnsAttachSpecList, cnsAttachSpec)
 	// Call the CNS AttachVolume
-	task, err := m.virtualCenter.CnsClient.AttachVolume(ctx, cnsAttachSpecList)
+	taskInfo, err := m.runTask(ctx, "AttachVolume", vm.UUID, func(ctx context.Context) (*object.Task, error) {
+		return m.virtualCenter.CnsClient.AttachVolume(ctx, cnsAttachSpecList)
+	})
 	if err != nil {
 		klog.Errorf("CNS AttachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return "", err
-	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
-	if err != nil {
-		klog.Errorf("Failed to get taskInfo for AttachVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return "", err
+		if len(volumeIDs) > 1 {
+			// The whole batch failed, attach volumes one by one so that
+			// a single failing volume does not fail the others
+			klog.V(2).Infof("AttachVolume: retrying volumes %q on vm %q individually", volumeIDs, vm.String())
+			for _, volumeID := range volumeIDs {
+				results[volumeID] = m.attachVolumesLocked(ctx, vm, []string{volumeID})[volumeID]
+			}
+			return results
+		}
+		return setError(err)
 	}
-	klog.V(2).Infof("AttachVolume: volumeID: %q, vm: %q, opId: %q", volumeID, vm.String(), taskInfo.ActivationId)
-	// Get the taskResult
-	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
+	klog.V(2).Infof("AttachVolume: volumeIDs: %q, vm: %q, opId: %q", volumeIDs, vm.String(), taskInfo.ActivationId)
+	// Get the task results for all volumes in the batch
+	taskResults, err := getTaskResults(taskInfo)
 	if err != nil {
-		klog.Errorf("unable to find the task result for AttachVolume task from vCenter %q with taskID %s and attachResults %v",
-			m.virtualCenter.Config.Host, taskInfo.Task.Value, taskResult)
-		return "", err
+		klog.Errorf("unable to find the task results for AttachVolume task from vCenter %q with taskID %s. err: %v",
+			m.virtualCenter.Config.Host, taskInfo.Task.Value, err)
+		return setError(err)
 	}
-
-	if taskResult == nil {
-		klog.Errorf("taskResult is empty for AttachVolume task: %q, opId: %q", taskInfo.Task.Value, taskInfo.ActivationId)
-		return "", errors.New("taskResult is empty")
-	}
-
-	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
-	if volumeOperationRes.Fault != nil {
-		if volumeOperationRes.Fault.LocalizedMessage == CNSVolumeResourceInUseFaultMessage {
-			// Volume is already attached to VM
-			diskUUID, err := GetDiskAttachedToVM(ctx, vm, volumeID)
-			if err != nil {
-				return "", err
-			}
-			if diskUUID != "" {
-				return diskUUID, nil
+	for _, taskResult := range taskResults {
+		if taskResult == nil {
+			continue
+		}
+		volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
+		volumeID := volumeOperationRes.VolumeId.Id
+		if volumeOperationRes.Fault != nil {
+			if volumeOperationRes.Fault.LocalizedMessage == CNSVolumeResourceInUseFaultMessage {
+				// Volume is already attached to VM
+				diskUUID, err := GetDiskAttachedToVM(ctx, vm, volumeID)
+				if err != nil {
+					results[volumeID] = &attachResult{err: err}
+					continue
+				}
+				if diskUUID != "" {
+					results[volumeID] = &attachResult{diskUUID: diskUUID}
+					continue
+				}
 			}
+			klog.Errorf("failed to attach cns volume: %q to node vm: %q. fault: %q. opId: %q", volumeID, vm.String(), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+			results[volumeID] = &attachResult{err: newCnsFaultError(volumeOperationRes.Fault)}
+			continue
+		}
+		attachRes, ok := taskResult.(*cnstypes.CnsVolumeAttachResult)
+		if !ok {
+			results[volumeID] = &attachResult{err: fmt.Errorf("unexpected task result type %T for AttachVolume", taskResult)}
+			continue
+		}
+		klog.V(2).Infof("AttachVolume: Volume attached successfully. volumeID: %q, opId: %q, vm: %q, diskUUID: %q", volumeID, taskInfo.ActivationId, vm.String(), attachRes.DiskUUID)
+		results[volumeID] = &attachResult{diskUUID: attachRes.DiskUUID}
+	}
+	for _, volumeID := range volumeIDs {
+		if _, ok := results[volumeID]; !ok {
+			klog.Errorf("taskResult is empty for volume: %q in AttachVolume task: %q, opId: %q", volumeID, taskInfo.Task.Value, taskInfo.ActivationId)
+			results[volumeID] = &attachResult{err: errors.New("taskResult is empty")}
 		}
-		klog.Errorf("failed to attach cns volume: %q to node vm: %q. fault: %q. opId: %q", volumeID, vm.String(), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
-		return "", errors.New(volumeOperationRes.Fault.LocalizedMessage)
 	}
-	diskUUID := interface{}(taskResult).(*cnstypes.CnsVolumeAttachResult).DiskUUID
-	klog.V(2).Infof("AttachVolume: Volume attached successfully. volumeID: %q, opId: %q, vm: %q, diskUUID: %q", volumeID, taskInfo.ActivationId, vm.String(), diskUUID)
-	return diskUUID, nil
+	return results
 }
 
 // DetachVolume detaches a volume from the virtual machine given the spec.
@@ -232,17 +392,13 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	}
 	cnsDetachSpecList = append(cnsDetachSpecList, cnsDetachSpec)
 	// Call the CNS DetachVolume
-	task, err := m.virtualCenter.CnsClient.DetachVolume(ctx, cnsDetachSpecList)
+	taskInfo, err := m.runTask(ctx, "DetachVolume", volumeID, func(ctx context.Context) (*object.Task, error) {
+		return m.virtualCenter.CnsClient.DetachVolume(ctx, cnsDetachSpecList)
+	})
 	if err != nil {
 		klog.Errorf("CNS DetachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
-	if err != nil {
-		klog.Errorf("Failed to get taskInfo for DetachVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return err
-	}
 	klog.V(2).Infof("DetachVolume: volumeID: %q, vm: %q, opId: %q", volumeID, vm.String(), taskInfo.ActivationId)
 	// Get the task results for the given task
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
@@ -261,7 +417,7 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 
 	if volumeOperationRes.Fault != nil {
 		klog.Errorf("failed to detach cns volume:%q from node vm: %q. fault: %q, opId: %q", volumeID, vm.InventoryPath, spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
-		return errors.New(volumeOperationRes.Fault.LocalizedMessage)
+		return newCnsFaultError(volumeOperationRes.Fault)
 	}
 	klog.V(2).Infof("DetachVolume: Volume detached successfully. volumeID: %q, vm: %q, opId: %q", volumeID, taskInfo.ActivationId, vm.String())
 	return nil
@@ -288,7 +444,9 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	}
 	// Call the CNS DeleteVolume
 	cnsVolumeIDList = append(cnsVolumeIDList, cnsVolumeID)
-	task, err := m.virtualCenter.CnsClient.DeleteVolume(ctx, cnsVolumeIDList, deleteDisk)
+	taskInfo, err := m.runTask(ctx, "DeleteVolume", volumeID, func(ctx context.Context) (*object.Task, error) {
+		return m.virtualCenter.CnsClient.DeleteVolume(ctx, cnsVolumeIDList, deleteDisk)
+	})
 	if err != nil {
 		if soap.IsSoapFault(err) {
 			soapFault := soap.ToSoapFault(err)
@@ -300,12 +458,6 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 		klog.Errorf("CNS DeleteVolume failed from the  vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
-	if err != nil {
-		klog.Errorf("Failed to get taskInfo for DeleteVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return err
-	}
 	klog.V(2).Infof("DeleteVolume: volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
 	// Get the task results for the given task
 	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
@@ -322,7 +474,7 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
 	if volumeOperationRes.Fault != nil {
 		klog.Errorf("Failed to delete volume: %q, fault: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
-		return errors.New(volumeOperationRes.Fault.LocalizedMessage)
+		return newCnsFaultError(volumeOperationRes.Fault)
 	}
 	klog.V(2).Infof("DeleteVolume: Volume deleted successfully. volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
 	return nil
@@ -334,67 +486,110 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 	if err != nil {
 		return err
 	}
+	return m.UpdateVolumesMetadata([]cnstypes.CnsVolumeMetadataUpdateSpec{*spec})[spec.VolumeId.Id]
+}
+
+// UpdateVolumesMetadata updates the metadata of volumes with a single CNS UpdateVolumeMetadata call.
+// It returns the result of the update for each volume. The specs must not contain the same volume twice.
+func (m *volumeManager) UpdateVolumesMetadata(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+	results := make(map[string]error)
+	setError := func(err error) map[string]error {
+		for _, spec := range specs {
+			results[spec.VolumeId.Id] = err
+		}
+		return results
+	}
+	if len(specs) == 0 {
+		return results
+	}
+	err := validateManager(m)
+	if err != nil {
+		return setError(err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
 		klog.Errorf("ConnectCNS failed with err: %+v", err)
-		return err
+		return setError(err)
 	}
 	// If the VSphereUser in the VolumeMetadataUpdateSpec is different from session user, update the VolumeMetadataUpdateSpec
 	s, err := m.virtualCenter.Client.SessionManager.UserSession(ctx)
 	if err != nil {
 		klog.Errorf("Failed to get usersession with err: %v", err)
-		return err
+		return setError(err)
 	}
-	if s.UserName != spec.Metadata.ContainerCluster.VSphereUser {
-		klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, s.UserName)
-		spec.Metadata.ContainerCluster.VSphereUser = s.UserName
-	}
-
+	var volumeIDs []string
 	var cnsUpdateSpecList []cnstypes.CnsVolumeMetadataUpdateSpec
-	cnsUpdateSpec := cnstypes.CnsVolumeMetadataUpdateSpec{
-		VolumeId: cnstypes.CnsVolumeId{
-			Id: spec.VolumeId.Id,
-		},
-		Metadata: spec.Metadata,
+	for _, spec := range specs {
+		if s.UserName != spec.Metadata.ContainerCluster.VSphereUser {
+			klog.V(4).Infof("Update VSphereUser from %s to %s", spec.Metadata.ContainerCluster.VSphereUser, s.UserName)
+			spec.Metadata.ContainerCluster.VSphereUser = s.UserName
+		}
+		cnsUpdateSpec := cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: spec.VolumeId.Id,
+			},
+			Metadata: spec.Metadata,
+		}
+		cnsUpdateSpecList = append(cnsUpdateSpecList, cnsUpdateSpec)
+		volumeIDs = append(volumeIDs, spec.VolumeId.Id)
 	}
-	cnsUpdateSpecList = append(cnsUpdateSpecList, cnsUpdateSpec)
-	task, err := m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
-	if err != nil {
-		klog.Errorf("CNS UpdateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return err
+	// Batches of several volumes are queued under a shared key
+	taskKey := updateVolumeMetadataBatchKey
+	if len(volumeIDs) == 1 {
+		taskKey = volumeIDs[0]
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
+	taskInfo, err := m.runTask(ctx, "UpdateVolumeMetadata", taskKey, func(ctx context.Context) (*object.Task, error) {
+		return m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
+	})
 	if err != nil {
-		klog.Errorf("Failed to get taskInfo for UpdateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return err
+		klog.Errorf("CNS UpdateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		if len(specs) > 1 {
+			// The whole batch failed, update volumes one by one so that
+			// a single failing volume does not fail the others
+			klog.V(2).Infof("UpdateVolumeMetadata: retrying volumes %q individually", volumeIDs)
+			for _, spec := range specs {
+				results[spec.VolumeId.Id] = m.UpdateVolumesMetadata([]cnstypes.CnsVolumeMetadataUpdateSpec{spec})[spec.VolumeId.Id]
+			}
+			return results
+		}
+		return setError(err)
 	}
-	klog.V(2).Infof("UpdateVolumeMetadata: volumeID: %q, opId: %q", spec.VolumeId.Id, taskInfo.ActivationId)
-	// Get the task results for the given task
-	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
+	klog.V(2).Infof("UpdateVolumeMetadata: volumeIDs: %q, opId: %q", volumeIDs, taskInfo.ActivationId)
+	// Get the task results for all volumes in the batch
+	taskResults, err := getTaskResults(taskInfo)
 	if err != nil {
-		klog.Errorf("unable to find the task result for UpdateVolume task from vCenter %q with taskID %q, opId: %q and updateResults %+v",
-			m.virtualCenter.Config.Host, taskInfo.Task.Value, taskInfo.ActivationId, taskResult)
-		return err
+		klog.Errorf("unable to find the task results for UpdateVolume task from vCenter %q with taskID %q, opId: %q. err: %v",
+			m.virtualCenter.Config.Host, taskInfo.Task.Value, taskInfo.ActivationId, err)
+		return setError(err)
 	}
-
-	if taskResult == nil {
-		klog.Errorf("taskResult is empty for UpdateVolume task: %q, opId: %q", taskInfo.Task.Value, taskInfo.ActivationId)
-		return errors.New("taskResult is empty")
+	for _, taskResult := range taskResults {
+		if taskResult == nil {
+			continue
+		}
+		volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
+		volumeID := volumeOperationRes.VolumeId.Id
+		if volumeOperationRes.Fault != nil {
+			klog.Errorf("Failed to update volume: %q, fault: %q, opID: %q", volumeID, spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+			results[volumeID] = newCnsFaultError(volumeOperationRes.Fault)
+			continue
+		}
+		klog.V(2).Infof("UpdateVolumeMetadata: Volume metadata updated successfully. volumeID: %q, opId: %q", volumeID, taskInfo.ActivationId)
+		results[volumeID] = nil
 	}
-	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
-	if volumeOperationRes.Fault != nil {
-		klog.Errorf("Failed to update volume. updateSpec: %q, fault: %q, opID: %q", spew.Sdump(spec), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
-		return errors.New(volumeOperationRes.Fault.LocalizedMessage)
+	for _, volumeID := range volumeIDs {
+		if _, ok := results[volumeID]; !ok {
+			klog.Errorf("taskResult is empty for volume: %q in UpdateVolume task: %q, opId: %q", volumeID, taskInfo.Task.Value, taskInfo.ActivationId)
+			results[volumeID] = errors.New("taskResult is empty")
+		}
 	}
-	klog.V(2).Infof("UpdateVolumeMetadata: Volume metadata updated successfully. volumeID: %q, opId: %q", spec.VolumeId.Id, taskInfo.ActivationId)
-	return nil
+	return results
 }
 
 // QueryVolume returns volumes matching the given filter.
+// All pages of the result are queried, the cursor of the filter sets the page size.
 func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
 	err := validateManager(m)
 	if err != nil {
@@ -409,7 +604,21 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 		return nil, err
 	}
 	//Call the CNS QueryVolume
-	res, err := m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
+	res, err := queryAllPages(queryFilter, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		var res *cnstypes.CnsQueryResult
+		err := retryOnFault("QueryVolume", func() error {
+			if err := m.rateLimiters.wait(ctx, "QueryVolume"); err != nil {
+				return err
+			}
+			defer observeSince(vCenterDuration, "QueryVolume", m.virtualCenter.Config.Host, time.Now())
+			callCtx, cancelCall := m.virtualCenter.WithSOAPTimeout(ctx)
+			defer cancelCall()
+			var err error
+			res, err = m.virtualCenter.CnsClient.QueryVolume(callCtx, queryFilter)
+			return err
+		})
+		return res, err
+	})
 	if err != nil {
 		klog.Errorf("CNS QueryVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
@@ -418,6 +627,7 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 }
 
 // QueryAllVolume returns all volumes matching the given filter and selection.
+// All pages of the result are queried, the cursor of the filter sets the page size.
 func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error) {
 	err := validateManager(m)
 	if err != nil {
@@ -432,7 +642,21 @@ func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, quer
 		return nil, err
 	}
 	//Call the CNS QueryAllVolume
-	res, err := m.virtualCenter.CnsClient.QueryAllVolume(ctx, queryFilter, querySelection)
+	res, err := queryAllPages(queryFilter, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		var res *cnstypes.CnsQueryResult
+		err := retryOnFault("QueryAllVolume", func() error {
+			if err := m.rateLimiters.wait(ctx, "QueryAllVolume"); err != nil {
+				return err
+			}
+			defer observeSince(vCenterDuration, "QueryAllVolume", m.virtualCenter.Config.Host, time.Now())
+			callCtx, cancelCall := m.virtualCenter.WithSOAPTimeout(ctx)
+			defer cancelCall()
+			var err error
+			res, err = m.virtualCenter.CnsClient.QueryAllVolume(callCtx, queryFilter, querySelection)
+			return err
+		})
+		return res, err
+	})
 	if err != nil {
 		klog.Errorf("CNS QueryAllVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
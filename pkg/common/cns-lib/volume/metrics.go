@@ -0,0 +1,54 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of all CNS metrics
+const metricsNamespace = "vsphere_cns"
+
+var (
+	// vCenterDuration observes the time spent in CNS calls, from starting a task to
+	// its completion, by operation and vCenter. Each attempt is observed.
+	vCenterDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "vcenter_duration_seconds",
+		Help:      "Time spent waiting on vCenter for CNS tasks and queries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"operation", "vcenter"})
+	// taskQueueDuration observes the time CNS tasks wait for an in-flight task slot
+	// by operation and vCenter.
+	taskQueueDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_queue_duration_seconds",
+		Help:      "Time CNS tasks wait in the driver before they are started on vCenter.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"operation", "vcenter"})
+)
+
+func init() {
+	prometheus.MustRegister(vCenterDuration, taskQueueDuration)
+}
+
+// observeSince observes the time since start in the histogram of operation on the vCenter host.
+func observeSince(histogram *prometheus.HistogramVec, operation string, host string, start time.Time) {
+	histogram.WithLabelValues(operation, host).Observe(time.Since(start).Seconds())
+}
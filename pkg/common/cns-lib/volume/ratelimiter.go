@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// rateLimiters limit the rate of the CNS calls to a vCenter by class of operation.
+// The limiter of a class is nil if its calls are not limited.
+type rateLimiters struct {
+	create   *rate.Limiter
+	attach   *rate.Limiter
+	metadata *rate.Limiter
+	query    *rate.Limiter
+}
+
+// newRateLimiters returns the rateLimiters of the rate limits of the vCenter config
+func newRateLimiters(config *cnsvsphere.VirtualCenterConfig) *rateLimiters {
+	if config == nil {
+		return &rateLimiters{}
+	}
+	return &rateLimiters{
+		create:   newRateLimiter(config.CreateRateLimit),
+		attach:   newRateLimiter(config.AttachRateLimit),
+		metadata: newRateLimiter(config.MetadataRateLimit),
+		query:    newRateLimiter(config.QueryRateLimit),
+	}
+}
+
+// newRateLimiter returns the limiter of rateLimit, or nil if its QPS is not set
+func newRateLimiter(rateLimit cnsvsphere.RateLimit) *rate.Limiter {
+	if rateLimit.QPS <= 0 {
+		return nil
+	}
+	burst := rateLimit.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(rateLimit.QPS))
+	}
+	return rate.NewLimiter(rate.Limit(rateLimit.QPS), burst)
+}
+
+// wait blocks until the CNS call of operation name is allowed by the limiter of its class
+func (r *rateLimiters) wait(ctx context.Context, name string) error {
+	var limiter *rate.Limiter
+	switch name {
+	case "CreateVolume", "DeleteVolume":
+		limiter = r.create
+	case "AttachVolume", "DetachVolume":
+		limiter = r.attach
+	case "UpdateVolumeMetadata":
+		limiter = r.metadata
+	case "QueryVolume", "QueryAllVolume":
+		limiter = r.query
+	}
+	if limiter == nil {
+		return nil
+	}
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	klog.V(4).Infof("%s is rate limited for %v", name, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestRateLimiters(t *testing.T) {
+	limiters := newRateLimiters(&cnsvsphere.VirtualCenterConfig{
+		CreateRateLimit: cnsvsphere.RateLimit{QPS: 0.5},
+		QueryRateLimit:  cnsvsphere.RateLimit{QPS: 100, Burst: 2},
+	})
+	if limiters.attach != nil || limiters.metadata != nil {
+		t.Fatalf("Expected attach and metadata calls not to be limited")
+	}
+	if burst := limiters.create.Burst(); burst != 1 {
+		t.Fatalf("Expected the burst of create calls to default to 1, got %d", burst)
+	}
+
+	ctx := context.Background()
+	// The burst of create calls is used by CreateVolume, DeleteVolume then waits 2s
+	if err := limiters.wait(ctx, "CreateVolume"); err != nil {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := limiters.wait(timeoutCtx, "DeleteVolume"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeleteVolume to be rate limited, got %v", err)
+	}
+	// Other classes are limited independently
+	for i := 0; i < 3; i++ {
+		if err := limiters.wait(timeoutCtx, "AttachVolume"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiters.wait(ctx, "QueryVolume"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Fatalf("Expected the third query to wait for the rate limit, took %v", elapsed)
+	}
+}
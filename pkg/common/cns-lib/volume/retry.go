@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io"
+	"net"
+	neturl "net/url"
+	"time"
+
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// retryBackoff is the backoff between attempts of a CNS call which failed with a
+// retryable error. The jitter keeps the retries of concurrent operations apart.
+var retryBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    5,
+	Cap:      30 * time.Second,
+}
+
+// retryableFaults are the names of the vim faults which vCenter reports for
+// transient conditions, e.g. a busy object or a host which is briefly unreachable.
+// All other faults, e.g. NotFound, InvalidArgument or CnsFault, are terminal.
+var retryableFaults = map[string]bool{
+	"ConcurrentAccess":              true,
+	"HostCommunication":             true,
+	"HostNotConnected":              true,
+	"HostNotReachable":              true,
+	"TaskInProgress":                true,
+	"Timedout":                      true,
+	"TooManyConcurrentNativeClones": true,
+}
+
+// nonIdempotentTasks are the names of the CNS tasks which must not be started again unless
+// the first task is known not to have started. A second CreateVolume task creates a second
+// disk, which is leaked if the first task created one.
+var nonIdempotentTasks = map[string]bool{
+	"CreateVolume": true,
+}
+
+// isRetryable returns true if err is caused by a transient fault of vCenter or of the
+// connection to it, so that the failed call is expected to succeed when repeated.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if taskErr, ok := err.(task.Error); ok {
+		return isRetryableFault(taskErr.Fault())
+	}
+	if soap.IsSoapFault(err) {
+		return isRetryableFault(soap.ToSoapFault(err).VimFault())
+	}
+	if soap.IsVimFault(err) {
+		return isRetryableFault(soap.ToVimFault(err))
+	}
+	if soap.IsRegularError(err) {
+		err = soap.ToRegularError(err)
+	}
+	if urlErr, ok := err.(*neturl.Error); ok {
+		err = urlErr.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+// isCallFault returns true if err is a fault vCenter returned for the call itself, rather
+// than an error of the connection. A task whose start failed with such a fault was not started.
+func isCallFault(err error) bool {
+	return soap.IsSoapFault(err) || soap.IsVimFault(err)
+}
+
+// isRetryableFault returns true if fault is one of the retryableFaults.
+func isRetryableFault(fault interface{}) bool {
+	return retryableFaults[faultTypeName(fault)]
+}
+
+// retryOnFault calls operation until it succeeds, it fails with an error which is not
+// retryable, or the steps of retryBackoff are used up. The error of the last call is returned.
+func retryOnFault(name string, operation func() error) error {
+	var err error
+	_ = wait.ExponentialBackoff(retryBackoff, func() (bool, error) {
+		err = operation()
+		if !isRetryable(err) {
+			return true, nil
+		}
+		klog.Warningf("%s failed with retryable error: %v", name, err)
+		return false, nil
+	})
+	return err
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"errors"
+	"io"
+	neturl "net/url"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("failed"), false},
+		{"task in progress", task.Error{LocalizedMethodFault: &vimtypes.LocalizedMethodFault{Fault: &vimtypes.TaskInProgress{}}}, true},
+		{"task not found", task.Error{LocalizedMethodFault: &vimtypes.LocalizedMethodFault{Fault: &vimtypes.NotFound{}}}, false},
+		{"soap host not connected", soap.WrapSoapFault(&soap.Fault{Detail: struct {
+			Fault vimtypes.AnyType `xml:",any,typeattr"`
+		}{Fault: vimtypes.HostNotConnected{}}}), true},
+		{"soap invalid argument", soap.WrapSoapFault(&soap.Fault{Detail: struct {
+			Fault vimtypes.AnyType `xml:",any,typeattr"`
+		}{Fault: vimtypes.InvalidArgument{}}}), false},
+		{"vim concurrent access", soap.WrapVimFault(&vimtypes.ConcurrentAccess{}), true},
+		{"timeout", &neturl.Error{Op: "Post", URL: "https://vc/sdk", Err: context.DeadlineExceeded}, true},
+		{"canceled", &neturl.Error{Op: "Post", URL: "https://vc/sdk", Err: context.Canceled}, false},
+		{"connection closed", &neturl.Error{Op: "Post", URL: "https://vc/sdk", Err: io.EOF}, true},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryOnFault(t *testing.T) {
+	backoff := retryBackoff
+	defer func() { retryBackoff = backoff }()
+	retryBackoff.Duration = time.Millisecond
+	retryBackoff.Cap = 100 * time.Millisecond
+
+	retryable := soap.WrapVimFault(&vimtypes.TaskInProgress{})
+	calls := 0
+	err := retryOnFault("test", func() error {
+		calls++
+		if calls < 3 {
+			return retryable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	terminal := errors.New("terminal")
+	err = retryOnFault("test", func() error {
+		calls++
+		return terminal
+	})
+	if err != terminal || calls != 1 {
+		t.Errorf("expected terminal error after 1 call, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retryOnFault("test", func() error {
+		calls++
+		return retryable
+	})
+	if err != retryable || calls != retryBackoff.Steps {
+		t.Errorf("expected retryable error after %d calls, got %v after %d calls", retryBackoff.Steps, err, calls)
+	}
+}
+
+func TestRunTaskRetries(t *testing.T) {
+	backoff := retryBackoff
+	defer func() { retryBackoff = backoff }()
+	retryBackoff.Duration = time.Millisecond
+	retryBackoff.Cap = 100 * time.Millisecond
+
+	m := &volumeManager{
+		virtualCenter: &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc"}},
+		tasks:         newTaskManager(1),
+		rateLimiters:  &rateLimiters{},
+	}
+	tests := []struct {
+		name      string
+		operation string
+		err       error
+		calls     int
+	}{
+		{"idempotent connection error", "DeleteVolume", &neturl.Error{Op: "Post", URL: "https://vc/sdk", Err: io.EOF}, retryBackoff.Steps},
+		{"non-idempotent connection error", "CreateVolume", &neturl.Error{Op: "Post", URL: "https://vc/sdk", Err: io.EOF}, 1},
+		{"non-idempotent fault", "CreateVolume", soap.WrapVimFault(&vimtypes.TaskInProgress{}), retryBackoff.Steps},
+	}
+	for _, test := range tests {
+		calls := 0
+		_, err := m.runTask(context.Background(), test.operation, "key", func(ctx context.Context) (*object.Task, error) {
+			calls++
+			return nil, test.err
+		})
+		if err != test.err || calls != test.calls {
+			t.Errorf("%s: expected %d calls failing with %v, got %d calls failing with %v", test.name, test.calls, test.err, calls, err)
+		}
+	}
+}
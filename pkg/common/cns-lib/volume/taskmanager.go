@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// taskManager limits the number of CNS tasks in flight on a vCenter, so that mass
+// events, e.g. the rescheduling of all pods of a failed node, do not overwhelm it.
+// Operations waiting for a task to start are queued by key, usually the volume ID,
+// and admitted round robin across keys, so that many operations on one volume do
+// not starve the operations on other volumes.
+type taskManager struct {
+	lock        sync.Mutex
+	maxInFlight int
+	inFlight    int
+	// waiting maps keys to the operations waiting to start a task, in order
+	waiting map[string][]chan struct{}
+	// keys holds the keys with waiting operations in round robin order
+	keys []string
+	// pending maps the IDs of started tasks to the task, until they complete
+	pending map[string]PendingTask
+}
+
+// PendingTask is a CNS task which was started and has not completed yet.
+type PendingTask struct {
+	// Operation is the name of the volume operation, e.g. "CreateVolume"
+	Operation string `json:"operation"`
+	// Key is the key the task was queued by, the volume name or ID or the VM UUID
+	Key string `json:"key"`
+	// VCenter is the host of the vCenter running the task
+	VCenter string `json:"vcenter"`
+	// TaskID is the managed object ID of the task in vCenter
+	TaskID string `json:"taskID"`
+	// StartTime is when the task was started
+	StartTime time.Time `json:"startTime"`
+}
+
+// newTaskManager returns a taskManager which admits at most maxInFlight tasks at a time
+func newTaskManager(maxInFlight int) *taskManager {
+	if maxInFlight <= 0 {
+		maxInFlight = cnsconfig.DefaultMaxInFlightTasks
+	}
+	return &taskManager{
+		maxInFlight: maxInFlight,
+		waiting:     make(map[string][]chan struct{}),
+		pending:     make(map[string]PendingTask),
+	}
+}
+
+// acquire blocks until an operation on key may start a CNS task, and returns the
+// function to call once the task completed
+func (t *taskManager) acquire(key string) func() {
+	t.lock.Lock()
+	if t.inFlight < t.maxInFlight && len(t.keys) == 0 {
+		t.inFlight++
+		t.lock.Unlock()
+		return t.release
+	}
+	ready := make(chan struct{})
+	if _, ok := t.waiting[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.waiting[key] = append(t.waiting[key], ready)
+	klog.V(4).Infof("Waiting to start CNS task for %q, %d tasks in flight", key, t.inFlight)
+	t.lock.Unlock()
+	<-ready
+	return t.release
+}
+
+// release completes a task and admits the next waiting operation, if any
+func (t *taskManager) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inFlight--
+	if len(t.keys) == 0 {
+		return
+	}
+	key := t.keys[0]
+	t.keys = t.keys[1:]
+	ready := t.waiting[key][0]
+	if len(t.waiting[key]) == 1 {
+		delete(t.waiting, key)
+	} else {
+		t.waiting[key] = t.waiting[key][1:]
+		t.keys = append(t.keys, key)
+	}
+	t.inFlight++
+	close(ready)
+}
+
+// started records task as pending until completed is called with its ID
+func (t *taskManager) started(task PendingTask) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[task.TaskID] = task
+}
+
+// completed removes the task with taskID from the pending tasks
+func (t *taskManager) completed(taskID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pending, taskID)
+}
+
+// pendingTasks returns the pending tasks, oldest first
+func (t *taskManager) pendingTasks() []PendingTask {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tasks := make([]PendingTask, 0, len(t.pending))
+	for _, task := range t.pending {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].StartTime.Before(tasks[j].StartTime) })
+	return tasks
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForWaiting waits until n operations are waiting in tasks
+func waitForWaiting(t *testing.T, tasks *taskManager, n int) {
+	for i := 0; i < 100; i++ {
+		tasks.lock.Lock()
+		waiting := 0
+		for _, w := range tasks.waiting {
+			waiting += len(w)
+		}
+		tasks.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiting operations", n)
+}
+
+func TestTaskManager(t *testing.T) {
+	tasks := newTaskManager(2)
+	releaseFirst := tasks.acquire("vol-1")
+	releaseSecond := tasks.acquire("vol-1")
+
+	// Queue three operations on vol-1, then one on vol-2
+	started := make(chan string, 4)
+	releases := make(chan func(), 4)
+	for i, key := range []string{"vol-1", "vol-1", "vol-1", "vol-2"} {
+		go func(key string) {
+			release := tasks.acquire(key)
+			started <- key
+			releases <- release
+		}(key)
+		waitForWaiting(t, tasks, i+1)
+	}
+	select {
+	case key := <-started:
+		t.Fatalf("operation on %q started with %d tasks in flight", key, tasks.maxInFlight)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Each completed task admits one waiting operation, round robin across volumes
+	var order []string
+	for _, release := range []func(){releaseFirst, releaseSecond} {
+		release()
+		order = append(order, <-started)
+	}
+	for len(order) < 4 {
+		(<-releases)()
+		order = append(order, <-started)
+	}
+	expected := []string{"vol-1", "vol-2", "vol-1", "vol-1"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("operations started in order %v, expected %v", order, expected)
+	}
+	for i := 0; i < 2; i++ {
+		(<-releases)()
+	}
+	if tasks.inFlight != 0 {
+		t.Errorf("%d tasks in flight after all tasks completed", tasks.inFlight)
+	}
+}
@@ -19,8 +19,11 @@ package volume
 import (
 	"context"
 	"errors"
+	"fmt"
 
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
 	"k8s.io/klog"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
@@ -40,6 +43,47 @@ func validateManager(m *volumeManager) error {
 	return nil
 }
 
+// getTaskResults returns the results for all volumes of a CNS batch task given the task info
+func getTaskResults(taskInfo *vimtypes.TaskInfo) ([]cnstypes.BaseCnsVolumeOperationResult, error) {
+	if taskInfo == nil {
+		return nil, errors.New("TaskInfo is empty")
+	}
+	volumeOperationBatchResult, ok := taskInfo.Result.(cnstypes.CnsVolumeOperationBatchResult)
+	if !ok || len(volumeOperationBatchResult.VolumeResults) == 0 {
+		return nil, errors.New("Cannot get VolumeOperationResult")
+	}
+	return volumeOperationBatchResult.VolumeResults, nil
+}
+
+// queryAllPages calls query with the cursor of queryFilter advanced until all matching
+// volumes are returned, so that results are not truncated at the page size of CNS.
+// The volumes of all pages are returned in a single result.
+func queryAllPages(queryFilter cnstypes.CnsQueryFilter,
+	query func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)) (*cnstypes.CnsQueryResult, error) {
+	result := &cnstypes.CnsQueryResult{}
+	for {
+		res, err := query(queryFilter)
+		if err != nil {
+			return nil, err
+		}
+		result.Volumes = append(result.Volumes, res.Volumes...)
+		result.Cursor = res.Cursor
+		var offset int64
+		if queryFilter.Cursor != nil {
+			offset = queryFilter.Cursor.Offset
+		}
+		// Stop when all records are read or the cursor does not advance
+		if res.Cursor.Offset >= res.Cursor.TotalRecords || res.Cursor.Offset <= offset {
+			return result, nil
+		}
+		klog.V(4).Infof("Querying volumes from offset %d of %d", res.Cursor.Offset, res.Cursor.TotalRecords)
+		queryFilter.Cursor = &cnstypes.CnsCursor{
+			Offset: res.Cursor.Offset,
+			Limit:  res.Cursor.Limit,
+		}
+	}
+}
+
 // GetDiskAttachedToVM checks if the volume is attached to the VM.
 // If the volume is attached to the VM, return disk uuid of the volume, else return empty string
 func GetDiskAttachedToVM(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
@@ -65,3 +109,70 @@ func GetDiskAttachedToVM(ctx context.Context, vm *cnsvsphere.VirtualMachine, vol
 	klog.V(3).Infof("Volume %s is not attached to VM: %s", volumeID, vm.InventoryPath)
 	return "", nil
 }
+
+// AttachDiskWithSharingMode attaches the disk backing the volume to the VM with the given sharing mode
+// and returns the disk uuid. CNS attaches disks without sharing, and the sharing mode of a disk can not
+// be changed once it is attached to a powered on VM, so the disk is added to the VM by reconfiguring it
+// with the sharing mode set on the backing. The VM is not reconfigured if the disk is already attached
+// with the requested sharing mode.
+func AttachDiskWithSharingMode(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string,
+	datastore *cnsvsphere.Datastore, sharing vimtypes.VirtualDiskSharing) (string, error) {
+	vmDevices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices from vm: %s", vm.InventoryPath)
+		return "", err
+	}
+	for _, device := range vmDevices {
+		virtualDisk, ok := device.(*vimtypes.VirtualDisk)
+		if !ok || virtualDisk.VDiskId == nil || virtualDisk.VDiskId.Id != volumeID {
+			continue
+		}
+		backing, ok := virtualDisk.Backing.(*vimtypes.VirtualDiskFlatVer2BackingInfo)
+		if !ok {
+			return "", fmt.Errorf("unsupported backing type %T for volume %s on vm %s", virtualDisk.Backing, volumeID, vm.InventoryPath)
+		}
+		if backing.Sharing != string(sharing) {
+			return "", fmt.Errorf("volume %s is already attached to vm %s with sharing mode %q", volumeID, vm.InventoryPath, backing.Sharing)
+		}
+		klog.V(4).Infof("Volume %s is already attached to vm %s with sharing mode %s", volumeID, vm.InventoryPath, sharing)
+		return backing.Uuid, nil
+	}
+	vStorageObject, err := vslm.NewObjectManager(vm.Client()).Retrieve(ctx, datastore, volumeID)
+	if err != nil {
+		klog.Errorf("Failed to retrieve the disk of volume %s on datastore %v. err: %v", volumeID, datastore, err)
+		return "", err
+	}
+	fileBacking, ok := vStorageObject.Config.Backing.(*vimtypes.BaseConfigInfoDiskFileBackingInfo)
+	if !ok {
+		return "", fmt.Errorf("unsupported backing type %T for volume %s", vStorageObject.Config.Backing, volumeID)
+	}
+	controller := vmDevices.PickController((*vimtypes.VirtualSCSIController)(nil))
+	if controller == nil {
+		return "", fmt.Errorf("no SCSI controller of vm %s has a free slot for volume %s", vm.InventoryPath, volumeID)
+	}
+	virtualDisk := &vimtypes.VirtualDisk{
+		VirtualDevice: vimtypes.VirtualDevice{
+			Backing: &vimtypes.VirtualDiskFlatVer2BackingInfo{
+				VirtualDeviceFileBackingInfo: vimtypes.VirtualDeviceFileBackingInfo{
+					FileName: fileBacking.FilePath,
+				},
+				DiskMode: string(vimtypes.VirtualDiskModePersistent),
+				Sharing:  string(sharing),
+			},
+		},
+	}
+	vmDevices.AssignController(virtualDisk, controller)
+	if err := vm.AddDevice(ctx, virtualDisk); err != nil {
+		klog.Errorf("Failed to attach volume %s to vm %s with sharing mode %s. err: %v", volumeID, vm.InventoryPath, sharing, err)
+		return "", err
+	}
+	diskUUID, err := GetDiskAttachedToVM(ctx, vm, volumeID)
+	if err != nil {
+		return "", err
+	}
+	if diskUUID == "" {
+		return "", fmt.Errorf("volume %s is not attached to vm %s", volumeID, vm.InventoryPath)
+	}
+	klog.V(3).Infof("Attached volume %s to vm %s with sharing mode %s", volumeID, vm.InventoryPath, sharing)
+	return diskUUID, nil
+}
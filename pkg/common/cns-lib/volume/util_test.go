@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+)
+
+func TestQueryAllPages(t *testing.T) {
+	var allVolumes []cnstypes.CnsVolume
+	for i := 0; i < 5; i++ {
+		allVolumes = append(allVolumes, cnstypes.CnsVolume{VolumeId: cnstypes.CnsVolumeId{Id: fmt.Sprintf("vol-%d", i)}})
+	}
+	calls := 0
+	// query returns pages of 2 volumes, unless the cursor sets the page size
+	query := func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		calls++
+		offset, limit := int64(0), int64(2)
+		if queryFilter.Cursor != nil {
+			offset, limit = queryFilter.Cursor.Offset, queryFilter.Cursor.Limit
+		}
+		end := offset + limit
+		if end > int64(len(allVolumes)) {
+			end = int64(len(allVolumes))
+		}
+		return &cnstypes.CnsQueryResult{
+			Volumes: allVolumes[offset:end],
+			Cursor:  cnstypes.CnsCursor{Offset: end, Limit: limit, TotalRecords: int64(len(allVolumes))},
+		}, nil
+	}
+	res, err := queryAllPages(cnstypes.CnsQueryFilter{}, query)
+	if err != nil {
+		t.Fatalf("queryAllPages failed. Err: %v", err)
+	}
+	if len(res.Volumes) != len(allVolumes) || calls != 3 {
+		t.Fatalf("Expected %d volumes in 3 calls, got %d volumes in %d calls", len(allVolumes), len(res.Volumes), calls)
+	}
+	calls = 0
+	res, err = queryAllPages(cnstypes.CnsQueryFilter{Cursor: &cnstypes.CnsCursor{Limit: 4}}, query)
+	if err != nil {
+		t.Fatalf("queryAllPages failed. Err: %v", err)
+	}
+	if len(res.Volumes) != len(allVolumes) || calls != 2 {
+		t.Fatalf("Expected %d volumes in 2 calls, got %d volumes in %d calls", len(allVolumes), len(res.Volumes), calls)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 
 	"github.com/vmware/govmomi/cns"
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/vim25"
 	"k8s.io/klog"
 )
@@ -50,6 +51,24 @@ func (vc *VirtualCenter) ConnectCNS(ctx context.Context) error {
 	return nil
 }
 
+// CheckCNS returns an error if the session of the virtual center is not valid and
+// can not be logged in again, or if CNS does not respond to a query of one volume.
+func (vc *VirtualCenter) CheckCNS(ctx context.Context) error {
+	if err := vc.ConnectCNS(ctx); err != nil {
+		return err
+	}
+	queryCtx, cancelQuery := vc.WithSOAPTimeout(ctx)
+	defer cancelQuery()
+	queryFilter := cnstypes.CnsQueryFilter{
+		Cursor: &cnstypes.CnsCursor{Limit: 1},
+	}
+	if _, err := vc.CnsClient.QueryVolume(queryCtx, queryFilter); err != nil {
+		klog.Errorf("Failed to query CNS on vCenter host %q with err: %v", vc.Config.Host, err)
+		return err
+	}
+	return nil
+}
+
 // DisconnectCNS destroys the CNS client for the virtual center.
 func (vc *VirtualCenter) DisconnectCNS(ctx context.Context) {
 	if vc.CnsClient == nil {
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	csictx "github.com/rexray/gocsi/context"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+const (
+	// credentialsCheckInterval is the interval at which the config file is checked
+	// for new credentials. Kubelet updates mounted secrets within about a minute.
+	credentialsCheckInterval = time.Minute
+	// staleSessionLogoutDelay is the time after which the session of the previous
+	// credentials is logged out, letting operations started with it complete.
+	staleSessionLogoutDelay = 10 * time.Minute
+)
+
+// readCredentials returns the username and password of the vCenter host from the config file.
+func readCredentials(ctx context.Context, host string) (string, string, error) {
+	cfgPath := csictx.Getenv(ctx, cnsconfig.EnvCloudConfig)
+	if cfgPath == "" {
+		cfgPath = cnsconfig.DefaultCloudConfigPath
+	}
+
+	cfg, err := cnsconfig.GetCnsconfig(cfgPath)
+	if err != nil {
+		klog.Errorf("Failed to read config with err: %v", err)
+		return "", "", err
+	}
+	vcConfig, ok := cfg.VirtualCenter[host]
+	if !ok {
+		err = fmt.Errorf("vCenter %q not found in config", host)
+		klog.Error(err)
+		return "", "", err
+	}
+	return vcConfig.User, vcConfig.Password, nil
+}
+
+// WatchCredentials checks the config file for new credentials until stopCh is closed.
+// When the credentials in the secret are rotated, the virtual center is logged in with
+// the new ones right away instead of failing operations once the old ones are revoked.
+func (vc *VirtualCenter) WatchCredentials(stopCh <-chan struct{}) {
+	go wait.Until(vc.reloadCredentials, credentialsCheckInterval, stopCh)
+}
+
+// reloadCredentials logs in with the credentials in the config file if they changed.
+func (vc *VirtualCenter) reloadCredentials() {
+	ctx, cancel := context.WithTimeout(context.Background(), keepAliveTimeout)
+	defer cancel()
+	username, password, err := readCredentials(ctx, vc.Config.Host)
+	if err != nil {
+		return
+	}
+	vc.credentialsLock.Lock()
+	changed := username != vc.Config.Username || password != vc.Config.Password
+	vc.credentialsLock.Unlock()
+	if !changed {
+		return
+	}
+	klog.V(2).Infof("Credentials of vCenter %q changed, logging in with the new credentials", vc.Config.Host)
+	vc.UpdateCredentials(username, password)
+	if err := vc.reauthenticate(ctx); err != nil {
+		klog.Errorf("Failed to log in to vCenter %q with the new credentials. err: %v", vc.Config.Host, err)
+	}
+}
+
+// reauthenticate replaces the client of vc with a client logged in with the current
+// credentials. The session of the previous client is logged out after staleSessionLogoutDelay.
+func (vc *VirtualCenter) reauthenticate(ctx context.Context) error {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if vc.Client == nil {
+		// Not connected, the next Connect logs in with the current credentials
+		return nil
+	}
+	client, err := vc.newClient(ctx)
+	if err != nil {
+		return err
+	}
+	staleClient := vc.Client
+	vc.Client = client
+	if err = vc.newServiceClients(ctx); err != nil {
+		return err
+	}
+	time.AfterFunc(staleSessionLogoutDelay, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), keepAliveTimeout)
+		defer cancel()
+		if err := staleClient.Logout(ctx); err != nil {
+			klog.V(4).Infof("Failed to logout previous session of vCenter %q with err: %v", vc.Config.Host, err)
+		}
+	})
+	return nil
+}
@@ -79,6 +79,17 @@ func (dc *Datacenter) GetDatastoreByURL(ctx context.Context, datastoreURL string
 	return nil, err
 }
 
+// GetDatastoreByName returns the *Datastore instance given its name.
+func (dc *Datacenter) GetDatastoreByName(ctx context.Context, name string) (*Datastore, error) {
+	finder := find.NewFinder(dc.Datacenter.Client(), false)
+	finder.SetDatacenter(dc.Datacenter)
+	ds, err := finder.Datastore(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Datastore{ds, dc}, nil
+}
+
 // GetVirtualMachineByUUID returns the VirtualMachine instance given its UUID in a datacenter.
 // If instanceUUID is set to true, then UUID is an instance UUID.
 //  - In this case, this function searches for virtual machines whose instance UUID matches the given uuid.
@@ -104,6 +115,47 @@ func (dc *Datacenter) GetVirtualMachineByUUID(ctx context.Context, uuid string,
 	return vm, nil
 }
 
+// GetVirtualMachineByDNSNameOrIP returns the virtual machine whose guest reports dnsName as its
+// host name or one of ips as one of its IP addresses. The guest must be running VMware Tools.
+func (dc *Datacenter) GetVirtualMachineByDNSNameOrIP(ctx context.Context, dnsName string, ips []string) (*VirtualMachine, error) {
+	searchIndex := object.NewSearchIndex(dc.Datacenter.Client())
+	var ref object.Reference
+	var err error
+	if dnsName != "" {
+		if ref, err = searchIndex.FindByDnsName(ctx, dc.Datacenter, dnsName, true); err != nil {
+			klog.Errorf("Failed to find VM given DNS name %s with err: %v", dnsName, err)
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if ref != nil {
+			break
+		}
+		if ref, err = searchIndex.FindByIp(ctx, dc.Datacenter, ip, true); err != nil {
+			klog.Errorf("Failed to find VM given IP %s with err: %v", ip, err)
+			return nil, err
+		}
+	}
+	if ref == nil {
+		return nil, ErrVMNotFound
+	}
+	vm := object.NewVirtualMachine(dc.Datacenter.Client(), ref.Reference())
+	var vmMo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.uuid"}, &vmMo); err != nil {
+		klog.Errorf("Failed to get the UUID of VM %v with err: %v", vm.Reference(), err)
+		return nil, err
+	}
+	if vmMo.Config == nil {
+		return nil, fmt.Errorf("VM %v has no config", vm.Reference())
+	}
+	return &VirtualMachine{
+		VirtualCenterHost: dc.VirtualCenterHost,
+		UUID:              strings.ToLower(vmMo.Config.Uuid),
+		VirtualMachine:    vm,
+		Datacenter:        dc,
+	}, nil
+}
+
 // asyncGetAllDatacenters returns *Datacenter instances over the given
 // channel. If an error occurs, it will be returned via the given error channel.
 // If the given context is canceled, the processing will be stopped as soon as
@@ -224,3 +276,26 @@ func (dc *Datacenter) GetAllDatastores(ctx context.Context) (map[string]*Datasto
 	}
 	return dsURLInfoMap, nil
 }
+
+// GetDatastoreClusterMembers returns the datastores in the datastore cluster with the given name
+// and whether Storage DRS is enabled on the datastore cluster.
+func (dc *Datacenter) GetDatastoreClusterMembers(ctx context.Context, datastoreClusterName string) ([]types.ManagedObjectReference, bool, error) {
+	finder := find.NewFinder(dc.Client(), false)
+	finder.SetDatacenter(dc.Datacenter)
+	storagePod, err := finder.DatastoreCluster(ctx, datastoreClusterName)
+	if err != nil {
+		klog.Errorf("Failed to find datastore cluster %q in the Datacenter %s with error: %v", datastoreClusterName, dc.Datacenter.String(), err)
+		return nil, false, err
+	}
+	var storagePodMo mo.StoragePod
+	pc := property.DefaultCollector(dc.Client())
+	properties := []string{"childEntity", "podStorageDrsEntry"}
+	err = pc.RetrieveOne(ctx, storagePod.Reference(), properties, &storagePodMo)
+	if err != nil {
+		klog.Errorf("Failed to get datastore cluster managed object %v with properties %v: %v", storagePod.Reference(), properties, err)
+		return nil, false, err
+	}
+	sdrsEnabled := storagePodMo.PodStorageDrsEntry != nil &&
+		storagePodMo.PodStorageDrsEntry.StorageDrsConfig.PodConfig.Enabled
+	return storagePodMo.ChildEntity, sdrsEnabled, nil
+}
@@ -22,11 +22,28 @@ import (
 
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 )
 
+const (
+	// VsanDatastoreType is the type of vSAN datastores in their summary
+	VsanDatastoreType = "vsan"
+	// VmfsDatastoreType is the type of VMFS datastores in their summary
+	VmfsDatastoreType = "VMFS"
+	// NfsDatastoreType and Nfs41DatastoreType are the types of NFS 3 and NFS 4.1 datastores in their summary
+	NfsDatastoreType   = "NFS"
+	Nfs41DatastoreType = "NFS41"
+	// VsanDirectDatastoreType is the type of vSAN Direct datastores in their summary
+	VsanDirectDatastoreType = "vsanD"
+	// PmemDatastoreType is the type of the persistent memory datastores of hosts in their summary
+	PmemDatastoreType = "PMEM"
+	// VvolDatastoreType is the type of Virtual Volumes datastores in their summary
+	VvolDatastoreType = "VVOL"
+)
+
 // Datastore holds Datastore and Datacenter information.
 type Datastore struct {
 	// Datastore represents the govmomi Datastore instance.
@@ -56,3 +73,163 @@ func (ds *Datastore) GetDatastoreURL(ctx context.Context) (string, error) {
 	}
 	return dsMo.Summary.Url, nil
 }
+
+// RegisterDisk registers the virtual disk at path on the datastore, e.g.
+// "kubevols/pvc-1.vmdk", as a First Class Disk with name and returns its ID.
+// The ID of the First Class Disk is returned if the disk is registered already.
+func (ds *Datastore) RegisterDisk(ctx context.Context, path string, name string) (string, error) {
+	req := types.RegisterDisk{
+		This: *ds.Client().ServiceContent.VStorageObjectManager,
+		Path: ds.NewURL(path).String(),
+		Name: name,
+	}
+	res, err := methods.RegisterDisk(ctx, ds.Client(), &req)
+	if err == nil {
+		return res.Returnval.Config.Id.Id, nil
+	}
+	id, findErr := ds.getFirstClassDiskID(ctx, path)
+	if findErr != nil || id == "" {
+		klog.Errorf("Failed to register disk %q on datastore %v. err: %+v", path, ds, err)
+		return "", err
+	}
+	klog.V(2).Infof("Disk %q on datastore %v is registered as First Class Disk %s already", path, ds, id)
+	return id, nil
+}
+
+// GetFirstClassDiskPath returns the datastore path of the First Class Disk id,
+// e.g. "[vsanDatastore] fcd/7a1c4b0e.vmdk".
+func (ds *Datastore) GetFirstClassDiskPath(ctx context.Context, id string) (string, error) {
+	backing, err := ds.getFirstClassDiskBacking(ctx, id)
+	if err != nil {
+		klog.Errorf("Failed to retrieve First Class Disk %s on datastore %v. err: %+v", id, ds, err)
+		return "", err
+	}
+	return backing.FilePath, nil
+}
+
+// EnableChangedBlockTracking enables changed block tracking on the First Class Disk id,
+// whose changed areas can then be queried in the snapshots of the disk.
+func (ds *Datastore) EnableChangedBlockTracking(ctx context.Context, id string) error {
+	_, err := methods.SetVStorageObjectControlFlags(ctx, ds.Client(), &types.SetVStorageObjectControlFlags{
+		This:         *ds.Client().ServiceContent.VStorageObjectManager,
+		Id:           types.ID{Id: id},
+		Datastore:    ds.Reference(),
+		ControlFlags: []string{string(types.VslmVStorageObjectControlFlagEnableChangedBlockTracking)},
+	})
+	if err != nil {
+		klog.Errorf("Failed to enable changed block tracking of First Class Disk %s on datastore %v. err: %+v", id, ds, err)
+		return err
+	}
+	return nil
+}
+
+// GetFirstClassDiskCapacityInMB returns the capacity of the First Class Disk id in MB.
+func (ds *Datastore) GetFirstClassDiskCapacityInMB(ctx context.Context, id string) (int64, error) {
+	obj, err := ds.retrieveFirstClassDisk(ctx, id)
+	if err != nil {
+		klog.Errorf("Failed to retrieve First Class Disk %s on datastore %v. err: %+v", id, ds, err)
+		return 0, err
+	}
+	return obj.Config.CapacityInMB, nil
+}
+
+// getFirstClassDiskID returns the ID of the First Class Disk at path on the
+// datastore, or an empty string if the disk at path is not a First Class Disk.
+func (ds *Datastore) getFirstClassDiskID(ctx context.Context, path string) (string, error) {
+	res, err := methods.ListVStorageObject(ctx, ds.Client(), &types.ListVStorageObject{
+		This:      *ds.Client().ServiceContent.VStorageObjectManager,
+		Datastore: ds.Reference(),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, id := range res.Returnval {
+		backing, err := ds.getFirstClassDiskBacking(ctx, id.Id)
+		if err != nil {
+			return "", err
+		}
+		var dsPath object.DatastorePath
+		if dsPath.FromString(backing.FilePath) && dsPath.Path == path {
+			return id.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// getFirstClassDiskBacking returns the file backing of the First Class Disk id on the datastore.
+func (ds *Datastore) getFirstClassDiskBacking(ctx context.Context, id string) (*types.BaseConfigInfoDiskFileBackingInfo, error) {
+	obj, err := ds.retrieveFirstClassDisk(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	backing, ok := obj.Config.Backing.(*types.BaseConfigInfoDiskFileBackingInfo)
+	if !ok {
+		return nil, fmt.Errorf("First Class Disk %s has an unexpected backing %T", id, obj.Config.Backing)
+	}
+	return backing, nil
+}
+
+// retrieveFirstClassDisk returns the First Class Disk id on the datastore.
+func (ds *Datastore) retrieveFirstClassDisk(ctx context.Context, id string) (*types.VStorageObject, error) {
+	res, err := methods.RetrieveVStorageObject(ctx, ds.Client(), &types.RetrieveVStorageObject{
+		This:      *ds.Client().ServiceContent.VStorageObjectManager,
+		Id:        types.ID{Id: id},
+		Datastore: ds.Reference(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res.Returnval, nil
+}
+
+// IsHostLocal returns true if the datastore is only accessible from a single host,
+// like vSAN Direct and local VMFS datastores.
+func (ds *Datastore) IsHostLocal(ctx context.Context) (bool, error) {
+	var dsMo mo.Datastore
+	pc := property.DefaultCollector(ds.Client())
+	err := pc.RetrieveOne(ctx, ds.Datastore.Reference(), []string{"summary", "host"}, &dsMo)
+	if err != nil {
+		klog.Errorf("Failed to retrieve datastore summary and host properties: %v", err)
+		return false, err
+	}
+	if dsMo.Summary.MultipleHostAccess != nil {
+		return !*dsMo.Summary.MultipleHostAccess, nil
+	}
+	return len(dsMo.Host) <= 1, nil
+}
+
+// GetDatastoreTypes returns the types of datastores of a virtual center by their URL,
+// retrieved with a single call.
+func GetDatastoreTypes(ctx context.Context, datastores []*DatastoreInfo) (map[string]string, error) {
+	dsTypes := make(map[string]string)
+	if len(datastores) == 0 {
+		return dsTypes, nil
+	}
+	var refs []types.ManagedObjectReference
+	for _, datastore := range datastores {
+		refs = append(refs, datastore.Reference())
+	}
+	var dsMos []mo.Datastore
+	pc := property.DefaultCollector(datastores[0].Client())
+	if err := pc.Retrieve(ctx, refs, []string{"summary"}, &dsMos); err != nil {
+		klog.Errorf("Failed to retrieve datastore summary properties: %v", err)
+		return nil, err
+	}
+	for _, dsMo := range dsMos {
+		dsTypes[dsMo.Summary.Url] = dsMo.Summary.Type
+	}
+	return dsTypes, nil
+}
+
+// GetDatastoreType returns the type of the datastore, e.g. "VMFS", VsanDirectDatastoreType
+// or PmemDatastoreType.
+func (ds *Datastore) GetDatastoreType(ctx context.Context) (string, error) {
+	var dsMo mo.Datastore
+	pc := property.DefaultCollector(ds.Client())
+	err := pc.RetrieveOne(ctx, ds.Datastore.Reference(), []string{"summary"}, &dsMo)
+	if err != nil {
+		klog.Errorf("Failed to retrieve datastore summary property: %v", err)
+		return "", err
+	}
+	return dsMo.Summary.Type, nil
+}
@@ -43,6 +43,9 @@ func (host *HostSystem) GetAllAccessibleDatastores(ctx context.Context) ([]*Data
 	}
 	var dsRefList []types.ManagedObjectReference
 	dsRefList = append(dsRefList, hostSystemMo.Datastore...)
+	if len(dsRefList) == 0 {
+		return nil, nil
+	}
 
 	var dsMoList []mo.Datastore
 	pc := property.DefaultCollector(host.Client())
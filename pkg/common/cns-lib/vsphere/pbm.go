@@ -18,11 +18,32 @@ package vsphere
 
 import (
 	"context"
+	"strings"
 
 	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
 	"k8s.io/klog"
 )
 
+const (
+	// encryptionCapabilityNamespace is the namespace of capabilities provided by the VM encryption IO filter
+	encryptionCapabilityNamespace = "vmwarevmcrypt"
+	// dataServiceCapabilityNamespace is the namespace of capabilities referring to data service policies
+	dataServiceCapabilityNamespace = "com.vmware.storageprofile.dataservice"
+	// defaultEncryptionDataServiceID is the ID of the "Default encryption properties" data service policy
+	defaultEncryptionDataServiceID = "ad5a249d-cbc2-43af-9366-694d7664fa52"
+	// vsanCapabilityNamespace is the namespace of vSAN capabilities
+	vsanCapabilityNamespace = "VSAN"
+	// vsanLocalityCapabilityID is the ID of the vSAN capability for site affinity on stretched clusters
+	vsanLocalityCapabilityID = "locality"
+	// VsanLocalityNone is the vSAN locality of objects which are not pinned to a site
+	VsanLocalityNone = "None"
+	// VsanLocalityPreferred is the vSAN locality of objects pinned to the preferred fault domain
+	VsanLocalityPreferred = "Preferred Fault Domain"
+	// VsanLocalitySecondary is the vSAN locality of objects pinned to the secondary fault domain
+	VsanLocalitySecondary = "Secondary Fault Domain"
+)
+
 // ConnectPbm creates a PBM client for the virtual center.
 func (vc *VirtualCenter) ConnectPbm(ctx context.Context) error {
 	var err = vc.Connect(ctx)
@@ -35,6 +56,7 @@ func (vc *VirtualCenter) ConnectPbm(ctx context.Context) error {
 			klog.Errorf("Failed to create pbm client with err: %v", err)
 			return err
 		}
+		setDialTLSTimeout(vc.PbmClient.Client)
 	}
 	return nil
 }
@@ -51,10 +73,146 @@ func (vc *VirtualCenter) DisconnectPbm(ctx context.Context) error {
 
 // GetStoragePolicyIDByName gets storage policy ID by name.
 func (vc *VirtualCenter) GetStoragePolicyIDByName(ctx context.Context, storagePolicyName string) (string, error) {
-	storagePolicyID, err := vc.PbmClient.ProfileIDByName(ctx, storagePolicyName)
+	callCtx, cancelCall := vc.WithSOAPTimeout(ctx)
+	storagePolicyID, err := vc.PbmClient.ProfileIDByName(callCtx, storagePolicyName)
+	cancelCall()
 	if err != nil {
 		klog.Errorf("Failed to get StoragePolicyID from StoragePolicyName %s with err: %v", storagePolicyName, err)
 		return "", err
 	}
 	return storagePolicyID, nil
 }
+
+// StoragePolicyExists returns true if there is a storage policy with storagePolicyID.
+func (vc *VirtualCenter) StoragePolicyExists(ctx context.Context, storagePolicyID string) (bool, error) {
+	callCtx, cancelCall := vc.WithSOAPTimeout(ctx)
+	profiles, err := vc.PbmClient.RetrieveContent(callCtx, []pbmtypes.PbmProfileId{{UniqueId: storagePolicyID}})
+	cancelCall()
+	if err != nil {
+		klog.Errorf("Failed to retrieve content of storage policy %s with err: %v", storagePolicyID, err)
+		return false, err
+	}
+	return len(profiles) > 0, nil
+}
+
+// GetCompatibleDatastores returns the subset of the given datastores which are compatible
+// with the storage policy identified by storagePolicyID.
+func (vc *VirtualCenter) GetCompatibleDatastores(ctx context.Context, storagePolicyID string, datastores []*DatastoreInfo) ([]*DatastoreInfo, error) {
+	var hubs []pbmtypes.PbmPlacementHub
+	for _, ds := range datastores {
+		hubs = append(hubs, pbmtypes.PbmPlacementHub{
+			HubType: ds.Reference().Type,
+			HubId:   ds.Reference().Value,
+		})
+	}
+	req := []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{
+			ProfileId: pbmtypes.PbmProfileId{
+				UniqueId: storagePolicyID,
+			},
+		},
+	}
+	callCtx, cancelCall := vc.WithSOAPTimeout(ctx)
+	res, err := vc.PbmClient.CheckRequirements(callCtx, hubs, nil, req)
+	cancelCall()
+	if err != nil {
+		klog.Errorf("Failed to check datastore compatibility with StoragePolicyID %s with err: %v", storagePolicyID, err)
+		return nil, err
+	}
+	compatibleHubs := make(map[string]bool)
+	for _, hub := range res.CompatibleDatastores() {
+		compatibleHubs[hub.HubId] = true
+	}
+	var compatibleDatastores []*DatastoreInfo
+	for _, ds := range datastores {
+		if compatibleHubs[ds.Reference().Value] {
+			compatibleDatastores = append(compatibleDatastores, ds)
+		}
+	}
+	return compatibleDatastores, nil
+}
+
+// IsEncryptionPolicy returns true if the storage policy identified by storagePolicyID
+// requires volumes to be encrypted.
+func (vc *VirtualCenter) IsEncryptionPolicy(ctx context.Context, storagePolicyID string) (bool, error) {
+	callCtx, cancelCall := vc.WithSOAPTimeout(ctx)
+	profiles, err := vc.PbmClient.RetrieveContent(callCtx, []pbmtypes.PbmProfileId{{UniqueId: storagePolicyID}})
+	cancelCall()
+	if err != nil {
+		klog.Errorf("Failed to retrieve content of storage policy %s with err: %v", storagePolicyID, err)
+		return false, err
+	}
+	var dataServiceIDs []pbmtypes.PbmProfileId
+	for _, capability := range getProfileCapabilities(profiles) {
+		if strings.HasPrefix(capability.Id.Namespace, encryptionCapabilityNamespace) {
+			return true, nil
+		}
+		if capability.Id.Namespace == dataServiceCapabilityNamespace {
+			if capability.Id.Id == defaultEncryptionDataServiceID {
+				return true, nil
+			}
+			dataServiceIDs = append(dataServiceIDs, pbmtypes.PbmProfileId{UniqueId: capability.Id.Id})
+		}
+	}
+	if len(dataServiceIDs) == 0 {
+		return false, nil
+	}
+	// Look for the encryption capability in the data service policies referred to by the storage policy
+	callCtx, cancelCall = vc.WithSOAPTimeout(ctx)
+	dataServiceProfiles, err := vc.PbmClient.RetrieveContent(callCtx, dataServiceIDs)
+	cancelCall()
+	if err != nil {
+		klog.Errorf("Failed to retrieve content of data service policies %v with err: %v", dataServiceIDs, err)
+		return false, err
+	}
+	for _, capability := range getProfileCapabilities(dataServiceProfiles) {
+		if strings.HasPrefix(capability.Id.Namespace, encryptionCapabilityNamespace) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getProfileCapabilities returns the capabilities in all sub-profiles of the given capability profiles
+func getProfileCapabilities(profiles []pbmtypes.BasePbmProfile) []pbmtypes.PbmCapabilityInstance {
+	var capabilities []pbmtypes.PbmCapabilityInstance
+	for _, profile := range profiles {
+		capabilityProfile, ok := profile.(*pbmtypes.PbmCapabilityProfile)
+		if !ok {
+			continue
+		}
+		constraints, ok := capabilityProfile.Constraints.(*pbmtypes.PbmCapabilitySubProfileConstraints)
+		if !ok {
+			continue
+		}
+		for _, subProfile := range constraints.SubProfiles {
+			capabilities = append(capabilities, subProfile.Capability...)
+		}
+	}
+	return capabilities
+}
+
+// GetVsanLocality returns the vSAN site affinity of the storage policy identified by storagePolicyID.
+// VsanLocalityNone is returned if the storage policy does not set a site affinity.
+func (vc *VirtualCenter) GetVsanLocality(ctx context.Context, storagePolicyID string) (string, error) {
+	callCtx, cancelCall := vc.WithSOAPTimeout(ctx)
+	profiles, err := vc.PbmClient.RetrieveContent(callCtx, []pbmtypes.PbmProfileId{{UniqueId: storagePolicyID}})
+	cancelCall()
+	if err != nil {
+		klog.Errorf("Failed to retrieve content of storage policy %s with err: %v", storagePolicyID, err)
+		return "", err
+	}
+	for _, capability := range getProfileCapabilities(profiles) {
+		if capability.Id.Namespace != vsanCapabilityNamespace || capability.Id.Id != vsanLocalityCapabilityID {
+			continue
+		}
+		for _, constraint := range capability.Constraint {
+			for _, property := range constraint.PropertyInstance {
+				if locality, ok := property.Value.(string); ok && property.Id == vsanLocalityCapabilityID {
+					return locality, nil
+				}
+			}
+		}
+	}
+	return VsanLocalityNone, nil
+}
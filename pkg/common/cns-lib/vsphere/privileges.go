@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+)
+
+// ErrNoActiveSession is returned when there is no active session with vCenter.
+var ErrNoActiveSession = errors.New("no active session with vCenter")
+
+var (
+	// DatastorePrivileges are the privileges required on datastores hosting CNS volumes.
+	DatastorePrivileges = []string{"Datastore.FileManagement"}
+	// NodeVMPrivileges are the privileges required on node VMs to attach and detach volumes.
+	NodeVMPrivileges = []string{"VirtualMachine.Config.AddExistingDisk", "VirtualMachine.Config.AddRemoveDevice"}
+	// RootFolderPrivileges are the privileges required on the vCenter root folder.
+	RootFolderPrivileges = []string{"Cns.Searchable", "StorageProfile.View"}
+)
+
+// GetMissingPrivileges returns a map of entities to the privileges from privIds
+// which are not granted on them to the user of the current vCenter session.
+// Entities on which all privileges are granted are not included in the result.
+func (vc *VirtualCenter) GetMissingPrivileges(ctx context.Context, entities []types.ManagedObjectReference, privIds []string) (map[types.ManagedObjectReference][]string, error) {
+	missingPrivileges := make(map[types.ManagedObjectReference][]string)
+	if len(entities) == 0 {
+		return missingPrivileges, nil
+	}
+	userSession, err := vc.Client.SessionManager.UserSession(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get user session for vCenter: %q. err: %v", vc.Config.Host, err)
+		return nil, err
+	}
+	if userSession == nil {
+		klog.Errorf("No active session found for vCenter: %q", vc.Config.Host)
+		return nil, ErrNoActiveSession
+	}
+	req := types.HasPrivilegeOnEntities{
+		This:      *vc.Client.ServiceContent.AuthorizationManager,
+		Entity:    entities,
+		SessionId: userSession.Key,
+		PrivId:    privIds,
+	}
+	res, err := methods.HasPrivilegeOnEntities(ctx, vc.Client, &req)
+	if err != nil {
+		klog.Errorf("Failed to check privileges %v on entities %v. err: %v", privIds, entities, err)
+		return nil, err
+	}
+	for _, entityPrivilege := range res.Returnval {
+		for _, privAvailability := range entityPrivilege.PrivAvailability {
+			if !privAvailability.IsGranted {
+				missingPrivileges[entityPrivilege.Entity] = append(missingPrivileges[entityPrivilege.Entity], privAvailability.PrivId)
+			}
+		}
+	}
+	return missingPrivileges, nil
+}
+
+// PrivilegeCheck is the result of checking the privileges required by the driver on a vCenter.
+type PrivilegeCheck struct {
+	// Missing maps the entities to the privileges which are not granted on them.
+	Missing map[types.ManagedObjectReference][]string
+	// Checked is the set of the privileges which could be checked on any entity.
+	Checked map[string]bool
+}
+
+// CheckPrivileges checks that the user of the current vCenter session holds RootFolderPrivileges
+// on the root folder, DatastorePrivileges on datastores and NodeVMPrivileges on nodeVMs.
+// Privileges which fail to be checked are logged and left out of Checked.
+func (vc *VirtualCenter) CheckPrivileges(ctx context.Context, datastores []types.ManagedObjectReference,
+	nodeVMs []types.ManagedObjectReference) *PrivilegeCheck {
+	check := &PrivilegeCheck{
+		Missing: make(map[types.ManagedObjectReference][]string),
+		Checked: make(map[string]bool),
+	}
+	vc.checkEntityPrivileges(ctx, check, []types.ManagedObjectReference{vc.Client.ServiceContent.RootFolder}, RootFolderPrivileges)
+	vc.checkEntityPrivileges(ctx, check, datastores, DatastorePrivileges)
+	vc.checkEntityPrivileges(ctx, check, nodeVMs, NodeVMPrivileges)
+	return check
+}
+
+// checkEntityPrivileges adds the privileges from privIds which are not granted on entities to
+// check.Missing, and privIds to check.Checked if they could be checked.
+func (vc *VirtualCenter) checkEntityPrivileges(ctx context.Context, check *PrivilegeCheck,
+	entities []types.ManagedObjectReference, privIds []string) {
+	entityPrivileges, err := vc.GetMissingPrivileges(ctx, entities, privIds)
+	if err != nil {
+		klog.Errorf("PrivilegeCheck: failed to check privileges %v on vCenter %q. err: %v", privIds, vc.Config.Host, err)
+		return
+	}
+	for entity, privileges := range entityPrivileges {
+		check.Missing[entity] = append(check.Missing[entity], privileges...)
+	}
+	if len(entities) > 0 {
+		for _, privID := range privIds {
+			check.Checked[privID] = true
+		}
+	}
+}
+
+// GetDatastoresByURL returns the datastores of the datacenters of vc by their URLs.
+// Datacenters whose datastores fail to be listed are logged and skipped.
+func (vc *VirtualCenter) GetDatastoresByURL(ctx context.Context) (map[string]types.ManagedObjectReference, error) {
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get datacenters of vCenter %q. err: %v", vc.Config.Host, err)
+		return nil, err
+	}
+	datastores := make(map[string]types.ManagedObjectReference)
+	for _, dc := range datacenters {
+		dsURLInfoMap, err := dc.GetAllDatastores(ctx)
+		if err != nil {
+			klog.Errorf("Failed to get datastores of %s. err: %v", dc.Datacenter.String(), err)
+			continue
+		}
+		for dsURL, dsInfo := range dsURLInfoMap {
+			datastores[dsURL] = dsInfo.Datastore.Reference()
+		}
+	}
+	return datastores, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"time"
+
+	"github.com/vmware/govmomi/pbm"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	"k8s.io/klog"
+)
+
+const (
+	// keepAliveInterval is the idle time after which the session is checked,
+	// well below the default vCenter session timeout of 30 minutes.
+	keepAliveInterval = 5 * time.Minute
+	// keepAliveTimeout is the timeout of the session check and re-login.
+	keepAliveTimeout = time.Minute
+)
+
+// ConnectVirtualCenter returns the VirtualCenter for config from the VirtualCenterManager,
+// registering it if it is not registered yet, and connects to it. The controller, node
+// and syncer share the session of the returned VirtualCenter, which is kept alive while
+// idle and logged in again when it is no longer authenticated.
+func ConnectVirtualCenter(ctx context.Context, config *VirtualCenterConfig) (*VirtualCenter, error) {
+	vcManager := GetVirtualCenterManager()
+	vc, err := vcManager.RegisterVirtualCenter(config)
+	if err == ErrVCAlreadyRegistered {
+		vc, err = vcManager.GetVirtualCenter(config.Host)
+	}
+	if err != nil {
+		klog.Errorf("Failed to register VirtualCenter %q. err=%v", config.Host, err)
+		return nil, err
+	}
+	if err = vc.Connect(ctx); err != nil {
+		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", config.Host, err)
+		return nil, err
+	}
+	return vc, nil
+}
+
+// keepAlive returns the keep-alive handler of the session of client. The handler
+// logs in again if the session is not authenticated, e.g. after the vCenter was
+// restarted or could not be reached for longer than the session timeout.
+func (vc *VirtualCenter) keepAlive(client *vim25.Client) func(soap.RoundTripper) error {
+	return func(soap.RoundTripper) error {
+		ctx, cancel := context.WithTimeout(context.Background(), keepAliveTimeout)
+		defer cancel()
+		// Errors are never returned, they stop the keep-alive
+		userSession, err := session.NewManager(client).UserSession(ctx)
+		if err != nil {
+			klog.Warningf("Failed to check session of vCenter %q with err: %v", vc.Config.Host, err)
+			return nil
+		}
+		if userSession != nil {
+			return nil
+		}
+		clientMutex.Lock()
+		defer clientMutex.Unlock()
+		if vc.Client == nil || vc.Client.Client != client {
+			// Disconnected, the session is no longer used
+			return nil
+		}
+		klog.Warningf("Session of vCenter %q is not authenticated, logging in again", vc.Config.Host)
+		if err := vc.relogin(ctx); err != nil {
+			klog.Errorf("Failed to log in to vCenter %q again with err: %v", vc.Config.Host, err)
+		}
+		return nil
+	}
+}
+
+// relogin logs in to the virtual center again with the client of vc.
+// clientMutex must be held by the caller.
+func (vc *VirtualCenter) relogin(ctx context.Context) error {
+	if err := vc.login(ctx, vc.Client); err != nil {
+		return err
+	}
+	return vc.newServiceClients(ctx)
+}
+
+// newServiceClients recreates the PBM and CNS clients of vc, if created, which hold
+// the cookie of the session they were created with.
+func (vc *VirtualCenter) newServiceClients(ctx context.Context) error {
+	var err error
+	if vc.PbmClient != nil {
+		if vc.PbmClient, err = pbm.NewClient(ctx, vc.Client.Client); err != nil {
+			klog.Errorf("Failed to create pbm client with err: %v", err)
+			return err
+		}
+		setDialTLSTimeout(vc.PbmClient.Client)
+	}
+	if vc.CnsClient != nil {
+		if vc.CnsClient, err = NewCNSClient(ctx, vc.Client.Client); err != nil {
+			klog.Errorf("Failed to create CNS client on vCenter host %v with err: %v", vc.Config.Host, err)
+			return err
+		}
+	}
+	return nil
+}
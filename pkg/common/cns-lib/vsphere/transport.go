@@ -0,0 +1,153 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"k8s.io/klog"
+)
+
+const (
+	// defaultDialKeepAlive is the keep-alive period of virtual center connections,
+	// the same as for http.DefaultTransport.
+	defaultDialKeepAlive = 30 * time.Second
+)
+
+var (
+	// proxies maps virtual center hosts to the URL of their configured proxy.
+	proxies sync.Map
+	// dialTimeouts maps virtual center hosts to the timeout of establishing a connection.
+	dialTimeouts sync.Map
+	// onceForTransport is used for installing the settings of virtual center connections.
+	onceForTransport sync.Once
+)
+
+// configureTransport sets the proxy and timeouts of connections to the virtual center
+// host. govmomi creates the transport of each SOAP client, including the PBM, CNS and
+// STS clients, from http.DefaultTransport, so the settings are made there for all of
+// them. Requests to other hosts keep using the proxy of the environment and the default
+// dial timeout. The idle connection timeout can not be set per host, the one of the
+// first configured virtual center is used.
+func configureTransport(host string, config *VirtualCenterConfig) error {
+	onceForTransport.Do(func() {
+		transport, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			klog.Warning("vCenter connections can not be configured, unexpected default HTTP transport")
+			return
+		}
+		envProxy := transport.Proxy
+		transport.Proxy = func(req *http.Request) (*neturl.URL, error) {
+			if proxy, ok := proxies.Load(req.URL.Hostname()); ok {
+				return proxy.(*neturl.URL), nil
+			}
+			if envProxy == nil {
+				return nil, nil
+			}
+			return envProxy(req)
+		}
+		dialContext := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addrHost, _, err := net.SplitHostPort(addr); err == nil {
+				if timeout, ok := dialTimeouts.Load(addrHost); ok {
+					dialer := &net.Dialer{Timeout: timeout.(time.Duration), KeepAlive: defaultDialKeepAlive}
+					return dialer.DialContext(ctx, network, addr)
+				}
+			}
+			return dialContext(ctx, network, addr)
+		}
+		if config.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = config.IdleConnTimeout
+		}
+	})
+	if config.DialTimeout > 0 {
+		dialTimeouts.Store(host, config.DialTimeout)
+	} else {
+		dialTimeouts.Delete(host)
+	}
+	if config.ProxyURL == "" {
+		proxies.Delete(host)
+		return nil
+	}
+	proxy, err := neturl.Parse(config.ProxyURL)
+	if err != nil || proxy.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q for vCenter %q", config.ProxyURL, host)
+	}
+	klog.V(2).Infof("Connecting to vCenter %q through proxy %q", host, proxy.Host)
+	proxies.Store(host, proxy)
+	return nil
+}
+
+// setDialTLSTimeout applies the dial timeout of the virtual center host to the TLS
+// connections of client. soap.NewClient sets its own DialTLS for clients which verify
+// certificates, which dials without a timeout and bypasses the DialContext installed by
+// configureTransport. The timeout covers the TLS handshake as well.
+// govmomi does not expose the SOAP client of the CNS client, its connections are only
+// limited by the SOAP timeout of each call.
+func setDialTLSTimeout(client *soap.Client) {
+	transport, ok := client.Client.Transport.(*http.Transport)
+	if !ok || transport.DialTLS == nil {
+		return
+	}
+	dialTLS := transport.DialTLS
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		if addrHost, _, err := net.SplitHostPort(addr); err == nil {
+			if timeout, ok := dialTimeouts.Load(addrHost); ok {
+				dialer := &net.Dialer{Timeout: timeout.(time.Duration), KeepAlive: defaultDialKeepAlive}
+				return tls.DialWithDialer(dialer, network, addr, transport.TLSClientConfig)
+			}
+		}
+		return dialTLS(network, addr)
+	}
+}
+
+// timeoutRoundTripper limits the duration of each SOAP call to the virtual center.
+// WaitForUpdatesEx calls are not limited, they are long polls of the property
+// collector which only return once the awaited task has progressed.
+type timeoutRoundTripper struct {
+	soap.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip calls the wrapped RoundTripper with a context which expires after the timeout.
+func (t *timeoutRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	if _, ok := req.(*methods.WaitForUpdatesExBody); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	return t.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+// WithSOAPTimeout returns a context for a single SOAP call to a service of the
+// virtual center, e.g. CNS or PBM, which expires after the configured SOAP timeout.
+// The returned context.CancelFunc must be called once the call returns.
+func (vc *VirtualCenter) WithSOAPTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if vc.Config.SOAPTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, vc.Config.SOAPTimeout)
+}
@@ -19,12 +19,15 @@ package vsphere
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/sts"
@@ -44,6 +47,15 @@ func IsInvalidCredentialsError(err error) bool {
 	return isInvalidCredentialsError
 }
 
+// IsManagedObjectNotFound returns true if error is of type ManagedObjectNotFound
+func IsManagedObjectNotFound(err error) bool {
+	isManagedObjectNotFound := false
+	if soap.IsSoapFault(err) {
+		_, isManagedObjectNotFound = soap.ToSoapFault(err).VimFault().(types.ManagedObjectNotFound)
+	}
+	return isManagedObjectNotFound
+}
+
 // GetCnsKubernetesEntityMetaData creates a CnsKubernetesEntityMetadataObject object from given parameters
 func GetCnsKubernetesEntityMetaData(entityName string, labels map[string]string, deleteFlag bool, entityType string, namespace string) *cnstypes.CnsKubernetesEntityMetadata {
 	// Create new metadata spec
@@ -68,6 +80,12 @@ func GetCnsKubernetesEntityMetaData(entityName string, labels map[string]string,
 
 // GetContainerCluster creates ContainerCluster object from given parameters
 func GetContainerCluster(clusterid string, username string) cnstypes.CnsContainerCluster {
+	// Solution users log in with a certificate, they are named by its subject
+	if block, _ := pem.Decode([]byte(username)); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			username = cert.Subject.CommonName
+		}
+	}
 	return cnstypes.CnsContainerCluster{
 		ClusterType: string(cnstypes.CnsClusterTypeKubernetes),
 		ClusterId:   clusterid,
@@ -77,25 +95,63 @@ func GetContainerCluster(clusterid string, username string) cnstypes.CnsContaine
 }
 
 // GetVirtualCenterConfig returns VirtualCenterConfig Object created using vSphere Configuration
-// specified in the argurment.
+// specified in the argurment. With multiple vCenters, the config of the first one is returned.
 func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
-	var err error
-	vCenterIPs, err := GetVcenterIPs(cfg) //  make([]string, 0)
+	vcConfigs, err := GetVirtualCenterConfigs(cfg)
 	if err != nil {
 		return nil, err
 	}
-	host := vCenterIPs[0]
+	return vcConfigs[0], nil
+}
+
+// GetVirtualCenterConfigs returns the VirtualCenterConfig of each vCenter in the vSphere
+// Configuration, ordered by host.
+func GetVirtualCenterConfigs(cfg *config.Config) ([]*VirtualCenterConfig, error) {
+	vCenterIPs, err := GetVcenterIPs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var vcConfigs []*VirtualCenterConfig
+	for _, host := range vCenterIPs {
+		vcConfig, err := getVirtualCenterConfig(cfg, host)
+		if err != nil {
+			return nil, err
+		}
+		vcConfigs = append(vcConfigs, vcConfig)
+	}
+	return vcConfigs, nil
+}
+
+// getVirtualCenterConfig returns the VirtualCenterConfig of the vCenter host in cfg.
+func getVirtualCenterConfig(cfg *config.Config, host string) (*VirtualCenterConfig, error) {
 	port, err := strconv.Atoi(cfg.VirtualCenter[host].VCenterPort)
 	if err != nil {
 		return nil, err
 	}
+	tlsConfig, err := config.TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	vcConfig := &VirtualCenterConfig{
-		Host:            host,
-		Port:            port,
-		Username:        cfg.VirtualCenter[host].User,
-		Password:        cfg.VirtualCenter[host].Password,
-		Insecure:        cfg.VirtualCenter[host].InsecureFlag,
-		DatacenterPaths: strings.Split(cfg.VirtualCenter[host].Datacenters, ","),
+		Host:                 host,
+		Server:               cfg.VirtualCenter[host].Server,
+		Port:                 port,
+		Username:             cfg.VirtualCenter[host].User,
+		Password:             cfg.VirtualCenter[host].Password,
+		Insecure:             cfg.VirtualCenter[host].InsecureFlag,
+		DatacenterPaths:      strings.Split(cfg.VirtualCenter[host].Datacenters, ","),
+		MaxInFlightTasks:     cfg.VirtualCenter[host].MaxInFlightTasks,
+		AttachControllerType: cfg.Global.AttachControllerType,
+		CreateRateLimit:      RateLimit{QPS: cfg.RateLimit.CreateQPS, Burst: cfg.RateLimit.CreateBurst},
+		AttachRateLimit:      RateLimit{QPS: cfg.RateLimit.AttachQPS, Burst: cfg.RateLimit.AttachBurst},
+		MetadataRateLimit:    RateLimit{QPS: cfg.RateLimit.MetadataQPS, Burst: cfg.RateLimit.MetadataBurst},
+		QueryRateLimit:       RateLimit{QPS: cfg.RateLimit.QueryQPS, Burst: cfg.RateLimit.QueryBurst},
+		ProxyURL:             cfg.VirtualCenter[host].ProxyURL,
+		DialTimeout:          time.Duration(cfg.Global.DialTimeout) * time.Second,
+		SOAPTimeout:          time.Duration(cfg.Global.SOAPTimeout) * time.Second,
+		IdleConnTimeout:      time.Duration(cfg.Global.IdleConnTimeout) * time.Second,
+		TLSMinVersion:        tlsConfig.MinVersion,
+		TLSCipherSuites:      tlsConfig.CipherSuites,
 	}
 	for idx := range vcConfig.DatacenterPaths {
 		vcConfig.DatacenterPaths[idx] = strings.TrimSpace(vcConfig.DatacenterPaths[idx])
@@ -116,6 +172,7 @@ func GetVcenterIPs(cfg *config.Config) ([]string, error) {
 	if len(vCenterIPs) == 0 {
 		err = errors.New("Unable get vCenter Hosts from VSphereConfig")
 	}
+	sort.Strings(vCenterIPs)
 	return vCenterIPs, err
 }
 
@@ -151,6 +208,7 @@ func signer(ctx context.Context, client *vim25.Client, username string, password
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create STS client. err: %+v", err)
 	}
+	setDialTLSTimeout(tokens.Client)
 	req := sts.TokenRequest{
 		Certificate: &certificate,
 		Delegatable: true,
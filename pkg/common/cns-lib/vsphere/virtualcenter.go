@@ -22,11 +22,12 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
 	neturl "net/url"
 	"strconv"
 	"sync"
+	"time"
 
-	csictx "github.com/rexray/gocsi/context"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/cns"
 	"github.com/vmware/govmomi/find"
@@ -61,6 +62,8 @@ type VirtualCenter struct {
 	// CnsClient represents the CNS client instance.
 	CnsClient       *cns.Client
 	credentialsLock sync.Mutex
+	// datacentersLock guards Config.DatacenterPaths, which may be changed by SetDatacenterPaths
+	datacentersLock sync.RWMutex
 }
 
 func (vc *VirtualCenter) String() string {
@@ -72,8 +75,12 @@ func (vc *VirtualCenter) String() string {
 type VirtualCenterConfig struct {
 	// Scheme represents the connection scheme. (Ex: https)
 	Scheme string
-	// Host represents the virtual center host address.
+	// Host represents the virtual center host address. It identifies the virtual center,
+	// unless Server is set, as a virtual center may be configured more than once.
 	Host string
+	// Server is the address of the virtual center if it differs from Host.
+	// Optional; if not set, Host is connected to.
+	Server string
 	// Port represents the virtual center host port.
 	Port int
 	// Username represents the virtual center username.
@@ -91,15 +98,53 @@ type VirtualCenterConfig struct {
 	RoundTripperCount int
 	// DatacenterPaths represents paths of datacenters on the virtual center.
 	DatacenterPaths []string
+	// MaxInFlightTasks is the maximum number of CNS tasks in flight on the virtual center.
+	MaxInFlightTasks int
+	// AttachControllerType is the type of the SCSI controllers hot-added to VMs when the
+	// disks attached to them do not fit. Optional; if not set, pvscsi controllers are added.
+	AttachControllerType string
+	// CreateRateLimit, AttachRateLimit, MetadataRateLimit and QueryRateLimit are the
+	// rate limits of the CNS calls to the virtual center by class of operation.
+	CreateRateLimit   RateLimit
+	AttachRateLimit   RateLimit
+	MetadataRateLimit RateLimit
+	QueryRateLimit    RateLimit
+	// ProxyURL is the URL of the proxy through which the virtual center is reached.
+	// Optional; if not set, the proxy environment variables are used.
+	ProxyURL string
+	// DialTimeout is the timeout of establishing a connection to the virtual center.
+	// Optional; if not set, the default of the HTTP transport is used.
+	DialTimeout time.Duration
+	// SOAPTimeout is the timeout of a single SOAP call to the virtual center.
+	// Optional; if not set, SOAP calls are only limited by the context of the caller.
+	SOAPTimeout time.Duration
+	// IdleConnTimeout is the time after which idle connections to the virtual center
+	// are closed. Optional; if not set, the default of the HTTP transport is used.
+	IdleConnTimeout time.Duration
+	// TLSMinVersion is the minimum TLS version of connections to the virtual center.
+	// Optional; if not set, the default of Go is used.
+	TLSMinVersion uint16
+	// TLSCipherSuites are the cipher suites allowed for connections to the virtual
+	// center. Optional; if not set, the cipher suites of Go are used.
+	TLSCipherSuites []uint16
 }
 
 func (vcc *VirtualCenterConfig) String() string {
-	return fmt.Sprintf("VirtualCenterConfig [Scheme: %v, Host: %v, Port: %v, "+
+	return fmt.Sprintf("VirtualCenterConfig [Scheme: %v, Host: %v, Server: %v, Port: %v, "+
 		"Username: %v, Password: %v, Insecure: %v, RoundTripperCount: %v, "+
-		"DatacenterPaths: %v]", vcc.Scheme, vcc.Host, vcc.Port, vcc.Username,
+		"DatacenterPaths: %v]", vcc.Scheme, vcc.Host, vcc.Server, vcc.Port, vcc.Username,
 		vcc.Password, vcc.Insecure, vcc.RoundTripperCount, vcc.DatacenterPaths)
 }
 
+// RateLimit is the rate limit of the CNS calls of a class of operations.
+type RateLimit struct {
+	// QPS is the number of calls per second. The calls are not limited if it is 0.
+	QPS float64
+	// Burst is the number of calls allowed at once. Optional; if not set, the QPS
+	// rounded up is used.
+	Burst int
+}
+
 // clientMutex is used for exclusive connection creation.
 var clientMutex sync.Mutex
 
@@ -109,13 +154,27 @@ func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error)
 		vc.Config.Scheme = DefaultScheme
 	}
 
-	url, err := soap.ParseURL(net.JoinHostPort(vc.Config.Host, strconv.Itoa(vc.Config.Port)))
+	server := vc.Config.Server
+	if server == "" {
+		server = vc.Config.Host
+	}
+	url, err := soap.ParseURL(net.JoinHostPort(server, strconv.Itoa(vc.Config.Port)))
 	if err != nil {
 		klog.Errorf("Failed to parse URL %s with err: %v", url, err)
 		return nil, err
 	}
+	if err := configureTransport(url.Hostname(), vc.Config); err != nil {
+		klog.Errorf("Failed to configure connection with err: %v", err)
+		return nil, err
+	}
 
 	soapClient := soap.NewClient(url, vc.Config.Insecure)
+	setDialTLSTimeout(soapClient)
+	// The TLS config is shared with the PBM, CNS and STS clients of the session
+	if transport, ok := soapClient.Client.Transport.(*http.Transport); ok {
+		transport.TLSClientConfig.MinVersion = vc.Config.TLSMinVersion
+		transport.TLSClientConfig.CipherSuites = vc.Config.TLSCipherSuites
+	}
 	if len(vc.Config.CAFile) > 0 && !vc.Config.Insecure {
 		if err := soapClient.SetRootCAs(vc.Config.CAFile); err != nil {
 			klog.Errorf("Failed to load CA file: %v", err)
@@ -129,6 +188,11 @@ func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error)
 	}
 
 	vimClient.UserAgent = "k8s-csi-useragent"
+	// Keep the session alive, the keep-alive starts on login
+	vimClient.RoundTripper = session.KeepAliveHandler(vimClient.RoundTripper, keepAliveInterval, vc.keepAlive(vimClient))
+	if vc.Config.SOAPTimeout > 0 {
+		vimClient.RoundTripper = &timeoutRoundTripper{RoundTripper: vimClient.RoundTripper, timeout: vc.Config.SOAPTimeout}
+	}
 
 	client := &govmomi.Client{
 		Client:         vimClient,
@@ -175,6 +239,7 @@ func (vc *VirtualCenter) login(ctx context.Context, client *govmomi.Client) erro
 		klog.Errorf("Failed to create STS client with err: %v", err)
 		return err
 	}
+	setDialTLSTimeout(tokens.Client)
 
 	req := sts.TokenRequest{
 		Certificate: &cert,
@@ -207,22 +272,12 @@ func (vc *VirtualCenter) Connect(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cfgPath := csictx.Getenv(ctx, cnsconfig.EnvCloudConfig)
-	if cfgPath == "" {
-		cfgPath = cnsconfig.DefaultCloudConfigPath
-	}
-
-	cfg, err := cnsconfig.GetCnsconfig(cfgPath)
-	if err != nil {
-		klog.Errorf("Failed to read config with err: %v", err)
-		return err
-	}
-	vcenterconfig, err := GetVirtualCenterConfig(cfg)
+	cnsconfig.ForgetBackendCredentials(vc.Config.Host)
+	username, password, err := readCredentials(ctx, vc.Config.Host)
 	if err != nil {
-		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
 		return err
 	}
-	vc.UpdateCredentials(vcenterconfig.Username, vcenterconfig.Password)
+	vc.UpdateCredentials(username, password)
 	return vc.connect(ctx)
 }
 
@@ -251,26 +306,12 @@ func (vc *VirtualCenter) connect(ctx context.Context) error {
 	} else if userSession != nil {
 		return nil
 	}
-	// If session has expired, create a new instance.
-	klog.Warning("Creating a new client session as the existing session isn't valid or not authenticated")
-	if vc.Client, err = vc.newClient(ctx); err != nil {
-		klog.Errorf("Failed to create govmomi client with err: %v", err)
+	// If session has expired, log in again with the same client.
+	klog.Warning("Logging in again as the existing session isn't valid or not authenticated")
+	if err = vc.relogin(ctx); err != nil {
+		klog.Errorf("Failed to log in to vCenter %q with err: %v", vc.Config.Host, err)
 		return err
 	}
-	// Recreate PbmClient If created using timed out VC Client
-	if vc.PbmClient != nil {
-		if vc.PbmClient, err = pbm.NewClient(ctx, vc.Client.Client); err != nil {
-			klog.Errorf("Failed to create pbm client with err: %v", err)
-			return err
-		}
-	}
-	// Recreate CNSClient If created using timed out VC Client
-	if vc.CnsClient != nil {
-		if vc.CnsClient, err = NewCNSClient(ctx, vc.Client.Client); err != nil {
-			klog.Errorf("Failed to create CNS client on vCenter host %v with err: %v", vc.Config.Host, err)
-			return err
-		}
-	}
 	return nil
 }
 
@@ -313,12 +354,26 @@ func (vc *VirtualCenter) getDatacenters(ctx context.Context, dcPaths []string) (
 // is configured in VirtualCenterConfig during registration, only the listed
 // Datacenters are returned.
 func (vc *VirtualCenter) GetDatacenters(ctx context.Context) ([]*Datacenter, error) {
-	if len(vc.Config.DatacenterPaths) != 0 {
-		return vc.getDatacenters(ctx, vc.Config.DatacenterPaths)
+	if dcPaths := vc.GetDatacenterPaths(); len(dcPaths) != 0 {
+		return vc.getDatacenters(ctx, dcPaths)
 	}
 	return vc.listDatacenters(ctx)
 }
 
+// GetDatacenterPaths returns the paths of the datacenters of the VirtualCenter
+func (vc *VirtualCenter) GetDatacenterPaths() []string {
+	vc.datacentersLock.RLock()
+	defer vc.datacentersLock.RUnlock()
+	return vc.Config.DatacenterPaths
+}
+
+// SetDatacenterPaths replaces the paths of the datacenters returned by GetDatacenters
+func (vc *VirtualCenter) SetDatacenterPaths(dcPaths []string) {
+	vc.datacentersLock.Lock()
+	defer vc.datacentersLock.Unlock()
+	vc.Config.DatacenterPaths = dcPaths
+}
+
 // Disconnect disconnects the virtual center host connection if connected.
 func (vc *VirtualCenter) Disconnect(ctx context.Context) error {
 	if vc.Client == nil {
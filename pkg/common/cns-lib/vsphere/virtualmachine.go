@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/vmware/govmomi/object"
@@ -28,12 +29,27 @@ import (
 	"github.com/vmware/govmomi/vapi/tags"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog"
 )
 
 // ErrVMNotFound is returned when a virtual machine isn't found.
 var ErrVMNotFound = errors.New("virtual machine wasn't found")
 
+const (
+	// maxSCSIControllers is the number of SCSI controllers a VM can have
+	maxSCSIControllers = 4
+	// disksPerSCSIController is the number of disks per SCSI controller,
+	// unit number 7 is reserved for the controller itself
+	disksPerSCSIController = 15
+	// disksPerPVSCSIController is the number of disks per paravirtual SCSI controller
+	// from hardware version 14 (vmx-14) onwards
+	disksPerPVSCSIController = 64
+	// pvscsi64DisksHardwareVersion is the hardware version from which paravirtual SCSI
+	// controllers support disksPerPVSCSIController disks
+	pvscsi64DisksHardwareVersion = 14
+)
+
 // VirtualMachine holds details of a virtual machine instance.
 type VirtualMachine struct {
 	// VirtualCenterHost represents the virtual machine's vCenter host.
@@ -64,6 +80,200 @@ func (vm *VirtualMachine) IsActive(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// IsEncrypted returns true if the Virtual Machine is encrypted.
+// Only encrypted Virtual Machines can have encrypted disks attached.
+func (vm *VirtualMachine) IsEncrypted(ctx context.Context) (bool, error) {
+	var vmMo mo.VirtualMachine
+	err := vm.VirtualMachine.Properties(ctx, vm.Reference(), []string{"config.keyId"}, &vmMo)
+	if err != nil {
+		klog.Errorf("Failed to get VM Managed object with property config.keyId. err: %+v", err)
+		return false, err
+	}
+	return vmMo.Config != nil && vmMo.Config.KeyId != nil, nil
+}
+
+// IsDeleted returns true if the Virtual Machine was removed from the inventory of its vCenter.
+// Such a VM has no disks to detach. An orphaned VM is not deleted, its host may reconnect with
+// the disks still attached.
+func (vm *VirtualMachine) IsDeleted(ctx context.Context) (bool, error) {
+	var vmMo mo.VirtualMachine
+	err := vm.VirtualMachine.Properties(ctx, vm.Reference(), []string{"runtime.connectionState"}, &vmMo)
+	if IsManagedObjectNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		klog.Errorf("Failed to get VM Managed object with property runtime.connectionState. err: %+v", err)
+		return false, err
+	}
+	return false, nil
+}
+
+// GetMaxVolumes returns the number of volumes that can be attached to the VM. These are the
+// disks supported by its SCSI controllers and by the controllers of controllerType which can
+// still be hot-added, less the disks on them which are not volumes, like the boot disk.
+func (vm *VirtualMachine) GetMaxVolumes(ctx context.Context, controllerType string) (int64, error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %+v", vm.Reference(), err)
+		return 0, err
+	}
+	hardwareVersion, err := vm.getHardwareVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return getMaxVolumes(devices, hardwareVersion, controllerType), nil
+}
+
+// getMaxVolumes returns the number of volumes that can be attached to a VM of hardwareVersion
+// with devices, whose SCSI controllers are added as controllerType
+func getMaxVolumes(devices object.VirtualDeviceList, hardwareVersion int, controllerType string) int64 {
+	var maxVolumes int64
+	scsiControllers := make(map[int32]bool)
+	for _, device := range devices {
+		if _, ok := device.(types.BaseVirtualSCSIController); ok {
+			scsiControllers[device.GetVirtualDevice().Key] = true
+			maxVolumes += int64(getDisksPerController(device, hardwareVersion))
+		}
+	}
+	if len(scsiControllers) < maxSCSIControllers {
+		disksPerController := disksPerSCSIController
+		if controller, err := devices.CreateSCSIController(controllerType); err == nil {
+			disksPerController = getDisksPerController(controller, hardwareVersion)
+		}
+		maxVolumes += int64((maxSCSIControllers - len(scsiControllers)) * disksPerController)
+	}
+	for _, device := range devices {
+		// Volumes are First Class Disks, which have an ID
+		if disk, ok := device.(*types.VirtualDisk); ok && disk.VDiskId == nil && scsiControllers[disk.ControllerKey] {
+			maxVolumes--
+		}
+	}
+	return maxVolumes
+}
+
+// getDisksPerController returns the number of disks supported by the SCSI controller
+// of a VM of hardwareVersion
+func getDisksPerController(controller types.BaseVirtualDevice, hardwareVersion int) int {
+	if _, ok := controller.(*types.ParaVirtualSCSIController); ok && hardwareVersion >= pvscsi64DisksHardwareVersion {
+		return disksPerPVSCSIController
+	}
+	return disksPerSCSIController
+}
+
+// getHardwareVersion returns the hardware version of the VM, e.g. 14 for vmx-14
+func (vm *VirtualMachine) getHardwareVersion(ctx context.Context) (int, error) {
+	var vmMo mo.VirtualMachine
+	err := vm.VirtualMachine.Properties(ctx, vm.Reference(), []string{"config.version"}, &vmMo)
+	if err != nil {
+		klog.Errorf("Failed to get VM Managed object with property config.version. err: %+v", err)
+		return 0, err
+	}
+	if vmMo.Config == nil {
+		return 0, fmt.Errorf("config of VM %v is not available", vm.Reference())
+	}
+	var hardwareVersion int
+	if _, err = fmt.Sscanf(vmMo.Config.Version, "vmx-%d", &hardwareVersion); err != nil {
+		return 0, fmt.Errorf("failed to parse hardware version %q of VM %v. err: %v", vmMo.Config.Version, vm.Reference(), err)
+	}
+	return hardwareVersion, nil
+}
+
+// deviceChangeLocks maps the UUIDs of VMs to the *sync.Mutex returned by LockDeviceChanges
+var deviceChangeLocks sync.Map
+
+// LockDeviceChanges serializes the disk attaches and SCSI controller hot-adds of the VM in
+// this process, so that the free SCSI slots checked by EnsureFreeSCSISlots are not taken
+// by a concurrent attach. It returns the function which unlocks the device changes.
+func (vm *VirtualMachine) LockDeviceChanges() func() {
+	lock, _ := deviceChangeLocks.LoadOrStore(vm.UUID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// EnsureFreeSCSISlots makes sure the disks of volumeIDs can be attached to the VM. If the SCSI
+// controllers of the VM do not have enough free slots for the disks which are not attached yet,
+// SCSI controllers of controllerType are hot-added to the VM, up to maxSCSIControllers.
+// The caller must hold the lock of LockDeviceChanges.
+func (vm *VirtualMachine) EnsureFreeSCSISlots(ctx context.Context, controllerType string, volumeIDs []string) error {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %+v", vm.Reference(), err)
+		return err
+	}
+	hardwareVersion, err := vm.getHardwareVersion(ctx)
+	if err != nil {
+		return err
+	}
+	controllersToAdd, err := getSCSIControllersToAdd(devices, hardwareVersion, controllerType, volumeIDs)
+	if err != nil {
+		return fmt.Errorf("failed to attach %d disk(s) to VM %v: %v", len(volumeIDs), vm.Reference(), err)
+	}
+	for i := 0; i < controllersToAdd; i++ {
+		controller, err := devices.CreateSCSIController(controllerType)
+		if err != nil {
+			klog.Errorf("Failed to create %s SCSI controller spec. err: %+v", controllerType, err)
+			return err
+		}
+		klog.V(2).Infof("SCSI controllers of VM %v are full, adding a %s SCSI controller", vm.Reference(), controllerType)
+		if err = vm.AddDevice(ctx, controller); err != nil {
+			klog.Errorf("Failed to add %s SCSI controller to VM %v. err: %+v", controllerType, vm.Reference(), err)
+			return err
+		}
+		// The bus number of the next controller follows the one of the added controller
+		devices = append(devices, controller)
+	}
+	return nil
+}
+
+// getSCSIControllersToAdd returns the number of SCSI controllers of controllerType which have
+// to be added to a VM of hardwareVersion with devices, so that the disks of volumeIDs which are
+// not attached yet can be attached. Controllers are only added up to maxSCSIControllers, disks
+// which do not fit then are left to fail the attach. It fails if no disk fits.
+func getSCSIControllersToAdd(devices object.VirtualDeviceList, hardwareVersion int, controllerType string, volumeIDs []string) (int, error) {
+	attachedVolumes := make(map[string]bool)
+	disksPerControllerKey := make(map[int32]int)
+	for _, device := range devices {
+		if disk, ok := device.(*types.VirtualDisk); ok {
+			disksPerControllerKey[disk.ControllerKey]++
+			if disk.VDiskId != nil {
+				attachedVolumes[disk.VDiskId.Id] = true
+			}
+		}
+	}
+	disksToAttach := 0
+	for _, volumeID := range volumeIDs {
+		if !attachedVolumes[volumeID] {
+			attachedVolumes[volumeID] = true
+			disksToAttach++
+		}
+	}
+	if disksToAttach == 0 {
+		return 0, nil
+	}
+	var controllers, freeSlots int
+	for _, device := range devices {
+		if _, ok := device.(types.BaseVirtualSCSIController); !ok {
+			continue
+		}
+		controllers++
+		if free := getDisksPerController(device, hardwareVersion) - disksPerControllerKey[device.GetVirtualDevice().Key]; free > 0 {
+			freeSlots += free
+		}
+	}
+	disksPerNewController := disksPerSCSIController
+	if controllerType == "pvscsi" && hardwareVersion >= pvscsi64DisksHardwareVersion {
+		disksPerNewController = disksPerPVSCSIController
+	}
+	controllersToAdd := 0
+	for freeSlots < disksToAttach && controllers+controllersToAdd < maxSCSIControllers {
+		controllersToAdd++
+		freeSlots += disksPerNewController
+	}
+	if freeSlots == 0 {
+		return 0, fmt.Errorf("all %d SCSI controllers are full", controllers)
+	}
+	return controllersToAdd, nil
+}
+
 // renew renews the virtual machine and datacenter objects given its virtual center.
 func (vm *VirtualMachine) renew(vc *VirtualCenter) {
 	vm.VirtualMachine = object.NewVirtualMachine(vc.Client.Client, vm.VirtualMachine.Reference())
@@ -198,6 +408,59 @@ func GetVirtualMachineByUUID(uuid string, instanceUUID bool) (*VirtualMachine, e
 	}
 }
 
+// GetVirtualMachineByDNSNameOrIP returns the virtual machine with the host name dnsName or one of
+// the IP addresses ips in the datacenters of all vCenters. It is used to find the VMs of nodes
+// which have no providerID, so unlike GetVirtualMachineByUUID the datacenters are searched in turn.
+func GetVirtualMachineByDNSNameOrIP(ctx context.Context, dnsName string, ips []string) (*VirtualMachine, error) {
+	for _, vc := range GetVirtualCenterManager().GetAllVirtualCenters() {
+		if err := vc.Connect(ctx); err != nil {
+			klog.Errorf("Failed to connect to vCenter %q with err: %v", vc.Config.Host, err)
+			return nil, err
+		}
+		dcs, err := vc.GetDatacenters(ctx)
+		if err != nil {
+			klog.Errorf("Failed to get datacenters of vCenter %q with err: %v", vc.Config.Host, err)
+			return nil, err
+		}
+		for _, dc := range dcs {
+			vm, err := dc.GetVirtualMachineByDNSNameOrIP(ctx, dnsName, ips)
+			if err == nil {
+				klog.V(2).Infof("Found VM %v given DNS name %s or IPs %v", vm, dnsName, ips)
+				return vm, nil
+			}
+			if err != ErrVMNotFound {
+				return nil, err
+			}
+		}
+	}
+	klog.Errorf("Returning VM not found err for DNS name %s and IPs %v", dnsName, ips)
+	return nil, ErrVMNotFound
+}
+
+// GetHostTopologyValue returns the value of the host topology label of the ESXi host of the
+// virtual machine. It is the hardware UUID of the host, which unlike the managed object ID of
+// the host is unique across vCenters and a valid label value.
+func (vm *VirtualMachine) GetHostTopologyValue(ctx context.Context) (string, error) {
+	host, err := vm.VirtualMachine.HostSystem(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get host system for vm: %v. err: %+v", vm, err)
+		return "", err
+	}
+	var hostMo mo.HostSystem
+	if err = host.Properties(ctx, host.Reference(), []string{"summary.hardware"}, &hostMo); err != nil {
+		klog.Errorf("Failed to get hardware summary of host %v. err: %+v", host.Reference(), err)
+		return "", err
+	}
+	if hostMo.Summary.Hardware == nil || hostMo.Summary.Hardware.Uuid == "" {
+		return "", fmt.Errorf("hardware UUID of host %v is not available", host.Reference())
+	}
+	value := strings.ToLower(hostMo.Summary.Hardware.Uuid)
+	if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+		return "", fmt.Errorf("hardware UUID %q of host %v is not a valid label value: %s", value, host.Reference(), strings.Join(errs, ", "))
+	}
+	return value, nil
+}
+
 // GetHostSystem returns HostSystem object of the virtual machine
 func (vm *VirtualMachine) GetHostSystem(ctx context.Context) (*object.HostSystem, error) {
 	vmHost, err := vm.VirtualMachine.HostSystem(ctx)
@@ -351,3 +614,58 @@ func (vm *VirtualMachine) IsInZoneRegion(ctx context.Context, zoneCategoryName s
 	}
 	return false, nil
 }
+
+// GetTopologyLabels returns the tags of the virtual machine in the tag categories categoryNames,
+// keyed by category name. Like the zone and region, the tag of a category is taken from the
+// nearest ancestor of the virtual machine which has one. Categories without a tag are left out.
+func (vm *VirtualMachine) GetTopologyLabels(ctx context.Context, categoryNames []string) (map[string]string, error) {
+	klog.V(4).Infof("GetTopologyLabels: called with categoryNames: %v", categoryNames)
+	labels := make(map[string]string)
+	if len(categoryNames) == 0 {
+		return labels, nil
+	}
+	tagManager, err := vm.GetTagManager(ctx)
+	if err != nil || tagManager == nil {
+		klog.Errorf("Failed to get tagManager. Error: %v", err)
+		return nil, err
+	}
+	defer tagManager.Logout(ctx)
+	objects, err := vm.GetAncestors(ctx)
+	if err != nil {
+		klog.Errorf("GetAncestors failed for %s with err %v", vm.Reference(), err)
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, categoryName := range categoryNames {
+		wanted[categoryName] = true
+	}
+	// search the hierarchy, example order: ["Host", "Cluster", "Datacenter", "Folder"]
+	for i := range objects {
+		obj := objects[len(objects)-1-i]
+		tags, err := tagManager.ListAttachedTags(ctx, obj)
+		if err != nil {
+			klog.Errorf("Cannot list attached tags. Err: %v", err)
+			return nil, err
+		}
+		for _, value := range tags {
+			tag, err := tagManager.GetTag(ctx, value)
+			if err != nil {
+				klog.Errorf("Failed to get tag:%s, error:%v", value, err)
+				return nil, err
+			}
+			category, err := tagManager.GetCategory(ctx, tag.CategoryID)
+			if err != nil {
+				klog.Errorf("Failed to get category for tag: %s, error: %v", tag.Name, err)
+				return nil, err
+			}
+			if _, found := labels[category.Name]; wanted[category.Name] && !found {
+				klog.V(4).Infof("Found tag: %s in category: %s for object %v", tag.Name, category.Name, obj)
+				labels[category.Name] = tag.Name
+			}
+		}
+		if len(labels) == len(wanted) {
+			break
+		}
+	}
+	return labels, nil
+}
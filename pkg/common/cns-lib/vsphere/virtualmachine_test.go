@@ -0,0 +1,308 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// newSCSIController returns a SCSI controller device of controllerType with key
+func newSCSIController(controllerType string, key int32) types.BaseVirtualDevice {
+	var controller types.BaseVirtualDevice
+	switch controllerType {
+	case "pvscsi":
+		controller = &types.ParaVirtualSCSIController{}
+	case "lsilogic-sas":
+		controller = &types.VirtualLsiLogicSASController{}
+	}
+	controller.GetVirtualDevice().Key = key
+	return controller
+}
+
+// newDisks returns count disks on the controller with controllerKey, the FCDs of the first
+// fcds disks have the IDs <controllerKey>-<index>
+func newDisks(controllerKey int32, count int, fcds int) []types.BaseVirtualDevice {
+	var disks []types.BaseVirtualDevice
+	for i := 0; i < count; i++ {
+		disk := &types.VirtualDisk{}
+		disk.ControllerKey = controllerKey
+		if i < fcds {
+			disk.VDiskId = &types.ID{Id: fmt.Sprintf("%d-%d", controllerKey, i)}
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+func TestGetSCSIControllersToAdd(t *testing.T) {
+	var fullLsiLogic object.VirtualDeviceList
+	for key := int32(1000); key < 1004; key++ {
+		fullLsiLogic = append(fullLsiLogic, newSCSIController("lsilogic-sas", key))
+		fullLsiLogic = append(fullLsiLogic, newDisks(key, disksPerSCSIController, 1)...)
+	}
+	tests := []struct {
+		name            string
+		devices         object.VirtualDeviceList
+		hardwareVersion int
+		volumeIDs       []string
+		expected        int
+		expectedErr     bool
+	}{
+		{
+			name:            "free slot",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 14, 0)...),
+			hardwareVersion: 13,
+			volumeIDs:       []string{"vol-1"},
+		},
+		{
+			name:            "batch larger than the free slots",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 14, 0)...),
+			hardwareVersion: 13,
+			volumeIDs:       []string{"vol-1", "vol-2"},
+			expected:        1,
+		},
+		{
+			name:            "64 disks per pvscsi controller from hardware version 14",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 15, 0)...),
+			hardwareVersion: 14,
+			volumeIDs:       []string{"vol-1", "vol-2"},
+		},
+		{
+			name:            "batch needing several controllers",
+			devices:         append(object.VirtualDeviceList{newSCSIController("lsilogic-sas", 1000)}, newDisks(1000, 15, 0)...),
+			hardwareVersion: 13,
+			volumeIDs: []string{"vol-1", "vol-2", "vol-3", "vol-4", "vol-5", "vol-6", "vol-7", "vol-8", "vol-9",
+				"vol-10", "vol-11", "vol-12", "vol-13", "vol-14", "vol-15", "vol-16"},
+			expected: 2,
+		},
+		{
+			name:            "attached and repeated volumes take no slot",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 14, 2)...),
+			hardwareVersion: 13,
+			volumeIDs:       []string{"1000-0", "1000-1", "vol-1", "vol-1"},
+		},
+		{
+			name:            "all controllers full",
+			devices:         fullLsiLogic,
+			hardwareVersion: 13,
+			volumeIDs:       []string{"vol-1"},
+			expectedErr:     true,
+		},
+		{
+			name:            "all controllers full but the volume is attached",
+			devices:         fullLsiLogic,
+			hardwareVersion: 13,
+			volumeIDs:       []string{"1003-0"},
+		},
+	}
+	for _, test := range tests {
+		controllersToAdd, err := getSCSIControllersToAdd(test.devices, test.hardwareVersion, "pvscsi", test.volumeIDs)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %d controllers to add", test.name, controllersToAdd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if controllersToAdd != test.expected {
+			t.Errorf("%s: expected %d controllers to add, got %d", test.name, test.expected, controllersToAdd)
+		}
+	}
+}
+
+func TestGetMaxVolumes(t *testing.T) {
+	var fourControllers object.VirtualDeviceList
+	for key := int32(1000); key < 1004; key++ {
+		fourControllers = append(fourControllers, newSCSIController("lsilogic-sas", key))
+	}
+	ideDisk := &types.VirtualDisk{}
+	ideDisk.ControllerKey = 200
+	tests := []struct {
+		name            string
+		devices         object.VirtualDeviceList
+		hardwareVersion int
+		controllerType  string
+		expected        int64
+	}{
+		{
+			name:            "no controllers",
+			hardwareVersion: 14,
+			controllerType:  "pvscsi",
+			expected:        4 * disksPerPVSCSIController,
+		},
+		{
+			name:            "64 disks per pvscsi controller from hardware version 14",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 1, 0)...),
+			hardwareVersion: 14,
+			controllerType:  "pvscsi",
+			expected:        4*disksPerPVSCSIController - 1,
+		},
+		{
+			name:            "15 disks per pvscsi controller before hardware version 14",
+			devices:         append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 1, 0)...),
+			hardwareVersion: 13,
+			controllerType:  "pvscsi",
+			expected:        4*disksPerSCSIController - 1,
+		},
+		{
+			name: "mixed controller types, pvscsi controllers added",
+			devices: append(object.VirtualDeviceList{newSCSIController("lsilogic-sas", 1000), newSCSIController("pvscsi", 1001)},
+				newDisks(1000, 1, 0)...),
+			hardwareVersion: 14,
+			controllerType:  "pvscsi",
+			expected:        disksPerSCSIController + 3*disksPerPVSCSIController - 1,
+		},
+		{
+			name: "mixed controller types, lsilogic-sas controllers added",
+			devices: append(object.VirtualDeviceList{newSCSIController("lsilogic-sas", 1000), newSCSIController("pvscsi", 1001)},
+				newDisks(1000, 1, 0)...),
+			hardwareVersion: 14,
+			controllerType:  "lsilogic-sas",
+			expected:        3*disksPerSCSIController + disksPerPVSCSIController - 1,
+		},
+		{
+			name:            "unknown controller type added as 15 disk controllers",
+			hardwareVersion: 14,
+			controllerType:  "unknown",
+			expected:        4 * disksPerSCSIController,
+		},
+		{
+			name: "non-FCD disks are not volumes, FCDs are",
+			devices: append(append(object.VirtualDeviceList{newSCSIController("pvscsi", 1000)}, newDisks(1000, 5, 2)...),
+				ideDisk),
+			hardwareVersion: 13,
+			controllerType:  "pvscsi",
+			expected:        4*disksPerSCSIController - 3,
+		},
+		{
+			name:            "full set of 4 controllers",
+			devices:         append(fourControllers, newDisks(1000, 1, 0)...),
+			hardwareVersion: 14,
+			controllerType:  "pvscsi",
+			expected:        4*disksPerSCSIController - 1,
+		},
+	}
+	for _, test := range tests {
+		if maxVolumes := getMaxVolumes(test.devices, test.hardwareVersion, test.controllerType); maxVolumes != test.expected {
+			t.Errorf("%s: expected %d volumes, got %d", test.name, test.expected, maxVolumes)
+		}
+	}
+}
+
+func TestGetTopologyLabels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The tagging API of vapi/simulator is served as an endpoint of vcsim
+	model := simulator.VPX()
+	defer model.Remove()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.RegisterEndpoints = true
+	model.Service.TLS = new(tls.Config)
+	server := model.Service.NewServer()
+	defer server.Close()
+	password, _ := server.URL.User.Password()
+	port, _ := strconv.Atoi(server.URL.Port())
+	vcconfig := &VirtualCenterConfig{
+		Host:     server.URL.Hostname(),
+		Port:     port,
+		Username: server.URL.User.Username(),
+		Password: password,
+		Insecure: true,
+	}
+	vc, err := ConnectVirtualCenter(ctx, vcconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := GetVirtualCenterManager().UnregisterVirtualCenter(vcconfig.Host); err != nil {
+			t.Error(err)
+		}
+	}()
+	simVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	simHost := simulator.Map.Get(*simVM.Runtime.Host).(*simulator.HostSystem)
+	simDC := simulator.Map.Any("Datacenter").(*simulator.Datacenter)
+	vm := &VirtualMachine{
+		VirtualCenterHost: vcconfig.Host,
+		VirtualMachine:    object.NewVirtualMachine(vc.Client.Client, simVM.Reference()),
+		Datacenter:        &Datacenter{Datacenter: object.NewDatacenter(vc.Client.Client, simDC.Reference())},
+	}
+
+	tagManager, err := vm.GetTagManager(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tagManager.Logout(ctx)
+	}()
+	// building is tagged on the datacenter and on the host, whose tag is the nearest
+	tagged := map[string]map[string]mo.Reference{
+		"building": {"building-dc": simDC, "building-host": simHost},
+		"rack":     {"rack-1": simHost},
+		"other":    {"other-1": simHost},
+		"floor":    {},
+	}
+	for categoryName, tagObjects := range tagged {
+		categoryID, err := tagManager.CreateCategory(ctx, &tags.Category{Name: categoryName, Cardinality: "SINGLE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for tagName, obj := range tagObjects {
+			tagID, err := tagManager.CreateTag(ctx, &tags.Tag{Name: tagName, CategoryID: categoryID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tagManager.AttachTag(ctx, tagID, obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		categories []string
+		expected   map[string]string
+	}{
+		{"no categories", nil, map[string]string{}},
+		{"nearest tag", []string{"building"}, map[string]string{"building": "building-host"}},
+		{"several categories", []string{"building", "rack"}, map[string]string{"building": "building-host", "rack": "rack-1"}},
+		{"category without a tag", []string{"floor", "rack"}, map[string]string{"rack": "rack-1"}},
+		{"missing category", []string{"missing"}, map[string]string{}},
+	}
+	for _, test := range tests {
+		labels, err := vm.GetTopologyLabels(ctx, test.categories)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !reflect.DeepEqual(labels, test.expected) {
+			t.Errorf("%s: expected labels %v, got %v", test.name, test.expected, labels)
+		}
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"strings"
 
 	"gopkg.in/gcfg.v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog"
 )
 
@@ -38,6 +39,17 @@ const (
 	DefaultCloudConfigPath = "/etc/cloud/csi-vsphere.conf"
 	// EnvCloudConfig contains the path to the CSI vSphere Config
 	EnvCloudConfig = "VSPHERE_CSI_CONFIG"
+	// DefaultQueryLimit is the default CnsCursor limit used for CNS queries.
+	DefaultQueryLimit int = 100
+	// DefaultMetadataBatchSize is the default number of volumes whose metadata
+	// is queried from CNS in a single call.
+	DefaultMetadataBatchSize int = 50
+	// DefaultAttachControllerType is the default type of the SCSI controllers
+	// hot-added to node VMs when all their controllers are full.
+	DefaultAttachControllerType = "pvscsi"
+	// DefaultMaxInFlightTasks is the default maximum number of CNS tasks
+	// in flight on a vCenter.
+	DefaultMaxInFlightTasks int = 16
 )
 
 // Errors
@@ -52,6 +64,10 @@ var (
 	// missing from the provided configuration.
 	ErrInvalidVCenterIP = errors.New("vsphere.conf does not have the VirtualCenter IP address specified")
 
+	// ErrUnsupportedAttachControllerType is returned when the configured attach controller type
+	// is not supported. CNS only attaches volumes to SCSI controllers.
+	ErrUnsupportedAttachControllerType = errors.New("attach-controller-type is not supported, must be pvscsi or lsilogic-sas")
+
 	// ErrMissingVCenter is returned when the provided configuration does not
 	// define any vCenters.
 	ErrMissingVCenter = errors.New("No Virtual Center hosts defined")
@@ -121,12 +137,199 @@ func FromEnv(cfg *Config) error {
 			cfg.Global.InsecureFlag = InsecureFlag
 		}
 	}
+	if v := os.Getenv("VSPHERE_QUERY_LIMIT"); v != "" {
+		queryLimit, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_QUERY_LIMIT: %s", err)
+		} else {
+			cfg.Global.QueryLimit = queryLimit
+		}
+	}
+	if v := os.Getenv("VSPHERE_METADATA_BATCH_SIZE"); v != "" {
+		batchSize, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_METADATA_BATCH_SIZE: %s", err)
+		} else {
+			cfg.Global.MetadataBatchSize = batchSize
+		}
+	}
+	if v := os.Getenv("VSPHERE_ALLOWED_DATASTORES"); v != "" {
+		cfg.Global.AllowedDatastores = v
+	}
+	if v := os.Getenv("VSPHERE_DENIED_DATASTORES"); v != "" {
+		cfg.Global.DeniedDatastores = v
+	}
+	if v := os.Getenv("VSPHERE_DEFAULT_FSTYPE"); v != "" {
+		cfg.Global.DefaultFsType = v
+	}
+	if v := os.Getenv("VSPHERE_ENABLE_NAMESPACE_QUOTA"); v != "" {
+		enableNamespaceQuota, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_ENABLE_NAMESPACE_QUOTA: %s", err)
+		} else {
+			cfg.Global.EnableNamespaceQuota = enableNamespaceQuota
+		}
+	}
+	if v := os.Getenv("VSPHERE_ENABLE_CSI_MIGRATION"); v != "" {
+		enableCSIMigration, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_ENABLE_CSI_MIGRATION: %s", err)
+		} else {
+			cfg.Global.EnableCSIMigration = enableCSIMigration
+		}
+	}
+	if v := os.Getenv("VSPHERE_REPAIR_NODE_PROVIDER_ID"); v != "" {
+		repairNodeProviderID, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_REPAIR_NODE_PROVIDER_ID: %s", err)
+		} else {
+			cfg.Global.RepairNodeProviderID = repairNodeProviderID
+		}
+	}
+	if v := os.Getenv("VSPHERE_ENABLE_NODEVM_ATTACHMENT"); v != "" {
+		enableNodeVMAttachment, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_ENABLE_NODEVM_ATTACHMENT: %s", err)
+		} else {
+			cfg.Global.EnableNodeVMAttachment = enableNodeVMAttachment
+		}
+	}
+	if v := os.Getenv("VSPHERE_ENABLE_GUEST_CLUSTER_METADATA"); v != "" {
+		enableGuestClusterMetadata, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_ENABLE_GUEST_CLUSTER_METADATA: %s", err)
+		} else {
+			cfg.Global.EnableGuestClusterMetadata = enableGuestClusterMetadata
+		}
+	}
+	if v := os.Getenv("VSPHERE_HOST_LOCAL_TOPOLOGY"); v != "" {
+		hostLocalTopology, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_HOST_LOCAL_TOPOLOGY: %s", err)
+		} else {
+			cfg.Global.HostLocalTopology = hostLocalTopology
+		}
+	}
+	if v := os.Getenv("VSPHERE_MAX_VOLUMES_PER_NODE"); v != "" {
+		maxVolumesPerNode, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_MAX_VOLUMES_PER_NODE: %s", err)
+		} else {
+			cfg.Global.MaxVolumesPerNode = maxVolumesPerNode
+		}
+	}
+	if v := os.Getenv("VSPHERE_ATTACH_CONTROLLER_TYPE"); v != "" {
+		cfg.Global.AttachControllerType = v
+	}
+	if v := os.Getenv("VSPHERE_MAX_INFLIGHT_TASKS"); v != "" {
+		maxInFlightTasks, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_MAX_INFLIGHT_TASKS: %s", err)
+		} else {
+			cfg.Global.MaxInFlightTasks = maxInFlightTasks
+		}
+	}
+	if v := os.Getenv("VSPHERE_MAX_CONCURRENT_PROVISIONING"); v != "" {
+		maxConcurrentProvisioning, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_MAX_CONCURRENT_PROVISIONING: %s", err)
+		} else {
+			cfg.Global.MaxConcurrentProvisioning = maxConcurrentProvisioning
+		}
+	}
+	if v := os.Getenv("VSPHERE_MAX_CONCURRENT_PROVISIONING_PER_DATASTORE"); v != "" {
+		maxPerDatastore, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_MAX_CONCURRENT_PROVISIONING_PER_DATASTORE: %s", err)
+		} else {
+			cfg.Global.MaxConcurrentProvisioningPerDatastore = maxPerDatastore
+		}
+	}
+	if v := os.Getenv("VSPHERE_PROXY_URL"); v != "" {
+		cfg.Global.ProxyURL = v
+	}
+	if v := os.Getenv("VSPHERE_DIAL_TIMEOUT"); v != "" {
+		dialTimeout, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_DIAL_TIMEOUT: %s", err)
+		} else {
+			cfg.Global.DialTimeout = dialTimeout
+		}
+	}
+	if v := os.Getenv("VSPHERE_SOAP_TIMEOUT"); v != "" {
+		soapTimeout, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_SOAP_TIMEOUT: %s", err)
+		} else {
+			cfg.Global.SOAPTimeout = soapTimeout
+		}
+	}
+	if v := os.Getenv("VSPHERE_IDLE_CONNECTION_TIMEOUT"); v != "" {
+		idleConnTimeout, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse VSPHERE_IDLE_CONNECTION_TIMEOUT: %s", err)
+		} else {
+			cfg.Global.IdleConnTimeout = idleConnTimeout
+		}
+	}
+	if v := os.Getenv("VSPHERE_INCLUDED_METADATA_LABELS"); v != "" {
+		cfg.Global.IncludedMetadataLabels = v
+	}
+	if v := os.Getenv("VSPHERE_EXCLUDED_METADATA_LABELS"); v != "" {
+		cfg.Global.ExcludedMetadataLabels = v
+	}
+	if v := os.Getenv("VSPHERE_CREDENTIALS_BACKEND"); v != "" {
+		cfg.Global.CredentialsBackend = v
+	}
+	if v := os.Getenv("VSPHERE_CREDENTIALS_DIR"); v != "" {
+		cfg.Global.CredentialsDir = v
+	}
+	if v := os.Getenv("VSPHERE_CREDENTIALS_COMMAND"); v != "" {
+		cfg.Global.CredentialsCommand = v
+	}
+	if v := os.Getenv(EnvTLSMinVersion); v != "" {
+		cfg.Global.TLSMinVersion = v
+	}
+	if v := os.Getenv(EnvTLSCipherSuites); v != "" {
+		cfg.Global.TLSCipherSuites = v
+	}
 	if v := os.Getenv("VSPHERE_LABEL_REGION"); v != "" {
 		cfg.Labels.Region = v
 	}
 	if v := os.Getenv("VSPHERE_LABEL_ZONE"); v != "" {
 		cfg.Labels.Zone = v
 	}
+	if v := os.Getenv("VSPHERE_LABEL_TOPOLOGY_CATEGORIES"); v != "" {
+		cfg.Labels.TopologyCategories = v
+	}
+	rateLimits := []struct {
+		class string
+		qps   *float64
+		burst *int
+	}{
+		{"CREATE", &cfg.RateLimit.CreateQPS, &cfg.RateLimit.CreateBurst},
+		{"ATTACH", &cfg.RateLimit.AttachQPS, &cfg.RateLimit.AttachBurst},
+		{"METADATA", &cfg.RateLimit.MetadataQPS, &cfg.RateLimit.MetadataBurst},
+		{"QUERY", &cfg.RateLimit.QueryQPS, &cfg.RateLimit.QueryBurst},
+	}
+	for _, rateLimit := range rateLimits {
+		if v := os.Getenv("VSPHERE_RATE_LIMIT_" + rateLimit.class + "_QPS"); v != "" {
+			qps, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				klog.Errorf("Failed to parse VSPHERE_RATE_LIMIT_%s_QPS: %s", rateLimit.class, err)
+			} else {
+				*rateLimit.qps = qps
+			}
+		}
+		if v := os.Getenv("VSPHERE_RATE_LIMIT_" + rateLimit.class + "_BURST"); v != "" {
+			burst, err := strconv.Atoi(v)
+			if err != nil {
+				klog.Errorf("Failed to parse VSPHERE_RATE_LIMIT_%s_BURST: %s", rateLimit.class, err)
+			} else {
+				*rateLimit.burst = burst
+			}
+		}
+	}
 	//Build VirtualCenter from ENVs
 	for _, e := range os.Environ() {
 		pair := strings.Split(e, "=")
@@ -197,6 +400,37 @@ func validateConfig(cfg *Config) error {
 	if cfg.Global.VCenterPort == "" {
 		cfg.Global.VCenterPort = DefaultVCenterPort
 	}
+	if cfg.Global.QueryLimit <= 0 {
+		cfg.Global.QueryLimit = DefaultQueryLimit
+	}
+	if cfg.Global.MetadataBatchSize <= 0 {
+		cfg.Global.MetadataBatchSize = DefaultMetadataBatchSize
+	}
+	if cfg.Global.MaxInFlightTasks <= 0 {
+		cfg.Global.MaxInFlightTasks = DefaultMaxInFlightTasks
+	}
+	if cfg.Global.AttachControllerType == "" {
+		cfg.Global.AttachControllerType = DefaultAttachControllerType
+	}
+	if cfg.Global.AttachControllerType != "pvscsi" && cfg.Global.AttachControllerType != "lsilogic-sas" {
+		klog.Errorf("Unsupported attach-controller-type: %q", cfg.Global.AttachControllerType)
+		return ErrUnsupportedAttachControllerType
+	}
+	if cfg.Global.CredentialsBackend == "" {
+		cfg.Global.CredentialsBackend = CredentialsBackendConfig
+	}
+	if cfg.Global.CredentialsBackend != CredentialsBackendConfig && cfg.Global.CredentialsBackend != CredentialsBackendFile &&
+		cfg.Global.CredentialsBackend != CredentialsBackendExec && cfg.Global.CredentialsBackend != CredentialsBackendCertificate {
+		klog.Errorf("Unsupported credentials-backend: %q", cfg.Global.CredentialsBackend)
+		return ErrUnsupportedCredentialsBackend
+	}
+	if _, err := TLSConfig(cfg); err != nil {
+		klog.Errorf("Invalid TLS settings. Err: %v", err)
+		return err
+	}
+	if err := validateTopologyCategories(cfg); err != nil {
+		return err
+	}
 	// Must have at least one vCenter defined
 	if len(cfg.VirtualCenter) == 0 {
 		klog.Error(ErrMissingVCenter)
@@ -209,6 +443,13 @@ func validateConfig(cfg *Config) error {
 			return ErrInvalidVCenterIP
 		}
 
+		if cfg.Global.CredentialsBackend != CredentialsBackendConfig {
+			username, password, err := readBackendCredentials(cfg, vcServer)
+			if err != nil {
+				return err
+			}
+			vcConfig.User, vcConfig.Password = username, password
+		}
 		if vcConfig.User == "" {
 			vcConfig.User = cfg.Global.User
 			if vcConfig.User == "" {
@@ -226,6 +467,12 @@ func validateConfig(cfg *Config) error {
 		if vcConfig.VCenterPort == "" {
 			vcConfig.VCenterPort = cfg.Global.VCenterPort
 		}
+		if vcConfig.MaxInFlightTasks <= 0 {
+			vcConfig.MaxInFlightTasks = cfg.Global.MaxInFlightTasks
+		}
+		if vcConfig.ProxyURL == "" {
+			vcConfig.ProxyURL = cfg.Global.ProxyURL
+		}
 		if vcConfig.Datacenters == "" {
 			if cfg.Global.Datacenters != "" {
 				vcConfig.Datacenters = cfg.Global.Datacenters
@@ -283,3 +530,33 @@ func GetCnsconfig(cfgPath string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+// validateTopologyCategories returns an error if an additional topology category of cfg
+// is not a valid label name. The categories are the names of topology keys of nodes and PVs.
+func validateTopologyCategories(cfg *Config) error {
+	for _, category := range GetTopologyCategories(cfg) {
+		errs := validation.IsQualifiedName(category)
+		if strings.Contains(category, "/") {
+			errs = append(errs, "must not contain '/'")
+		}
+		if len(errs) != 0 {
+			klog.Errorf("Invalid topology category %q in topology-categories: %v", category, errs)
+			return fmt.Errorf("topology category %q is not a valid label name: %s", category, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// GetTopologyCategories returns the tag categories of the additional topology levels of cfg.
+// The zone and region categories are not additional levels and are left out.
+func GetTopologyCategories(cfg *Config) []string {
+	var categories []string
+	for _, category := range strings.Split(cfg.Labels.TopologyCategories, ",") {
+		category = strings.TrimSpace(category)
+		if category == "" || category == cfg.Labels.Zone || category == cfg.Labels.Region {
+			continue
+		}
+		categories = append(categories, category)
+	}
+	return categories
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/gcfg.v1"
+)
+
+func TestGetTopologyCategories(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   string
+		expected []string
+	}{
+		{"no categories", "", nil},
+		{"one category", `topology-categories = "building"`, []string{"building"}},
+		{"spaces around categories", `topology-categories = " building , rack "`, []string{"building", "rack"}},
+		{"empty categories", `topology-categories = "building,,rack,"`, []string{"building", "rack"}},
+		{"zone and region are not additional levels",
+			`zone = "k8s-zone"
+region = "k8s-region"
+topology-categories = "k8s-region,k8s-zone,rack"`, []string{"rack"}},
+	}
+	for _, test := range tests {
+		cfg := &Config{}
+		if err := gcfg.ReadStringInto(cfg, "[Labels]\n"+test.labels); err != nil {
+			t.Fatalf("%s: failed to parse config: %v", test.name, err)
+		}
+		if categories := GetTopologyCategories(cfg); !reflect.DeepEqual(categories, test.expected) {
+			t.Errorf("%s: expected categories %v, got %v", test.name, test.expected, categories)
+		}
+	}
+}
+
+func TestValidateTopologyCategories(t *testing.T) {
+	tests := []struct {
+		name       string
+		categories string
+		valid      bool
+	}{
+		{"no categories", "", true},
+		{"valid names", "building,rack-1,row_2,Floor.3", true},
+		{"space", "server room", false},
+		{"slash", "example.com/rack", false},
+		{"leading dash", "-rack", false},
+		{"longest name", strings.Repeat("r", 63), true},
+		{"too long", strings.Repeat("r", 64), false},
+		{"second category invalid", "building,server room", false},
+	}
+	for _, test := range tests {
+		cfg := &Config{}
+		cfg.Labels.TopologyCategories = test.categories
+		if err := validateTopologyCategories(cfg); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got err: %v", test.name, test.valid, err)
+		}
+	}
+}
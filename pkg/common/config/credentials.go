@@ -0,0 +1,158 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// CredentialsBackendConfig reads the vCenter credentials from the config file, the default.
+	CredentialsBackendConfig = "config"
+	// CredentialsBackendFile reads the credentials of each vCenter from the files
+	// "<vcenter>.username" and "<vcenter>.password" in CredentialsDir, e.g. a mounted
+	// secret which an external secret operator keeps up to date.
+	CredentialsBackendFile = "file"
+	// CredentialsBackendExec runs CredentialsCommand with the vCenter host as its
+	// argument, which prints the credentials as {"username": "...", "password": "..."}.
+	CredentialsBackendExec = "exec"
+	// CredentialsBackendCertificate reads the certificate and private key of a solution
+	// user of each vCenter in PEM format from the files "<vcenter>.crt" and "<vcenter>.key"
+	// in CredentialsDir, e.g. a mounted secret which the supervisor cluster rotates. The
+	// driver logs in with a SAML token issued for the certificate instead of a password.
+	CredentialsBackendCertificate = "certificate"
+
+	// credentialsCommandTimeout is the timeout of CredentialsCommand
+	credentialsCommandTimeout = 30 * time.Second
+)
+
+// ErrUnsupportedCredentialsBackend is returned when the configured credentials backend is not supported.
+var ErrUnsupportedCredentialsBackend = errors.New("credentials-backend is not supported, must be config, file, exec or certificate")
+
+// execCredentials is the output of CredentialsCommand
+type execCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// execCredentialsCache maps vCenter hosts to the execCredentials printed by
+// CredentialsCommand, so the command is not run each time the config is read.
+var execCredentialsCache sync.Map
+
+// readBackendCredentials returns the username and password of the vCenter host
+// from the credentials backend of cfg.
+func readBackendCredentials(cfg *Config, host string) (string, string, error) {
+	switch cfg.Global.CredentialsBackend {
+	case CredentialsBackendFile:
+		return readFileCredentials(cfg.Global.CredentialsDir, host)
+	case CredentialsBackendExec:
+		if cached, ok := execCredentialsCache.Load(host); ok {
+			credentials := cached.(*execCredentials)
+			return credentials.Username, credentials.Password, nil
+		}
+		username, password, err := readExecCredentials(cfg.Global.CredentialsCommand, host)
+		if err != nil {
+			return "", "", err
+		}
+		execCredentialsCache.Store(host, &execCredentials{Username: username, Password: password})
+		return username, password, nil
+	case CredentialsBackendCertificate:
+		return readCertificateCredentials(cfg.Global.CredentialsDir, host)
+	}
+	return "", "", ErrUnsupportedCredentialsBackend
+}
+
+// ForgetBackendCredentials drops the cached credentials of the vCenter host, so the
+// next read of the config gets them from the credentials backend again. It is called
+// when the vCenter rejects the credentials.
+func ForgetBackendCredentials(host string) {
+	execCredentialsCache.Delete(host)
+}
+
+// readFileCredentials returns the username and password of the vCenter host from the
+// files "<host>.username" and "<host>.password" in dir.
+func readFileCredentials(dir string, host string) (string, string, error) {
+	var credentials []string
+	for _, key := range []string{"username", "password"} {
+		path := filepath.Join(dir, host+"."+key)
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("Failed to read credentials of vCenter %q. Err: %v", host, err)
+			return "", "", err
+		}
+		credentials = append(credentials, strings.TrimRight(string(value), "\r\n"))
+	}
+	return credentials[0], credentials[1], nil
+}
+
+// readCertificateCredentials returns the certificate and the private key of the solution user
+// of the vCenter host from the files "<host>.crt" and "<host>.key" in dir. They are used as
+// the username and password, which makes the login use a SAML token.
+func readCertificateCredentials(dir string, host string) (string, string, error) {
+	var credentials []string
+	for _, ext := range []string{"crt", "key"} {
+		path := filepath.Join(dir, host+"."+ext)
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("Failed to read solution user certificate of vCenter %q. Err: %v", host, err)
+			return "", "", err
+		}
+		if block, _ := pem.Decode(value); block == nil {
+			err = fmt.Errorf("%s is not PEM encoded", path)
+			klog.Errorf("Failed to read solution user certificate of vCenter %q. Err: %v", host, err)
+			return "", "", err
+		}
+		credentials = append(credentials, string(value))
+	}
+	return credentials[0], credentials[1], nil
+}
+
+// readExecCredentials returns the username and password of the vCenter host printed by command.
+func readExecCredentials(command string, host string) (string, string, error) {
+	if command == "" {
+		return "", "", fmt.Errorf("credentials-command is not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, host)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		klog.Errorf("Failed to run %s for the credentials of vCenter %q. Err: %v", command, host, err)
+		return "", "", err
+	}
+	credentials := &execCredentials{}
+	if err := json.Unmarshal(output, credentials); err != nil {
+		klog.Errorf("Failed to parse the credentials of vCenter %q printed by %s. Err: %v", host, command, err)
+		return "", "", err
+	}
+	return credentials.Username, credentials.Password, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/gcfg.v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultGCPort is the default port of the API server of the supervisor cluster
+	DefaultGCPort = "6443"
+	// DefaultSupervisorCredentialsPath is the default directory with the token, the
+	// CA certificate and the namespace of the service account of a guest cluster in
+	// its supervisor cluster, as in a service account token secret
+	DefaultSupervisorCredentialsPath = "/etc/cloud/pvcsi-provider"
+	// EnvSupervisorCredentialsPath contains the directory with the credentials of a
+	// guest cluster in its supervisor cluster
+	EnvSupervisorCredentialsPath = "VSPHERE_SUPERVISOR_CREDENTIALS_PATH"
+)
+
+// GetGCconfig returns the Config of the paravirtual driver of a guest cluster from the
+// config file cfgPath. Only its GC section is read, there are no vCenters to configure.
+func GetGCconfig(cfgPath string) (*Config, error) {
+	klog.V(4).Infof("GetGCconfig called with cfgPath: %s", cfgPath)
+	cfg := &Config{}
+	if _, err := os.Stat(cfgPath); err == nil {
+		if err := gcfg.FatalOnly(gcfg.ReadFileInto(cfg, cfgPath)); err != nil {
+			klog.Errorf("Failed to parse config. Err: %v", err)
+			return nil, err
+		}
+	} else {
+		klog.V(2).Infof("Could not stat %s, reading config params from env", cfgPath)
+	}
+	if v := os.Getenv("VSPHERE_GC_ENDPOINT"); v != "" {
+		cfg.GC.Endpoint = v
+	}
+	if v := os.Getenv("VSPHERE_GC_PORT"); v != "" {
+		cfg.GC.Port = v
+	}
+	if v := os.Getenv("VSPHERE_GC_TANZUKUBERNETESCLUSTER_UID"); v != "" {
+		cfg.GC.TanzuKubernetesClusterUID = v
+	}
+	if v := os.Getenv("VSPHERE_GC_TANZUKUBERNETESCLUSTER_NAME"); v != "" {
+		cfg.GC.TanzuKubernetesClusterName = v
+	}
+	if cfg.GC.Port == "" {
+		cfg.GC.Port = DefaultGCPort
+	}
+	if cfg.GC.Endpoint == "" {
+		return nil, fmt.Errorf("the endpoint of the supervisor cluster is not configured")
+	}
+	if cfg.GC.TanzuKubernetesClusterUID == "" {
+		return nil, fmt.Errorf("the UID of the TanzuKubernetesCluster is not configured")
+	}
+	return cfg, nil
+}
+
+// GetSupervisorClientConfig returns the rest.Config of the supervisor cluster of cfg and
+// the supervisor namespace of the guest cluster, using the service account credentials
+// in the directory of EnvSupervisorCredentialsPath.
+func GetSupervisorClientConfig(cfg *Config) (*rest.Config, string, error) {
+	path := os.Getenv(EnvSupervisorCredentialsPath)
+	if path == "" {
+		path = DefaultSupervisorCredentialsPath
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(path, "namespace"))
+	if err != nil {
+		klog.Errorf("Failed to read the supervisor namespace. Err: %v", err)
+		return nil, "", err
+	}
+	restConfig := &rest.Config{
+		Host:            "https://" + net.JoinHostPort(cfg.GC.Endpoint, cfg.GC.Port),
+		BearerTokenFile: filepath.Join(path, "token"),
+		TLSClientConfig: rest.TLSClientConfig{
+			CAFile: filepath.Join(path, "ca.crt"),
+		},
+	}
+	return restConfig, strings.TrimSpace(string(namespace)), nil
+}
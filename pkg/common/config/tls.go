@@ -0,0 +1,62 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/tls"
+	"strings"
+
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+const (
+	// EnvTLSMinVersion contains the minimum TLS version, e.g. "VersionTLS12"
+	EnvTLSMinVersion = "VSPHERE_TLS_MIN_VERSION"
+	// EnvTLSCipherSuites contains the comma separated list of allowed TLS cipher suites
+	EnvTLSCipherSuites = "VSPHERE_TLS_CIPHER_SUITES"
+)
+
+// TLSConfig returns a tls.Config with the minimum TLS version and the cipher suites of cfg.
+func TLSConfig(cfg *Config) (*tls.Config, error) {
+	return NewTLSConfig(cfg.Global.TLSMinVersion, cfg.Global.TLSCipherSuites)
+}
+
+// NewTLSConfig returns a tls.Config with the minimum TLS version minVersion, e.g.
+// "VersionTLS12", and the comma separated list of IANA names of cipherSuites. The
+// defaults of Go are kept for empty values.
+func NewTLSConfig(minVersion, cipherSuites string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if minVersion != "" {
+		version, err := cliflag.TLSVersion(minVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cipherSuites != "" {
+		var names []string
+		for _, name := range strings.Split(cipherSuites, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+		suites, err := cliflag.TLSCipherSuites(names)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+	return tlsConfig, nil
+}
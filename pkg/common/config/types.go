@@ -38,6 +38,108 @@ type Config struct {
 		CAFile string `gcfg:"ca-file"`
 		// Datacenter in which Node VMs are located.
 		Datacenters string `gcfg:"datacenters"`
+		// Maximum number of volumes returned by vCenter for a single CNS query, i.e. the page
+		// size of the queries of all volumes of the cluster by the full sync of the syncer.
+		// Large vCenters may need a smaller value to keep SOAP responses within limits.
+		// Optional; if not configured, 100 is used.
+		QueryLimit int `gcfg:"query-limit"`
+		// Maximum number of volumes whose metadata is requested from CNS in a single call by
+		// the full sync, and whose metadata updates are sent to CNS in a single call by the
+		// syncer. Optional; if not configured, 50 is used.
+		MetadataBatchSize int `gcfg:"metadata-batch-size"`
+		// Comma separated list of datastore URLs on which volumes may be provisioned.
+		// Optional; if not configured, all datastores shared across the nodes can be used.
+		AllowedDatastores string `gcfg:"allowed-datastores"`
+		// Comma separated list of datastore URLs on which volumes must not be provisioned,
+		// e.g. management or ISO datastores. Takes precedence over AllowedDatastores.
+		DeniedDatastores string `gcfg:"denied-datastores"`
+		// Filesystem type used to format volumes whose StorageClass does not specify one.
+		// Optional; if not configured, ext4 is used.
+		DefaultFsType string `gcfg:"default-fstype"`
+		// True if the capacity of volumes provisioned in a namespace is to be limited
+		// by the CnsStorageQuota objects in that namespace.
+		EnableNamespaceQuota bool `gcfg:"enable-namespace-quota"`
+		// True if in-tree vSphere volumes are migrated to the driver, i.e. the CSIMigrationvSphere
+		// feature gate is enabled. Their VMDKs are registered with CNS on first use.
+		EnableCSIMigration bool `gcfg:"enable-csi-migration"`
+		// True if the missing providerID of a node, whose VM was found by the host name or the
+		// IP addresses of the node instead, is to be set by the controller. Malformed providerIDs
+		// can not be changed and are only logged.
+		RepairNodeProviderID bool `gcfg:"repair-node-provider-id"`
+		// True if the controller runs in a supervisor cluster and attaches the volumes of
+		// guest clusters as requested by their CnsNodeVmAttachment objects.
+		EnableNodeVMAttachment bool `gcfg:"enable-nodevm-attachment"`
+		// True if the syncer runs in a supervisor cluster and sends the metadata of guest
+		// cluster objects in CnsVolumeMetadata objects to CNS.
+		EnableGuestClusterMetadata bool `gcfg:"enable-guest-cluster-metadata"`
+		// True if nodes report their ESXi host in their topology, so that volumes on host-local
+		// datastores, vSAN Direct or PMem datastores, are only accessible from the nodes on the
+		// host that owns the datastore. Volumes are only placed on host-local datastores when
+		// the StorageClass asks for vSAN Direct or PMem. The host of a node is read when the
+		// node registers, so node VMs must not migrate to other hosts.
+		HostLocalTopology bool `gcfg:"host-local-topology"`
+		// Maximum number of volumes that can be attached to a node, reported in NodeGetInfo.
+		// Optional; if not configured, it is derived from the hardware version of the node VM.
+		MaxVolumesPerNode int `gcfg:"max-volumes-per-node"`
+		// Type of the SCSI controller hot-added to a node VM when all of its SCSI controllers
+		// are full, "pvscsi" or "lsilogic-sas". Optional; if not configured, pvscsi is used.
+		AttachControllerType string `gcfg:"attach-controller-type"`
+		// Maximum number of CNS tasks in flight on each vCenter. Further operations wait
+		// for a task to complete. Optional; if not configured, 16 tasks are allowed.
+		MaxInFlightTasks int `gcfg:"max-inflight-tasks"`
+		// Maximum number of CreateVolume and DeleteVolume operations the controller runs at a
+		// time. Further operations are queued by datastore and run round robin across datastores.
+		// Optional; if not configured, the operations are only limited by max-inflight-tasks.
+		MaxConcurrentProvisioning int `gcfg:"max-concurrent-provisioning"`
+		// Maximum number of CreateVolume and DeleteVolume operations the controller runs at a
+		// time on a single datastore. When set, the driver rather than CNS chooses the shared
+		// datastore of volumes whose StorageClass does not pin one: the least busy datastore
+		// compatible with the storage policy. Volumes placed on a member of a datastore cluster
+		// or on a vSAN Direct or PMem datastore are only subject to max-concurrent-provisioning.
+		// Optional; if not configured, not limited.
+		MaxConcurrentProvisioningPerDatastore int `gcfg:"max-concurrent-provisioning-per-datastore"`
+		// URL of the HTTP(S) proxy through which vCenter is reached, e.g. "http://proxy:3128".
+		// Optional; if not configured, the HTTPS_PROXY and NO_PROXY environment variables are used.
+		ProxyURL string `gcfg:"proxy-url"`
+		// Timeout in seconds of establishing a connection to vCenter, including the TLS
+		// handshake. Optional; if not configured, connections are only limited by the
+		// timeout of the SOAP call and the TCP connect timeout of the OS.
+		DialTimeout int `gcfg:"dial-timeout"`
+		// Timeout in seconds of a single SOAP call to vCenter, so an unresponsive vCenter fails
+		// the CSI call before the sidecar gives up on it. Waiting for the completion of tasks is
+		// not limited. Optional; if not configured, SOAP calls do not time out.
+		SOAPTimeout int `gcfg:"soap-timeout"`
+		// Time in seconds after which idle connections to vCenter are closed. Optional; if not
+		// configured, idle connections are closed after 90 seconds.
+		IdleConnTimeout int `gcfg:"idle-connection-timeout"`
+		// Comma separated list of regular expressions matched against the beginning of PV, PVC
+		// and Pod label keys, so plain key prefixes can be used as well. Optional; if configured,
+		// only matching labels are synced to CNS.
+		IncludedMetadataLabels string `gcfg:"included-metadata-labels"`
+		// Comma separated list of label key patterns, as for IncludedMetadataLabels, of labels
+		// which are not synced to CNS, e.g. frequently changing hashes. Takes precedence over
+		// IncludedMetadataLabels. Optional; if not configured, no labels are excluded.
+		ExcludedMetadataLabels string `gcfg:"excluded-metadata-labels"`
+		// Source of the vCenter credentials, "config", "file", "exec" or "certificate". They are
+		// read again every minute, and vCenter is logged in again when they change. Optional;
+		// if not configured, the user and password of the config file are used.
+		CredentialsBackend string `gcfg:"credentials-backend"`
+		// Directory with the files "<vcenter>.username" and "<vcenter>.password", for the
+		// "file" credentials backend, or with the solution user certificate and key
+		// "<vcenter>.crt" and "<vcenter>.key", for the "certificate" credentials backend.
+		CredentialsDir string `gcfg:"credentials-dir"`
+		// Command run with the vCenter host as its argument which prints the credentials as
+		// {"username": "...", "password": "..."}, for the "exec" credentials backend. It is run
+		// once per vCenter, and again only when vCenter rejects the credentials.
+		CredentialsCommand string `gcfg:"credentials-command"`
+		// Minimum TLS version of the connections to vCenter and of the admission webhook,
+		// "VersionTLS10" to "VersionTLS13". Optional; if not configured, the default of Go is used.
+		TLSMinVersion string `gcfg:"tls-min-version"`
+		// Comma separated list of the IANA names of the TLS cipher suites allowed for the
+		// connections to vCenter and the admission webhook, e.g.
+		// "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384". They don't apply to TLS 1.3. Optional; if
+		// not configured, the cipher suites of Go are used.
+		TLSCipherSuites string `gcfg:"tls-cipher-suites"`
 	}
 
 	// Virtual Center configurations
@@ -47,12 +149,60 @@ type Config struct {
 	Labels struct {
 		Zone   string `gcfg:"zone"`
 		Region string `gcfg:"region"`
+		// Comma separated tag categories of additional topology levels, e.g. "building,rack".
+		// The tag of each category is reported in the topology of a node under the key
+		// "topology.csi.vmware.com/<category>", so each category must be a valid label name.
+		// Only used if Zone and Region are configured.
+		TopologyCategories string `gcfg:"topology-categories"`
+	}
+
+	// Rate limits of the calls to CNS on each vCenter by class of operation, so that large
+	// clusters can tune the load on vCenter independently of the concurrency of the sidecars.
+	// Each vCenter is limited separately. A class is not limited unless its QPS is configured.
+	// If its burst is not configured, the QPS rounded up is used. Calls over the limit wait
+	// for their turn, and fail if their request is canceled first. For example, to create or
+	// delete at most 2 volumes per second with bursts of 5:
+	//   [RateLimit]
+	//   create-qps = 2
+	//   create-burst = 5
+	RateLimit struct {
+		// Calls per second and burst of CreateVolume and DeleteVolume.
+		CreateQPS   float64 `gcfg:"create-qps"`
+		CreateBurst int     `gcfg:"create-burst"`
+		// Calls per second and burst of AttachVolume and DetachVolume.
+		AttachQPS   float64 `gcfg:"attach-qps"`
+		AttachBurst int     `gcfg:"attach-burst"`
+		// Calls per second and burst of UpdateVolumeMetadata.
+		MetadataQPS   float64 `gcfg:"metadata-qps"`
+		MetadataBurst int     `gcfg:"metadata-burst"`
+		// Calls per second and burst of QueryVolume and QueryAllVolume, each page is a call.
+		QueryQPS   float64 `gcfg:"query-qps"`
+		QueryBurst int     `gcfg:"query-burst"`
+	}
+
+	// Supervisor cluster of a guest cluster, whose volumes the paravirtual driver
+	// of the guest cluster provisions through it
+	GC struct {
+		// Address of the API server of the supervisor cluster.
+		Endpoint string `gcfg:"endpoint"`
+		// Port of the API server of the supervisor cluster. Optional; if not configured, 6443 is used.
+		Port string `gcfg:"port"`
+		// UID of the TanzuKubernetesCluster of the guest cluster, which prefixes the names
+		// of its PersistentVolumeClaims in the supervisor namespace.
+		TanzuKubernetesClusterUID string `gcfg:"tanzukubernetescluster-uid"`
+		// Name of the TanzuKubernetesCluster of the guest cluster.
+		TanzuKubernetesClusterName string `gcfg:"tanzukubernetescluster-name"`
 	}
 }
 
 // VirtualCenterConfig contains information used to access a remote vCenter
-// endpoint.
+// endpoint. The name of its section is the address of the vCenter, unless Server
+// is set.
 type VirtualCenterConfig struct {
+	// Address of the vCenter. Optional; if not configured, the section name is used. Allows
+	// configuring a vCenter in more than one section, e.g. with the user and datacenters of
+	// each zone, so that the role of each user can be scoped to the inventory of its zone.
+	Server string `gcfg:"server"`
 	// vCenter username.
 	User string `gcfg:"user"`
 	// vCenter password in clear text.
@@ -63,4 +213,8 @@ type VirtualCenterConfig struct {
 	InsecureFlag bool `gcfg:"insecure-flag"`
 	// Datacenter in which VMs are located.
 	Datacenters string `gcfg:"datacenters"`
+	// Maximum number of CNS tasks in flight on this vCenter, overrides the global setting.
+	MaxInFlightTasks int `gcfg:"max-inflight-tasks"`
+	// URL of the HTTP(S) proxy through which this vCenter is reached, overrides the global setting.
+	ProxyURL string `gcfg:"proxy-url"`
 }
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package debug serves the CSI operations in progress and their pending CNS tasks,
+// to help triage operations which are stuck.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+)
+
+// Operation is a CSI RPC in progress.
+type Operation struct {
+	// Method is the full name of the RPC, e.g. "/csi.v1.Controller/CreateVolume"
+	Method string `json:"method"`
+	// RequestID is the ID of the request, which its log entries carry
+	RequestID uint64 `json:"requestID,omitempty"`
+	// VolumeID is the ID of the volume of the request, if any
+	VolumeID string `json:"volumeID,omitempty"`
+	// VolumeName is the name of the volume to create, for CreateVolume
+	VolumeName string `json:"volumeName,omitempty"`
+	// NodeID is the ID of the node of the request, if any
+	NodeID string `json:"nodeID,omitempty"`
+	// StartTime is when the RPC was received
+	StartTime time.Time `json:"startTime"`
+}
+
+// State is the response of the debug handler.
+type State struct {
+	// Operations are the CSI RPCs in progress, oldest first
+	Operations []Operation `json:"operations"`
+	// Tasks are the CNS tasks which were started and have not completed, oldest first
+	Tasks []volume.PendingTask `json:"tasks"`
+}
+
+var (
+	// operations holds the RPCs in progress by a sequence number
+	operations     = make(map[uint64]Operation)
+	operationsLock sync.Mutex
+	lastOperation  uint64
+)
+
+// NewUnaryServerInterceptor returns a gRPC interceptor which records the CSI RPCs
+// in progress for the debug handler.
+func NewUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		done := track(ctx, info.FullMethod, req)
+		defer done()
+		return handler(ctx, req)
+	}
+}
+
+// track records the RPC method with request req as in progress until the returned
+// function is called.
+func track(ctx context.Context, method string, req interface{}) func() {
+	op := Operation{
+		Method:    method,
+		StartTime: time.Now(),
+	}
+	op.RequestID, _ = csictx.GetRequestID(ctx)
+	if r, ok := req.(interface{ GetVolumeId() string }); ok {
+		op.VolumeID = r.GetVolumeId()
+	}
+	if r, ok := req.(interface{ GetNodeId() string }); ok {
+		op.NodeID = r.GetNodeId()
+	}
+	if r, ok := req.(interface{ GetName() string }); ok {
+		op.VolumeName = r.GetName()
+	}
+
+	operationsLock.Lock()
+	lastOperation++
+	seq := lastOperation
+	operations[seq] = op
+	operationsLock.Unlock()
+	return func() {
+		operationsLock.Lock()
+		defer operationsLock.Unlock()
+		delete(operations, seq)
+	}
+}
+
+// GetState returns the CSI RPCs and the CNS tasks in progress.
+func GetState() *State {
+	operationsLock.Lock()
+	ops := make([]Operation, 0, len(operations))
+	for _, op := range operations {
+		ops = append(ops, op)
+	}
+	operationsLock.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].StartTime.Before(ops[j].StartTime) })
+
+	tasks := volume.GetPendingTasks()
+	if tasks == nil {
+		tasks = []volume.PendingTask{}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].StartTime.Before(tasks[j].StartTime) })
+	return &State{
+		Operations: ops,
+		Tasks:      tasks,
+	}
+}
+
+// Handler returns the HTTP handler which writes the State as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(GetState()); err != nil {
+			klog.Errorf("Failed to write debug state. Err: %v", err)
+		}
+	})
+}
+
+// Serve serves the Handler at /debug/operations on port of the loopback interface
+// only, as the operations reveal the names of volumes and nodes.
+func Serve(port int) {
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	mux := http.NewServeMux()
+	mux.Handle("/debug/operations", Handler())
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Serving debug handler on %s failed. Err: %v", address, err)
+	}
+}
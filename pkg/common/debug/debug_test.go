@@ -0,0 +1,51 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestHandler(t *testing.T) {
+	doneCreate := track(context.Background(), "/csi.v1.Controller/CreateVolume", &csi.CreateVolumeRequest{Name: "pvc-1"})
+	donePublish := track(context.Background(), "/csi.v1.Controller/ControllerPublishVolume",
+		&csi.ControllerPublishVolumeRequest{VolumeId: "vol-1", NodeId: "node-1"})
+	doneCreate()
+	defer donePublish()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/operations", nil))
+	var state State
+	if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+		t.Fatalf("Failed to decode %s: %v", recorder.Body.String(), err)
+	}
+	if len(state.Operations) != 1 {
+		t.Fatalf("Expected 1 operation in progress, got %+v", state.Operations)
+	}
+	op := state.Operations[0]
+	if op.Method != "/csi.v1.Controller/ControllerPublishVolume" || op.VolumeID != "vol-1" || op.NodeID != "node-1" {
+		t.Errorf("Expected ControllerPublishVolume of vol-1 on node-1, got %+v", op)
+	}
+	if state.Tasks == nil {
+		t.Errorf("Expected an empty list of tasks, got %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// redacted replaces the values of redacted fields in logged requests and responses.
+const redacted = "***redacted***"
+
+// redactedFieldNames are substrings of the names of fields whose values are not
+// logged, e.g. the secrets of CSI requests.
+var redactedFieldNames = []string{"secret", "password", "credential"}
+
+// NewUnaryServerInterceptor returns a gRPC interceptor which logs the requests and the
+// responses of CSI RPCs at debug verbosity, with secrets and credentials redacted, and
+// their errors. The entries are prefixed with the method and the ID of the request, so
+// that the entries of a request can be correlated in both log formats.
+func NewUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		prefix := requestPrefix(ctx, info.FullMethod)
+		debug := klog.V(debugVerbosity)
+		if debug {
+			debug.Infof("%sRequest: %s", prefix, Redact(req))
+		}
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		if err != nil {
+			klog.Errorf("%sFailed after %v: %v", prefix, time.Since(start), err)
+		} else if debug {
+			debug.Infof("%sResponse after %v: %s", prefix, time.Since(start), Redact(resp))
+		}
+		return resp, err
+	}
+}
+
+// requestPrefix returns the prefix of the log entries of the request of ctx to method,
+// e.g. "/csi.v1.Controller/CreateVolume: REQ 0042: ", like the entries gocsi logs.
+func requestPrefix(ctx context.Context, method string) string {
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		return fmt.Sprintf("%s: REQ %04d: ", method, id)
+	}
+	return method + ": "
+}
+
+// Redact returns the JSON representation of the protobuf message msg with the values
+// of all fields whose names contain one of redactedFieldNames replaced.
+func Redact(msg interface{}) string {
+	pb, ok := msg.(proto.Message)
+	if !ok || pb == nil {
+		return fmt.Sprintf("%T", msg)
+	}
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	s, err := marshaler.MarshalToString(pb)
+	if err != nil {
+		return fmt.Sprintf("%T", msg)
+	}
+	var fields interface{}
+	if err := json.Unmarshal([]byte(s), &fields); err != nil {
+		return fmt.Sprintf("%T", msg)
+	}
+	redactFields(fields)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf("%T", msg)
+	}
+	return string(b)
+}
+
+// redactFields replaces the values of redacted fields in the decoded JSON value v.
+func redactFields(v interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if isRedactedField(name) {
+				value[name] = redacted
+				continue
+			}
+			redactFields(field)
+		}
+	case []interface{}:
+		for _, element := range value {
+			redactFields(element)
+		}
+	}
+}
+
+// isRedactedField returns true if the value of the field name must not be logged.
+func isRedactedField(name string) bool {
+	name = strings.ToLower(name)
+	for _, redactedName := range redactedFieldNames {
+		if strings.Contains(name, redactedName) {
+			return true
+		}
+	}
+	return false
+}
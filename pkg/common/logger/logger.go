@@ -0,0 +1,182 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logger writes the logs of the driver and the syncer as structured JSON.
+// The output of klog is converted, so existing log calls keep working, and the
+// verbosity of klog remains the log level, which can be changed at runtime.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	csictx "github.com/rexray/gocsi/context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/klog"
+)
+
+const (
+	// FormatJSON writes each log entry as a JSON object.
+	FormatJSON = "json"
+	// FormatText keeps the plain text output of klog.
+	FormatText = "text"
+
+	// debugVerbosity is the klog verbosity from which debug entries are written.
+	debugVerbosity klog.Level = 4
+	// maxVerbosity is the highest klog verbosity set by SIGUSR1.
+	maxVerbosity = 10
+)
+
+var (
+	// zapLogger is the logger which entries are written to, it discards entries until Init.
+	zapLogger = zap.NewNop()
+	// verbosityLock is used for changing the klog verbosity.
+	verbosityLock sync.Mutex
+)
+
+// Init sets up logging in format, FormatJSON or FormatText. It must be called after
+// the klog flags are parsed.
+func Init(format string) error {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	switch format {
+	case FormatText:
+		zapLogger = zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.Lock(os.Stderr), zap.LevelEnablerFunc(enabled)))
+	case FormatJSON:
+		zapLogger = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.Lock(os.Stderr), zap.LevelEnablerFunc(enabled)))
+		// klog writes each entry to the output of its severity and of all lower severities,
+		// each output only converts the entries of its own severity
+		for name, w := range map[string]*klogWriter{
+			"INFO":    {severity: 'I', level: zapcore.InfoLevel},
+			"WARNING": {severity: 'W', level: zapcore.WarnLevel},
+			"ERROR":   {severity: 'E', level: zapcore.ErrorLevel},
+			"FATAL":   {severity: 'F', level: zapcore.FatalLevel},
+		} {
+			klog.SetOutputBySeverity(name, w)
+		}
+		for name, value := range map[string]string{"logtostderr": "false", "skip_headers": "false", "stderrthreshold": "FATAL"} {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("failed to set klog flag %s: %v", name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
+
+// WatchVerbositySignals changes the klog verbosity on SIGUSR1 (increase) and SIGUSR2
+// (decrease). It is not called by processes which use these signals otherwise, the
+// syncer triggers a full sync on SIGUSR1.
+func WatchVerbositySignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				changeVerbosity(1)
+			} else {
+				changeVerbosity(-1)
+			}
+		}
+	}()
+}
+
+// GetLogger returns a logger whose entries carry the ID of the CSI request of ctx,
+// so that the entries of a request can be correlated.
+func GetLogger(ctx context.Context) *zap.SugaredLogger {
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		return zapLogger.Sugar().With("requestID", id)
+	}
+	return zapLogger.Sugar()
+}
+
+// enabled returns true if entries of level are written. Debug entries are written
+// at the klog verbosity of debugVerbosity and above.
+func enabled(level zapcore.Level) bool {
+	if level < zapcore.InfoLevel {
+		return bool(klog.V(debugVerbosity))
+	}
+	return true
+}
+
+// changeVerbosity changes the klog verbosity by delta, within 0 and maxVerbosity.
+func changeVerbosity(delta int) {
+	verbosityLock.Lock()
+	defer verbosityLock.Unlock()
+	v := flag.Lookup("v")
+	if v == nil {
+		return
+	}
+	verbosity, err := strconv.Atoi(v.Value.String())
+	if err != nil {
+		klog.Errorf("Failed to parse log verbosity %q: %v", v.Value.String(), err)
+		return
+	}
+	verbosity += delta
+	if verbosity < 0 || verbosity > maxVerbosity {
+		return
+	}
+	if err := v.Value.Set(strconv.Itoa(verbosity)); err != nil {
+		klog.Errorf("Failed to set log verbosity to %d: %v", verbosity, err)
+		return
+	}
+	klog.Infof("Log verbosity changed to %d", verbosity)
+}
+
+// klogWriter converts the klog entries of a severity to JSON log entries.
+type klogWriter struct {
+	// severity is the first character of the klog header of the entries to convert.
+	severity byte
+	level    zapcore.Level
+}
+
+// Write converts the klog entry p, "Lmmdd hh:mm:ss.uuuuuu threadid file:line] msg",
+// if it is of the severity of w.
+func (w *klogWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 || p[0] != w.severity {
+		return len(p), nil
+	}
+	entry := zapcore.Entry{Level: w.level, Time: time.Now()}
+	message := p
+	if i := bytes.Index(p, []byte("] ")); i >= 0 {
+		header := bytes.Fields(p[:i])
+		if len(header) > 0 {
+			caller := string(header[len(header)-1])
+			if j := strings.LastIndex(caller, ":"); j >= 0 {
+				if line, err := strconv.Atoi(caller[j+1:]); err == nil {
+					entry.Caller = zapcore.NewEntryCaller(0, caller[:j], line, true)
+				}
+			}
+		}
+		message = p[i+2:]
+	}
+	entry.Message = string(bytes.TrimRight(message, "\n"))
+	if ce := zapLogger.Core().Check(entry, nil); ce != nil {
+		ce.Write()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csictx "github.com/rexray/gocsi/context"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog"
+)
+
+func TestKlogWriter(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	defer func(l *zap.Logger) { zapLogger = l }(zapLogger)
+	zapLogger = zap.New(core)
+
+	info := &klogWriter{severity: 'I', level: zapcore.InfoLevel}
+	warning := &klogWriter{severity: 'W', level: zapcore.WarnLevel}
+	// klog writes warnings to the outputs of warnings and infos
+	for _, line := range []string{
+		"I1015 10:11:12.123456    4242 controller.go:134] CreateVolume: called\n",
+		"W1015 10:11:13.123456    4242 manager.go:98] CreateVolume failed with retryable error\n",
+	} {
+		for _, w := range []*klogWriter{info, warning} {
+			if n, err := w.Write([]byte(line)); n != len(line) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", line, n, err)
+			}
+		}
+	}
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d: %+v", len(entries), entries)
+	}
+	expected := []struct {
+		level   zapcore.Level
+		caller  string
+		message string
+	}{
+		{zapcore.InfoLevel, "controller.go:134", "CreateVolume: called"},
+		{zapcore.WarnLevel, "manager.go:98", "CreateVolume failed with retryable error"},
+	}
+	for i, e := range expected {
+		if entries[i].Level != e.level || entries[i].Caller.TrimmedPath() != e.caller || entries[i].Message != e.message {
+			t.Errorf("Expected entry %d to be %+v, got level %v, caller %q, message %q",
+				i, e, entries[i].Level, entries[i].Caller.TrimmedPath(), entries[i].Message)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/staging",
+		Secrets:           map[string]string{"password": "hunter2"},
+		VolumeContext:     map[string]string{"fstype": "ext4", "luks-password": "hunter2"},
+	}
+	redactedReq := Redact(req)
+	if strings.Contains(redactedReq, "hunter2") {
+		t.Fatalf("Expected secrets to be redacted, got %s", redactedReq)
+	}
+	for _, expected := range []string{`"volume_id":"vol-1"`, `"fstype":"ext4"`, `"secrets":"` + redacted + `"`} {
+		if !strings.Contains(redactedReq, expected) {
+			t.Errorf("Expected %s in %s", expected, redactedReq)
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	for name, value := range map[string]string{"logtostderr": "false", "v": "4"} {
+		if err := flags.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		_ = flags.Set("logtostderr", "true")
+		_ = flags.Set("v", "0")
+	}()
+	var output bytes.Buffer
+	klog.SetOutput(&output)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(csictx.RequestIDKey, "42"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("no space")
+	}
+	if _, err := NewUnaryServerInterceptor()(ctx, &csi.CreateVolumeRequest{Name: "pvc-1"}, info, handler); err == nil {
+		t.Fatal("Expected the error of the handler")
+	}
+	klog.Flush()
+
+	// klog writes errors to the outputs of all lower severities as well
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Expected the request and the error to be logged, got %s", output.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "/csi.v1.Controller/CreateVolume: REQ 0042: ") {
+			t.Errorf("Expected the method and the request ID in log entry %q", line)
+		}
+	}
+	if !strings.Contains(lines[0], `"name":"pvc-1"`) || !strings.Contains(lines[1], "no space") {
+		t.Errorf("Expected the request and the error in the log entries, got %s", output.String())
+	}
+}
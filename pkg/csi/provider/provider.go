@@ -18,7 +18,11 @@ package provider
 
 import (
 	"github.com/rexray/gocsi"
+	"github.com/rexray/gocsi/middleware/requestid"
+	"google.golang.org/grpc"
 
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/debug"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/logger"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
 )
 
@@ -33,6 +37,15 @@ func New() gocsi.StoragePluginProvider {
 		Node:        svc,
 		BeforeServe: svc.BeforeServe,
 
+		// Inject request IDs, they correlate the log entries of a request,
+		// log requests and responses without their secrets and record the
+		// requests in progress for the debug handler.
+		Interceptors: []grpc.UnaryServerInterceptor{
+			requestid.NewServerRequestIDInjector(),
+			logger.NewUnaryServerInterceptor(),
+			debug.NewUnaryServerInterceptor(),
+		},
+
 		EnvVars: []string{
 			// Enable request validation.
 			gocsi.EnvVarSpecReqValidation + "=true",
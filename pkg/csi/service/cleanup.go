@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akutz/gofsutil"
+	"k8s.io/klog"
+)
+
+const (
+	// defaultKubeletDir is the root directory of the kubelet on the node
+	defaultKubeletDir = "/var/lib/kubelet"
+	// envKubeletDir overrides defaultKubeletDir
+	envKubeletDir = "KUBELET_DIR"
+	// volDataFileName is the file in which the kubelet records the driver of a CSI volume
+	// next to its staging and publish directories
+	volDataFileName = "vol_data.json"
+)
+
+// volData is the part of the kubelet's vol_data.json needed to identify volumes of this driver
+type volData struct {
+	DriverName string `json:"driverName"`
+}
+
+// cleanupStaleMounts unmounts staging and publish mounts of volumes of this driver
+// whose disk is no longer attached to the node, e.g. after the node plugin or the
+// node crashed while a volume was in use. LUKS devices left open on such disks are
+// closed as well. Failures are logged and skipped, the kubelet retries unpublish and
+// unstage for volumes which are still in use.
+func cleanupStaleMounts(ctx context.Context) {
+	mnts, err := gofsutil.GetMounts(ctx)
+	if err != nil {
+		klog.Errorf("failed to list mounts to clean up stale mounts. err: %v", err)
+		return
+	}
+	staleMnts := getStaleMounts(mnts, getKubeletDir())
+	luksMappers := make(map[string]bool)
+	// Publish mounts are created after the staging mount of a volume, unmount
+	// in reverse order so that staging mounts are unmounted last
+	for i := len(staleMnts) - 1; i >= 0; i-- {
+		m := staleMnts[i]
+		klog.V(2).Infof("unmounting stale mount %q of device %q", m.Path, m.Device)
+		if err := gofsutil.Unmount(ctx, m.Path); err != nil {
+			klog.Errorf("failed to unmount stale mount %q. err: %v", m.Path, err)
+			continue
+		}
+		if isLuksMapper(&Device{FullPath: m.Device, Name: filepath.Base(m.Device)}) {
+			luksMappers[filepath.Base(m.Device)] = true
+		}
+	}
+	for mapperName := range luksMappers {
+		if err := closeLuksDevice(ctx, mapperName); err != nil {
+			klog.Errorf("failed to close stale LUKS device %q. err: %v", mapperName, err)
+		}
+	}
+}
+
+// getStaleMounts returns the mounts under kubeletDir of volumes of this driver
+// whose device is gone
+func getStaleMounts(mnts []gofsutil.Info, kubeletDir string) []gofsutil.Info {
+	var staleMnts []gofsutil.Info
+	for _, m := range getDriverMounts(mnts, kubeletDir) {
+		if isStaleDevice(m.Device) {
+			staleMnts = append(staleMnts, m)
+		}
+	}
+	return staleMnts
+}
+
+// getDriverMounts returns the staging and publish mounts under kubeletDir of
+// filesystem volumes of this driver
+func getDriverMounts(mnts []gofsutil.Info, kubeletDir string) []gofsutil.Info {
+	var driverMnts []gofsutil.Info
+	for _, m := range mnts {
+		if !strings.HasPrefix(m.Path, kubeletDir+string(filepath.Separator)) {
+			continue
+		}
+		if strings.HasPrefix(m.Device, "/dev/") && isDriverMount(m.Path) {
+			driverMnts = append(driverMnts, m)
+		}
+	}
+	return driverMnts
+}
+
+// getKubeletDir returns the root directory of the kubelet
+func getKubeletDir() string {
+	if v := os.Getenv(envKubeletDir); v != "" {
+		return v
+	}
+	return defaultKubeletDir
+}
+
+// isDriverMount returns true if the kubelet recorded this driver for the
+// volume mounted at path
+func isDriverMount(path string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(path), volDataFileName))
+	if err != nil {
+		return false
+	}
+	var vd volData
+	if err := json.Unmarshal(data, &vd); err != nil {
+		klog.V(4).Infof("failed to parse %s for mount %q. err: %v", volDataFileName, path, err)
+		return false
+	}
+	return vd.DriverName == Name
+}
+
+// isStaleDevice returns true if device no longer exists, or if it is a LUKS
+// device whose disk is no longer attached
+func isStaleDevice(device string) bool {
+	if _, err := os.Stat(device); os.IsNotExist(err) {
+		return true
+	}
+	name := filepath.Base(device)
+	if !isLuksMapper(&Device{FullPath: device, Name: name}) {
+		return false
+	}
+	diskPath, err := getDiskPath(strings.TrimPrefix(name, luksMapperPrefix), nil)
+	return err == nil && diskPath == ""
+}
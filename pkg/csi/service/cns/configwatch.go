@@ -0,0 +1,186 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// configReloadInterval is the interval at which the config file is checked for changes
+const configReloadInterval = time.Minute
+
+// reloadableGlobals are the Global config fields whose changes are applied without a restart.
+// They are read for each request, or applied to the vCenters like the credentials, which are
+// reloaded by WatchCredentials. Changes to the other Global fields, which are only read when
+// the controller is initialized, are logged and ignored until the controller is restarted.
+var reloadableGlobals = map[string]bool{
+	"User":              true,
+	"Password":          true,
+	"Datacenters":       true,
+	"AllowedDatastores": true,
+	"DeniedDatastores":  true,
+	"DefaultFsType":     true,
+}
+
+// reloadableVirtualCenterFields are the fields of VirtualCenter sections whose changes are
+// applied without a restart, changes to the other fields are ignored until the restart
+var reloadableVirtualCenterFields = map[string]bool{
+	"User":        true,
+	"Password":    true,
+	"Datacenters": true,
+}
+
+// getConfigPath returns the path of the config file of the controller
+func getConfigPath() string {
+	if cfgPath := os.Getenv(config.EnvCloudConfig); cfgPath != "" {
+		return cfgPath
+	}
+	return config.DefaultCloudConfigPath
+}
+
+// isFile returns true if path is an existing file, configs read from the environment
+// are not reloaded
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// watchConfig applies the changes of the config file at cfgPath until stopCh is closed
+func (c *controller) watchConfig(cfgPath string, stopCh <-chan struct{}) {
+	go wait.Until(func() { c.reloadConfig(cfgPath) }, configReloadInterval, stopCh)
+}
+
+// reloadConfig reads and validates the config file at cfgPath and applies its changes.
+// The vCenters of the controller can not be changed without a restart, a config with
+// other vCenters is not applied.
+func (c *controller) reloadConfig(cfgPath string) {
+	cfg, err := config.GetCnsconfig(cfgPath)
+	if err != nil {
+		klog.Errorf("Failed to reload config %s, keeping the current config. Err: %v", cfgPath, err)
+		return
+	}
+	if err := validateControllerConfig(cfg); err != nil {
+		klog.Errorf("Reloaded config %s is invalid, keeping the current config. Err: %v", cfgPath, err)
+		return
+	}
+	current := c.manager.GetCnsConfig()
+	if reflect.DeepEqual(current, cfg) {
+		return
+	}
+	if !reflect.DeepEqual(getVirtualCenterHosts(current), getVirtualCenterHosts(cfg)) {
+		klog.Errorf("vCenters changed from %v to %v in config %s, the controller must be restarted to apply it",
+			getVirtualCenterHosts(current), getVirtualCenterHosts(cfg), cfgPath)
+		return
+	}
+
+	// Keep the current value of the fields which are only applied by a restart
+	restartRequired := keepRestartRequiredFields("Global.", reflect.ValueOf(&current.Global).Elem(),
+		reflect.ValueOf(&cfg.Global).Elem(), reloadableGlobals)
+	if !reflect.DeepEqual(current.RateLimit, cfg.RateLimit) {
+		restartRequired = append(restartRequired, "RateLimit")
+		cfg.RateLimit = current.RateLimit
+	}
+	for _, host := range getVirtualCenterHosts(cfg) {
+		restartRequired = append(restartRequired, keepRestartRequiredFields("VirtualCenter "+host+".",
+			reflect.ValueOf(current.VirtualCenter[host]).Elem(), reflect.ValueOf(cfg.VirtualCenter[host]).Elem(),
+			reloadableVirtualCenterFields)...)
+	}
+	for _, name := range restartRequired {
+		klog.Warningf("%s changed in config %s, the controller must be restarted to apply it", name, cfgPath)
+	}
+	vcenterconfigs, err := cnsvsphere.GetVirtualCenterConfigs(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig of reloaded config %s, keeping the current config. Err: %v", cfgPath, err)
+		return
+	}
+
+	changed := diffGlobalConfig(current, cfg)
+	if !reflect.DeepEqual(current.Labels, cfg.Labels) {
+		changed = append(changed, "Labels")
+	}
+	for _, vcenterconfig := range vcenterconfigs {
+		vc, err := c.manager.VcenterManager.GetVirtualCenter(vcenterconfig.Host)
+		if err != nil {
+			klog.Errorf("Failed to get vCenter %q. Err: %v", vcenterconfig.Host, err)
+			continue
+		}
+		if !reflect.DeepEqual(vc.GetDatacenterPaths(), vcenterconfig.DatacenterPaths) {
+			changed = append(changed, "VirtualCenter "+vcenterconfig.Host+" Datacenters")
+			vc.SetDatacenterPaths(vcenterconfig.DatacenterPaths)
+		}
+	}
+	c.manager.SetCnsConfig(cfg)
+	klog.Infof("Reloaded config %s, changed: %v", cfgPath, changed)
+}
+
+// keepRestartRequiredFields sets the fields of the struct cfg which are not reloadable to their
+// value in current, and returns the names of those which changed prefixed with prefix
+func keepRestartRequiredFields(prefix string, current reflect.Value, cfg reflect.Value, reloadable map[string]bool) []string {
+	var changed []string
+	for i := 0; i < cfg.NumField(); i++ {
+		name := cfg.Type().Field(i).Name
+		if reloadable[name] || reflect.DeepEqual(current.Field(i).Interface(), cfg.Field(i).Interface()) {
+			continue
+		}
+		changed = append(changed, prefix+name)
+		cfg.Field(i).Set(current.Field(i))
+	}
+	return changed
+}
+
+// validateControllerConfig returns an error if cfg is not supported by the controller
+func validateControllerConfig(cfg *config.Config) error {
+	if cfg.Global.DefaultFsType != "" && !common.IsValidFsType(cfg.Global.DefaultFsType) {
+		return fmt.Errorf("default fsType %q is not supported. Supported fsTypes: %v", cfg.Global.DefaultFsType, common.SupportedFsTypes)
+	}
+	return nil
+}
+
+// diffGlobalConfig returns the names of the Global fields which differ between current and cfg.
+// Only the names are returned, as the fields include credentials.
+func diffGlobalConfig(current *config.Config, cfg *config.Config) []string {
+	var changed []string
+	currentGlobal := reflect.ValueOf(current.Global)
+	global := reflect.ValueOf(cfg.Global)
+	for i := 0; i < global.NumField(); i++ {
+		if !reflect.DeepEqual(currentGlobal.Field(i).Interface(), global.Field(i).Interface()) {
+			changed = append(changed, "Global."+global.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// getVirtualCenterHosts returns the sorted vCenter hosts of cfg
+func getVirtualCenterHosts(cfg *config.Config) []string {
+	var hosts []string
+	for host := range cfg.VirtualCenter {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func TestReloadConfig(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The config is read from the environment")
+	}
+	ct := getControllerTest(t)
+	host := ct.controller.manager.VcenterConfig.Host
+	vc, err := ct.controller.manager.VcenterManager.GetVirtualCenter(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datacenterPaths := vc.GetDatacenterPaths()
+	defer vc.SetDatacenterPaths(datacenterPaths)
+
+	cfgFile, err := ioutil.TempFile("", "vsphere.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cfgFile.Name())
+	writeConfig := func(global string, datacenters string) {
+		vcConfig := ct.config.VirtualCenter[host]
+		content := fmt.Sprintf("[Global]\n%s\n[VirtualCenter %q]\nuser = %q\npassword = %q\nport = %q\ninsecure-flag = true\ndatacenters = %q\n",
+			global, host, vcConfig.User, vcConfig.Password, vcConfig.VCenterPort, datacenters)
+		if strings.Contains(datacenters, "DC1") {
+			content += "max-inflight-tasks = 5\n[RateLimit]\ncreate-qps = 2\n"
+		}
+		if err := ioutil.WriteFile(cfgFile.Name(), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`cluster-id = "test-cluster"`, "DC0")
+	cfg, err := config.GetCnsconfig(cfgFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{
+		manager: &common.Manager{
+			CnsConfig:      cfg,
+			VcenterManager: ct.controller.manager.VcenterManager,
+		},
+	}
+
+	// Datastore lists and datacenters are applied, the cluster ID, provisioning limits,
+	// rate limits and other vCenter fields require a restart
+	writeConfig("cluster-id = \"other-cluster\"\nmax-concurrent-provisioning = 3\ndenied-datastores = \"ds:///vmfs/volumes/denied/\"", "DC0, DC1")
+	c.reloadConfig(cfgFile.Name())
+	reloaded := c.manager.GetCnsConfig()
+	if reloaded.Global.DeniedDatastores != "ds:///vmfs/volumes/denied/" {
+		t.Errorf("Expected the denied datastores to be reloaded, got %q", reloaded.Global.DeniedDatastores)
+	}
+	if reloaded.Global.ClusterID != "test-cluster" {
+		t.Errorf("Expected the cluster ID to be kept until restart, got %q", reloaded.Global.ClusterID)
+	}
+	if reloaded.Global.MaxConcurrentProvisioning != cfg.Global.MaxConcurrentProvisioning {
+		t.Errorf("Expected the provisioning limit to be kept until restart, got %d", reloaded.Global.MaxConcurrentProvisioning)
+	}
+	if reloaded.RateLimit != cfg.RateLimit {
+		t.Errorf("Expected the rate limits to be kept until restart, got %+v", reloaded.RateLimit)
+	}
+	if reloaded.VirtualCenter[host].MaxInFlightTasks != cfg.VirtualCenter[host].MaxInFlightTasks {
+		t.Errorf("Expected the in-flight tasks of the vCenter to be kept until restart, got %d", reloaded.VirtualCenter[host].MaxInFlightTasks)
+	}
+	if !reflect.DeepEqual(vc.GetDatacenterPaths(), []string{"DC0", "DC1"}) {
+		t.Errorf("Expected the datacenters to be reloaded, got %v", vc.GetDatacenterPaths())
+	}
+
+	// Invalid configs are not applied
+	writeConfig(`default-fstype = "unsupported"`, "DC0")
+	c.reloadConfig(cfgFile.Name())
+	if c.manager.GetCnsConfig().Global.DeniedDatastores != "ds:///vmfs/volumes/denied/" {
+		t.Errorf("Expected the invalid config not to be applied, got denied datastores %q", c.manager.GetCnsConfig().Global.DeniedDatastores)
+	}
+}
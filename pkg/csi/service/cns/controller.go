@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,13 +29,27 @@ import (
 	"github.com/vmware/govmomi/units"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
+	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/logger"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const (
+	// controllerComponentName is the component of the events recorded by the controller
+	controllerComponentName = "vsphere-csi-controller"
+	// datastoreInaccessibleReason is the reason of the event recorded on a node whose host
+	// can not access the datastore of a volume to be attached
+	datastoreInaccessibleReason = "VolumeDatastoreInaccessible"
 )
 
 var (
@@ -42,6 +57,7 @@ var (
 	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	}
 )
 
@@ -50,11 +66,24 @@ type nodeManager interface {
 	GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cnsvsphere.DatastoreInfo, error)
 	GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error)
 	GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error)
+	GetDeletedNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error)
+	GetKubernetesNode(nodeName string) (*v1.Node, error)
 }
 
 type controller struct {
-	manager *common.Manager
-	nodeMgr nodeManager
+	manager    *common.Manager
+	nodeMgr    nodeManager
+	operations *operationStore
+	// provisioning is nil unless the concurrency of CreateVolume and DeleteVolume is limited
+	provisioning *provisioningLimiter
+	// quota is nil unless namespace quotas are enabled in the config
+	quota *namespaceQuota
+	// health is the result of the periodic vCenter health checks
+	health *vcenterHealth
+	// migration is nil unless CSI migration of in-tree volumes is enabled in the config
+	migration *volumeMigration
+	// eventRecorder records the events of the controller on kubernetes objects
+	eventRecorder record.EventRecorder
 }
 
 // New creates a CNS controller
@@ -66,86 +95,238 @@ func New() csitypes.Controller {
 func (c *controller) Init(config *config.Config) error {
 	klog.Infof("Initializing CNS controller")
 	// Get VirtualCenterManager instance and validate version
-	var err error
-	vcenterconfig, err := cnsvsphere.GetVirtualCenterConfig(config)
-	if err != nil {
-		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
-		return err
-	}
-	vcManager := cnsvsphere.GetVirtualCenterManager()
-	vcenter, err := vcManager.RegisterVirtualCenter(vcenterconfig)
+	err := validateControllerConfig(config)
 	if err != nil {
-		klog.Errorf("Failed to register VC with virtualCenterManager. err=%v", err)
+		klog.Error(err)
 		return err
 	}
-	c.manager = &common.Manager{
-		VcenterConfig:  vcenterconfig,
-		CnsConfig:      config,
-		VolumeManager:  cnsvolume.GetManager(vcenter),
-		VcenterManager: cnsvsphere.GetVirtualCenterManager(),
-	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	vc, err := common.GetVCenter(ctx, c.manager)
+	var vcenters []*cnsvsphere.VirtualCenter
+	c.manager, vcenters, err = connectVirtualCenters(ctx, config)
 	if err != nil {
-		klog.Errorf("Failed to get vcenter. err=%v", err)
 		return err
 	}
-	// Check vCenter API Version
-	if err = common.CheckAPI(vc.Client.ServiceContent.About.ApiVersion); err != nil {
-		klog.Errorf("checkAPI failed for vcenter API version: %s, err=%v", vc.Client.ServiceContent.About.ApiVersion, err)
-		return err
+	for _, vc := range vcenters {
+		// Log in again when the vCenter credentials are rotated
+		vc.WatchCredentials(wait.NeverStop)
+	}
+	if cfgPath := getConfigPath(); isFile(cfgPath) {
+		// Apply changes of the mounted config file without a restart
+		c.watchConfig(cfgPath, wait.NeverStop)
+	}
+	c.operations = newOperationStore()
+	c.provisioning = newProvisioningLimiter(config.Global.MaxConcurrentProvisioning,
+		config.Global.MaxConcurrentProvisioningPerDatastore)
+	c.watchHealth(wait.NeverStop)
+	if config.Global.EnableNamespaceQuota {
+		c.quota, err = newNamespaceQuota()
+		if err != nil {
+			klog.Errorf("Failed to initialize namespace quota. err=%v", err)
+			return err
+		}
+	}
+	if config.Global.EnableCSIMigration {
+		c.migration, err = newVolumeMigration(c.manager)
+		if err != nil {
+			klog.Errorf("Failed to initialize CSI migration. err=%v", err)
+			return err
+		}
+	}
+	if config.Global.EnableNodeVMAttachment {
+		reconciler, err := newNodeVMAttachmentReconciler(c.manager)
+		if err != nil {
+			klog.Errorf("Failed to initialize CnsNodeVmAttachment reconciler. err=%v", err)
+			return err
+		}
+		reconciler.run(wait.NeverStop)
+	}
+	c.nodeMgr = &Nodes{
+		manager:              c.manager,
+		repairProviderID:     config.Global.RepairNodeProviderID,
+		maxVolumesPerNode:    int64(config.Global.MaxVolumesPerNode),
+		attachControllerType: config.Global.AttachControllerType,
 	}
-	c.nodeMgr = &Nodes{}
 	err = c.nodeMgr.Initialize()
 	if err != nil {
 		klog.Errorf("Failed to initialize nodeMgr. err=%v", err)
 		return err
 	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return err
+	}
+	c.eventRecorder = k8s.NewEventRecorder(k8sclient, controllerComponentName)
+	// Listing all datastores and node VMs may take a while, so privileges are checked in the background
+	go checkPrivileges(context.Background(), vcenters, k8sclient)
 	return nil
 }
 
+// connectVirtualCenters connects to the vCenters of config and returns a Manager of their
+// volumes. Volumes are created on the first vCenter unless their datastores are on another one.
+func connectVirtualCenters(ctx context.Context, config *config.Config) (*common.Manager, []*cnsvsphere.VirtualCenter, error) {
+	vcenterconfigs, err := cnsvsphere.GetVirtualCenterConfigs(config)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
+		return nil, nil, err
+	}
+	volumeManagers := make(map[string]cnsvolume.Manager)
+	var vcenters []*cnsvsphere.VirtualCenter
+	for _, vcenterconfig := range vcenterconfigs {
+		vc, err := cnsvsphere.ConnectVirtualCenter(ctx, vcenterconfig)
+		if err != nil {
+			klog.Errorf("Failed to get vcenter. err=%v", err)
+			return nil, nil, err
+		}
+		// Check vCenter API Version
+		if err = common.CheckAPI(vc.Client.ServiceContent.About.ApiVersion); err != nil {
+			klog.Errorf("checkAPI failed for vcenter API version: %s, err=%v", vc.Client.ServiceContent.About.ApiVersion, err)
+			return nil, nil, err
+		}
+		volumeManagers[vcenterconfig.Host] = cnsvolume.GetManager(vc)
+		vcenters = append(vcenters, vc)
+	}
+	manager := &common.Manager{
+		VcenterConfig:  vcenterconfigs[0],
+		CnsConfig:      config,
+		VolumeManager:  volumeManagers[vcenterconfigs[0].Host],
+		VolumeManagers: volumeManagers,
+		VcenterManager: cnsvsphere.GetVirtualCenterManager(),
+	}
+	return manager, vcenters, nil
+}
+
 // CreateVolume is creating CNS Volume using volume request specified
 // in CreateVolumeRequest
 func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
-	klog.V(4).Infof("CreateVolume: called with args %+v", *req)
+	// Concurrent and repeated requests for the same volume name get the same volume,
+	// requests for a different volume with the same name fail
+	start := time.Now()
+	resp, err := c.operations.doRequest(ctx, "CreateVolume/"+req.Name, createVolumeRequest{req}, createVolumeResultTTL, func() (interface{}, error) {
+		return c.createVolumeWithinQuota(ctx, req)
+	})
+	if _, ok := err.(*operationMismatchError); ok {
+		msg := fmt.Sprintf("Volume %q is already being created or has been created with different parameters", req.Name)
+		klog.Error(msg)
+		err = status.Error(codes.AlreadyExists, msg)
+	}
+	observeOperation(operationCreateVolume, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.CreateVolumeResponse), nil
+}
+
+// getVolumeSizeBytes returns the capacity of the volume in req, 10 GiB by default
+func getVolumeSizeBytes(req *csi.CreateVolumeRequest) int64 {
+	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
+		return req.GetCapacityRange().GetRequiredBytes()
+	}
+	return int64(common.DefaultGbDiskSize * common.GbInBytes)
+}
+
+// createVolumeWithinQuota creates the CNS Volume specified in CreateVolumeRequest after reserving
+// its capacity in the storage quota of its namespace, if namespace quotas are enabled
+func (c *controller) createVolumeWithinQuota(ctx context.Context, req *csi.CreateVolumeRequest) (
+	*csi.CreateVolumeResponse, error) {
+	if c.quota == nil {
+		return c.createVolume(ctx, req)
+	}
 	err := validateVanillaCreateVolumeRequest(req)
 	if err != nil {
 		klog.Errorf("Failed to validate Create Volume Request with err: %v", err)
 		return nil, err
 	}
+	namespace, err := c.quota.getNamespace(req)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get namespace of volume %q. Error: %+v", req.Name, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if namespace == "" {
+		klog.Warningf("Namespace of volume %q is unknown, storage quota is not enforced", req.Name)
+		return c.createVolume(ctx, req)
+	}
+	// Concurrent requests for other volumes in the namespace see the capacity reserved
+	// for this one, until it is counted in its PV
+	if err = c.quota.reserve(namespace, req.Name, getVolumeSizeBytes(req)); err != nil {
+		return nil, err
+	}
+	resp, err := c.createVolume(ctx, req)
+	if err != nil {
+		c.quota.release(req.Name)
+		return nil, err
+	}
+	c.quota.complete(req.Name, resp.Volume.VolumeId)
+	return resp, nil
+}
 
-	// Volume Size - Default is 10 GiB
-	volSizeBytes := int64(common.DefaultGbDiskSize * common.GbInBytes)
-	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
-		volSizeBytes = int64(req.GetCapacityRange().GetRequiredBytes())
+// createVolume creates the CNS Volume specified in CreateVolumeRequest
+func (c *controller) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
+	*csi.CreateVolumeResponse, error) {
+	err := validateVanillaCreateVolumeRequest(req)
+	if err != nil {
+		klog.Errorf("Failed to validate Create Volume Request with err: %v", err)
+		return nil, err
 	}
+
+	volSizeBytes := getVolumeSizeBytes(req)
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
 	var datastoreURL string
+	var datastoreClusterName string
+	var siteAffinity string
 	var storagePolicyName string
+	var storagePolicyID string
 	var fsType string
+	var mkfsOptions string
+	var luksEncryption bool
+	var datastoreName string
 
 	// Support case insensitive parameters
 	for paramName := range req.Parameters {
 		param := strings.ToLower(paramName)
 		if param == common.AttributeDatastoreURL {
 			datastoreURL = req.Parameters[paramName]
+		} else if param == common.AttributeDatastoreClusterName {
+			datastoreClusterName = req.Parameters[paramName]
+		} else if param == common.AttributeSiteAffinity {
+			siteAffinity = strings.ToLower(req.Parameters[paramName])
 		} else if param == common.AttributeStoragePolicyName {
 			storagePolicyName = req.Parameters[paramName]
+		} else if param == common.AttributeStoragePolicyID {
+			storagePolicyID = req.Parameters[paramName]
 		} else if param == common.AttributeFsType {
-			fsType = req.Parameters[common.AttributeFsType]
+			fsType = req.Parameters[paramName]
+		} else if param == common.AttributeMkfsOptions {
+			mkfsOptions = req.Parameters[paramName]
+		} else if param == common.AttributeLuksEncryption {
+			// Already validated
+			luksEncryption, _ = strconv.ParseBool(req.Parameters[paramName])
+		} else if param == common.AttributeDatastoreMigrationParam {
+			datastoreName = req.Parameters[paramName]
 		}
 	}
+	csiMigration := common.IsCSIMigrationRequest(req.Parameters)
+	if csiMigration && c.migration == nil {
+		msg := fmt.Sprintf("Volume %q is requested for a migrated in-tree StorageClass, but CSI migration is not enabled", req.Name)
+		klog.Error(msg)
+		return nil, status.Error(codes.InvalidArgument, msg)
+	}
 
 	var createVolumeSpec = common.CreateVolumeSpec{
-		CapacityMB:        volSizeMB,
-		Name:              req.Name,
-		DatastoreURL:      datastoreURL,
-		StoragePolicyName: storagePolicyName,
+		CapacityMB:           volSizeMB,
+		Name:                 common.SanitizeVolumeName(req.Name),
+		DatastoreURL:         datastoreURL,
+		DatastoreClusterName: datastoreClusterName,
+		SiteAffinity:         siteAffinity,
+		StoragePolicyName:    storagePolicyName,
+		StoragePolicyID:      storagePolicyID,
+		DatastoreType:        common.GetDatastoreType(req.Parameters),
+		SharedDatastoreTypes: common.GetSharedDatastoreTypes(req.Parameters),
 	}
 	var sharedDatastores []*cnsvsphere.DatastoreInfo
 	var datastoreTopologyMap = make(map[string][]map[string]string)
@@ -154,14 +335,15 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	topologyRequirement := req.GetAccessibilityRequirements()
 	if topologyRequirement != nil {
 		// Get shared accessible datastores for matching topology requirement
-		if c.manager.CnsConfig.Labels.Zone == "" || c.manager.CnsConfig.Labels.Region == "" {
+		cfg := c.manager.GetCnsConfig()
+		if !isTopologyAware(cfg) {
 			// if zone and region label (vSphere category names) not specified in the config secret, then return
 			// NotFound error.
 			errMsg := fmt.Sprintf("Zone/Region vsphere category names not specified in the vsphere config secret")
 			klog.Errorf(errMsg)
 			return nil, status.Error(codes.NotFound, errMsg)
 		}
-		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
+		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, cfg.Labels.Zone, cfg.Labels.Region)
 		if err != nil || len(sharedDatastores) == 0 {
 			msg := fmt.Sprintf("Failed to get shared datastores in topology: %+v. Error: %+v", topologyRequirement, err)
 			klog.Errorf(msg)
@@ -194,15 +376,88 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 	}
-	volumeID, err := common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, sharedDatastores)
+	if datastoreName != "" {
+		// In-tree StorageClasses name the datastore rather than its URL
+		for _, sharedDatastore := range sharedDatastores {
+			if sharedDatastore.Info.Name == datastoreName {
+				createVolumeSpec.DatastoreURL = sharedDatastore.Info.Url
+				break
+			}
+		}
+		if createVolumeSpec.DatastoreURL == "" {
+			msg := fmt.Sprintf("Datastore %q of the migrated in-tree StorageClass is not shared by the nodes", datastoreName)
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+	}
+	// The datastore is known up front if it is the only shared one
+	provisioningDatastoreURL := createVolumeSpec.DatastoreURL
+	if provisioningDatastoreURL == "" && len(sharedDatastores) == 1 && createVolumeSpec.DatastoreClusterName == "" {
+		provisioningDatastoreURL = sharedDatastores[0].Info.Url
+	}
+	release := func() {}
+	if provisioningDatastoreURL == "" && createVolumeSpec.DatastoreClusterName == "" && createVolumeSpec.DatastoreType == "" &&
+		c.provisioning.limitsDatastores() {
+		// Otherwise CNS would choose the datastore, which is then unknown to the limiter.
+		// The volume is placed on the candidate datastore the operation is admitted on first.
+		createVolumeSpec.SelectDatastore = func(ctx context.Context, datastores []*cnsvsphere.DatastoreInfo) (*cnsvsphere.DatastoreInfo, error) {
+			datastoresByURL := make(map[string]*cnsvsphere.DatastoreInfo)
+			var datastoreURLs []string
+			for _, datastore := range datastores {
+				datastoresByURL[datastore.Info.Url] = datastore
+				datastoreURLs = append(datastoreURLs, datastore.Info.Url)
+			}
+			datastoreURL, releaseDatastore, err := c.provisioning.acquireAny(ctx, "CreateVolume "+req.Name, datastoreURLs)
+			if err != nil {
+				return nil, err
+			}
+			release = releaseDatastore
+			return datastoresByURL[datastoreURL], nil
+		}
+	} else {
+		// Datastore cluster members and host-local datastores are selected by CreateVolumeUtil, and
+		// CNS chooses among several shared datastores if they are not limited, so these operations
+		// are queued by the empty URL and only subject to the total limit
+		release, err = c.provisioning.acquire(ctx, "CreateVolume "+req.Name, provisioningDatastoreURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	volumeID, vcenter, err := common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, sharedDatastores)
+	release()
 	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			// The operation was aborted waiting for its datastore
+			return nil, err
+		}
 		msg := fmt.Sprintf("Failed to create volume. Error: %+v", err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(faultCode(err), msg)
 	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeString
-	attributes[common.AttributeFsType] = fsType
+	if common.IsBlockVolumeRequest(req.GetVolumeCapabilities()) {
+		// Raw block volumes are never formatted, so fsType is not passed on to the node
+		if fsType != "" {
+			klog.V(2).Infof("Ignoring fsType: %q for volume: %s requested with block access type", fsType, volumeID)
+		}
+	} else {
+		if fsType == "" {
+			// Use the driver level default fsType, if configured
+			fsType = c.manager.GetCnsConfig().Global.DefaultFsType
+		}
+		attributes[common.AttributeFsType] = fsType
+		if mkfsOptions != "" {
+			attributes[common.AttributeMkfsOptions] = mkfsOptions
+		}
+		if luksEncryption {
+			attributes[common.AttributeLuksEncryption] = "true"
+		}
+		if createVolumeSpec.DatastoreType == cnsvsphere.PmemDatastoreType {
+			// Tells the node to mount the filesystem with DAX, if the device supports it
+			attributes[common.AttributePmem] = "true"
+		}
+	}
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
@@ -212,25 +467,56 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	}
 	// Call QueryVolume API and get the datastoreURL of the Provisioned Volume
 	var volumeAccessibleTopology = make(map[string]string)
-	if len(datastoreTopologyMap) > 0 {
-		volumeIds := []cnstypes.CnsVolumeId{{Id: volumeID}}
-		queryFilter := cnstypes.CnsQueryFilter{
-			VolumeIds: volumeIds,
+	volumeIds := []cnstypes.CnsVolumeId{{Id: volumeID}}
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: volumeIds,
+	}
+	queryResult, err := common.GetVolumeManager(c.manager, vcenter.Config.Host).QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volumeID: %s. err: %+v", volumeID, err)
+		if len(datastoreTopologyMap) > 0 || csiMigration {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		queryResult = &cnstypes.CnsQueryResult{}
+	}
+	if len(queryResult.Volumes) > 0 {
+		// The FCD, its datastore and vCenter are recorded in the PV for backup tools, if known
+		attributes[common.AttributeFcdID] = volumeID
+		attributes[common.AttributeVcenterUUID] = vcenter.Client.ServiceContent.About.InstanceUuid
+		attributes[common.AttributeDatastoreURL] = queryResult.Volumes[0].DatastoreUrl
+	}
+	if common.IsChangedBlockTrackingRequest(req.Parameters) {
+		if err := c.enableChangedBlockTracking(ctx, volumeID, queryResult.Volumes); err != nil {
+			msg := fmt.Sprintf("Failed to enable changed block tracking of volume %s. Error: %+v", volumeID, err)
+			klog.Error(msg)
+			c.deleteCreatedVolume(vcenter.Config.Host, volumeID)
+			return nil, status.Error(codes.Internal, msg)
 		}
-		queryResult, err := c.manager.VolumeManager.QueryVolume(queryFilter)
+	}
+	if len(queryResult.Volumes) > 0 && csiMigration {
+		// Migrated in-tree PVs reference their volume by its VMDK path
+		volumePath, err := c.migration.addVolume(ctx, volumeID, queryResult.Volumes[0].DatastoreUrl)
 		if err != nil {
-			klog.Errorf("QueryVolume failed for volumeID: %s", volumeID)
-			return nil, status.Error(codes.Internal, err.Error())
+			msg := fmt.Sprintf("Failed to get the volume path of volume %s. Error: %+v", volumeID, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
 		}
-		if len(queryResult.Volumes) > 0 {
-			// Find datastore topology from the retrieved datastoreURL
-			datastoreAccessibleTopology := datastoreTopologyMap[queryResult.Volumes[0].DatastoreUrl]
-			klog.V(3).Infof("Volume: %s is provisioned on the datastore: %s ", volumeID, queryResult.Volumes[0].DatastoreUrl)
-			if len(datastoreAccessibleTopology) > 0 {
+		resp.Volume.VolumeId = volumePath
+	}
+	if len(queryResult.Volumes) > 0 && len(datastoreTopologyMap) > 0 {
+		// Find datastore topology from the retrieved datastoreURL
+		datastoreAccessibleTopology := datastoreTopologyMap[queryResult.Volumes[0].DatastoreUrl]
+		klog.V(3).Infof("Volume: %s is provisioned on the datastore: %s ", volumeID, queryResult.Volumes[0].DatastoreUrl)
+		if len(datastoreAccessibleTopology) > 0 {
+			if len(topologyRequirement.GetPreferred()) > 0 {
+				// Topologies are ordered by preference, so pick the most preferred one.
+				// With delayed binding this is the topology of the node selected for the pod.
+				volumeAccessibleTopology = datastoreAccessibleTopology[0]
+			} else {
 				rand.Seed(time.Now().Unix())
 				volumeAccessibleTopology = datastoreAccessibleTopology[rand.Intn(len(datastoreAccessibleTopology))]
-				klog.V(3).Infof("volumeAccessibleTopology: [%+v] is selected for datastore: %s ", volumeAccessibleTopology, queryResult.Volumes[0].DatastoreUrl)
 			}
+			klog.V(3).Infof("volumeAccessibleTopology: [%+v] is selected for datastore: %s ", volumeAccessibleTopology, queryResult.Volumes[0].DatastoreUrl)
 		}
 	}
 	if len(volumeAccessibleTopology) != 0 {
@@ -245,17 +531,56 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 // CreateVolume is deleting CNS Volume specified in DeleteVolumeRequest
 func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
-	klog.V(4).Infof("DeleteVolume: called with args: %+v", *req)
 	var err error
 	err = validateVanillaDeleteVolumeRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
+	start := time.Now()
+	// Operations are keyed on the CNS volume ID, which is also the one of migrated in-tree volumes
+	volumeID, err := c.resolveVolumeID(ctx, req.VolumeId)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to delete volume: %q. Error: %+v", req.VolumeId, err)
+		observeOperation(operationDeleteVolume, start, err)
+		return nil, err
+	}
+	// Deleting a volume which is being attached or detached could leak or destroy its disk
+	_, err = c.operations.doExclusive(ctx, "DeleteVolume/"+volumeID, 0, volumeAttachmentPrefixes(volumeID), func() (interface{}, error) {
+		var datastoreURL string
+		if c.provisioning.limitsDatastores() {
+			datastoreURL = c.getVolumeDatastoreURL(ctx, volumeID)
+		}
+		release, err := c.provisioning.acquire(ctx, "DeleteVolume "+volumeID, datastoreURL)
+		if err != nil {
+			return nil, err
+		}
+		err = common.DeleteVolumeUtil(ctx, c.manager, volumeID, true)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		if volumeID != req.VolumeId {
+			return nil, c.migration.removeVolume(req.VolumeId, volumeID)
+		}
+		return nil, nil
+	})
+	if conflict, ok := err.(*operationConflictError); ok {
+		msg := fmt.Sprintf("Volume %q can not be deleted while operation %q is in progress", req.VolumeId, conflict.key)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		err = status.Error(codes.FailedPrecondition, msg)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			msg := fmt.Sprintf("Failed to delete volume: %q. Error: %+v", req.VolumeId, err)
+			klog.Error(msg)
+			err = status.Errorf(faultCode(err), msg)
+		}
+		observeOperation(operationDeleteVolume, start, err)
+		return nil, err
+	}
+	observeOperation(operationDeleteVolume, start, nil)
+	c.operations.forgetCreatedVolume(req.VolumeId)
+	if c.quota != nil {
+		c.quota.releaseVolume(req.VolumeId)
 	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -265,13 +590,36 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	klog.V(4).Infof("ControllerPublishVolume: called with args %+v", *req)
 	err := validateVanillaControllerPublishVolumeRequest(req)
 	if err != nil {
-		msg := fmt.Sprintf("Validation for PublishVolume Request: %+v has failed. Error: %v", *req, err)
+		klog.Errorf("Validation for PublishVolume Request: %s has failed. Error: %v", logger.Redact(req), err)
+		return nil, err
+	}
+	start := time.Now()
+	volumeID, err := c.resolveVolumeID(ctx, req.VolumeId)
+	if err != nil {
+		observeOperation(operationControllerPublishVolume, start, err)
+		return nil, err
+	}
+	resp, err := c.operations.doExclusive(ctx, "ControllerPublishVolume/"+volumeID+"/"+req.NodeId, 0,
+		[]string{"DeleteVolume/" + volumeID}, func() (interface{}, error) {
+			return c.controllerPublishVolume(ctx, req, volumeID)
+		})
+	if _, ok := err.(*operationConflictError); ok {
+		msg := fmt.Sprintf("Volume %q is being deleted", req.VolumeId)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		err = status.Error(codes.Aborted, msg)
 	}
+	observeOperation(operationControllerPublishVolume, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.ControllerPublishVolumeResponse), nil
+}
+
+// controllerPublishVolume attaches the volume volumeID specified in ControllerPublishVolumeRequest to the Node VM
+func (c *controller) controllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest, volumeID string) (
+	*csi.ControllerPublishVolumeResponse, error) {
 	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
@@ -279,12 +627,62 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		return nil, status.Errorf(codes.Internal, msg)
 	}
 	klog.V(4).Infof("Found VirtualMachine for node:%q.", req.NodeId)
-	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	err = common.RegisterVolumeUtil(ctx, c.manager, node.VirtualCenterHost, volumeID)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
+		msg := fmt.Sprintf("Failed to register disk: %+q with CNS. err %+v", req.VolumeId, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	isEncryptionCompatible, err := common.IsEncryptionCompatibleUtil(ctx, c.manager, node, volumeID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to validate encryption of disk: %+q for node: %q err %+v", req.VolumeId, req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	if !isEncryptionCompatible {
+		msg := fmt.Sprintf("Disk: %+q has an encryption storage policy and can not be attached to node: %q whose VM is not encrypted",
+			req.VolumeId, req.NodeId)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.FailedPrecondition, msg)
+	}
+	isDatastoreAccessible, datastoreURL, err := common.IsDatastoreAccessibleUtil(ctx, c.manager, node, volumeID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to validate datastore accessibility of disk: %+q for node: %q err %+v", req.VolumeId, req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	if !isDatastoreAccessible {
+		msg := fmt.Sprintf("Disk: %+q can not be attached to node: %q, its datastore %s is not accessible from the host of the node VM",
+			req.VolumeId, req.NodeId, datastoreURL)
+		klog.Error(msg)
+		if c.eventRecorder != nil {
+			if k8sNode, err := c.nodeMgr.GetKubernetesNode(req.NodeId); err == nil {
+				c.eventRecorder.Event(k8sNode, v1.EventTypeWarning, datastoreInaccessibleReason, msg)
+			} else {
+				klog.Warningf("Failed to get node %q to record event %s. err=%v", req.NodeId, datastoreInaccessibleReason, err)
+			}
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, msg)
+	}
+	if req.Readonly {
+		// CNS attaches disks in persistent mode only, the node
+		// plugin enforces read-only access by mounting the volume read-only
+		klog.V(4).Infof("Disk: %+q is requested read-only on node: %q, it will be mounted read-only on the node",
+			req.VolumeId, req.NodeId)
+	}
+	// The sharing mode of a disk can not be changed while it is attached to a powered on VM,
+	// so multi-writer disks are attached with the sharing mode instead of through CNS
+	var diskUUID string
+	if common.IsMultiWriterBlockVolume(req.GetVolumeCapability()) {
+		diskUUID, err = common.AttachMultiWriterVolumeUtil(ctx, c.manager, node, volumeID, datastoreURL)
+	} else {
+		diskUUID, err = common.AttachVolumeUtil(ctx, c.manager, node, volumeID)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(faultCode(err), msg)
+	}
 	publishInfo := make(map[string]string)
 	publishInfo[common.AttributeDiskType] = common.DiskTypeString
 	publishInfo[common.AttributeFirstClassDiskUUID] = common.FormatDiskUUID(diskUUID)
@@ -299,34 +697,130 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (
 	*csi.ControllerUnpublishVolumeResponse, error) {
 
-	klog.V(4).Infof("ControllerUnpublishVolume: called with args %+v", *req)
 	err := validateVanillaControllerUnpublishVolumeRequest(req)
 	if err != nil {
-		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %+v has failed. Error: %v", *req, err)
+		msg := fmt.Sprintf("Validation for UnpublishVolume Request: %s has failed. Error: %v", logger.Redact(req), err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	start := time.Now()
+	volumeID, err := c.resolveVolumeID(ctx, req.VolumeId)
+	if err != nil {
+		observeOperation(operationControllerUnpublishVolume, start, err)
+		return nil, err
+	}
+	resp, err := c.operations.do(ctx, "ControllerUnpublishVolume/"+volumeID+"/"+req.NodeId, 0, func() (interface{}, error) {
+		return c.controllerUnpublishVolume(ctx, req, volumeID)
+	})
+	observeOperation(operationControllerUnpublishVolume, start, err)
 	if err != nil {
+		return nil, err
+	}
+	return resp.(*csi.ControllerUnpublishVolumeResponse), nil
+}
+
+// controllerUnpublishVolume detaches the volume volumeID specified in ControllerUnpublishVolumeRequest from the Node VM
+func (c *controller) controllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest, volumeID string) (
+	*csi.ControllerUnpublishVolumeResponse, error) {
+	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	if err == cnsnode.ErrNodeNotFound {
+		// The VM of a deleted node may outlive it with the volume attached
+		node, err = c.nodeMgr.GetDeletedNodeByName(req.NodeId)
+	}
+	// A VM which is not found by its UUID may only be missing from the search index, the
+	// volume is only considered detached once the detach confirms that the VM is gone
+	if err == cnsnode.ErrNodeNotFound {
+		// The node may not be registered yet, or the VM of the deleted node is not found by
+		// its name, the detach is retried
+		msg := fmt.Sprintf("Node %q is not registered and its VM is not found, failed to detach volume %q", req.NodeId, req.VolumeId)
+		klog.Error(msg)
+		return nil, status.Error(codes.Unavailable, msg)
+	} else if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	err = common.DetachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	err = common.DetachVolumeUtil(ctx, c.manager, node, volumeID)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to detach disk: %+q from node: %q err %+v", req.VolumeId, req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(faultCode(err), msg)
 	}
 	resp := &csi.ControllerUnpublishVolumeResponse{}
 	return resp, nil
 }
 
+// volumeAttachmentPrefixes returns the operation key prefixes of the attaches and detaches of volumeID
+func volumeAttachmentPrefixes(volumeID string) []string {
+	return []string{"ControllerPublishVolume/" + volumeID + "/", "ControllerUnpublishVolume/" + volumeID + "/"}
+}
+
+// resolveVolumeID returns the CNS volume ID of volumeID, which is the VMDK path of
+// migrated in-tree volumes and the volume ID of all other volumes.
+func (c *controller) resolveVolumeID(ctx context.Context, volumeID string) (string, error) {
+	if !common.IsVolumePath(volumeID) {
+		return volumeID, nil
+	}
+	if c.migration == nil {
+		msg := fmt.Sprintf("Volume %q is an in-tree vSphere volume, but CSI migration is not enabled", volumeID)
+		klog.Error(msg)
+		return "", status.Error(codes.InvalidArgument, msg)
+	}
+	resolvedVolumeID, err := c.migration.getVolumeID(ctx, volumeID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to register in-tree volume %q. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return "", status.Errorf(faultCode(err), msg)
+	}
+	return resolvedVolumeID, nil
+}
+
+// deleteCreatedVolume deletes the volume volumeID just created on the vCenter host, which
+// CreateVolume fails to return. CreateVolume is not idempotent by name, so the volume would
+// leak when it is retried.
+func (c *controller) deleteCreatedVolume(host string, volumeID string) {
+	if err := common.GetVolumeManager(c.manager, host).DeleteVolume(volumeID, true); err != nil {
+		klog.Errorf("Failed to delete volume %s of the failed CreateVolume, the volume is leaked. Error: %+v", volumeID, err)
+		return
+	}
+	klog.V(2).Infof("Deleted volume %s of the failed CreateVolume", volumeID)
+}
+
+// enableChangedBlockTracking enables changed block tracking on the First Class Disk of the
+// volume volumeID, whose query result is volumes
+func (c *controller) enableChangedBlockTracking(ctx context.Context, volumeID string, volumes []cnstypes.CnsVolume) error {
+	if len(volumes) == 0 {
+		return fmt.Errorf("volume %s is not found", volumeID)
+	}
+	datastore, err := getDatastoreByURL(ctx, c.manager, volumes[0].DatastoreUrl)
+	if err != nil {
+		return err
+	}
+	return datastore.EnableChangedBlockTracking(ctx, volumeID)
+}
+
+// getVolumeDatastoreURL returns the URL of the datastore of the CNS volume volumeID,
+// or "" if the volume can not be queried
+func (c *controller) getVolumeDatastoreURL(ctx context.Context, volumeID string) string {
+	volumeManager, err := common.GetVolumeManagerForVolume(ctx, c.manager, volumeID)
+	if err != nil {
+		klog.Warningf("Failed to get the volume manager of volume %s. Error: %+v", volumeID, err)
+		return ""
+	}
+	queryResult, err := volumeManager.QueryVolume(cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	})
+	if err != nil || len(queryResult.Volumes) == 0 {
+		klog.Warningf("Failed to get the datastore of volume %s. Error: %+v", volumeID, err)
+		return ""
+	}
+	return queryResult.Volumes[0].DatastoreUrl
+}
+
 // ValidateVolumeCapabilities returns the capabilities of the volume.
 func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
-	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
 	volCaps := req.GetVolumeCapabilities()
 	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
 	if common.IsValidVolumeCapabilities(volCaps) {
@@ -340,21 +834,69 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	klog.V(4).Infof("ListVolumes: called with args %+v", *req)
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// GetCapacity returns the capacity available for new volumes in the topology
+// segment and with the parameters specified in GetCapacityRequest
 func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	klog.V(4).Infof("GetCapacity: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+	err := validateVanillaGetCapacityRequest(req)
+	if err != nil {
+		klog.Errorf("Failed to validate GetCapacity Request with err: %v", err)
+		return nil, err
+	}
+	var spec common.CreateVolumeSpec
+	for paramName, paramValue := range req.Parameters {
+		switch strings.ToLower(paramName) {
+		case common.AttributeDatastoreURL:
+			spec.DatastoreURL = paramValue
+		case common.AttributeDatastoreClusterName:
+			spec.DatastoreClusterName = paramValue
+		case common.AttributeStoragePolicyName:
+			spec.StoragePolicyName = paramValue
+		case common.AttributeStoragePolicyID:
+			spec.StoragePolicyID = paramValue
+		}
+	}
+	spec.DatastoreType = common.GetDatastoreType(req.Parameters)
+	spec.SharedDatastoreTypes = common.GetSharedDatastoreTypes(req.Parameters)
+	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	if req.GetAccessibleTopology() != nil {
+		cfg := c.manager.GetCnsConfig()
+		if !isTopologyAware(cfg) {
+			errMsg := fmt.Sprintf("Zone/Region vsphere category names not specified in the vsphere config secret")
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.NotFound, errMsg)
+		}
+		topologyRequirement := &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{req.GetAccessibleTopology()},
+		}
+		sharedDatastores, _, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, cfg.Labels.Zone, cfg.Labels.Region)
+	} else {
+		sharedDatastores, err = c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get shared datastores. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	capacity, err := common.GetCapacityUtil(ctx, c.manager, &spec, sharedDatastores)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get capacity. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	klog.V(4).Infof("GetCapacity: available capacity is %d bytes", capacity)
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+	}, nil
 }
 
 func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
 	var caps []*csi.ControllerServiceCapability
 	for _, cap := range controllerCaps {
 		c := &csi.ControllerServiceCapability{
@@ -372,20 +914,17 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 
-	klog.V(4).Infof("CreateSnapshot: called with args %+v", *req)
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
 	*csi.DeleteSnapshotResponse, error) {
 
-	klog.V(4).Infof("DeleteSnapshot: called with args %+v", *req)
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
 	*csi.ListSnapshotsResponse, error) {
 
-	klog.V(4).Infof("ListSnapshots: called with args %+v", *req)
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -18,12 +18,15 @@ package cns
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
@@ -31,16 +34,72 @@ import (
 // CreateVolumeRequest for Vanilla CSI driver.
 // Function returns error if validation fails otherwise returns nil.
 func validateVanillaCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
-	// Get create params
+	params := req.GetParameters()
+	if err := common.ValidateVolumeParameters(params); err != nil {
+		return err
+	}
+	for paramName, paramValue := range params {
+		// Raw block volumes are never staged, so there is no node layer to encrypt them
+		if strings.ToLower(paramName) != common.AttributeLuksEncryption || !common.IsBlockVolumeRequest(req.GetVolumeCapabilities()) {
+			continue
+		}
+		if luksEncryption, _ := strconv.ParseBool(paramValue); luksEncryption {
+			msg := fmt.Sprintf("Volume parameter %s is not supported for volumes with block access type.", common.AttributeLuksEncryption)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+	}
+	// fsType from csi.storage.k8s.io/fstype is passed in the mount volume capability
+	for _, volCap := range req.GetVolumeCapabilities() {
+		if fsType := volCap.GetMount().GetFsType(); fsType != "" && !common.IsValidFsType(fsType) {
+			msg := fmt.Sprintf("fsType %q in volume capability is not supported. Supported fsTypes: %v", fsType, common.SupportedFsTypes)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+		// StorageClass mountOptions are passed in the mount volume capability
+		if err := common.ValidateMountFlags(volCap.GetMount().GetMountFlags()); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	// CNS does not support snapshots, so there is no snapshot to restore from or to
+	// clone and relocate to a different storage policy or datastore
+	if req.GetVolumeContentSource() != nil {
+		msg := "Creating a volume from a snapshot or another volume is not supported."
+		return status.Error(codes.Unimplemented, msg)
+	}
+	// ReadWriteMany and ReadOnlyMany filesystem volumes need a vSAN file share,
+	// which can not be provisioned through the CNS client in use
+	if common.IsFileVolumeRequest(req.GetVolumeCapabilities()) {
+		msg := fmt.Sprintf("File volumes of type %q with multi-node access modes are not supported.", common.FileVolumeType)
+		return status.Error(codes.Unimplemented, msg)
+	}
+	return common.ValidateCreateVolumeRequest(req)
+}
+
+// validateVanillaGetCapacityRequest is the helper function to validate
+// GetCapacityRequest for Vanilla CSI driver.
+// Function returns error if validation fails otherwise returns nil.
+func validateVanillaGetCapacityRequest(req *csi.GetCapacityRequest) error {
 	params := req.GetParameters()
 	for paramName := range params {
 		paramName = strings.ToLower(paramName)
-		if paramName != common.AttributeDatastoreURL && paramName != common.AttributeStoragePolicyName && paramName != common.AttributeFsType {
+		if paramName != common.AttributeDatastoreURL && paramName != common.AttributeDatastoreClusterName &&
+			paramName != common.AttributeStoragePolicyName && paramName != common.AttributeStoragePolicyID &&
+			paramName != common.AttributeSiteAffinity && paramName != common.AttributeFsType {
 			msg := fmt.Sprintf("Volume parameter %s is not a valid Vanilla CSI parameter.", paramName)
 			return status.Error(codes.InvalidArgument, msg)
 		}
 	}
-	return common.ValidateCreateVolumeRequest(req)
+	if common.HasParameter(params, common.AttributeStoragePolicyName) && common.HasParameter(params, common.AttributeStoragePolicyID) {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", common.AttributeStoragePolicyName, common.AttributeStoragePolicyID)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if common.HasParameter(params, common.AttributeDatastoreURL) && common.HasParameter(params, common.AttributeDatastoreClusterName) {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", common.AttributeDatastoreURL, common.AttributeDatastoreClusterName)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if len(req.GetVolumeCapabilities()) > 0 && !common.IsValidVolumeCapabilities(req.GetVolumeCapabilities()) {
+		return status.Error(codes.InvalidArgument, "Volume capabilities not supported")
+	}
+	return nil
 }
 
 // validateVanillaDeleteVolumeRequest is the helper function to validate
@@ -54,7 +113,16 @@ func validateVanillaDeleteVolumeRequest(req *csi.DeleteVolumeRequest) error {
 // validateControllerPublishVolumeRequest is the helper function to validate
 // ControllerPublishVolumeRequest. Function returns error if validation fails otherwise returns nil.
 func validateVanillaControllerPublishVolumeRequest(req *csi.ControllerPublishVolumeRequest) error {
-	return common.ValidateControllerPublishVolumeRequest(req)
+	if err := common.ValidateControllerPublishVolumeRequest(req); err != nil {
+		return err
+	}
+	// Statically provisioned PVs must reference the volume by its First Class Disk ID,
+	// migrated in-tree PVs reference it by the path of its VMDK
+	if !common.IsValidVolumeID(req.VolumeId) && !common.IsVolumePath(req.VolumeId) {
+		msg := fmt.Sprintf("Volume ID %q is not a valid First Class Disk ID or VMDK path", req.VolumeId)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
 }
 
 // validateControllerUnpublishVolumeRequest is the helper function to validate
@@ -62,3 +130,32 @@ func validateVanillaControllerPublishVolumeRequest(req *csi.ControllerPublishVol
 func validateVanillaControllerUnpublishVolumeRequest(req *csi.ControllerUnpublishVolumeRequest) error {
 	return common.ValidateControllerUnpublishVolumeRequest(req)
 }
+
+// faultCode returns the gRPC code of err. Operations which failed with a fault of
+// CNS or vCenter get a code which tells the sidecars whether to retry them, volumes
+// whose StorageClass parameters can not be satisfied are invalid arguments and all
+// other errors are internal.
+func faultCode(err error) codes.Code {
+	if _, ok := err.(*common.InvalidParametersError); ok {
+		return codes.InvalidArgument
+	}
+	faultErr, ok := err.(*cnsvolume.FaultError)
+	if !ok {
+		return codes.Internal
+	}
+	switch faultErr.FaultType {
+	case "NoDiskSpace", "InsufficientStorageSpace":
+		return codes.ResourceExhausted
+	case "InaccessibleDatastore", "DatastoreNotWritableOnHost", "HostNotConnected", "HostNotReachable":
+		return codes.Unavailable
+	case "NoPermission":
+		return codes.PermissionDenied
+	}
+	return codes.Internal
+}
+
+// isTopologyAware returns true if volumes are provisioned in the topology of their nodes, which
+// requires either the zone and region tag categories or the host-local topology
+func isTopologyAware(cfg *config.Config) bool {
+	return (cfg.Labels.Zone != "" && cfg.Labels.Region != "") || cfg.Global.HostLocalTopology
+}
@@ -19,11 +19,17 @@ package cns
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
@@ -31,12 +37,25 @@ import (
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/simulator"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	clientset "k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
+	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
@@ -47,6 +66,10 @@ import (
 const (
 	testVolumeName  = "test-volume"
 	testClusterName = "test-cluster"
+	// missingVMNodeName is the name of a node whose VM the FakeNodeManager does not find
+	missingVMNodeName = "missing-vm-node"
+	// deletedVMNodeName is the name of a node whose VM the FakeNodeManager returns after it was deleted
+	deletedVMNodeName = "deleted-vm-node"
 )
 
 type FakeNodeManager struct {
@@ -101,7 +124,7 @@ func (f *FakeNodeManager) GetSharedDatastoresInK8SCluster(ctx context.Context) (
 	return []*cnsvsphere.DatastoreInfo{
 		{
 			Datastore: &cnsvsphere.Datastore{
-				Datastore:  object.NewDatastore(nil, sharedDatastoreManagedObject.Reference()),
+				Datastore:  object.NewDatastore(f.client, sharedDatastoreManagedObject.Reference()),
 				Datacenter: nil},
 			Info: sharedDatastoreManagedObject.Info.GetDatastoreInfo(),
 		},
@@ -109,6 +132,9 @@ func (f *FakeNodeManager) GetSharedDatastoresInK8SCluster(ctx context.Context) (
 }
 
 func (f *FakeNodeManager) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error) {
+	if nodeName == missingVMNodeName {
+		return nil, cnsvsphere.ErrVMNotFound
+	}
 	var vm *cnsvsphere.VirtualMachine
 	if v := os.Getenv("VSPHERE_DATACENTER"); v != "" {
 		nodeUUID, err := k8s.GetNodeVMUUID(f.k8sClient, nodeName)
@@ -121,6 +147,17 @@ func (f *FakeNodeManager) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMac
 			klog.Errorf("Couldn't find VM instance with nodeUUID %s, failed to discover with err: %v", nodeUUID, err)
 			return nil, err
 		}
+	} else if simVM := findSimulatedVM(nodeName); simVM != nil {
+		// Simulated VMs are found by name, with their datacenter, as disks are attached to them
+		dc := simulator.Map.Any("Datacenter").(*simulator.Datacenter)
+		vm = &cnsvsphere.VirtualMachine{
+			VirtualMachine: object.NewVirtualMachine(f.client, simVM.Reference()),
+			Datacenter:     &cnsvsphere.Datacenter{Datacenter: object.NewDatacenter(f.client, dc.Reference())},
+		}
+	} else if nodeName == deletedVMNodeName {
+		vm = &cnsvsphere.VirtualMachine{
+			VirtualMachine: object.NewVirtualMachine(f.client, types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-deleted"}),
+		}
 	} else {
 		obj := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
 		vm = &cnsvsphere.VirtualMachine{
@@ -130,6 +167,24 @@ func (f *FakeNodeManager) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMac
 	return vm, nil
 }
 
+// findSimulatedVM returns the simulated VM named name, or nil if there is none
+func findSimulatedVM(name string) *simulator.VirtualMachine {
+	for _, entity := range simulator.Map.All("VirtualMachine") {
+		if simVM := entity.(*simulator.VirtualMachine); simVM.Name == name {
+			return simVM
+		}
+	}
+	return nil
+}
+
+func (f *FakeNodeManager) GetDeletedNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error) {
+	return nil, cnsnode.ErrNodeNotFound
+}
+
+func (f *FakeNodeManager) GetKubernetesNode(nodeName string) (*v1.Node, error) {
+	return f.k8sClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+}
+
 func (f *FakeNodeManager) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
 	return nil, nil, nil
 }
@@ -194,7 +249,8 @@ func getControllerTest(t *testing.T) *controllerTest {
 		}
 
 		c := &controller{
-			manager: manager,
+			manager:    manager,
+			operations: newOperationStore(),
 			nodeMgr: &FakeNodeManager{
 				client:             vcenter.Client.Client,
 				sharedDatastoreURL: sharedDatastoreURL,
@@ -281,6 +337,14 @@ func TestCreateVolumeWithStoragePolicy(t *testing.T) {
 		t.Fatalf("Failed to match volume policy ID: %s", profileID)
 	}
 
+	// The volume context locates the volume for backup tools
+	volumeContext := respCreate.Volume.VolumeContext
+	if volumeContext[common.AttributeFcdID] != volID ||
+		volumeContext[common.AttributeDatastoreURL] != queryResult.Volumes[0].DatastoreUrl ||
+		volumeContext[common.AttributeVcenterUUID] != ct.vcenter.Client.ServiceContent.About.InstanceUuid {
+		t.Fatalf("Unexpected volume context: %+v", volumeContext)
+	}
+
 	// QueryAll
 	queryFilter = cnstypes.CnsQueryFilter{
 		VolumeIds: []cnstypes.CnsVolumeId{
@@ -442,3 +506,1755 @@ func TestCompleteControllerFlow(t *testing.T) {
 		t.Fatalf("Volume should not exist after deletion with ID: %s", volID)
 	}
 }
+
+func TestCreateBlockVolume(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// Create
+	params := make(map[string]string)
+	if v := os.Getenv("VSPHERE_DATASTORE_URL"); v != "" {
+		params[common.AttributeDatastoreURL] = v
+	}
+	params[common.AttributeFsType] = common.DefaultFsType
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+	if fsType, ok := respCreate.Volume.VolumeContext[common.AttributeFsType]; ok {
+		t.Fatalf("fsType: %q should not be set in VolumeContext for block volume with ID: %s", fsType, volID)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateFileVolumeNotSupported(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         make(map[string]string),
+		VolumeCapabilities: capabilities,
+	}
+
+	failures := operations.WithLabelValues(operationCreateVolume, operationFailed, codes.Unimplemented.String())
+	failuresBefore := testutil.ToFloat64(failures)
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected CreateVolume for file volume to fail with %v, got err: %v", codes.Unimplemented, err)
+	}
+	if diff := testutil.ToFloat64(failures) - failuresBefore; diff != 1 {
+		t.Fatalf("Expected 1 failed CreateVolume to be counted, got %v", diff)
+	}
+}
+
+func TestCreateMultiWriterBlockVolume(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// Create
+	params := make(map[string]string)
+	if v := os.Getenv("VSPHERE_DATASTORE_URL"); v != "" {
+		params[common.AttributeDatastoreURL] = v
+	}
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		return
+	}
+
+	// The volumes of the CNS simulator are not backed by First Class Disks, so a disk is
+	// created by the vStorage object manager and registered with CNS to be attached
+	volID, cleanup := createSimulatedFirstClassDisk(ctx, t, ct, "multi-writer")
+	defer cleanup()
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+			t.Error(err)
+		}
+	}()
+	nodes := []string{"DC0_H0_VM0", "DC0_H0_VM1"}
+	diskUUIDs := make(map[string]bool)
+	for _, node := range nodes {
+		respPublish, err := ct.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volID,
+			NodeId:           node,
+			VolumeCapability: capabilities[0],
+		})
+		if err != nil {
+			t.Fatalf("Expected multi-writer volume %s to be attached to node %s, got err: %v", volID, node, err)
+		}
+		diskUUIDs[respPublish.PublishContext[common.AttributeFirstClassDiskUUID]] = true
+	}
+	if len(diskUUIDs) != 1 {
+		t.Fatalf("Expected nodes %v to be attached the same disk, got disk UUIDs %v", nodes, diskUUIDs)
+	}
+	for _, node := range nodes {
+		vm, err := ct.controller.nodeMgr.GetNodeByName(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices, err := vm.Device(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attached *types.VirtualDisk
+		for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+			if disk := device.(*types.VirtualDisk); disk.VDiskId != nil && disk.VDiskId.Id == volID {
+				attached = disk
+			}
+		}
+		if attached == nil {
+			t.Fatalf("Expected volume %s to be attached to node %s", volID, node)
+		}
+		// The simulated CNS does not know about the attachment, so the disk is detached from the VM
+		defer func() {
+			if err := vm.RemoveDevice(ctx, true, attached); err != nil {
+				t.Error(err)
+			}
+		}()
+		if sharing := attached.Backing.(*types.VirtualDiskFlatVer2BackingInfo).Sharing; sharing != string(types.VirtualDiskSharingSharingMultiWriter) {
+			t.Fatalf("Expected volume %s to be attached to node %s with sharing mode %s, got %q",
+				volID, node, types.VirtualDiskSharingSharingMultiWriter, sharing)
+		}
+	}
+}
+
+// fcdDiskIDs sets the First Class Disk ID of the disks added to simulated VMs, which vcsim leaves
+// unset, to the ID of the First Class Disk whose file backs them
+type fcdDiskIDs struct {
+	ref types.ManagedObjectReference
+	// files maps the files of First Class Disks to their IDs
+	files sync.Map
+}
+
+func (h *fcdDiskIDs) Reference() types.ManagedObjectReference {
+	return h.ref
+}
+
+func (h *fcdDiskIDs) PutObject(mo.Reference) {}
+
+func (h *fcdDiskIDs) RemoveObject(types.ManagedObjectReference) {}
+
+func (h *fcdDiskIDs) UpdateObject(obj mo.Reference, changes []types.PropertyChange) {
+	vm, ok := obj.(*mo.VirtualMachine)
+	if !ok || vm.Config == nil {
+		return
+	}
+	for _, device := range vm.Config.Hardware.Device {
+		disk, ok := device.(*types.VirtualDisk)
+		if !ok || disk.VDiskId != nil {
+			continue
+		}
+		backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if !ok {
+			continue
+		}
+		if id, ok := h.files.Load(backing.FileName); ok {
+			disk.VDiskId = &types.ID{Id: id.(string)}
+			backing.Uuid = strings.ToUpper(strings.Replace(id.(string), "-", "", -1))
+		}
+	}
+}
+
+var (
+	onceForFCDDiskIDs sync.Once
+	fcdDiskIDsHandler = &fcdDiskIDs{ref: types.ManagedObjectReference{Type: "fcdDiskIDs", Value: "fcdDiskIDs"}}
+)
+
+// createSimulatedFirstClassDisk creates a First Class Disk named name on the datastore the CNS
+// simulator registers volumes on, registers it with CNS, and returns its volume ID and the function
+// removing its file. The directory of the datastore is created as well, as config.FromEnvOrSim
+// removes it once vcsim is set up.
+func createSimulatedFirstClassDisk(ctx context.Context, t *testing.T, ct *controllerTest, name string) (string, func()) {
+	onceForFCDDiskIDs.Do(func() {
+		simulator.Map.AddHandler(fcdDiskIDsHandler)
+	})
+	datastore := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	datastoreDir := datastore.Info.GetDatastoreInfo().Url
+	if err := os.MkdirAll(datastoreDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(datastoreDir) }
+	task, err := vslm.NewObjectManager(ct.vcenter.Client.Client).CreateDisk(ctx, types.VslmCreateSpec{
+		Name:         name,
+		CapacityInMB: 1024,
+		BackingSpec: &types.VslmCreateSpecDiskFileBackingSpec{
+			VslmCreateSpecBackingSpec: types.VslmCreateSpecBackingSpec{Datastore: datastore.Reference()},
+			ProvisioningType:          string(types.BaseConfigInfoDiskFileBackingInfoProvisioningTypeThin),
+		},
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	result, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	disk := result.Result.(types.VStorageObject)
+	backing := disk.Config.Backing.(*types.BaseConfigInfoDiskFileBackingInfo)
+	fcdDiskIDsHandler.files.Store(backing.FilePath, disk.Config.Id.Id)
+	if err := common.RegisterVolumeUtil(ctx, ct.controller.manager, ct.vcenter.Config.Host, disk.Config.Id.Id); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return disk.Config.Id.Id, cleanup
+}
+
+func TestCreateVolumeFromSnapshotNotSupported(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         make(map[string]string),
+		VolumeCapabilities: capabilities,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: "test-snapshot",
+				},
+			},
+		},
+	}
+
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected CreateVolume from snapshot to fail with %v, got err: %v", codes.Unimplemented, err)
+	}
+}
+
+func TestCreateVolumeWithDatastoreURLAndStoragePolicy(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// Create
+	params := make(map[string]string)
+	params[common.AttributeDatastoreURL] = ct.controller.nodeMgr.(*FakeNodeManager).sharedDatastoreURL
+	// PBM simulator defaults
+	params[common.AttributeStoragePolicyName] = "vSAN Default Storage Policy"
+	if v := os.Getenv("VSPHERE_STORAGE_POLICY_NAME"); v != "" {
+		params[common.AttributeStoragePolicyName] = v
+	}
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	// Varify the volume has been created on the specified datastore
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{
+			{
+				Id: volID,
+			},
+		},
+	}
+	queryResult, err := ct.vcenter.CnsClient.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResult.Volumes) != 1 || queryResult.Volumes[0].DatastoreUrl != params[common.AttributeDatastoreURL] {
+		t.Fatalf("Failed to find the newly created volume with ID: %s on datastore: %s", volID, params[common.AttributeDatastoreURL])
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeOnDeniedDatastore(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	sharedDatastoreURL := ct.controller.nodeMgr.(*FakeNodeManager).sharedDatastoreURL
+	ct.config.Global.DeniedDatastores = sharedDatastoreURL
+	defer func() {
+		ct.config.Global.DeniedDatastores = ""
+	}()
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	// Create without datastoreURL, the only shared datastore is denied
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         make(map[string]string),
+		VolumeCapabilities: capabilities,
+	}
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatalf("Expected CreateVolume to fail when all shared datastores are denied")
+	}
+
+	// Create with datastoreURL of the denied datastore
+	reqCreate.Parameters[common.AttributeDatastoreURL] = sharedDatastoreURL
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatalf("Expected CreateVolume to fail for denied datastore: %s", sharedDatastoreURL)
+	}
+}
+
+func TestCreateVolumeWithUnsupportedFsType(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// fsType in StorageClass parameters
+	params := make(map[string]string)
+	params[common.AttributeFsType] = "ntfs"
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with fsType parameter %q to fail with %v, got err: %v", params[common.AttributeFsType], codes.InvalidArgument, err)
+	}
+
+	// fsType in mount volume capability
+	reqCreate.Parameters = make(map[string]string)
+	reqCreate.VolumeCapabilities = []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType: "ntfs",
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	_, err = ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with fsType %q in volume capability to fail with %v, got err: %v", "ntfs", codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeWithStoragePolicyID(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// PBM simulator defaults
+	storagePolicyName := "vSAN Default Storage Policy"
+	if v := os.Getenv("VSPHERE_STORAGE_POLICY_NAME"); v != "" {
+		storagePolicyName = v
+	}
+	if err := ct.vcenter.ConnectPbm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	storagePolicyID, err := ct.vcenter.GetStoragePolicyIDByName(ctx, storagePolicyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create
+	params := make(map[string]string)
+	params[common.AttributeStoragePolicyID] = storagePolicyID
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// storagePolicyName and storagePolicyID are mutually exclusive
+	params[common.AttributeStoragePolicyName] = storagePolicyName
+	_, err = ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with both %s and %s to fail with %v, got err: %v",
+			common.AttributeStoragePolicyName, common.AttributeStoragePolicyID, codes.InvalidArgument, err)
+	}
+}
+
+func TestCreateVolumeWithSameName(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         make(map[string]string),
+		VolumeCapabilities: capabilities,
+	}
+
+	// Concurrent requests with the same name share a single volume
+	var wg sync.WaitGroup
+	volIDs := make([]string, 3)
+	errs := make([]error, 3)
+	for i := range volIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			volIDs[i] = respCreate.Volume.VolumeId
+		}(i)
+	}
+	wg.Wait()
+	for i := range volIDs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if volIDs[i] != volIDs[0] {
+			t.Fatalf("Expected concurrent CreateVolume requests to return volume %s, got %s", volIDs[0], volIDs[i])
+		}
+	}
+
+	// A retry after the volume has been created returns the same volume
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCreate.Volume.VolumeId != volIDs[0] {
+		t.Fatalf("Expected retried CreateVolume to return volume %s, got %s", volIDs[0], respCreate.Volume.VolumeId)
+	}
+	// The secrets of a retry may differ
+	reqRetry := *reqCreate
+	reqRetry.Secrets = map[string]string{"key": "value"}
+	if _, err = ct.controller.CreateVolume(ctx, &reqRetry); err != nil {
+		t.Fatal(err)
+	}
+	// A request for a different volume with the same name fails
+	reqLarger := *reqCreate
+	reqLarger.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 * common.GbInBytes}
+	if _, err = ct.controller.CreateVolume(ctx, &reqLarger); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected CreateVolume with a different capacity to fail with %v, got err: %v", codes.AlreadyExists, err)
+	}
+	reqReadOnly := *reqCreate
+	reqReadOnly.VolumeCapabilities = []*csi.VolumeCapability{{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+	}}
+	if _, err = ct.controller.CreateVolume(ctx, &reqReadOnly); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected CreateVolume with different capabilities to fail with %v, got err: %v", codes.AlreadyExists, err)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volIDs[0],
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeWithLongName(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName + "/" + strings.Repeat("a", 2*common.MaxVolumeNameLength),
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         make(map[string]string),
+		VolumeCapabilities: capabilities,
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	// Verify the volume name is sanitized
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{
+			{
+				Id: volID,
+			},
+		},
+	}
+	queryResult, err := ct.vcenter.CnsClient.QueryVolume(ctx, queryFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResult.Volumes) != 1 {
+		t.Fatalf("Failed to find the newly created volume with ID: %s", volID)
+	}
+	if name := queryResult.Volumes[0].Name; name != common.SanitizeVolumeName(reqCreate.Name) ||
+		len(name) > common.MaxVolumeNameLength || strings.Contains(name, "/") {
+		t.Fatalf("Volume name %q is not sanitized", name)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	sharedDatastores, err := ct.controller.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqCapacity := &csi.GetCapacityRequest{
+		Parameters: make(map[string]string),
+	}
+	respCapacity, err := ct.controller.GetCapacity(ctx, reqCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCapacity.AvailableCapacity != sharedDatastores[0].Info.FreeSpace {
+		t.Fatalf("Expected available capacity %d, got %d", sharedDatastores[0].Info.FreeSpace, respCapacity.AvailableCapacity)
+	}
+
+	// No capacity is available on denied datastores
+	ct.config.Global.DeniedDatastores = sharedDatastores[0].Info.Url
+	defer func() {
+		ct.config.Global.DeniedDatastores = ""
+	}()
+	respCapacity, err = ct.controller.GetCapacity(ctx, reqCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCapacity.AvailableCapacity != 0 {
+		t.Fatalf("Expected no available capacity on denied datastore, got %d", respCapacity.AvailableCapacity)
+	}
+	ct.config.Global.DeniedDatastores = ""
+
+	// With the host-local topology, no capacity is available on host-local datastores
+	// unless vSAN Direct or PMem datastores are requested
+	if os.Getenv("VSPHERE_DATACENTER") == "" {
+		ct.config.Global.HostLocalTopology = true
+		defer func() {
+			ct.config.Global.HostLocalTopology = false
+		}()
+		ds := simulator.Map.Get(sharedDatastores[0].Reference()).(*simulator.Datastore)
+		multipleHostAccess := ds.Summary.MultipleHostAccess
+		ds.Summary.MultipleHostAccess = types.NewBool(false)
+		defer func() { ds.Summary.MultipleHostAccess = multipleHostAccess }()
+		respCapacity, err = ct.controller.GetCapacity(ctx, reqCapacity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if respCapacity.AvailableCapacity != 0 {
+			t.Fatalf("Expected no available capacity on host-local datastore, got %d", respCapacity.AvailableCapacity)
+		}
+	}
+}
+
+func TestCreateVolumeWithDatastoreCluster(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	params := make(map[string]string)
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	// datastoreURL and datastoreClusterName are mutually exclusive
+	params[common.AttributeDatastoreURL] = ct.controller.nodeMgr.(*FakeNodeManager).sharedDatastoreURL
+	params[common.AttributeDatastoreClusterName] = "DatastoreCluster"
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with both %s and %s to fail with %v, got err: %v",
+			common.AttributeDatastoreURL, common.AttributeDatastoreClusterName, codes.InvalidArgument, err)
+	}
+	delete(params, common.AttributeDatastoreURL)
+
+	// Datastore cluster does not exist
+	if _, err = ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatalf("Expected CreateVolume to fail for datastore cluster which does not exist")
+	}
+
+	// Datastore cluster without shared member datastores
+	finder := find.NewFinder(ct.vcenter.Client.Client, false)
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = folders.DatastoreFolder.CreateStoragePod(ctx, params[common.AttributeDatastoreClusterName]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatalf("Expected CreateVolume to fail for datastore cluster without shared member datastores")
+	}
+}
+
+func TestPublishEncryptedVolumeToUnencryptedNode(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// PBM simulator defaults
+	params := make(map[string]string)
+	params[common.AttributeStoragePolicyName] = "VM Encryption Policy"
+	if v := os.Getenv("VSPHERE_ENCRYPTION_STORAGE_POLICY_NAME"); v != "" {
+		params[common.AttributeStoragePolicyName] = v
+	}
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+
+	// Attach to a node VM which is not encrypted
+	var nodeID string
+	if v := os.Getenv("VSPHERE_K8S_NODE"); v != "" {
+		nodeID = v
+	} else {
+		nodeID = simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine).Name
+	}
+	reqControllerPublishVolume := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volID,
+		NodeId:           nodeID,
+		VolumeCapability: capabilities[0],
+		Readonly:         false,
+	}
+	_, err = ct.controller.ControllerPublishVolume(ctx, reqControllerPublishVolume)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected ControllerPublishVolume of encrypted volume to fail with %v, got err: %v", codes.FailedPrecondition, err)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: volID,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeWithSiteAffinity(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	params := make(map[string]string)
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	// Unsupported site affinity
+	params[common.AttributeSiteAffinity] = "primary"
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with %s %q to fail with %v, got err: %v", common.AttributeSiteAffinity, "primary", codes.InvalidArgument, err)
+	}
+
+	// Site affinity without storage policy
+	params[common.AttributeSiteAffinity] = common.SiteAffinityPreferred
+	if _, err = ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with site affinity and no storage policy to fail with %v, got err: %v", codes.InvalidArgument, err)
+	}
+
+	// Site affinity not matching the storage policy, PBM simulator default policy has no locality rule
+	params[common.AttributeStoragePolicyName] = "vSAN Default Storage Policy"
+	if _, err = ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with site affinity not matching the storage policy to fail with %v, got err: %v", codes.InvalidArgument, err)
+	}
+
+	// Site affinity matching the storage policy
+	params[common.AttributeSiteAffinity] = common.SiteAffinityNone
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: respCreate.Volume.VolumeId,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishVolumeWithInvalidVolumeID(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	var nodeID string
+	if v := os.Getenv("VSPHERE_K8S_NODE"); v != "" {
+		nodeID = v
+	} else {
+		nodeID = simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine).Name
+	}
+	reqControllerPublishVolume := &csi.ControllerPublishVolumeRequest{
+		VolumeId: "[vsanDatastore] fcd/disk-0.vmdk",
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		Readonly: false,
+	}
+	_, err := ct.controller.ControllerPublishVolume(ctx, reqControllerPublishVolume)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected ControllerPublishVolume with invalid volume ID to fail with %v, got err: %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestUnpublishVolumeFromOrphanedOrDeletedNode(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Orphaned node VMs are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          testVolumeName + "-orphaned-node",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// A VM which is not found by its UUID is not known to be gone
+	if _, err := ct.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   missingVMNodeName,
+	}); err == nil {
+		t.Fatal("Expected ControllerUnpublishVolume from a node whose VM is not found to fail")
+	}
+	// The volume is not attached, so detaching it fails unless the node VM is deleted
+	reqControllerUnpublishVolume := &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   "orphaned-node",
+	}
+	if _, err := ct.controller.ControllerUnpublishVolume(ctx, reqControllerUnpublishVolume); err == nil {
+		t.Fatal("Expected ControllerUnpublishVolume of a volume which is not attached to fail")
+	}
+	// The host of an orphaned VM may reconnect with the disks attached, so the detach is retried
+	// The fake node manager may return any simulated VM
+	for _, entity := range simulator.Map.All("VirtualMachine") {
+		simVM := entity.(*simulator.VirtualMachine)
+		simVM.Runtime.ConnectionState = types.VirtualMachineConnectionStateOrphaned
+		defer func() { simVM.Runtime.ConnectionState = types.VirtualMachineConnectionStateConnected }()
+	}
+	if _, err := ct.controller.ControllerUnpublishVolume(ctx, reqControllerUnpublishVolume); err == nil {
+		t.Fatal("Expected ControllerUnpublishVolume from an orphaned node VM to fail")
+	}
+	if _, err := ct.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   deletedVMNodeName,
+	}); err != nil {
+		t.Fatalf("Expected ControllerUnpublishVolume from a deleted node VM to succeed, got err: %v", err)
+	}
+}
+
+func TestDeleteVolumeWhileAttaching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// An attach of the volume is in progress until attached is closed
+	volID := "volume-being-attached"
+	attaching := make(chan struct{})
+	attached := make(chan struct{})
+	go func() {
+		_, _ = ct.controller.operations.do(ctx, "ControllerPublishVolume/"+volID+"/node", 0, func() (interface{}, error) {
+			close(attaching)
+			<-attached
+			return nil, nil
+		})
+	}()
+	<-attaching
+	_, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID})
+	close(attached)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected DeleteVolume of a volume being attached to fail with %v, got err: %v", codes.FailedPrecondition, err)
+	}
+}
+
+func TestOperationStoreDoExclusive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	operations := newOperationStore()
+	// Concurrent deletes and attaches of a volume never run together
+	var deleting, attaching, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		key, conflicting, running, other := "DeleteVolume/vol", volumeAttachmentPrefixes("vol"), &deleting, &attaching
+		if i%2 == 1 {
+			key, conflicting, running, other = fmt.Sprintf("ControllerPublishVolume/vol/node-%d", i), []string{"DeleteVolume/vol"}, &attaching, &deleting
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = operations.doExclusive(ctx, key, 0, conflicting, func() (interface{}, error) {
+				atomic.AddInt32(running, 1)
+				if atomic.LoadInt32(other) != 0 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(running, -1)
+				return nil, nil
+			})
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 {
+		t.Fatalf("Expected DeleteVolume to never run while the volume is attached, it did %d times", overlaps)
+	}
+	// A conflicting operation fails without running
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_, _ = operations.do(ctx, "ControllerUnpublishVolume/vol/node", 0, func() (interface{}, error) {
+			close(started)
+			<-block
+			return nil, nil
+		})
+	}()
+	<-started
+	_, err := operations.doExclusive(ctx, "DeleteVolume/vol", 0, volumeAttachmentPrefixes("vol"), func() (interface{}, error) {
+		t.Fatal("Expected DeleteVolume not to run while the volume is detached")
+		return nil, nil
+	})
+	close(block)
+	if conflict, ok := err.(*operationConflictError); !ok || conflict.key != "ControllerUnpublishVolume/vol/node" {
+		t.Fatalf("Expected a conflict with the detach, got err: %v", err)
+	}
+}
+
+func TestPublishVolumeToNodeWithoutDatastoreAccess(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Datastore accessibility is only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}}
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               testVolumeName + "-inaccessible",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// No host can access the datastore of the volume, whichever VM the fake node manager returns
+	queryResult, err := ct.controller.manager.VolumeManager.QueryVolume(cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volID}},
+	})
+	if err != nil || len(queryResult.Volumes) == 0 {
+		t.Fatalf("Failed to query volume %q: %v", volID, err)
+	}
+	for _, entity := range simulator.Map.All("HostSystem") {
+		host := entity.(*simulator.HostSystem)
+		datastores := host.Datastore
+		host.Datastore = nil
+		for _, ref := range datastores {
+			ds := simulator.Map.Get(ref).(*simulator.Datastore)
+			if ds.Info.GetDatastoreInfo().Url != queryResult.Volumes[0].DatastoreUrl {
+				host.Datastore = append(host.Datastore, ref)
+			}
+		}
+		defer func() { host.Datastore = datastores }()
+	}
+	// The event is recorded on the Node
+	nodeName := "node-without-datastore-access"
+	k8sClient := ct.controller.nodeMgr.(*FakeNodeManager).k8sClient
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName, UID: "node-without-datastore-access-uid"}}
+	if _, err = k8sClient.CoreV1().Nodes().Create(node); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := k8sClient.CoreV1().Nodes().Delete(nodeName, nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	recorder := record.NewFakeRecorder(10)
+	ct.controller.eventRecorder = recorder
+	defer func() {
+		ct.controller.eventRecorder = nil
+	}()
+	_, err = ct.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volID,
+		NodeId:           nodeName,
+		VolumeCapability: capabilities[0],
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected ControllerPublishVolume to a node without access to the datastore to fail with %v, got err: %v", codes.FailedPrecondition, err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected an event on node %q, got %d events", nodeName, len(recorder.Events))
+	}
+}
+
+func TestCreateVolumeExceedingNamespaceQuota(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	namespace := "test-namespace"
+	quota := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": storageQuotaGVR.Group + "/" + storageQuotaGVR.Version,
+			"kind":       "CnsStorageQuota",
+			"metadata": map[string]interface{}{
+				"name":      "test-quota",
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"limit": "2Gi",
+			},
+		},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	var err error
+	ct.controller.quota, err = newNamespaceQuotaWithClients(testclient.NewSimpleClientset(),
+		dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), quota), stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ct.controller.quota = nil
+	}()
+
+	params := make(map[string]string)
+	params[common.AttributePVCNamespace] = namespace
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 3 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+	_, err = ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected CreateVolume exceeding the quota to fail with %v, got err: %v", codes.ResourceExhausted, err)
+	}
+
+	// Within the quota
+	reqCreate.CapacityRange.RequiredBytes = 1 * common.GbInBytes
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The capacity of the created volume is counted before its PV is created
+	otherVolumeBytes := 3 * common.GbInBytes / 2
+	_, err = ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               testVolumeName + "-other",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: otherVolumeBytes},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected CreateVolume exceeding the quota with a pending volume to fail with %v, got err: %v", codes.ResourceExhausted, err)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: respCreate.Volume.VolumeId,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The capacity of the deleted volume is released
+	if err = ct.controller.quota.reserve(namespace, testVolumeName+"-other", otherVolumeBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespaceQuotaReservations(t *testing.T) {
+	namespace := "test-namespace"
+	quota := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": storageQuotaGVR.Group + "/" + storageQuotaGVR.Version,
+			"kind":       "CnsStorageQuota",
+			"metadata": map[string]interface{}{
+				"name":      "test-quota",
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"limit": "2Gi",
+			},
+		},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: common.VSphereCSIDriverName, VolumeHandle: "volume-1"},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: namespace, Name: "claim-1"},
+		},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	q, err := newNamespaceQuotaWithClients(testclient.NewSimpleClientset(pv),
+		dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), quota), stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The volume of the PV was created by this controller, it is counted once
+	if err = q.reserve(namespace, "pvc-1", common.GbInBytes); err != nil {
+		t.Fatal(err)
+	}
+	q.complete("pvc-1", "volume-1")
+	if err = q.reserve(namespace, "pvc-2", common.GbInBytes/2); err != nil {
+		t.Fatal(err)
+	}
+	// The volume being created is counted
+	if err = q.reserve(namespace, "pvc-3", common.GbInBytes); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected reserving beyond the quota to fail with %v, got err: %v", codes.ResourceExhausted, err)
+	}
+	// The volume which failed to be created is not
+	q.release("pvc-2")
+	if err = q.reserve(namespace, "pvc-3", common.GbInBytes); err != nil {
+		t.Fatal(err)
+	}
+	// Nor are the volumes of other namespaces
+	if err = q.reserve("other-namespace", "pvc-4", 2*common.GbInBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeWithLuksEncryption(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	params := make(map[string]string)
+	params[common.AttributeLuksEncryption] = "true"
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters: params,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume of block volume with LUKS encryption to fail with %v, got err: %v", codes.InvalidArgument, err)
+	}
+
+	// LUKS encryption is passed on to the node for mount volumes
+	reqCreate.VolumeCapabilities = []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCreate.Volume.VolumeContext[common.AttributeLuksEncryption] != "true" {
+		t.Errorf("Expected %s in volume context, got: %v", common.AttributeLuksEncryption, respCreate.Volume.VolumeContext)
+	}
+
+	// Delete
+	reqDelete := &csi.DeleteVolumeRequest{
+		VolumeId: respCreate.Volume.VolumeId,
+	}
+	_, err = ct.controller.DeleteVolume(ctx, reqDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratedInTreeVolume(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("In-tree volumes are only created on the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	ct.controller.migration = &volumeMigration{
+		manager:       ct.controller.manager,
+		dynamicClient: dynamicClient,
+		volumeIDs:     make(map[string]string),
+	}
+	defer func() { ct.controller.migration = nil }()
+
+	// The VMDK of an in-tree volume, as created by the in-tree volume plugin
+	ds := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	dir := filepath.Join(ds.Info.GetDatastoreInfo().Url, "kubevols")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "in-tree.vmdk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	volumePath := fmt.Sprintf("[%s] kubevols/in-tree.vmdk", ds.Name)
+	nodeID := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine).Name
+	capability := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	// The VMDK is registered with CNS when the volume is first attached
+	_, err := ct.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumePath,
+		NodeId:           nodeID,
+		VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := dynamicClient.Resource(common.VolumeMigrationGVR).List(metav1.ListOptions{})
+	if err != nil || len(migrations.Items) != 1 {
+		t.Fatalf("Expected 1 CnsVSphereVolumeMigration, got %v, err: %v", migrations, err)
+	}
+	volumeID := migrations.Items[0].GetName()
+	queryResult, err := ct.vcenter.CnsClient.QueryVolume(ctx, cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	})
+	if err != nil || len(queryResult.Volumes) != 1 {
+		t.Fatalf("Expected volume %s of %q to be registered with CNS, got %v, err: %v", volumeID, volumePath, queryResult, err)
+	}
+
+	_, err = ct.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumePath,
+		NodeId:   nodeID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumePath}); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err = dynamicClient.Resource(common.VolumeMigrationGVR).List(metav1.ListOptions{})
+	if err != nil || len(migrations.Items) != 0 {
+		t.Fatalf("Expected the CnsVSphereVolumeMigration to be deleted with the volume, got %v, err: %v", migrations, err)
+	}
+}
+
+func TestCreateVolumeOnVsanDirectDatastore(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("vSAN Direct datastores are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name:          "pvc-vsan-direct",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		Parameters:    map[string]string{common.AttributeVsanDirect: "true"},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	}
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatal("Expected CreateVolume to fail without vSAN Direct datastores")
+	}
+
+	for _, obj := range simulator.Map.All("Datastore") {
+		ds := obj.(*simulator.Datastore)
+		dsType := ds.Summary.Type
+		ds.Summary.Type = cnsvsphere.VsanDirectDatastoreType
+		defer func() { ds.Summary.Type = dsType }()
+	}
+
+	// No vSAN Direct datastore has space for the volume
+	tooLarge := *reqCreate
+	tooLarge.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 60}
+	if _, err := ct.controller.CreateVolume(ctx, &tooLarge); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected CreateVolume to fail with %v, got err: %v", codes.ResourceExhausted, err)
+	}
+
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: respCreate.Volume.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// controlFlagsRecorder records the control flags set on First Class Disks, which vcsim does not
+// implement, or fails to set them if fail is set
+type controlFlagsRecorder struct {
+	*simulator.VcenterVStorageObjectManager
+	controlFlags map[string][]string
+	fail         bool
+}
+
+func (m *controlFlagsRecorder) SetVStorageObjectControlFlags(req *types.SetVStorageObjectControlFlags) soap.HasFault {
+	if m.fail {
+		return &methods.SetVStorageObjectControlFlagsBody{Fault_: simulator.Fault("", &types.NotSupported{})}
+	}
+	m.controlFlags[req.Id.Id] = req.ControlFlags
+	return &methods.SetVStorageObjectControlFlagsBody{Res: &types.SetVStorageObjectControlFlagsResponse{}}
+}
+
+func TestCreateVolumeWithChangedBlockTracking(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Control flags of First Class Disks are only recorded with vcsim")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name:          "pvc-cbt",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		Parameters:    map[string]string{common.AttributeChangedBlockTracking: "yes"},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	}
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected CreateVolume with %s %q to fail with %v, got err: %v",
+			common.AttributeChangedBlockTracking, "yes", codes.InvalidArgument, err)
+	}
+
+	ref := *ct.vcenter.Client.ServiceContent.VStorageObjectManager
+	manager := simulator.Map.Get(ref).(*simulator.VcenterVStorageObjectManager)
+	recorder := &controlFlagsRecorder{VcenterVStorageObjectManager: manager, controlFlags: make(map[string][]string)}
+	simulator.Map.Put(recorder)
+	defer simulator.Map.Put(manager)
+
+	reqCreate.Parameters[common.AttributeChangedBlockTracking] = "true"
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := respCreate.Volume.VolumeId
+	controlFlags := recorder.controlFlags[volumeID]
+	if len(controlFlags) != 1 || controlFlags[0] != string(types.VslmVStorageObjectControlFlagEnableChangedBlockTracking) {
+		t.Fatalf("Expected changed block tracking to be enabled on volume %s, got control flags %v", volumeID, controlFlags)
+	}
+	if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The volume is deleted again if changed block tracking can not be enabled
+	recorder.fail = true
+	reqCreate.Name = "pvc-cbt-failing"
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.Internal {
+		t.Fatalf("Expected CreateVolume to fail with %v, got err: %v", codes.Internal, err)
+	}
+	queryResult, err := ct.controller.manager.VolumeManager.QueryVolume(cnstypes.CnsQueryFilter{Names: []string{reqCreate.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResult.Volumes) != 0 {
+		t.Fatalf("Expected the volume of the failed CreateVolume to be deleted, got %+v", queryResult.Volumes)
+	}
+}
+
+func TestCreateVolumeOnVvolDatastore(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Virtual Volumes datastores are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	for _, obj := range simulator.Map.All("Datastore") {
+		ds := obj.(*simulator.Datastore)
+		dsType := ds.Summary.Type
+		ds.Summary.Type = cnsvsphere.VvolDatastoreType
+		defer func() { ds.Summary.Type = dsType }()
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name:          "pvc-vvol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	}
+	// vcsim reports the API version of vCenter 6.5, whose CNS does not support vVols
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); err == nil {
+		t.Fatal("Expected CreateVolume to fail with only vVol datastores before vCenter 7.0")
+	}
+	reqCapacity := &csi.GetCapacityRequest{Parameters: make(map[string]string)}
+	if respCapacity, err := ct.controller.GetCapacity(ctx, reqCapacity); err != nil || respCapacity.AvailableCapacity != 0 {
+		t.Fatalf("Expected no capacity on vVol datastores before vCenter 7.0, got %v, err: %v", respCapacity, err)
+	}
+
+	about := &ct.vcenter.Client.ServiceContent.About
+	apiVersion := about.ApiVersion
+	about.ApiVersion = "7.0.0.0"
+	defer func() { about.ApiVersion = apiVersion }()
+	if respCapacity, err := ct.controller.GetCapacity(ctx, reqCapacity); err != nil || respCapacity.AvailableCapacity == 0 {
+		t.Fatalf("Expected capacity on vVol datastores of vCenter 7.0, got %v, err: %v", respCapacity, err)
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: respCreate.Volume.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeWithDatastoreType(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The datastore types of real vCenters vary")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	for _, obj := range simulator.Map.All("Datastore") {
+		ds := obj.(*simulator.Datastore)
+		dsType := ds.Summary.Type
+		ds.Summary.Type = cnsvsphere.VmfsDatastoreType
+		defer func() { ds.Summary.Type = dsType }()
+	}
+	newRequest := func(datastoreType string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          "pvc-datastore-type",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+			Parameters:    map[string]string{"datastoreType": datastoreType},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			}},
+		}
+	}
+	if _, err := ct.controller.CreateVolume(ctx, newRequest("ext4")); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an unknown datastore type, got %v", err)
+	}
+	if _, err := ct.controller.CreateVolume(ctx, newRequest(common.DatastoreTypeVsan)); err == nil {
+		t.Fatal("Expected CreateVolume to fail without vSAN datastores")
+	}
+	respCreate, err := ct.controller.CreateVolume(ctx, newRequest("VMFS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: respCreate.Volume.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingQueryVolumeManager is a volume manager whose QueryVolume calls fail
+type failingQueryVolumeManager struct {
+	cnsvolume.Manager
+}
+
+func (m *failingQueryVolumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	return nil, fmt.Errorf("QueryVolume is failing")
+}
+
+func TestCreateVolumeWithFailingQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	manager := ct.controller.manager
+	volumeManager := manager.VolumeManager
+	setVolumeManager := func(volumeManager cnsvolume.Manager) {
+		manager.VolumeManager = volumeManager
+		for host := range manager.VolumeManagers {
+			manager.VolumeManagers[host] = volumeManager
+		}
+	}
+	setVolumeManager(&failingQueryVolumeManager{Manager: volumeManager})
+	defer setVolumeManager(volumeManager)
+
+	// The volume is created without the attributes for backup tools
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-failing-query",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVolumeManager(volumeManager)
+	volumeContext := respCreate.Volume.VolumeContext
+	if _, ok := volumeContext[common.AttributeFcdID]; ok {
+		t.Errorf("Expected no %s without the query result, got volume context %+v", common.AttributeFcdID, volumeContext)
+	}
+	if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: respCreate.Volume.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetVolumeManagerForVolumeOfSection(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The vCenter is configured from the environment")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+	manager := ct.controller.manager
+
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-section",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: respCreate.Volume.VolumeId}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Configure the vCenter in a second section, whose datacenters hold the datastore
+	// of the volume while the datacenters of the first section do not exist
+	host := manager.VcenterConfig.Host
+	zoneConfig := *manager.VcenterConfig
+	zoneConfig.Host = "zone-b"
+	zoneConfig.Server = host
+	zoneVC, err := manager.VcenterManager.RegisterVirtualCenter(&zoneConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.VcenterManager.UnregisterVirtualCenter(zoneConfig.Host)
+	volumeManagers := manager.VolumeManagers
+	manager.VolumeManagers = map[string]cnsvolume.Manager{
+		host:            manager.VolumeManager,
+		zoneConfig.Host: cnsvolume.GetManager(zoneVC),
+	}
+	defer func() { manager.VolumeManagers = volumeManagers }()
+	vc, err := manager.VcenterManager.GetVirtualCenter(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datacenterPaths := vc.GetDatacenterPaths()
+	vc.SetDatacenterPaths([]string{"/missing"})
+	defer vc.SetDatacenterPaths(datacenterPaths)
+
+	volumeManager, err := common.GetVolumeManagerForVolume(ctx, manager, respCreate.Volume.VolumeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volumeManager != manager.VolumeManagers[zoneConfig.Host] {
+		t.Errorf("Expected the volume manager of the section holding the datastore of the volume")
+	}
+}
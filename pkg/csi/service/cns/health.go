@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+const (
+	// healthCheckInterval is the interval of the vCenter health checks. Probes
+	// report the result of the last check, they don't call vCenter themselves.
+	healthCheckInterval = 30 * time.Second
+	// healthCheckTimeout is the timeout of the check of a vCenter.
+	healthCheckTimeout = 20 * time.Second
+)
+
+// vcenterHealth holds the result of the last health check of each vCenter.
+type vcenterHealth struct {
+	lock sync.RWMutex
+	// errs maps the hosts of the unhealthy vCenters to the error of their check
+	errs map[string]error
+}
+
+// check checks the session and the CNS reachability of each of vcenters.
+func (h *vcenterHealth) check(vcenters []*cnsvsphere.VirtualCenter) {
+	errs := make(map[string]error)
+	for _, vc := range vcenters {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := vc.CheckCNS(ctx)
+		cancel()
+		if err != nil {
+			klog.Warningf("Health check of vCenter %q failed with err: %v", vc.Config.Host, err)
+			errs[vc.Config.Host] = err
+			vcenterHealthy.WithLabelValues(vc.Config.Host).Set(0)
+		} else {
+			vcenterHealthy.WithLabelValues(vc.Config.Host).Set(1)
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.errs = errs
+}
+
+// err returns an error naming each unhealthy vCenter, or nil if all vCenters are healthy.
+func (h *vcenterHealth) err() error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.errs) == 0 {
+		return nil
+	}
+	var unhealthy []string
+	for host, err := range h.errs {
+		unhealthy = append(unhealthy, fmt.Sprintf("%s: %v", host, err))
+	}
+	sort.Strings(unhealthy)
+	return fmt.Errorf("unhealthy vCenter: %s", strings.Join(unhealthy, "; "))
+}
+
+// CheckHealth returns an error if the last health check of a vCenter failed, i.e.
+// its session is not valid and could not be logged in again or CNS did not respond.
+func (c *controller) CheckHealth(ctx context.Context) error {
+	if c.health == nil {
+		return nil
+	}
+	return c.health.err()
+}
+
+// watchHealth checks the health of all vCenters every healthCheckInterval until stopCh is closed.
+func (c *controller) watchHealth(stopCh <-chan struct{}) {
+	c.health = &vcenterHealth{}
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.health.check(c.manager.VcenterManager.GetAllVirtualCenters())
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestVcenterHealth(t *testing.T) {
+	ct := getControllerTest(t)
+	// Nothing listens on port 1 of the unreachable vCenter
+	unreachable := &cnsvsphere.VirtualCenter{
+		Config: &cnsvsphere.VirtualCenterConfig{
+			Host:     "127.0.0.1",
+			Port:     1,
+			Username: "user",
+			Password: "pass",
+			Insecure: true,
+		},
+	}
+
+	health := &vcenterHealth{}
+	health.check([]*cnsvsphere.VirtualCenter{ct.vcenter})
+	if err := health.err(); err != nil {
+		t.Fatalf("Expected vCenter %q to be healthy, got err: %v", ct.vcenter.Config.Host, err)
+	}
+	if healthy := testutil.ToFloat64(vcenterHealthy.WithLabelValues(ct.vcenter.Config.Host)); healthy != 1 {
+		t.Errorf("Expected vcenter_healthy of %q to be 1, got %v", ct.vcenter.Config.Host, healthy)
+	}
+
+	health.check([]*cnsvsphere.VirtualCenter{ct.vcenter, unreachable})
+	if err := health.err(); err == nil {
+		t.Fatalf("Expected vCenter %q to be unhealthy", unreachable.Config.Host)
+	}
+	if healthy := testutil.ToFloat64(vcenterHealthy.WithLabelValues(unreachable.Config.Host)); healthy != 0 {
+		t.Errorf("Expected vcenter_healthy of %q to be 0, got %v", unreachable.Config.Host, healthy)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// metricsNamespace prefixes the names of all controller metrics
+	metricsNamespace = "vsphere_csi_controller"
+
+	// Values of the operation label of the operation metrics
+	operationCreateVolume              = "CreateVolume"
+	operationDeleteVolume              = "DeleteVolume"
+	operationControllerPublishVolume   = "ControllerPublishVolume"
+	operationControllerUnpublishVolume = "ControllerUnpublishVolume"
+
+	// Values of the status label of the operation metrics
+	operationSucceeded = "success"
+	operationFailed    = "failure"
+)
+
+var (
+	// operations counts the completed controller operations by operation, status and gRPC code
+	operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Number of completed volume operations. The code label classifies failures.",
+	}, []string{"operation", "status", "code"})
+	// operationDuration observes the duration of controller operations by operation and status
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of volume operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"operation", "status"})
+	// vcenterHealthy reports the result of the last health check of each vCenter
+	vcenterHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vcenter_healthy",
+		Help:      "Whether the session of the vCenter was valid and CNS responded in the last health check.",
+	}, []string{"vcenter"})
+	// missingPrivileges reports the result of the privilege check at startup
+	missingPrivileges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_privileges",
+		Help:      "Number of vCenter entities on which the vCenter user was missing the privilege at startup.",
+	}, []string{"vcenter", "privilege"})
+)
+
+func init() {
+	prometheus.MustRegister(operations, operationDuration, vcenterHealthy, missingPrivileges)
+}
+
+// observeOperation records the outcome and the duration of operation, which was
+// started at start and returned err.
+func observeOperation(operation string, start time.Time, err error) {
+	result := operationSucceeded
+	code := codes.OK
+	if err != nil {
+		result = operationFailed
+		code = status.Code(err)
+	}
+	operations.WithLabelValues(operation, result, code.String()).Inc()
+	operationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi/object"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+// volumeMigration resolves the VMDK paths, e.g. "[vsanDatastore] kubevols/pvc-1.vmdk",
+// with which in-tree vSphere volumes migrated to CSI are referenced, to the IDs of their
+// CNS volumes. The VMDK of an in-tree volume is registered as a First Class Disk and with
+// CNS when the volume is first used. The mappings are kept in CnsVSphereVolumeMigration
+// resources, as a VMDK can not be looked up by its path once it is registered.
+type volumeMigration struct {
+	manager       *common.Manager
+	dynamicClient dynamic.Interface
+	// lock serializes the registration of volumes
+	lock sync.Mutex
+	// volumeIDs maps the volume paths of migrated volumes to their volume IDs
+	volumeIDs map[string]string
+}
+
+// newVolumeMigration creates a volumeMigration using the service account of the controller
+func newVolumeMigration(manager *common.Manager) (*volumeMigration, error) {
+	dynamicClient, err := k8s.NewDynamicClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes dynamic client failed. Err: %v", err)
+		return nil, err
+	}
+	return &volumeMigration{
+		manager:       manager,
+		dynamicClient: dynamicClient,
+		volumeIDs:     make(map[string]string),
+	}, nil
+}
+
+// getVolumeID returns the ID of the CNS volume of the in-tree volume at volumePath.
+// Its VMDK is registered if the volume has not been used since it was migrated.
+func (m *volumeMigration) getVolumeID(ctx context.Context, volumePath string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if volumeID, ok := m.volumeIDs[volumePath]; ok {
+		return volumeID, nil
+	}
+	// The volume may have been registered by a previous instance of the controller
+	if err := m.loadVolumeIDs(); err != nil {
+		return "", err
+	}
+	if volumeID, ok := m.volumeIDs[volumePath]; ok {
+		return volumeID, nil
+	}
+	var dsPath object.DatastorePath
+	if !dsPath.FromString(volumePath) {
+		return "", fmt.Errorf("invalid volume path %q", volumePath)
+	}
+	ds, err := getDatastoreByName(ctx, m.manager, dsPath.Datastore)
+	if err != nil {
+		return "", err
+	}
+	volumeID, err := ds.RegisterDisk(ctx, dsPath.Path, strings.TrimSuffix(path.Base(dsPath.Path), ".vmdk"))
+	if err != nil {
+		return "", err
+	}
+	if err := common.RegisterVolumeUtil(ctx, m.manager, ds.Datacenter.VirtualCenterHost, volumeID); err != nil {
+		return "", err
+	}
+	if err := m.save(volumePath, volumeID); err != nil {
+		return "", err
+	}
+	klog.V(2).Infof("In-tree volume %q is registered as volume %s", volumePath, volumeID)
+	return volumeID, nil
+}
+
+// addVolume records the volume path of the volume volumeID on the datastore datastoreURL,
+// which was created for a migrated in-tree StorageClass, and returns it.
+func (m *volumeMigration) addVolume(ctx context.Context, volumeID string, datastoreURL string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ds, err := getDatastoreByURL(ctx, m.manager, datastoreURL)
+	if err != nil {
+		return "", err
+	}
+	volumePath, err := ds.GetFirstClassDiskPath(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+	if err := m.save(volumePath, volumeID); err != nil {
+		return "", err
+	}
+	return volumePath, nil
+}
+
+// removeVolume removes the mapping of volumePath to volumeID once the volume is deleted.
+func (m *volumeMigration) removeVolume(volumePath string, volumeID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err := m.dynamicClient.Resource(common.VolumeMigrationGVR).Delete(volumeID, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Errorf("Failed to delete CnsVSphereVolumeMigration %s. Err: %v", volumeID, err)
+		return err
+	}
+	delete(m.volumeIDs, volumePath)
+	return nil
+}
+
+// loadVolumeIDs caches the mappings of all CnsVSphereVolumeMigration resources.
+// The caller must hold m.lock.
+func (m *volumeMigration) loadVolumeIDs() error {
+	migrations, err := m.dynamicClient.Resource(common.VolumeMigrationGVR).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Failed to list CnsVSphereVolumeMigrations. Err: %v", err)
+		return err
+	}
+	for _, migration := range migrations.Items {
+		volumePath, _, _ := unstructured.NestedString(migration.Object, "spec", "volumePath")
+		volumeID, _, _ := unstructured.NestedString(migration.Object, "spec", "volumeID")
+		if volumePath != "" && volumeID != "" {
+			m.volumeIDs[volumePath] = volumeID
+		}
+	}
+	return nil
+}
+
+// save creates the CnsVSphereVolumeMigration resource which maps volumePath to volumeID.
+// The caller must hold m.lock.
+func (m *volumeMigration) save(volumePath string, volumeID string) error {
+	migration := &unstructured.Unstructured{}
+	migration.SetAPIVersion(common.VolumeMigrationGVR.GroupVersion().String())
+	migration.SetKind("CnsVSphereVolumeMigration")
+	migration.SetName(volumeID)
+	migration.Object["spec"] = map[string]interface{}{
+		"volumePath": volumePath,
+		"volumeID":   volumeID,
+	}
+	_, err := m.dynamicClient.Resource(common.VolumeMigrationGVR).Create(migration, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		klog.Errorf("Failed to create CnsVSphereVolumeMigration %s for volume path %q. Err: %v", volumeID, volumePath, err)
+		return err
+	}
+	m.volumeIDs[volumePath] = volumeID
+	return nil
+}
+
+// getDatastoreByName returns the datastore named name in the datacenters of the vCenters of manager.
+// As with the in-tree volume plugin, datastore names are expected to be unique.
+func getDatastoreByName(ctx context.Context, manager *common.Manager, name string) (*cnsvsphere.Datastore, error) {
+	for _, dc := range getDatacenters(ctx, manager) {
+		if ds, err := dc.GetDatastoreByName(ctx, name); err == nil {
+			return ds, nil
+		}
+	}
+	return nil, fmt.Errorf("datastore %q is not found in the datacenters of the vCenters", name)
+}
+
+// getDatastoreByURL returns the datastore with datastoreURL in the datacenters of the vCenters.
+func getDatastoreByURL(ctx context.Context, manager *common.Manager, datastoreURL string) (*cnsvsphere.Datastore, error) {
+	for _, dc := range getDatacenters(ctx, manager) {
+		if ds, err := dc.GetDatastoreByURL(ctx, datastoreURL); err == nil {
+			return ds, nil
+		}
+	}
+	return nil, fmt.Errorf("datastore %q is not found in the datacenters of the vCenters", datastoreURL)
+}
+
+// getDatacenters returns the datacenters of all vCenters which can be connected to
+func getDatacenters(ctx context.Context, manager *common.Manager) []*cnsvsphere.Datacenter {
+	var datacenters []*cnsvsphere.Datacenter
+	for _, vc := range manager.VcenterManager.GetAllVirtualCenters() {
+		if err := vc.Connect(ctx); err != nil {
+			klog.Errorf("Failed to connect to vCenter %q. Err: %v", vc.Config.Host, err)
+			continue
+		}
+		dcs, err := vc.GetDatacenters(ctx)
+		if err != nil {
+			klog.Errorf("Failed to get datacenters of vCenter %q. Err: %v", vc.Config.Host, err)
+			continue
+		}
+		datacenters = append(datacenters, dcs...)
+	}
+	return datacenters
+}
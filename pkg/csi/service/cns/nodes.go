@@ -18,10 +18,18 @@ package cns
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
@@ -33,8 +41,21 @@ import (
 
 // Nodes is the type comprising cns node manager and kubernetes informer
 type Nodes struct {
+	manager        *common.Manager
 	cnsNodeManager cnsnode.Manager
 	informMgr      *k8s.InformerManager
+	k8sclient      clientset.Interface
+	// repairProviderID is true if the missing providerIDs of nodes whose VMs were
+	// found by their addresses are to be set
+	repairProviderID bool
+	// maxVolumesPerNode is the configured number of volumes which can be attached to a node,
+	// if it is not set the number is derived from the VM of the node
+	maxVolumesPerNode int64
+	// attachControllerType is the type of the SCSI controllers added to node VMs for volumes
+	attachControllerType string
+	// deletedNodes maps the names of the nodes deleted since the controller started to
+	// their VMs, which may still have volumes attached
+	deletedNodes sync.Map
 }
 
 // Initialize helps initialize node manager and node informer manager
@@ -46,10 +67,15 @@ func (nodes *Nodes) Initialize() error {
 		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
 		return err
 	}
+	nodes.k8sclient = k8sclient
 	nodes.cnsNodeManager.SetKubernetesClient(k8sclient)
 	nodes.informMgr = k8s.NewInformer(k8sclient)
 	nodes.informMgr.AddNodeListener(nodes.nodeAdd, nodes.nodeUpdate, nodes.nodeDelete)
 	nodes.informMgr.Listen()
+	// Nodes which are not registered are not known to be deleted until the cache is synced
+	if !nodes.informMgr.WaitForCacheSync() {
+		return errors.New("failed to sync the node informer cache")
+	}
 	return nil
 }
 
@@ -80,10 +106,95 @@ func (nodes *Nodes) nodeRegister(obj interface{}) {
 		klog.Warningf("nodeRegister: unrecognized object %+v", obj)
 		return
 	}
-	err := nodes.cnsNodeManager.RegisterNode(common.GetUUIDFromProviderID(node.Spec.ProviderID), node.Name)
+	nodeUUID := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+	if !common.IsValidProviderID(node.Spec.ProviderID) {
+		if vmUUID := nodes.discoverNodeUUID(node); vmUUID != "" {
+			nodeUUID = vmUUID
+		}
+	}
+	nodes.deletedNodes.Delete(node.Name)
+	err := nodes.cnsNodeManager.RegisterNode(nodeUUID, node.Name)
 	if err != nil {
 		klog.Warningf("Failed to register node:%q. err=%v", node.Name, err)
+		return
+	}
+	nodes.annotateMaxVolumes(node)
+}
+
+// annotateMaxVolumes sets the AnnotationMaxVolumes of the registered node to the number of
+// volumes which can be attached to its VM
+func (nodes *Nodes) annotateMaxVolumes(node *v1.Node) {
+	if nodes.k8sclient == nil {
+		return
+	}
+	maxVolumes := nodes.maxVolumesPerNode
+	if maxVolumes <= 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		vm, err := nodes.cnsNodeManager.GetNodeByName(node.Name)
+		if err != nil {
+			klog.Warningf("Failed to get the VM of node %q. err=%v", node.Name, err)
+			return
+		}
+		if maxVolumes, err = vm.GetMaxVolumes(ctx, nodes.attachControllerType); err != nil {
+			klog.Warningf("Failed to get max volumes of node %q. err=%v", node.Name, err)
+			return
+		}
+	}
+	value := strconv.FormatInt(maxVolumes, 10)
+	if node.Annotations[common.AnnotationMaxVolumes] == value {
+		return
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, common.AnnotationMaxVolumes, value))
+	if _, err := nodes.k8sclient.CoreV1().Nodes().Patch(node.Name, types.StrategicMergePatchType, patch); err != nil {
+		klog.Warningf("Failed to set max volumes of node %q to %s. err=%v", node.Name, value, err)
+	}
+}
+
+// discoverNodeUUID returns the UUID of the VM of node, whose providerID is missing or malformed,
+// found by the host name or the IP addresses of node, or an empty string if it is not found.
+// With repairProviderID, a missing providerID is set, so the node is found by its UUID from then on.
+func (nodes *Nodes) discoverNodeUUID(node *v1.Node) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dnsName, ips := getNodeAddresses(node)
+	klog.V(2).Infof("Node %q has providerID %q, looking up its VM by DNS name %s or IPs %v", node.Name, node.Spec.ProviderID, dnsName, ips)
+	vm, err := cnsvsphere.GetVirtualMachineByDNSNameOrIP(ctx, dnsName, ips)
+	if err != nil {
+		klog.Warningf("Failed to find the VM of node %q by its addresses. err=%v", node.Name, err)
+		return ""
+	}
+	providerID := common.ProviderPrefix + vm.UUID
+	switch {
+	case node.Spec.ProviderID != "":
+		// The providerID of a node can not be changed once it is set
+		klog.Warningf("Node %q has the malformed providerID %q, its VM %v has the providerID %q", node.Name, node.Spec.ProviderID, vm, providerID)
+	case nodes.repairProviderID && nodes.k8sclient != nil:
+		patch := []byte(fmt.Sprintf(`{"spec":{"providerID":%q}}`, providerID))
+		if _, err := nodes.k8sclient.CoreV1().Nodes().Patch(node.Name, types.StrategicMergePatchType, patch); err != nil {
+			klog.Warningf("Failed to set the providerID of node %q to %q. err=%v", node.Name, providerID, err)
+		} else {
+			klog.Infof("Set the providerID of node %q to %q", node.Name, providerID)
+		}
 	}
+	return vm.UUID
+}
+
+// getNodeAddresses returns the host name and the IP addresses of node, internal ones first.
+func getNodeAddresses(node *v1.Node) (string, []string) {
+	dnsName := node.Name
+	var internalIPs, externalIPs []string
+	for _, address := range node.Status.Addresses {
+		switch address.Type {
+		case v1.NodeHostName:
+			dnsName = address.Address
+		case v1.NodeInternalIP:
+			internalIPs = append(internalIPs, address.Address)
+		case v1.NodeExternalIP:
+			externalIPs = append(externalIPs, address.Address)
+		}
+	}
+	return dnsName, append(internalIPs, externalIPs...)
 }
 
 func (nodes *Nodes) nodeDelete(obj interface{}) {
@@ -92,18 +203,126 @@ func (nodes *Nodes) nodeDelete(obj interface{}) {
 		klog.Warningf("nodeDelete: unrecognized object %+v", obj)
 		return
 	}
-	err := nodes.cnsNodeManager.UnregisterNode(node.Name)
+	vm, err := nodes.cnsNodeManager.GetNodeByName(node.Name)
+	if err != nil {
+		klog.Warningf("Failed to get the VM of deleted node %q, skipping the detach of its volumes. err=%v", node.Name, err)
+	} else {
+		nodes.deletedNodes.Store(node.Name, vm)
+		// Detaching may take long, the informer handlers must not be blocked meanwhile
+		go nodes.detachVolumes(node, vm)
+	}
+	err = nodes.cnsNodeManager.UnregisterNode(node.Name)
 	if err != nil {
 		klog.Warningf("Failed to unregister node:%q. err=%v", node.Name, err)
 	}
 }
 
+// detachVolumes detaches the volumes of the VolumeAttachments of the deleted node from its
+// VM vm if the VM is powered off, so they can be attached to the nodes replacing it right away.
+// The volumes of a VM which is still running may still be written to, so they are left to
+// ControllerUnpublishVolume once Kubernetes detaches them.
+func (nodes *Nodes) detachVolumes(node *v1.Node, vm *cnsvsphere.VirtualMachine) {
+	if nodes.manager == nil || nodes.k8sclient == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	active, err := vm.IsActive(ctx)
+	if err != nil {
+		klog.Warningf("Failed to get the power state of the VM of deleted node %q, skipping the detach of its volumes. err=%v", node.Name, err)
+		return
+	}
+	if active {
+		klog.V(2).Infof("The VM of deleted node %q is powered on, skipping the detach of its volumes", node.Name)
+		return
+	}
+	volumeAttachments, err := nodes.k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Failed to list VolumeAttachments of deleted node %q. err=%v", node.Name, err)
+		return
+	}
+	for _, volumeAttachment := range volumeAttachments.Items {
+		pvName := volumeAttachment.Spec.Source.PersistentVolumeName
+		if volumeAttachment.Spec.NodeName != node.Name || volumeAttachment.Spec.Attacher != common.VSphereCSIDriverName || pvName == nil {
+			continue
+		}
+		pv, err := nodes.k8sclient.CoreV1().PersistentVolumes().Get(*pvName, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Failed to get PersistentVolume %q attached to deleted node %q. err=%v", *pvName, node.Name, err)
+			continue
+		}
+		if pv.Spec.CSI == nil || common.IsVolumePath(pv.Spec.CSI.VolumeHandle) {
+			// The CNS volume IDs of migrated in-tree volumes are only known to the controller
+			klog.Warningf("Skipping the detach of PersistentVolume %q from deleted node %q", pv.Name, node.Name)
+			continue
+		}
+		if err := common.DetachVolumeUtil(ctx, nodes.manager, vm, pv.Spec.CSI.VolumeHandle); err != nil {
+			klog.Warningf("Failed to detach volume %q from deleted node %q. err=%v", pv.Spec.CSI.VolumeHandle, node.Name, err)
+			continue
+		}
+		klog.V(2).Infof("Detached volume %q from deleted node %q", pv.Spec.CSI.VolumeHandle, node.Name)
+	}
+}
+
+// GetDeletedNodeByName refreshes and returns the VirtualMachine of the deleted node nodeName,
+// which is no longer registered. The VM is returned even if it was deleted since, so that
+// the detach from it can confirm that it is gone. The VMs of nodes deleted before the
+// controller started are looked up by the node name, which is the host name of the VM.
+// ErrNodeNotFound is returned if the node still exists or its VM is not found.
+func (nodes *Nodes) GetDeletedNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error) {
+	vmInf, found := nodes.deletedNodes.Load(nodeName)
+	if !found {
+		vm, err := nodes.findDeletedNodeVM(nodeName)
+		if err != nil {
+			return nil, err
+		}
+		vmInf, _ = nodes.deletedNodes.LoadOrStore(nodeName, vm)
+	}
+	vm := vmInf.(*cnsvsphere.VirtualMachine)
+	if err := vm.Renew(true); err != nil {
+		klog.Errorf("Failed to renew VM %v of deleted node %q with err: %v", vm, nodeName, err)
+		return nil, err
+	}
+	return vm, nil
+}
+
+// findDeletedNodeVM returns the VM with the host name nodeName if the node nodeName does not
+// exist, or ErrNodeNotFound otherwise. A node which exists is only not registered yet.
+func (nodes *Nodes) findDeletedNodeVM(nodeName string) (*cnsvsphere.VirtualMachine, error) {
+	if nodes.k8sclient == nil {
+		return nil, cnsnode.ErrNodeNotFound
+	}
+	_, err := nodes.k8sclient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err == nil {
+		return nil, cnsnode.ErrNodeNotFound
+	} else if !apierrors.IsNotFound(err) {
+		klog.Errorf("Failed to get node %q. err=%v", nodeName, err)
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vm, err := cnsvsphere.GetVirtualMachineByDNSNameOrIP(ctx, nodeName, nil)
+	if err == cnsvsphere.ErrVMNotFound {
+		klog.Warningf("The VM of deleted node %q is not found by its name", nodeName)
+		return nil, cnsnode.ErrNodeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("Found VM %v of deleted node %q by its name", vm, nodeName)
+	return vm, nil
+}
+
 // GetNodeByName returns VirtualMachine object for given nodeName
 // This is called by ControllerPublishVolume and ControllerUnpublishVolume to perform attach and detach operations.
 func (nodes *Nodes) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error) {
 	return nodes.cnsNodeManager.GetNodeByName(nodeName)
 }
 
+// GetKubernetesNode returns the Node nodeName from the node informer cache
+func (nodes *Nodes) GetKubernetesNode(nodeName string) (*v1.Node, error) {
+	return nodes.informMgr.GetNodeLister().Get(nodeName)
+}
+
 // GetSharedDatastoresInTopology returns shared accessible datastores for specified topologyRequirement along with the map of
 // datastore URL and array of accessibleTopology map for each datastore returned from this function.
 // Here in this function, argument topologyRequirement can be passed in following form
@@ -137,19 +356,47 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 		return nil, nil, fmt.Errorf(errMsg)
 	}
 	// getNodesInZoneRegion takes zone and region as parameter and returns list of node VMs which belongs to specified
-	// zone and region.
-	getNodesInZoneRegion := func(zoneValue string, regionValue string) ([]*cnsvsphere.VirtualMachine, error) {
-		klog.V(4).Infof("getNodesInZoneRegion: called with zoneValue: %s, regionValue: %s", zoneValue, regionValue)
+	// zone and region, which have the tags of the additional topology levels in topologyLabels and which run on
+	// the ESXi host hostValue, if specified.
+	getNodesInZoneRegion := func(zoneValue string, regionValue string, topologyLabels map[string]string, hostValue string) ([]*cnsvsphere.VirtualMachine, error) {
+		klog.V(4).Infof("getNodesInZoneRegion: called with zoneValue: %s, regionValue: %s, topologyLabels: %v, hostValue: %s", zoneValue, regionValue, topologyLabels, hostValue)
+		var categoryNames []string
+		for category := range topologyLabels {
+			categoryNames = append(categoryNames, category)
+		}
 		var nodeVMsInZoneAndRegion []*cnsvsphere.VirtualMachine
 		for _, nodeVM := range allNodes {
-			isNodeInZoneRegion, err := nodeVM.IsInZoneRegion(ctx, zoneCategoryName, regionCategoryName, zoneValue, regionValue)
-			if err != nil {
-				klog.Errorf("Error checking if node VM: %v belongs to zone [%s] and region [%s]. err: %+v", nodeVM, zoneValue, regionValue, err)
-				return nil, err
+			if zoneValue != "" || regionValue != "" {
+				isNodeInZoneRegion, err := nodeVM.IsInZoneRegion(ctx, zoneCategoryName, regionCategoryName, zoneValue, regionValue)
+				if err != nil {
+					klog.Errorf("Error checking if node VM: %v belongs to zone [%s] and region [%s]. err: %+v", nodeVM, zoneValue, regionValue, err)
+					return nil, err
+				}
+				if !isNodeInZoneRegion {
+					continue
+				}
+			}
+			if hostValue != "" {
+				host, err := nodeVM.GetHostTopologyValue(ctx)
+				if err != nil {
+					klog.Errorf("Error getting host topology of node VM: %v. err: %+v", nodeVM, err)
+					return nil, err
+				}
+				if host != hostValue {
+					continue
+				}
 			}
-			if isNodeInZoneRegion {
-				nodeVMsInZoneAndRegion = append(nodeVMsInZoneAndRegion, nodeVM)
+			if len(topologyLabels) > 0 {
+				nodeLabels, err := nodeVM.GetTopologyLabels(ctx, categoryNames)
+				if err != nil {
+					klog.Errorf("Error getting topology labels of node VM: %v. err: %+v", nodeVM, err)
+					return nil, err
+				}
+				if !isTopologySubset(topologyLabels, nodeLabels) {
+					continue
+				}
 			}
+			nodeVMsInZoneAndRegion = append(nodeVMsInZoneAndRegion, nodeVM)
 		}
 		return nodeVMsInZoneAndRegion, nil
 	}
@@ -164,8 +411,15 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 			segments := topology.GetSegments()
 			zone := segments[csitypes.LabelZoneFailureDomain]
 			region := segments[csitypes.LabelRegionFailureDomain]
+			topologyLabels := make(map[string]string)
+			for key, value := range segments {
+				if strings.HasPrefix(key, csitypes.LabelTopologyPrefix) {
+					topologyLabels[strings.TrimPrefix(key, csitypes.LabelTopologyPrefix)] = value
+				}
+			}
+			host := segments[csitypes.LabelHostTopology]
 			klog.V(4).Infof("Getting list of nodeVMs for zone [%s] and region [%s]", zone, region)
-			nodeVMsInZoneRegion, err := getNodesInZoneRegion(zone, region)
+			nodeVMsInZoneRegion, err := getNodesInZoneRegion(zone, region, topologyLabels, host)
 			if err != nil {
 				klog.Errorf("Failed to find Nodes in the zone: [%s] and region: [%s]. Error: %+v", zone, region, err)
 				return nil, nil, err
@@ -185,6 +439,20 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 				if region != "" {
 					accessibleTopology[csitypes.LabelRegionFailureDomain] = region
 				}
+				for category, tag := range topologyLabels {
+					accessibleTopology[csitypes.LabelTopologyPrefix+category] = tag
+				}
+				if host != "" {
+					// Only volumes on host-local datastores are bound to the host
+					isHostLocal, err := datastore.IsHostLocal(ctx)
+					if err != nil {
+						klog.Errorf("Failed to check if datastore %s is host-local. Error: %+v", datastore.Info.Url, err)
+						return nil, nil, err
+					}
+					if isHostLocal {
+						accessibleTopology[csitypes.LabelHostTopology] = host
+					}
+				}
 				datastoreTopologyMap[datastore.Info.Url] = append(datastoreTopologyMap[datastore.Info.Url], accessibleTopology)
 			}
 			sharedDatastores = append(sharedDatastores, sharedDatastoresInZoneRegion...)
@@ -196,10 +464,18 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 	var datastoreTopologyMap = make(map[string][]map[string]string)
 	if topologyRequirement != nil && topologyRequirement.GetPreferred() != nil {
 		klog.V(3).Infoln("Using preferred topology")
-		sharedDatastores, datastoreTopologyMap, err = getSharedDatastoresInTopology(topologyRequirement.GetPreferred())
-		if err != nil {
-			klog.Errorf("Error occurred  while finding shared datastores from preferred topology: %+v", topologyRequirement.GetPreferred())
-			return nil, nil, err
+		// Preferred topologies are tried one at a time in the given order. With delayed binding,
+		// the first preferred topology is the one of the node selected by the scheduler,
+		// so the volume must be placed on a datastore accessible from it whenever possible.
+		for _, topology := range topologyRequirement.GetPreferred() {
+			sharedDatastores, datastoreTopologyMap, err = getSharedDatastoresInTopology([]*csi.Topology{topology})
+			if err != nil {
+				klog.Errorf("Error occurred  while finding shared datastores from preferred topology: %+v", topology)
+				return nil, nil, err
+			}
+			if len(sharedDatastores) > 0 {
+				break
+			}
 		}
 	}
 	if len(sharedDatastores) == 0 && topologyRequirement != nil && topologyRequirement.GetRequisite() != nil {
@@ -266,3 +542,13 @@ func (nodes *Nodes) GetSharedDatastoresForVMs(ctx context.Context, nodeVMs []*cn
 	}
 	return sharedDatastores, nil
 }
+
+// isTopologySubset returns true if labels has each of the tags in required
+func isTopologySubset(required map[string]string, labels map[string]string) bool {
+	for category, tag := range required {
+		if labels[category] != tag {
+			return false
+		}
+	}
+	return true
+}
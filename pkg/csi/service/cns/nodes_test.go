@@ -0,0 +1,295 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+func TestDiscoverNodeUUID(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The host names of guests are only set on the simulator")
+	}
+	getControllerTest(t)
+	simVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	simVM.Guest.HostName = "node-without-provider-id"
+	defer func() { simVM.Guest.HostName = "" }()
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-without-provider-id"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.0.2.10"}},
+		},
+	}
+	k8sclient := testclient.NewSimpleClientset(node)
+	nodes := &Nodes{k8sclient: k8sclient, repairProviderID: true}
+
+	expectedUUID := strings.ToLower(simVM.Config.Uuid)
+	if nodeUUID := nodes.discoverNodeUUID(node); nodeUUID != expectedUUID {
+		t.Fatalf("Expected the UUID %q of VM %s, got %q", expectedUUID, simVM.Name, nodeUUID)
+	}
+	node, err := k8sclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Spec.ProviderID != common.ProviderPrefix+expectedUUID {
+		t.Errorf("Expected the providerID of the node to be set, got %q", node.Spec.ProviderID)
+	}
+
+	unknown := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "unknown-node"}}
+	if nodeUUID := nodes.discoverNodeUUID(unknown); nodeUUID != "" {
+		t.Errorf("Expected no VM for node %q, got %q", unknown.Name, nodeUUID)
+	}
+}
+
+func TestAnnotateMaxVolumes(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-with-max-volumes"}}
+	k8sclient := testclient.NewSimpleClientset(node)
+	nodes := &Nodes{k8sclient: k8sclient, maxVolumesPerNode: 42}
+
+	nodes.annotateMaxVolumes(node)
+	node, err := k8sclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxVolumes := node.Annotations[common.AnnotationMaxVolumes]; maxVolumes != "42" {
+		t.Errorf("Expected max volumes of the node to be 42, got %q", maxVolumes)
+	}
+}
+
+func TestDetachVolumesOfDeletedNode(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Node VMs are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-deleted-node",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := respCreate.Volume.VolumeId
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	simVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "deleted-node"}}
+	cnsNodeManager := cnsnode.GetManager()
+	if err := cnsNodeManager.RegisterNode(strings.ToLower(simVM.Config.Uuid), node.Name); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := cnsNodeManager.GetNodeByName(node.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.AttachVolumeUtil(ctx, ct.controller.manager, vm, volumeID); err != nil {
+		t.Fatal(err)
+	}
+
+	pvName := "pv-deleted-node"
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: common.VSphereCSIDriverName, VolumeHandle: volumeID},
+			},
+		},
+	}
+	volumeAttachment := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-deleted-node"},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: common.VSphereCSIDriverName,
+			NodeName: node.Name,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+	nodes := &Nodes{
+		manager:        ct.controller.manager,
+		cnsNodeManager: cnsNodeManager,
+		k8sclient:      testclient.NewSimpleClientset(node, pv, volumeAttachment),
+	}
+	nodes.nodeDelete(node)
+	if _, err := cnsNodeManager.GetNodeByName(node.Name); err != cnsnode.ErrNodeNotFound {
+		t.Errorf("Expected node %q to be unregistered, got err: %v", node.Name, err)
+	}
+
+	// The VM is still running, so the volume is left attached to the VM of the deleted node
+	deletedVM, err := nodes.GetDeletedNodeByName(node.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := common.DetachVolumeUtil(ctx, ct.controller.manager, deletedVM, volumeID); err != nil {
+		t.Fatalf("Expected volume %q to be attached to the running VM of the deleted node, got %v", volumeID, err)
+	}
+
+	// The volumes of a powered off VM are detached when its node is deleted
+	if err := cnsNodeManager.RegisterNode(strings.ToLower(simVM.Config.Uuid), node.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.AttachVolumeUtil(ctx, ct.controller.manager, vm, volumeID); err != nil {
+		t.Fatal(err)
+	}
+	setPowerState := func(powerOn bool) {
+		task, err := vm.PowerOff(ctx)
+		if powerOn {
+			task, err = vm.PowerOn(ctx)
+		}
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPowerState(false)
+	defer setPowerState(true)
+	nodes.nodeDelete(node)
+	// The volumes are detached in the background
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		diskUUID, err := cnsvolume.GetDiskAttachedToVM(ctx, vm, volumeID)
+		return diskUUID == "", err
+	})
+	if err != nil {
+		t.Errorf("Expected volume %q to be detached from the VM of the deleted node, got err: %v", volumeID, err)
+	}
+}
+
+func TestGetDeletedNodeByNameAfterRestart(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The host names of guests are only set on the simulator")
+	}
+	getControllerTest(t)
+	simVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	simVM.Guest.HostName = "node-deleted-before-restart"
+	defer func() { simVM.Guest.HostName = "" }()
+
+	existing := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-not-registered"}}
+	// The controller restarted since the node was deleted, so it does not know the node
+	nodes := &Nodes{k8sclient: testclient.NewSimpleClientset(existing)}
+	vm, err := nodes.GetDeletedNodeByName("node-deleted-before-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Reference() != simVM.Reference() {
+		t.Errorf("Expected VM %v of the deleted node, got %v", simVM.Reference(), vm.Reference())
+	}
+	// A node which exists is not deleted, and neither is one whose VM is not found
+	for _, nodeName := range []string{existing.Name, "unknown-node"} {
+		if _, err := nodes.GetDeletedNodeByName(nodeName); err != cnsnode.ErrNodeNotFound {
+			t.Errorf("Expected %v for node %q, got err: %v", cnsnode.ErrNodeNotFound, nodeName, err)
+		}
+	}
+}
+
+func TestGetSharedDatastoresOnHost(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Host-local datastores are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	getControllerTest(t)
+
+	// Make all datastores host-local
+	for _, obj := range simulator.Map.All("Datastore") {
+		ds := obj.(*simulator.Datastore)
+		multipleHostAccess := ds.Summary.MultipleHostAccess
+		ds.Summary.MultipleHostAccess = types.NewBool(false)
+		defer func() { ds.Summary.MultipleHostAccess = multipleHostAccess }()
+	}
+	simVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	cnsNodeManager := cnsnode.GetManager()
+	if err := cnsNodeManager.RegisterNode(strings.ToLower(simVM.Config.Uuid), "host-local-node"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cnsNodeManager.UnregisterNode("host-local-node") }()
+	nodes := &Nodes{cnsNodeManager: cnsNodeManager}
+
+	// Hosts are identified by their hardware UUID, which is unique across vCenters
+	simHost := simulator.Map.Get(*simVM.Runtime.Host).(*simulator.HostSystem)
+	host := strings.ToLower(simHost.Summary.Hardware.Uuid)
+	topologyRequirement := &csi.TopologyRequirement{
+		Preferred: []*csi.Topology{{Segments: map[string]string{csitypes.LabelHostTopology: host}}},
+	}
+	datastores, datastoreTopologyMap, err := nodes.GetSharedDatastoresInTopology(ctx, topologyRequirement, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datastores) == 0 {
+		t.Fatalf("Expected the datastores of host %s", host)
+	}
+	for _, datastore := range datastores {
+		topologies := datastoreTopologyMap[datastore.Info.Url]
+		if len(topologies) != 1 || topologies[0][csitypes.LabelHostTopology] != host {
+			t.Errorf("Expected datastore %s to be accessible from host %s only, got %v", datastore.Info.Url, host, topologies)
+		}
+	}
+}
+
+func TestIsTopologySubset(t *testing.T) {
+	labels := map[string]string{
+		"k8s-region": "region-1",
+		"k8s-zone":   "zone-a",
+		"rack":       "rack-1",
+	}
+	tests := []struct {
+		name     string
+		required map[string]string
+		expected bool
+	}{
+		{"no requirement", nil, true},
+		{"zone and region", map[string]string{"k8s-region": "region-1", "k8s-zone": "zone-a"}, true},
+		{"additional level", map[string]string{"k8s-zone": "zone-a", "rack": "rack-1"}, true},
+		{"all levels", labels, true},
+		{"other tag", map[string]string{"k8s-zone": "zone-a", "rack": "rack-2"}, false},
+		{"category without a tag", map[string]string{"k8s-zone": "zone-a", "building": "building-1"}, false},
+	}
+	for _, test := range tests {
+		if subset := isTopologySubset(test.required, labels); subset != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, subset)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const (
+	// nodeVMAttachmentFinalizer keeps a CnsNodeVmAttachment until its volume is detached
+	nodeVMAttachmentFinalizer = "cns.vmware.com"
+	// nodeVMAttachmentResyncInterval is the interval at which all CnsNodeVmAttachments are
+	// reconciled again, which retries the failed attachments
+	nodeVMAttachmentResyncInterval = time.Minute
+)
+
+// nodeVMAttachmentReconciler attaches the volumes of guest clusters to their node VMs
+// as requested by the CnsNodeVmAttachments in the supervisor namespaces, and detaches
+// them when the CnsNodeVmAttachments are deleted.
+type nodeVMAttachmentReconciler struct {
+	manager       *common.Manager
+	k8sClient     clientset.Interface
+	dynamicClient dynamic.Interface
+	// operations serializes the reconciliation of each CnsNodeVmAttachment
+	operations *operationStore
+}
+
+// newNodeVMAttachmentReconciler creates a nodeVMAttachmentReconciler using the service account of the controller
+func newNodeVMAttachmentReconciler(manager *common.Manager) (*nodeVMAttachmentReconciler, error) {
+	k8sClient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return nil, err
+	}
+	dynamicClient, err := k8s.NewDynamicClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes dynamic client failed. Err: %v", err)
+		return nil, err
+	}
+	return &nodeVMAttachmentReconciler{
+		manager:       manager,
+		k8sClient:     k8sClient,
+		dynamicClient: dynamicClient,
+		operations:    newOperationStore(),
+	}, nil
+}
+
+// run reconciles each CnsNodeVmAttachment when it changes and every nodeVMAttachmentResyncInterval
+// until stopCh is closed.
+func (r *nodeVMAttachmentReconciler) run(stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(r.dynamicClient, nodeVMAttachmentResyncInterval)
+	informer := factory.ForResource(common.NodeVMAttachmentGVR).Informer()
+	enqueue := func(obj interface{}) {
+		attachment, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		go r.reconcileByName(attachment.GetNamespace(), attachment.GetName())
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { enqueue(newObj) },
+	})
+	factory.Start(stopCh)
+}
+
+// reconcileByName reconciles the CnsNodeVmAttachment name in namespace, unless it is being
+// reconciled already
+func (r *nodeVMAttachmentReconciler) reconcileByName(namespace string, name string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = r.operations.do(ctx, "CnsNodeVmAttachment/"+namespace+"/"+name, 0, func() (interface{}, error) {
+		err := r.reconcile(ctx, namespace, name)
+		if err != nil {
+			klog.Errorf("Failed to reconcile CnsNodeVmAttachment %s/%s. Err: %v", namespace, name, err)
+		}
+		return nil, err
+	})
+}
+
+// reconcile attaches the volume of the CnsNodeVmAttachment name in namespace to its node VM and
+// reports the disk UUID in its status, or detaches the volume once the CnsNodeVmAttachment is
+// deleted. The error of a failed attachment is reported in the status as well.
+func (r *nodeVMAttachmentReconciler) reconcile(ctx context.Context, namespace string, name string) error {
+	attachments := r.dynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(namespace)
+	attachment, err := attachments.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	nodeUUID, _, _ := unstructured.NestedString(attachment.Object, "spec", "nodeuuid")
+	volumeName, _, _ := unstructured.NestedString(attachment.Object, "spec", "volumename")
+	attached, _, _ := unstructured.NestedBool(attachment.Object, "status", "attached")
+
+	if attachment.GetDeletionTimestamp() != nil {
+		if !hasFinalizer(attachment, nodeVMAttachmentFinalizer) {
+			return nil
+		}
+		if attached {
+			if err := r.detach(ctx, namespace, nodeUUID, volumeName); err != nil {
+				return r.setError(attachment, err)
+			}
+		}
+		removeFinalizer(attachment, nodeVMAttachmentFinalizer)
+		_, err = attachments.Update(attachment, metav1.UpdateOptions{})
+		return err
+	}
+	if attached {
+		return nil
+	}
+	if !hasFinalizer(attachment, nodeVMAttachmentFinalizer) {
+		attachment.SetFinalizers(append(attachment.GetFinalizers(), nodeVMAttachmentFinalizer))
+		if attachment, err = attachments.Update(attachment, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	diskUUID, err := r.attach(ctx, namespace, nodeUUID, volumeName)
+	if err != nil {
+		return r.setError(attachment, err)
+	}
+	attachment.Object["status"] = map[string]interface{}{
+		"attached": true,
+		"metadata": map[string]interface{}{
+			common.AttributeFirstClassDiskUUID: common.FormatDiskUUID(diskUUID),
+		},
+		"error": "",
+	}
+	if _, err = attachments.Update(attachment, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Volume of PersistentVolumeClaim %s/%s is attached to node VM %s", namespace, volumeName, nodeUUID)
+	return nil
+}
+
+// attach attaches the volume of the PersistentVolumeClaim volumeName in namespace to the
+// node VM nodeUUID and returns its disk UUID
+func (r *nodeVMAttachmentReconciler) attach(ctx context.Context, namespace string, nodeUUID string, volumeName string) (string, error) {
+	volumeID, err := r.getVolumeID(namespace, volumeName)
+	if err != nil {
+		return "", err
+	}
+	vm, err := r.getNodeVM(namespace, nodeUUID)
+	if err != nil {
+		return "", err
+	}
+	if err := common.RegisterVolumeUtil(ctx, r.manager, vm.VirtualCenterHost, volumeID); err != nil {
+		return "", err
+	}
+	return common.AttachVolumeUtil(ctx, r.manager, vm, volumeID)
+}
+
+// detach detaches the volume of the PersistentVolumeClaim volumeName in namespace from the
+// node VM nodeUUID. A node VM which no longer exists has no volumes to detach.
+func (r *nodeVMAttachmentReconciler) detach(ctx context.Context, namespace string, nodeUUID string, volumeName string) error {
+	volumeID, err := r.getVolumeID(namespace, volumeName)
+	if err != nil {
+		return err
+	}
+	vm, err := r.getNodeVM(namespace, nodeUUID)
+	if err == errNodeVMNotInNamespace {
+		// Volumes are only attached to the VMs of the namespace, so there is nothing to detach
+		klog.Warningf("Node VM %s of CnsNodeVmAttachment for PersistentVolumeClaim %s/%s is not a VirtualMachine of the namespace, skipping detach",
+			nodeUUID, namespace, volumeName)
+		return nil
+	} else if err == cnsvsphere.ErrVMNotFound {
+		klog.Warningf("Node VM %s of CnsNodeVmAttachment for PersistentVolumeClaim %s/%s is not found, skipping detach", nodeUUID, namespace, volumeName)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return common.DetachVolumeUtil(ctx, r.manager, vm, volumeID)
+}
+
+// errNodeVMNotInNamespace is returned by getNodeVM for a BIOS UUID which is not the UUID of
+// a VirtualMachine of the namespace
+var errNodeVMNotInNamespace = errors.New("node VM is not a VirtualMachine of the namespace")
+
+// getNodeVM returns the node VM with the BIOS UUID nodeUUID. The UUID is written by the guest
+// cluster, so it is only trusted if it is the UUID of one of the VirtualMachines in namespace,
+// the supervisor namespace of the guest cluster. Otherwise a guest cluster could attach its
+// volumes to the VMs of other guest clusters or detach their volumes.
+func (r *nodeVMAttachmentReconciler) getNodeVM(namespace string, nodeUUID string) (*cnsvsphere.VirtualMachine, error) {
+	vms, err := r.dynamicClient.Resource(common.VirtualMachineGVR).Namespace(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	owned := false
+	for _, vm := range vms.Items {
+		biosUUID, _, _ := unstructured.NestedString(vm.Object, "status", "biosUUID")
+		if biosUUID != "" && strings.EqualFold(biosUUID, nodeUUID) {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		klog.Errorf("Node VM %s is not a VirtualMachine of namespace %s", nodeUUID, namespace)
+		return nil, errNodeVMNotInNamespace
+	}
+	vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+	if err == cnsvsphere.ErrVMNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find node VM %s: %v", nodeUUID, err)
+	}
+	return vm, nil
+}
+
+// getVolumeID returns the volume ID of the bound PersistentVolumeClaim volumeName in namespace
+func (r *nodeVMAttachmentReconciler) getVolumeID(namespace string, volumeName string) (string, error) {
+	pvc, err := r.k8sClient.CoreV1().PersistentVolumeClaims(namespace).Get(volumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName == "" {
+		return "", fmt.Errorf("PersistentVolumeClaim %s/%s is not bound", namespace, volumeName)
+	}
+	pv, err := r.k8sClient.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != common.VSphereCSIDriverName {
+		return "", fmt.Errorf("PersistentVolume %s of PersistentVolumeClaim %s/%s is not a vSphere CSI volume", pv.Name, namespace, volumeName)
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+// setError reports err in the status of attachment and returns it
+func (r *nodeVMAttachmentReconciler) setError(attachment *unstructured.Unstructured, err error) error {
+	if updateErr := unstructured.SetNestedField(attachment.Object, err.Error(), "status", "error"); updateErr != nil {
+		return updateErr
+	}
+	attachments := r.dynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(attachment.GetNamespace())
+	if _, updateErr := attachments.Update(attachment, metav1.UpdateOptions{}); updateErr != nil {
+		klog.Warningf("Failed to report the error of CnsNodeVmAttachment %s/%s. Err: %v", attachment.GetNamespace(), attachment.GetName(), updateErr)
+	}
+	return err
+}
+
+// hasFinalizer returns true if obj has the finalizer
+func hasFinalizer(obj *unstructured.Unstructured, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFinalizer removes the finalizer from obj
+func removeFinalizer(obj *unstructured.Unstructured, finalizer string) {
+	var finalizers []string
+	for _, f := range obj.GetFinalizers() {
+		if f != finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	obj.SetFinalizers(finalizers)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vmware/govmomi/simulator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func TestReconcileNodeVMAttachment(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Guest node VMs are only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-nodevmattachment",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := respCreate.Volume.VolumeId
+	defer func() {
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The supervisor PersistentVolumeClaim of the guest cluster volume
+	namespace := "test-namespace"
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "guest-pvc", Namespace: namespace},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-" + volumeID},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-" + volumeID},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: common.VSphereCSIDriverName, VolumeHandle: volumeID},
+			},
+		},
+	}
+	nodeVM := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	attachment := &unstructured.Unstructured{}
+	attachment.SetAPIVersion(common.NodeVMAttachmentGVR.GroupVersion().String())
+	attachment.SetKind("CnsNodeVmAttachment")
+	attachment.SetNamespace(namespace)
+	attachment.SetName("guest-pvc-attachment")
+	attachment.Object["spec"] = map[string]interface{}{
+		"nodeuuid":   nodeVM.Config.Uuid,
+		"volumename": pvc.Name,
+	}
+	// The node VM is a VirtualMachine of the namespace, another VM belongs to another namespace
+	var otherVM *simulator.VirtualMachine
+	for _, obj := range simulator.Map.All("VirtualMachine") {
+		if vm := obj.(*simulator.VirtualMachine); vm.Config.Uuid != nodeVM.Config.Uuid {
+			otherVM = vm
+			break
+		}
+	}
+	newVirtualMachine := func(namespace string, name string, biosUUID string) *unstructured.Unstructured {
+		vm := &unstructured.Unstructured{}
+		vm.SetAPIVersion(common.VirtualMachineGVR.GroupVersion().String())
+		vm.SetKind("VirtualMachine")
+		vm.SetNamespace(namespace)
+		vm.SetName(name)
+		vm.Object["status"] = map[string]interface{}{"biosUUID": biosUUID}
+		return vm
+	}
+	otherAttachment := attachment.DeepCopy()
+	otherAttachment.SetName("other-vm-attachment")
+	otherAttachment.Object["spec"] = map[string]interface{}{
+		"nodeuuid":   otherVM.Config.Uuid,
+		"volumename": pvc.Name,
+	}
+	r := &nodeVMAttachmentReconciler{
+		manager:   ct.controller.manager,
+		k8sClient: testclient.NewSimpleClientset(pvc, pv),
+		dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), attachment, otherAttachment,
+			newVirtualMachine(namespace, "guest-node", nodeVM.Config.Uuid),
+			newVirtualMachine("other-namespace", "other-guest-node", otherVM.Config.Uuid)),
+		operations: newOperationStore(),
+	}
+	attachments := r.dynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(namespace)
+
+	if err := r.reconcile(ctx, namespace, otherAttachment.GetName()); err != errNodeVMNotInNamespace {
+		t.Fatalf("Expected the VM of another namespace to be rejected, got %v", err)
+	}
+	if err := r.reconcile(ctx, namespace, attachment.GetName()); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err = attachments.Get(attachment.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, _, _ := unstructured.NestedBool(attachment.Object, "status", "attached")
+	diskUUID, _, _ := unstructured.NestedString(attachment.Object, "status", "metadata", common.AttributeFirstClassDiskUUID)
+	if !attached || diskUUID == "" || !hasFinalizer(attachment, nodeVMAttachmentFinalizer) {
+		t.Fatalf("Expected the volume to be attached, got %+v", attachment.Object)
+	}
+
+	// The fake client deletes objects with finalizers right away, so the deletion is marked instead
+	now := metav1.Now()
+	attachment.SetDeletionTimestamp(&now)
+	if _, err := attachments.Update(attachment, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcile(ctx, namespace, attachment.GetName()); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err = attachments.Get(attachment.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer(attachment, nodeVMAttachmentFinalizer) {
+		t.Fatalf("Expected the finalizer to be removed once the volume is detached, got %+v", attachment.Object)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	// createVolumeResultTTL is how long the result of a successful CreateVolume
+	// is kept, so that retries from the external-provisioner which arrive after
+	// the volume has been created are answered with the same volume
+	createVolumeResultTTL = 10 * time.Minute
+)
+
+// operation is a controller operation which is in progress, or whose result is retained
+type operation struct {
+	// request is the request of the operation, nil if repeats are not compared with it
+	request operationRequest
+	done    chan struct{}
+	result  interface{}
+	err     error
+	// expiresAt is zero while the operation is in progress
+	expiresAt time.Time
+}
+
+// operationStore deduplicates concurrent controller operations on the same volume.
+// Requests for an operation that is already in progress wait for it and share its result.
+type operationStore struct {
+	lock       sync.Mutex
+	operations map[string]*operation
+}
+
+// newOperationStore returns an empty operationStore
+func newOperationStore() *operationStore {
+	return &operationStore{
+		operations: make(map[string]*operation),
+	}
+}
+
+// operationRequest is the request of an operation which repeats of the operation must match
+type operationRequest interface {
+	matches(other operationRequest) bool
+}
+
+// createVolumeRequest is the operationRequest of CreateVolume. Repeats must request the
+// same volume, the secrets are not compared.
+type createVolumeRequest struct {
+	*csi.CreateVolumeRequest
+}
+
+func (r createVolumeRequest) matches(other operationRequest) bool {
+	o, ok := other.(createVolumeRequest)
+	if !ok {
+		return false
+	}
+	if !proto.Equal(r.GetCapacityRange(), o.GetCapacityRange()) ||
+		!proto.Equal(r.GetAccessibilityRequirements(), o.GetAccessibilityRequirements()) ||
+		!proto.Equal(r.GetVolumeContentSource(), o.GetVolumeContentSource()) ||
+		!reflect.DeepEqual(r.GetParameters(), o.GetParameters()) ||
+		len(r.GetVolumeCapabilities()) != len(o.GetVolumeCapabilities()) {
+		return false
+	}
+	for i, capability := range r.GetVolumeCapabilities() {
+		if !proto.Equal(capability, o.GetVolumeCapabilities()[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// operationMismatchError is returned by doRequest when the operation is in progress or
+// retained for a different request
+type operationMismatchError struct {
+	key string
+}
+
+func (e *operationMismatchError) Error() string {
+	return fmt.Sprintf("operation %q is in progress or completed for a different request", e.key)
+}
+
+// operationConflictError is returned by doExclusive when a conflicting operation is in progress
+type operationConflictError struct {
+	key string
+}
+
+func (e *operationConflictError) Error() string {
+	return fmt.Sprintf("operation %q is in progress", e.key)
+}
+
+// do runs fn for the operation identified by key, unless the same operation is already
+// in progress or its result is retained, in which case that result is returned instead.
+// The result of a successful fn is retained for resultTTL. Failed operations are
+// never retained so that they can be retried.
+func (s *operationStore) do(ctx context.Context, key string, resultTTL time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	return s.run(ctx, key, nil, resultTTL, nil, fn)
+}
+
+// doRequest is like do, but fails with an *operationMismatchError without running fn if the
+// operation is in progress or retained for a request which does not match request
+func (s *operationStore) doRequest(ctx context.Context, key string, request operationRequest, resultTTL time.Duration,
+	fn func() (interface{}, error)) (interface{}, error) {
+	return s.run(ctx, key, request, resultTTL, nil, fn)
+}
+
+// doExclusive is like do, but fails with an *operationConflictError without running fn if an
+// operation whose key starts with one of conflictingPrefixes is in progress. The check and the
+// registration of key happen under the same lock, so a conflicting operation which uses
+// doExclusive as well can not start in between.
+func (s *operationStore) doExclusive(ctx context.Context, key string, resultTTL time.Duration, conflictingPrefixes []string,
+	fn func() (interface{}, error)) (interface{}, error) {
+	return s.run(ctx, key, nil, resultTTL, conflictingPrefixes, fn)
+}
+
+// run implements do, doRequest and doExclusive
+func (s *operationStore) run(ctx context.Context, key string, request operationRequest, resultTTL time.Duration,
+	conflictingPrefixes []string, fn func() (interface{}, error)) (interface{}, error) {
+	s.lock.Lock()
+	s.removeExpired()
+	if op, ok := s.operations[key]; ok {
+		s.lock.Unlock()
+		if request != nil && op.request != nil && !request.matches(op.request) {
+			return nil, &operationMismatchError{key: key}
+		}
+		klog.V(2).Infof("Operation %q is already in progress or completed, waiting for its result", key)
+		select {
+		case <-op.done:
+			return op.result, op.err
+		case <-ctx.Done():
+			msg := fmt.Sprintf("Operation %q is still in progress", key)
+			klog.Error(msg)
+			return nil, status.Error(codes.Aborted, msg)
+		}
+	}
+	if conflictingKey, ok := s.inProgress(conflictingPrefixes...); ok {
+		s.lock.Unlock()
+		return nil, &operationConflictError{key: conflictingKey}
+	}
+	op := &operation{
+		request: request,
+		done:    make(chan struct{}),
+	}
+	s.operations[key] = op
+	s.lock.Unlock()
+
+	op.result, op.err = fn()
+
+	s.lock.Lock()
+	if op.err == nil && resultTTL > 0 {
+		op.expiresAt = time.Now().Add(resultTTL)
+	} else {
+		delete(s.operations, key)
+	}
+	s.lock.Unlock()
+	close(op.done)
+	return op.result, op.err
+}
+
+// inProgress returns the key of an operation in progress whose key starts with one of prefixes.
+// The caller must hold s.lock.
+func (s *operationStore) inProgress(prefixes ...string) (string, bool) {
+	for key, op := range s.operations {
+		if !op.expiresAt.IsZero() {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// forgetCreatedVolume drops the retained CreateVolume result for volumeID,
+// so that a new volume is created if a volume with the same name is requested again
+func (s *operationStore) forgetCreatedVolume(volumeID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, op := range s.operations {
+		if op.expiresAt.IsZero() {
+			continue
+		}
+		if resp, ok := op.result.(*csi.CreateVolumeResponse); ok && resp.GetVolume().GetVolumeId() == volumeID {
+			delete(s.operations, key)
+		}
+	}
+}
+
+// removeExpired removes retained results whose TTL has expired.
+// The caller must hold s.lock.
+func (s *operationStore) removeExpired() {
+	now := time.Now()
+	for key, op := range s.operations {
+		if !op.expiresAt.IsZero() && now.After(op.expiresAt) {
+			delete(s.operations, key)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// checkPrivileges verifies that the user of each of vcenters holds the privileges
+// required by the driver on the vCenter root folder, on the datastores of the
+// configured datacenters and on the VMs of the nodes of k8sClient, and logs the
+// missing ones. Volume operations fail without them, with errors that often don't
+// name the privilege.
+func checkPrivileges(ctx context.Context, vcenters []*cnsvsphere.VirtualCenter, k8sClient clientset.Interface) {
+	nodeVMs := getNodeVMs(k8sClient)
+	for _, vc := range vcenters {
+		var datastores []types.ManagedObjectReference
+		datastoresByURL, err := vc.GetDatastoresByURL(ctx)
+		if err != nil {
+			klog.Errorf("PrivilegeCheck: failed to get datastores of vCenter %q. err: %v", vc.Config.Host, err)
+		}
+		for _, ds := range datastoresByURL {
+			datastores = append(datastores, ds)
+		}
+		check := vc.CheckPrivileges(ctx, datastores, nodeVMs[vc.Config.Host])
+		reportMissingPrivileges(vc, check.Missing, check.Checked)
+	}
+}
+
+// reportMissingPrivileges logs the privileges missing on each entity and exports
+// the number of entities each of the checked privileges is missing on.
+func reportMissingPrivileges(vc *cnsvsphere.VirtualCenter, missing map[types.ManagedObjectReference][]string, checked map[string]bool) {
+	entityCount := make(map[string]int)
+	for privID := range checked {
+		entityCount[privID] = 0
+	}
+	var report []string
+	for entity, privIds := range missing {
+		for _, privID := range privIds {
+			entityCount[privID]++
+		}
+		report = append(report, entity.Type+" "+entity.Value+": "+strings.Join(privIds, ", "))
+	}
+	for privID, count := range entityCount {
+		missingPrivileges.WithLabelValues(vc.Config.Host, privID).Set(float64(count))
+	}
+	if len(report) == 0 {
+		klog.Infof("PrivilegeCheck: vCenter user %q holds the checked privileges %v on vCenter %q",
+			vc.Config.Username, sortedKeys(checked), vc.Config.Host)
+		return
+	}
+	sort.Strings(report)
+	klog.Errorf("PrivilegeCheck: vCenter user %q is missing privileges on vCenter %q, volume operations on these entities will fail:\n%s",
+		vc.Config.Username, vc.Config.Host, strings.Join(report, "\n"))
+}
+
+// getNodeVMs returns the VMs of the nodes of k8sClient by the host of their vCenter
+func getNodeVMs(k8sClient clientset.Interface) map[string][]types.ManagedObjectReference {
+	nodeVMs := make(map[string][]types.ManagedObjectReference)
+	nodes, err := k8sClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("PrivilegeCheck: failed to list nodes. err: %v", err)
+		return nodeVMs
+	}
+	for _, node := range nodes.Items {
+		nodeUUID := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+		if nodeUUID == "" {
+			klog.V(4).Infof("PrivilegeCheck: skipping node %q without providerID", node.Name)
+			continue
+		}
+		vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+		if err != nil {
+			klog.Warningf("PrivilegeCheck: failed to find VM for node %q with UUID %q. err: %v", node.Name, nodeUUID, err)
+			continue
+		}
+		nodeVMs[vm.VirtualCenterHost] = append(nodeVMs[vm.VirtualCenterHost], vm.Reference())
+	}
+	return nodeVMs
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestReportMissingPrivileges(t *testing.T) {
+	vc := &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc-privileges", Username: "user"}}
+	missing := map[types.ManagedObjectReference][]string{
+		{Type: "Datastore", Value: "datastore-1"}: {"Datastore.FileManagement"},
+		{Type: "Datastore", Value: "datastore-2"}: {"Datastore.FileManagement"},
+	}
+	checked := map[string]bool{"Datastore.FileManagement": true, "Cns.Searchable": true}
+	reportMissingPrivileges(vc, missing, checked)
+
+	expected := map[string]float64{"Datastore.FileManagement": 2, "Cns.Searchable": 0}
+	for privID, count := range expected {
+		if got := testutil.ToFloat64(missingPrivileges.WithLabelValues(vc.Config.Host, privID)); got != count {
+			t.Errorf("Expected privilege %s to be missing on %v entities, got %v", privID, count, got)
+		}
+	}
+}
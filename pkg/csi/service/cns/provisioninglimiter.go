@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// provisioningLimiter limits the number of CreateVolume and DeleteVolume operations the
+// controller runs at a time, in total and on each datastore. Operations waiting to run are
+// queued by datastore URL and admitted round robin across datastores, so that the bulk
+// creation of volumes on one datastore neither floods it nor delays the volumes of other
+// datastores.
+//
+// A CreateVolume operation whose StorageClass does not pin the datastore may run on any of
+// the datastores CNS could place the volume on. When the datastores are limited, it waits in
+// the queues of all of them and the driver places the volume on the datastore it is admitted
+// on, the least busy one. Otherwise it is queued by the empty URL, which is only subject to the
+// total limit, as are the creations on datastore cluster members and host-local datastores,
+// which are selected later on. DeleteVolume operations are queued by the datastore of their volume.
+// A nil provisioningLimiter admits all operations immediately.
+type provisioningLimiter struct {
+	lock sync.Mutex
+	// maxInFlight and maxPerDatastore are not enforced if 0
+	maxInFlight     int
+	maxPerDatastore int
+	inFlight        int
+	// perDatastore maps datastore URLs to the number of operations running on them
+	perDatastore map[string]int
+	// waiting maps datastore URLs to the operations waiting to run on them, in order
+	waiting map[string][]*provisioningWaiter
+	// datastores holds the datastore URLs with waiting operations in round robin order
+	datastores []string
+}
+
+// provisioningWaiter is an operation waiting to run on one of datastoreURLs
+type provisioningWaiter struct {
+	datastoreURLs []string
+	// datastoreURL is the datastore the operation is admitted on, once ready is closed
+	datastoreURL string
+	ready        chan struct{}
+}
+
+// newProvisioningLimiter returns a provisioningLimiter which runs at most maxInFlight
+// operations, and at most maxPerDatastore on each datastore, or nil if neither is limited
+func newProvisioningLimiter(maxInFlight int, maxPerDatastore int) *provisioningLimiter {
+	if maxInFlight <= 0 && maxPerDatastore <= 0 {
+		return nil
+	}
+	if maxInFlight < 0 {
+		maxInFlight = 0
+	}
+	if maxPerDatastore < 0 {
+		maxPerDatastore = 0
+	}
+	return &provisioningLimiter{
+		maxInFlight:     maxInFlight,
+		maxPerDatastore: maxPerDatastore,
+		perDatastore:    make(map[string]int),
+		waiting:         make(map[string][]*provisioningWaiter),
+	}
+}
+
+// limitsDatastores returns true if the number of operations on each datastore is limited
+func (l *provisioningLimiter) limitsDatastores() bool {
+	return l != nil && l.maxPerDatastore > 0
+}
+
+// acquire blocks until operation may run on the datastore datastoreURL, and returns the
+// function to call once it completed. Aborted is returned if ctx is done before then.
+func (l *provisioningLimiter) acquire(ctx context.Context, operation string, datastoreURL string) (func(), error) {
+	_, release, err := l.acquireAny(ctx, operation, []string{datastoreURL})
+	return release, err
+}
+
+// acquireAny blocks until operation may run on one of the datastores datastoreURLs, and returns
+// that datastore and the function to call once the operation completed. Of the datastores the
+// operation can run on right away, the one with the fewest operations is returned.
+// Aborted is returned if ctx is done before then.
+func (l *provisioningLimiter) acquireAny(ctx context.Context, operation string, datastoreURLs []string) (string, func(), error) {
+	if l == nil {
+		return datastoreURLs[0], func() {}, nil
+	}
+	l.lock.Lock()
+	// Waiting operations are admitted as soon as they can run, so none of them
+	// would be overtaken by an operation which can run right away
+	if datastoreURL, ok := l.leastBusy(datastoreURLs); ok {
+		l.run(datastoreURL)
+		l.lock.Unlock()
+		return datastoreURL, func() { l.release(datastoreURL) }, nil
+	}
+	waiter := &provisioningWaiter{datastoreURLs: datastoreURLs, ready: make(chan struct{})}
+	for _, datastoreURL := range datastoreURLs {
+		if _, ok := l.waiting[datastoreURL]; !ok {
+			l.datastores = append(l.datastores, datastoreURL)
+		}
+		l.waiting[datastoreURL] = append(l.waiting[datastoreURL], waiter)
+	}
+	klog.V(4).Infof("%s is waiting to run on datastores %q, %d operations in progress", operation, datastoreURLs, l.inFlight)
+	l.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return waiter.datastoreURL, func() { l.release(waiter.datastoreURL) }, nil
+	case <-ctx.Done():
+	}
+	l.lock.Lock()
+	select {
+	case <-waiter.ready:
+		// Admitted while ctx was done, give the slot to the next operation
+		l.lock.Unlock()
+		l.release(waiter.datastoreURL)
+	default:
+		l.remove(waiter)
+		l.lock.Unlock()
+	}
+	msg := fmt.Sprintf("%s is still waiting for other volume operations on datastores %q to complete", operation, datastoreURLs)
+	klog.Error(msg)
+	return "", nil, status.Error(codes.Aborted, msg)
+}
+
+// leastBusy returns the datastore of datastoreURLs with the fewest operations which another
+// operation can run on, and false if there is none. The caller must hold l.lock.
+func (l *provisioningLimiter) leastBusy(datastoreURLs []string) (string, bool) {
+	var leastBusy string
+	found := false
+	for _, datastoreURL := range datastoreURLs {
+		if l.canRun(datastoreURL) && (!found || l.perDatastore[datastoreURL] < l.perDatastore[leastBusy]) {
+			leastBusy = datastoreURL
+			found = true
+		}
+	}
+	return leastBusy, found
+}
+
+// release completes an operation on datastoreURL and admits the waiting operations which can run
+func (l *provisioningLimiter) release(datastoreURL string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight--
+	if l.perDatastore[datastoreURL]--; l.perDatastore[datastoreURL] <= 0 {
+		delete(l.perDatastore, datastoreURL)
+	}
+	for l.admitNext() {
+	}
+}
+
+// admitNext admits the first waiting operation in round robin order which can run,
+// and returns false if there is none. The caller must hold l.lock.
+func (l *provisioningLimiter) admitNext() bool {
+	for _, datastoreURL := range l.datastores {
+		if !l.canRun(datastoreURL) {
+			continue
+		}
+		waiter := l.waiting[datastoreURL][0]
+		l.remove(waiter)
+		// The datastore takes its next turn after the other datastores with waiting operations
+		if _, ok := l.waiting[datastoreURL]; ok {
+			l.removeDatastore(datastoreURL)
+			l.datastores = append(l.datastores, datastoreURL)
+		}
+		waiter.datastoreURL = datastoreURL
+		l.run(datastoreURL)
+		close(waiter.ready)
+		return true
+	}
+	return false
+}
+
+// canRun returns true if another operation can run on datastoreURL. The caller must hold l.lock.
+func (l *provisioningLimiter) canRun(datastoreURL string) bool {
+	if l.maxInFlight > 0 && l.inFlight >= l.maxInFlight {
+		return false
+	}
+	return datastoreURL == "" || l.maxPerDatastore == 0 || l.perDatastore[datastoreURL] < l.maxPerDatastore
+}
+
+// run counts an operation running on datastoreURL. The caller must hold l.lock.
+func (l *provisioningLimiter) run(datastoreURL string) {
+	l.inFlight++
+	l.perDatastore[datastoreURL]++
+}
+
+// remove drops waiter from the queues of its datastores. The caller must hold l.lock.
+func (l *provisioningLimiter) remove(waiter *provisioningWaiter) {
+	for _, datastoreURL := range waiter.datastoreURLs {
+		waiting := l.waiting[datastoreURL]
+		for i := range waiting {
+			if waiting[i] == waiter {
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		if len(waiting) > 0 {
+			l.waiting[datastoreURL] = waiting
+			continue
+		}
+		delete(l.waiting, datastoreURL)
+		l.removeDatastore(datastoreURL)
+	}
+}
+
+// removeDatastore drops datastoreURL from the round robin order. The caller must hold l.lock.
+func (l *provisioningLimiter) removeDatastore(datastoreURL string) {
+	for i := range l.datastores {
+		if l.datastores[i] == datastoreURL {
+			l.datastores = append(l.datastores[:i], l.datastores[i+1:]...)
+			break
+		}
+	}
+}
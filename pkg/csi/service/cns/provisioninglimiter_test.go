@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProvisioningLimiter(t *testing.T) {
+	ctx := context.Background()
+	if l := newProvisioningLimiter(0, 0); l != nil {
+		t.Fatalf("Expected no limiter if nothing is limited")
+	}
+	var unlimited *provisioningLimiter
+	release, err := unlimited.acquire(ctx, "CreateVolume", "ds:///a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	l := newProvisioningLimiter(2, 1)
+	releaseA, err := l.acquire(ctx, "CreateVolume a1", "ds:///a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a2 waits for a1 on datastore a, b1 runs on datastore b
+	admitted := make(chan string, 4)
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		release, _ := l.acquire(ctx, "CreateVolume a2", "ds:///a/")
+		admitted <- "a2"
+		release()
+	}()
+	waitForWaiting(t, l, 1)
+	releaseB, err := l.acquire(ctx, "CreateVolume b1", "ds:///b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two operations are in progress, so b2 and c1 wait as well
+	finishB2 := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		release, _ := l.acquire(ctx, "CreateVolume b2", "ds:///b/")
+		admitted <- "b2"
+		<-finishB2
+		release()
+	}()
+	waitForWaiting(t, l, 2)
+	go func() {
+		defer wg.Done()
+		release, _ := l.acquire(ctx, "CreateVolume c1", "ds:///c/")
+		admitted <- "c1"
+		release()
+	}()
+	waitForWaiting(t, l, 3)
+
+	// Datastore a was queued first, but only b2 can take the slot of b1
+	releaseB()
+	if op := <-admitted; op != "b2" {
+		t.Fatalf("Expected b2 to run after b1, got %s", op)
+	}
+	releaseA()
+	for _, expected := range []string{"a2", "c1"} {
+		if op := <-admitted; op != expected {
+			t.Fatalf("Expected %s to run next, got %s", expected, op)
+		}
+	}
+	close(finishB2)
+	wg.Wait()
+
+	// Operations which wait longer than their request are aborted
+	release, err = l.acquire(ctx, "CreateVolume a3", "ds:///a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = l.acquire(timeoutCtx, "CreateVolume a4", "ds:///a/"); status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted, got %v", err)
+	}
+	if len(l.waiting) != 0 || len(l.datastores) != 0 {
+		t.Fatalf("Expected aborted operation to be removed, got %v", l.waiting)
+	}
+	// Volumes placed by CNS are not limited per datastore
+	releaseAny, err := l.acquire(ctx, "CreateVolume any", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseAny()
+	release()
+	if l.inFlight != 0 || len(l.perDatastore) != 0 {
+		t.Fatalf("Expected no operations in progress, got %d", l.inFlight)
+	}
+}
+
+// waitForWaiting waits until n operations are waiting in l
+func waitForWaiting(t *testing.T, l *provisioningLimiter, n int) {
+	for i := 0; i < 100; i++ {
+		l.lock.Lock()
+		waiting := 0
+		for _, w := range l.waiting {
+			waiting += len(w)
+		}
+		l.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d waiting operations", n)
+}
+
+func TestProvisioningLimiterAcquireAny(t *testing.T) {
+	ctx := context.Background()
+	datastoreURLs := []string{"ds:///a/", "ds:///b/"}
+	l := newProvisioningLimiter(0, 2)
+	releaseA, err := l.acquire(ctx, "CreateVolume a1", "ds:///a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The least busy datastore is chosen
+	datastoreURL, releaseB, err := l.acquireAny(ctx, "CreateVolume any1", datastoreURLs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if datastoreURL != "ds:///b/" {
+		t.Fatalf("Expected datastore b, got %s", datastoreURL)
+	}
+	if _, _, err = l.acquireAny(ctx, "CreateVolume any2", datastoreURLs); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = l.acquireAny(ctx, "CreateVolume any3", datastoreURLs); err != nil {
+		t.Fatal(err)
+	}
+	// Both datastores are busy, so any4 waits on both and runs on the first one released
+	admitted := make(chan string)
+	go func() {
+		datastoreURL, release, _ := l.acquireAny(ctx, "CreateVolume any4", datastoreURLs)
+		admitted <- datastoreURL
+		release()
+	}()
+	waitForWaiting(t, l, 2)
+	releaseB()
+	if datastoreURL := <-admitted; datastoreURL != "ds:///b/" {
+		t.Fatalf("Expected any4 to run on datastore b, got %s", datastoreURL)
+	}
+	if len(l.waiting) != 0 || len(l.datastores) != 0 {
+		t.Fatalf("Expected admitted operation to be removed from all queues, got %v", l.waiting)
+	}
+
+	// Operations which wait longer than their request are aborted
+	releaseA()
+	for _, operation := range []string{"CreateVolume any5", "CreateVolume any6"} {
+		if _, _, err = l.acquireAny(ctx, operation, datastoreURLs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, _, err = l.acquireAny(timeoutCtx, "CreateVolume any7", datastoreURLs); status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted, got %v", err)
+	}
+	if len(l.waiting) != 0 || len(l.datastores) != 0 {
+		t.Fatalf("Expected aborted operation to be removed from all queues, got %v", l.waiting)
+	}
+}
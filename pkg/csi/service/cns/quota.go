@@ -0,0 +1,244 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	clientset "k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const (
+	// pvcNamePrefix is the prefix of the volume names generated by the external-provisioner,
+	// followed by the UID of the PVC
+	pvcNamePrefix = "pvc-"
+)
+
+// storageQuotaGVR identifies the CnsStorageQuota custom resource. Its spec.limit is the
+// total capacity of the volumes which may be provisioned in its namespace, e.g. "100Gi".
+var storageQuotaGVR = schema.GroupVersionResource{
+	Group:    "cns.vmware.com",
+	Version:  "v1alpha1",
+	Resource: "cnsstoragequotas",
+}
+
+// namespaceQuota limits the capacity of the volumes provisioned in a namespace
+// to the CnsStorageQuota objects of that namespace
+type namespaceQuota struct {
+	pvLister      corelisters.PersistentVolumeLister
+	pvcLister     corelisters.PersistentVolumeClaimLister
+	dynamicClient dynamic.Interface
+	// lock serializes the checks of the quotas with the changes of the reservations
+	lock sync.Mutex
+	// reservations maps the names of the volumes being provisioned, or provisioned
+	// without a PV yet, to the capacity reserved for them
+	reservations map[string]*quotaReservation
+}
+
+// quotaReservation is the capacity reserved for a volume in a namespace
+type quotaReservation struct {
+	namespace string
+	bytes     int64
+	// volumeID is set once the volume is created
+	volumeID string
+}
+
+// newNamespaceQuota creates a namespaceQuota using the service account of the controller
+func newNamespaceQuota() (*namespaceQuota, error) {
+	k8sClient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return nil, err
+	}
+	dynamicClient, err := k8s.NewDynamicClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes dynamic client failed. Err: %v", err)
+		return nil, err
+	}
+	return newNamespaceQuotaWithClients(k8sClient, dynamicClient, wait.NeverStop)
+}
+
+// newNamespaceQuotaWithClients creates a namespaceQuota whose PV and PVC informers
+// run until stopCh is closed
+func newNamespaceQuotaWithClients(k8sClient clientset.Interface, dynamicClient dynamic.Interface,
+	stopCh <-chan struct{}) (*namespaceQuota, error) {
+	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	q := &namespaceQuota{
+		pvLister:      factory.Core().V1().PersistentVolumes().Lister(),
+		pvcLister:     factory.Core().V1().PersistentVolumeClaims().Lister(),
+		dynamicClient: dynamicClient,
+		reservations:  make(map[string]*quotaReservation),
+	}
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync the %v informer cache", informerType)
+		}
+	}
+	return q, nil
+}
+
+// getNamespace returns the namespace of the PVC the volume in req is provisioned for.
+// The namespace is passed by the external-provisioner when started with --extra-create-metadata,
+// otherwise it is looked up from the PVC UID in the volume name.
+// An empty namespace is returned if the PVC can not be found.
+func (q *namespaceQuota) getNamespace(req *csi.CreateVolumeRequest) (string, error) {
+	for paramName, paramValue := range req.Parameters {
+		if strings.ToLower(paramName) == common.AttributePVCNamespace {
+			return paramValue, nil
+		}
+	}
+	if !strings.HasPrefix(req.Name, pvcNamePrefix) {
+		return "", nil
+	}
+	pvcUID := strings.TrimPrefix(req.Name, pvcNamePrefix)
+	pvcs, err := q.pvcLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list PVCs. Err: %v", err)
+		return "", err
+	}
+	for _, pvc := range pvcs {
+		if string(pvc.UID) == pvcUID {
+			return pvc.Namespace, nil
+		}
+	}
+	return "", nil
+}
+
+// reserve reserves requestedBytes in namespace for the volume name until it is released.
+// It returns a ResourceExhausted error if the capacity provisioned and reserved for other volumes
+// in namespace plus requestedBytes exceeds the limit of any CnsStorageQuota in the namespace.
+func (q *namespaceQuota) reserve(namespace string, name string, requestedBytes int64) error {
+	quotas, err := q.dynamicClient.Resource(storageQuotaGVR).Namespace(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list storage quotas in namespace %q. Err: %v", namespace, err)
+		klog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	if len(quotas.Items) == 0 {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	provisionedBytes, err := q.getProvisionedBytes(namespace, name)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get capacity provisioned in namespace %q. Err: %v", namespace, err)
+		klog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	for _, quota := range quotas.Items {
+		limitStr, found, err := unstructured.NestedString(quota.Object, "spec", "limit")
+		if err != nil || !found {
+			klog.Warningf("Ignoring storage quota %s/%s without spec.limit", namespace, quota.GetName())
+			continue
+		}
+		limit, err := resource.ParseQuantity(limitStr)
+		if err != nil {
+			klog.Warningf("Ignoring storage quota %s/%s with invalid limit %q. Err: %v", namespace, quota.GetName(), limitStr, err)
+			continue
+		}
+		if provisionedBytes+requestedBytes > limit.Value() {
+			msg := fmt.Sprintf("Provisioning %d bytes exceeds storage quota %s/%s. Limit: %s, provisioned: %d bytes",
+				requestedBytes, namespace, quota.GetName(), limitStr, provisionedBytes)
+			klog.Error(msg)
+			return status.Error(codes.ResourceExhausted, msg)
+		}
+	}
+	q.reservations[name] = &quotaReservation{namespace: namespace, bytes: requestedBytes}
+	return nil
+}
+
+// complete records that the volume name was created as volumeID. Its capacity stays reserved
+// until the PV of volumeID is found or volumeID is released.
+func (q *namespaceQuota) complete(name string, volumeID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if reservation, ok := q.reservations[name]; ok {
+		reservation.volumeID = volumeID
+	}
+}
+
+// release releases the capacity reserved for the volume name, which failed to be created
+func (q *namespaceQuota) release(name string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.reservations, name)
+}
+
+// releaseVolume releases the capacity reserved for the deleted volume volumeID
+func (q *namespaceQuota) releaseVolume(volumeID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for name, reservation := range q.reservations {
+		if reservation.volumeID == volumeID {
+			delete(q.reservations, name)
+		}
+	}
+}
+
+// getProvisionedBytes returns the total capacity of the vSphere CSI volumes bound
+// to PVCs in namespace and reserved for the volumes other than name in namespace.
+// The reservations of volumes whose PVs are found are dropped. It must be called
+// with q.lock held.
+func (q *namespaceQuota) getProvisionedBytes(namespace string, name string) (int64, error) {
+	pvs, err := q.pvLister.List(labels.Everything())
+	if err != nil {
+		return 0, err
+	}
+	var provisionedBytes int64
+	volumeIDs := make(map[string]bool)
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != common.VSphereCSIDriverName {
+			continue
+		}
+		volumeIDs[pv.Spec.CSI.VolumeHandle] = true
+		if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		provisionedBytes += capacity.Value()
+	}
+	for reservedName, reservation := range q.reservations {
+		if reservation.volumeID != "" && volumeIDs[reservation.volumeID] {
+			delete(q.reservations, reservedName)
+			continue
+		}
+		if reservation.namespace == namespace && reservedName != name {
+			provisionedBytes += reservation.bytes
+		}
+	}
+	return provisionedBytes, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// RegisterDisks registers the virtual disks at volumePaths, e.g. "[vsanDatastore] kubevols/disk-1.vmdk",
+// as First Class Disks and with CNS as volumes of the cluster of cfg, and writes a manifest of a
+// statically provisioned PersistentVolume for each of them to out. Registering a disk again is a no-op,
+// so RegisterDisks can be run again for the disks which failed to register.
+func RegisterDisks(ctx context.Context, cfg *config.Config, volumePaths []string, out io.Writer) error {
+	manager, _, err := connectVirtualCenters(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	fsType := cfg.Global.DefaultFsType
+	if fsType == "" {
+		fsType = common.DefaultFsType
+	}
+	return registerDisks(ctx, manager, volumePaths, fsType, out)
+}
+
+// registerDisks registers the virtual disks at volumePaths with the vCenters of manager and
+// writes the manifests of their PersistentVolumes with fsType to out.
+func registerDisks(ctx context.Context, manager *common.Manager, volumePaths []string, fsType string, out io.Writer) error {
+	failed := 0
+	for _, volumePath := range volumePaths {
+		pv, err := registerDisk(ctx, manager, volumePath, fsType)
+		if err != nil {
+			klog.Errorf("Failed to register disk %q. Err: %v", volumePath, err)
+			failed++
+			continue
+		}
+		manifest, err := yaml.Marshal(pv)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(out, "---\n%s", manifest); err != nil {
+			return err
+		}
+		klog.V(2).Infof("Disk %q is registered as volume %s", volumePath, pv.Spec.CSI.VolumeHandle)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d disks failed to register", failed, len(volumePaths))
+	}
+	return nil
+}
+
+// registerDisk registers the virtual disk at volumePath and returns the PersistentVolume of its volume.
+func registerDisk(ctx context.Context, manager *common.Manager, volumePath string, fsType string) (*v1.PersistentVolume, error) {
+	var dsPath object.DatastorePath
+	if !dsPath.FromString(volumePath) || !strings.HasSuffix(dsPath.Path, ".vmdk") {
+		return nil, fmt.Errorf("invalid volume path %q", volumePath)
+	}
+	ds, err := getDatastoreByName(ctx, manager, dsPath.Datastore)
+	if err != nil {
+		return nil, err
+	}
+	diskName := strings.TrimSuffix(path.Base(dsPath.Path), ".vmdk")
+	volumeID, err := ds.RegisterDisk(ctx, dsPath.Path, diskName)
+	if err != nil {
+		return nil, err
+	}
+	if err := common.RegisterVolumeUtil(ctx, manager, ds.Datacenter.VirtualCenterHost, volumeID); err != nil {
+		return nil, err
+	}
+	capacityInMB, err := ds.GetFirstClassDiskCapacityInMB(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	// PersistentVolumes are named after their disks where possible
+	name := strings.ToLower(diskName)
+	if len(validation.IsDNS1123Subdomain(name)) > 0 {
+		name = volumeID
+	}
+	return &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(capacityInMB*common.MbInBytes, resource.BinarySI),
+			},
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			// The disks predate the cluster, so they are kept when their PersistentVolumeClaims are deleted
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       common.VSphereCSIDriverName,
+					VolumeHandle: volumeID,
+					FSType:       fsType,
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/simulator"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestRegisterDisks(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Legacy disks are only created on the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := getControllerTest(t)
+
+	ds := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	dir := filepath.Join(ds.Info.GetDatastoreInfo().Url, "legacy")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Disk-1.vmdk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	volumePaths := []string{
+		fmt.Sprintf("[%s] legacy/Disk-1.vmdk", ds.Name),
+		fmt.Sprintf("[%s] legacy/missing.vmdk", ds.Name),
+	}
+
+	var out bytes.Buffer
+	if err := registerDisks(ctx, ct.controller.manager, volumePaths, "ext4", &out); err == nil {
+		t.Fatal("Expected an error for the missing disk")
+	}
+	manifests := strings.Split(strings.TrimPrefix(out.String(), "---\n"), "---\n")
+	if len(manifests) != 1 {
+		t.Fatalf("Expected 1 manifest, got %q", out.String())
+	}
+	var pv v1.PersistentVolume
+	if err := yaml.Unmarshal([]byte(manifests[0]), &pv); err != nil {
+		t.Fatal(err)
+	}
+	if pv.Name != "disk-1" || pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle == "" {
+		t.Fatalf("Unexpected PersistentVolume %+v", pv)
+	}
+	queryResult, err := ct.vcenter.CnsClient.QueryVolume(ctx, cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: pv.Spec.CSI.VolumeHandle}},
+	})
+	if err != nil || len(queryResult.Volumes) != 1 {
+		t.Fatalf("Expected volume %s to be registered with CNS, got %v, err: %v", pv.Spec.CSI.VolumeHandle, queryResult, err)
+	}
+}
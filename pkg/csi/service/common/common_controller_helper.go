@@ -25,6 +25,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
 
 // ValidateCreateVolumeRequest is the helper function to validate
@@ -49,6 +51,143 @@ func ValidateCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
 	return nil
 }
 
+// ValidateVolumeParameters validates the volume parameters of a StorageClass, as passed
+// in CreateVolumeRequest. The parameters added by the external-provisioner are ignored.
+// Function returns error if validation fails otherwise returns nil.
+func ValidateVolumeParameters(params map[string]string) error {
+	for paramName, paramValue := range params {
+		paramName = strings.ToLower(paramName)
+		if strings.HasPrefix(paramName, CSIParameterPrefix) {
+			continue
+		}
+		if paramName != AttributeDatastoreURL && paramName != AttributeDatastoreClusterName &&
+			paramName != AttributeStoragePolicyName && paramName != AttributeStoragePolicyID &&
+			paramName != AttributeSiteAffinity && paramName != AttributeFsType &&
+			paramName != AttributeMkfsOptions && paramName != AttributeLuksEncryption &&
+			paramName != AttributeCSIMigration && paramName != AttributeDatastoreMigrationParam &&
+			paramName != AttributeDiskFormatMigrationParam && paramName != AttributeVsanDirect &&
+			paramName != AttributePmem && paramName != AttributeChangedBlockTracking &&
+			paramName != AttributeDatastoreType {
+			msg := fmt.Sprintf("Volume parameter %s is not a valid Vanilla CSI parameter.", paramName)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+		if paramName == AttributeSiteAffinity {
+			if _, ok := SiteAffinityToVsanLocality[strings.ToLower(paramValue)]; !ok {
+				msg := fmt.Sprintf("Volume parameter %s: %q is not supported. Supported values: %s, %s, %s", paramName, paramValue,
+					SiteAffinityNone, SiteAffinityPreferred, SiteAffinitySecondary)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == AttributeLuksEncryption || paramName == AttributeCSIMigration ||
+			paramName == AttributeVsanDirect || paramName == AttributePmem ||
+			paramName == AttributeChangedBlockTracking {
+			if _, err := strconv.ParseBool(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s: %q is not a valid boolean.", paramName, paramValue)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == AttributeDatastoreType {
+			if _, ok := DatastoreTypeToSummaryTypes[strings.ToLower(paramValue)]; !ok {
+				msg := fmt.Sprintf("Volume parameter %s: %q is not supported. Supported values: %s, %s, %s, %s", paramName, paramValue,
+					DatastoreTypeVsan, DatastoreTypeVmfs, DatastoreTypeNfs, DatastoreTypeVvol)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == AttributeFsType && paramValue != "" && !IsValidFsType(paramValue) {
+			msg := fmt.Sprintf("Volume parameter %s: %q is not supported. Supported fsTypes: %v", paramName, paramValue, SupportedFsTypes)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+	}
+	if HasParameter(params, AttributeStoragePolicyName) && HasParameter(params, AttributeStoragePolicyID) {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", AttributeStoragePolicyName, AttributeStoragePolicyID)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if HasParameter(params, AttributeDatastoreURL) && HasParameter(params, AttributeDatastoreClusterName) {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", AttributeDatastoreURL, AttributeDatastoreClusterName)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if isTrueParameter(params, AttributeVsanDirect) && isTrueParameter(params, AttributePmem) {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", AttributeVsanDirect, AttributePmem)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if GetDatastoreType(params) != "" && (HasParameter(params, AttributeDatastoreURL) || HasParameter(params, AttributeDatastoreClusterName)) {
+		msg := fmt.Sprintf("Volume parameters %s and %s can not be combined with %s or %s.",
+			AttributeVsanDirect, AttributePmem, AttributeDatastoreURL, AttributeDatastoreClusterName)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if HasParameter(params, AttributeDatastoreType) && (GetDatastoreType(params) != "" || HasParameter(params, AttributeDatastoreClusterName)) {
+		msg := fmt.Sprintf("Volume parameter %s can not be combined with %s, %s or %s.",
+			AttributeDatastoreType, AttributeVsanDirect, AttributePmem, AttributeDatastoreClusterName)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if HasParameter(params, AttributeDatastoreMigrationParam) && !IsCSIMigrationRequest(params) {
+		msg := fmt.Sprintf("Volume parameter %s is only valid with %s: \"true\".", AttributeDatastoreMigrationParam, AttributeCSIMigration)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// HasParameter returns true if params has a non-empty value for the case insensitive name
+func HasParameter(params map[string]string, name string) bool {
+	for paramName, paramValue := range params {
+		if strings.ToLower(paramName) == name && paramValue != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCSIMigrationRequest returns true if params are those of a StorageClass translated
+// from an in-tree vSphere StorageClass
+func IsCSIMigrationRequest(params map[string]string) bool {
+	for paramName, paramValue := range params {
+		if strings.ToLower(paramName) == AttributeCSIMigration {
+			csiMigration, _ := strconv.ParseBool(paramValue)
+			return csiMigration
+		}
+	}
+	return false
+}
+
+// GetDatastoreType returns the type of the host-local datastores params request volumes on,
+// VsanDirectDatastoreType for vsandirect and PmemDatastoreType for pmem volumes, if any
+func GetDatastoreType(params map[string]string) string {
+	if isTrueParameter(params, AttributeVsanDirect) {
+		return cnsvsphere.VsanDirectDatastoreType
+	}
+	if isTrueParameter(params, AttributePmem) {
+		return cnsvsphere.PmemDatastoreType
+	}
+	return ""
+}
+
+// IsChangedBlockTrackingRequest returns true if changed block tracking is requested in params
+func IsChangedBlockTrackingRequest(params map[string]string) bool {
+	return isTrueParameter(params, AttributeChangedBlockTracking)
+}
+
+// GetSharedDatastoreTypes returns the summary types of the shared datastores the datastoretype
+// parameter of params places volumes on, or nil if volumes may be placed on any datastore
+func GetSharedDatastoreTypes(params map[string]string) []string {
+	for paramName, paramValue := range params {
+		if strings.ToLower(paramName) == AttributeDatastoreType {
+			return DatastoreTypeToSummaryTypes[strings.ToLower(paramValue)]
+		}
+	}
+	return nil
+}
+
+// isTrueParameter returns true if the boolean parameter with the case insensitive name is true
+func isTrueParameter(params map[string]string, name string) bool {
+	for paramName, paramValue := range params {
+		if strings.ToLower(paramName) == name {
+			value, _ := strconv.ParseBool(paramValue)
+			return value
+		}
+	}
+	return false
+}
+
 // ValidateDeleteVolumeRequest is the helper function to validate
 // DeleteVolumeRequest for all block controllers.
 // Function returns error if validation fails otherwise returns nil.
@@ -133,3 +272,10 @@ func CheckAPI(version string) error {
 	}
 	return nil
 }
+
+// IsVvolSupported returns true if CNS of the vCenter with the API version provisions
+// volumes on Virtual Volumes datastores
+func IsVvolSupported(version string) bool {
+	major, err := strconv.Atoi(strings.Split(version, ".")[0])
+	return err == nil && major >= MinVvolVCenterMajor
+}
@@ -44,14 +44,124 @@ const (
 	// For Example: StoragePolicyId: "251bce41-cb24-41df-b46b-7c75aed3c4ee"
 	AttributeStoragePolicyID = "storagepolicyid"
 
+	// AttributeDatastoreClusterName represents the name of a datastore cluster in the Storage Classs
+	// For Example: DatastoreClusterName: "DatastoreCluster1"
+	AttributeDatastoreClusterName = "datastoreclustername"
+
+	// AttributeSiteAffinity represents the site which volumes are pinned to on stretched vSAN clusters
+	// For Example: SiteAffinity: "preferred"
+	AttributeSiteAffinity = "siteaffinity"
+
+	// AttributeVsanDirect represents whether volumes are placed on the vSAN Direct datastores of the hosts
+	// of the nodes, which requires the host-local topology. For Example: VsanDirect: "true"
+	AttributeVsanDirect = "vsandirect"
+
+	// AttributePmem represents whether volumes are placed on the persistent memory datastores of the hosts
+	// of the nodes, which requires the host-local topology. For Example: Pmem: "true"
+	AttributePmem = "pmem"
+
+	// AttributeChangedBlockTracking represents whether changed block tracking is enabled on the
+	// First Class Disks of volumes, so that incremental backups can query their changed blocks
+	// For Example: changedBlockTracking: "true"
+	AttributeChangedBlockTracking = "changedblocktracking"
+
+	// AttributeDatastoreType represents the technology of the shared datastores volumes are placed on,
+	// DatastoreTypeVsan, DatastoreTypeVmfs, DatastoreTypeNfs or DatastoreTypeVvol
+	// For Example: datastoreType: "vmfs"
+	AttributeDatastoreType = "datastoretype"
+
+	// DatastoreTypeVsan places volumes on vSAN datastores
+	DatastoreTypeVsan = "vsan"
+
+	// DatastoreTypeVmfs places volumes on VMFS datastores
+	DatastoreTypeVmfs = "vmfs"
+
+	// DatastoreTypeNfs places volumes on NFS 3 and NFS 4.1 datastores
+	DatastoreTypeNfs = "nfs"
+
+	// DatastoreTypeVvol places volumes on Virtual Volumes datastores
+	DatastoreTypeVvol = "vvol"
+
+	// SiteAffinityNone means volumes are not pinned to a site
+	SiteAffinityNone = "none"
+
+	// SiteAffinityPreferred means volumes are pinned to the preferred fault domain
+	SiteAffinityPreferred = "preferred"
+
+	// SiteAffinitySecondary means volumes are pinned to the secondary fault domain
+	SiteAffinitySecondary = "secondary"
+
+	// CSIParameterPrefix is the prefix of the parameters added by the external-provisioner
+	// to CreateVolumeRequest, e.g. when started with --extra-create-metadata
+	CSIParameterPrefix = "csi.storage.k8s.io/"
+
+	// AttributePVCNamespace represents the namespace of the PVC for which the volume is provisioned
+	AttributePVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
 	// AttributeFsType represents filesystem type in the Storage Classs
 	// For Example: FsType: "ext4"
 	AttributeFsType = "fstype"
 
+	// AttributeMkfsOptions represents additional options passed to mkfs when formatting the volume,
+	// separated by spaces
+	// For Example: MkfsOptions: "-m reflink=1"
+	AttributeMkfsOptions = "mkfsoptions"
+
+	// AttributeLuksEncryption represents whether the volume is encrypted with LUKS on the node
+	// For Example: LuksEncryption: "true"
+	AttributeLuksEncryption = "luksencryption"
+
+	// AttributeCSIMigration is "true" in the parameters of StorageClasses translated from
+	// in-tree vSphere StorageClasses for CSI migration
+	AttributeCSIMigration = "csimigration"
+
+	// AttributeDatastoreMigrationParam represents the datastore name of a translated in-tree StorageClass
+	// For Example: Datastore-MigrationParam: "vsanDatastore"
+	AttributeDatastoreMigrationParam = "datastore-migrationparam"
+
+	// AttributeDiskFormatMigrationParam represents the disk format of a translated in-tree StorageClass.
+	// It is ignored, CNS provisions thin disks.
+	AttributeDiskFormatMigrationParam = "diskformat-migrationparam"
+
+	// AttributeSupervisorStorageClass represents the StorageClass in the supervisor cluster
+	// with which the volumes of a guest cluster are provisioned
+	// For Example: SVStorageClass: "gold"
+	AttributeSupervisorStorageClass = "svstorageclass"
+
+	// AttributeFcdID represents the ID of the First Class Disk backing the volume in the
+	// attributes of its PersistentVolume, which backup tools use to locate the disk in vCenter.
+	// It differs from the volume handle of migrated in-tree volumes, which is their VMDK path.
+	AttributeFcdID = "fcdid"
+
+	// AttributeVcenterUUID represents the instance UUID of the vCenter of the volume
+	// in the attributes of its PersistentVolume
+	AttributeVcenterUUID = "vcenteruuid"
+
+	// EnvClusterFlavor is the environment variable which selects the flavor of the driver,
+	// ClusterFlavorVanilla or ClusterFlavorGuest
+	EnvClusterFlavor = "CLUSTER_FLAVOR"
+
+	// ClusterFlavorVanilla is the flavor of the driver which provisions volumes with CNS
+	ClusterFlavorVanilla = "VANILLA"
+
+	// ClusterFlavorGuest is the paravirtual flavor of the driver in a guest cluster, which
+	// provisions volumes through PersistentVolumeClaims in its supervisor cluster
+	ClusterFlavorGuest = "GUEST_CLUSTER"
+
+	// LuksPassphraseKey is the key of the LUKS passphrase in the node stage secret
+	LuksPassphraseKey = "passphrase"
+
 	// DefaultFsType represents the default filesystem type which will be used to format the volume
 	// during mount if user does not specify the filesystem type in the Storage Class
 	DefaultFsType = "ext4"
 
+	// VSphereCSIDriverName is the name of the vSphere CSI driver
+	VSphereCSIDriverName = "csi.vsphere.vmware.com"
+
+	// AnnotationMaxVolumes is the node annotation with the number of volumes which can be
+	// attached to the VM of the node
+	AnnotationMaxVolumes = "csi.vsphere.vmware.com/max-volumes"
+
 	//ProviderPrefix is the prefix used for the ProviderID set on the node
 	// Example: vsphere://4201794a-f26b-8914-d95a-edeb7ecc4a8f
 	ProviderPrefix = "vsphere://"
@@ -62,6 +172,12 @@ const (
 	// BlockVolumeType is the VolumeType for CNS Volume
 	BlockVolumeType = "BLOCK"
 
+	// FileVolumeType is the VolumeType for CNS File Share Volume
+	FileVolumeType = "FILE"
+
+	// MaxVolumeNameLength is the maximum length of a CNS volume name
+	MaxVolumeNameLength = 80
+
 	// MinSupportedVCenterMajor is the minimum, major version of vCenter
 	// on which CNS is supported.
 	MinSupportedVCenterMajor int = 6
@@ -72,4 +188,9 @@ const (
 
 	// MinSupportedVCenterPatch is the patch version supported with MinSupportedVCenterMajor and MinSupportedVCenterMinor
 	MinSupportedVCenterPatch int = 3
+
+	// MinVvolVCenterMajor is the major version of the first vCenter whose CNS provisions
+	// volumes on Virtual Volumes datastores. Their replication groups are not managed by the
+	// driver, volumes are placed by storage policy like on any other datastore.
+	MinVvolVCenterMajor int = 7
 )
@@ -17,7 +17,11 @@ limitations under the License.
 package common
 
 import (
+	"context"
+	"sync"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
@@ -33,21 +37,120 @@ var (
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		},
 	}
+	// MultiWriterBlockVolumeCaps represents access modes supported only for
+	// raw block volumes. Such volumes are attached to every node with the
+	// multi-writer sharing mode, so clustered filesystems can coordinate
+	// concurrent access to the disk.
+	MultiWriterBlockVolumeCaps = []csi.VolumeCapability_AccessMode{
+		{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+	// SupportedFsTypes are the filesystem types which volumes can be formatted with
+	// during NodeStageVolume.
+	SupportedFsTypes = []string{"ext3", "ext4", "xfs"}
+	// SupportedMountOptions are the mount options which may be set in PV.spec.mountOptions.
+	// Options which allow device files or setuid binaries on volumes, or change how the
+	// volume is mounted, such as "bind" or "remount", are not supported.
+	SupportedMountOptions = []string{"ro", "rw", "sync", "async", "dirsync", "atime", "noatime", "diratime", "nodiratime",
+		"relatime", "norelatime", "strictatime", "nostrictatime", "lazytime", "nolazytime", "exec", "noexec", "nodev",
+		"nosuid", "discard", "nodiscard", "nouuid", "inode64", "largeio", "nobarrier"}
+	// SupportedMountOptionKeys are the keys of the supported mount options of the form key=value
+	SupportedMountOptionKeys = []string{"data", "commit", "errors", "barrier", "allocsize", "logbufs", "logbsize",
+		"context", "fscontext", "defcontext", "rootcontext"}
+	// SiteAffinityToVsanLocality maps the siteaffinity StorageClass parameter values
+	// to the vSAN locality of the storage policy.
+	SiteAffinityToVsanLocality = map[string]string{
+		SiteAffinityNone:      cnsvsphere.VsanLocalityNone,
+		SiteAffinityPreferred: cnsvsphere.VsanLocalityPreferred,
+		SiteAffinitySecondary: cnsvsphere.VsanLocalitySecondary,
+	}
+	// DatastoreTypeToSummaryTypes maps the datastoretype StorageClass parameter values
+	// to the types of the datastores in their summary.
+	DatastoreTypeToSummaryTypes = map[string][]string{
+		DatastoreTypeVsan: {cnsvsphere.VsanDatastoreType},
+		DatastoreTypeVmfs: {cnsvsphere.VmfsDatastoreType},
+		DatastoreTypeNfs:  {cnsvsphere.NfsDatastoreType, cnsvsphere.Nfs41DatastoreType},
+		DatastoreTypeVvol: {cnsvsphere.VvolDatastoreType},
+	}
+	// VolumeMigrationGVR identifies the CnsVSphereVolumeMigration custom resource. It maps
+	// the VMDK path of a migrated in-tree vSphere volume, spec.volumePath, to the ID of its
+	// CNS volume, spec.volumeID, which is also the name of the resource.
+	VolumeMigrationGVR = schema.GroupVersionResource{
+		Group:    "cns.vmware.com",
+		Version:  "v1alpha1",
+		Resource: "cnsvspherevolumemigrations",
+	}
+	// NodeVMAttachmentGVR identifies the CnsNodeVmAttachment custom resource. The paravirtual
+	// driver of a guest cluster creates one in its supervisor namespace to request that the
+	// volume of the supervisor PersistentVolumeClaim spec.volumename be attached to the guest
+	// node VM with the BIOS UUID spec.nodeuuid. The supervisor reports the attachment in
+	// status.attached, status.metadata and status.error.
+	NodeVMAttachmentGVR = schema.GroupVersionResource{
+		Group:    "cns.vmware.com",
+		Version:  "v1alpha1",
+		Resource: "cnsnodevmattachments",
+	}
+	// VirtualMachineGVR identifies the VirtualMachine resources of the VM operator. The node VMs
+	// of a guest cluster are VirtualMachines in its supervisor namespace, and status.biosUUID
+	// is the BIOS UUID of the vSphere VM of each.
+	VirtualMachineGVR = schema.GroupVersionResource{
+		Group:    "vmoperator.vmware.com",
+		Version:  "v1alpha1",
+		Resource: "virtualmachines",
+	}
+	// VolumeMetadataGVR identifies the CnsVolumeMetadata custom resource. The syncer of a guest
+	// cluster creates one in its supervisor namespace for each guest PV, PVC and Pod of its
+	// volumes, named after the UID of the guest object. spec.volumenames are the supervisor
+	// PersistentVolumeClaims of the volumes, and spec.entitytype, spec.entityname,
+	// spec.namespace and spec.labels describe the guest object of spec.guestclusterid.
+	VolumeMetadataGVR = schema.GroupVersionResource{
+		Group:    "cns.vmware.com",
+		Version:  "v1alpha1",
+		Resource: "cnsvolumemetadatas",
+	}
 )
 
-// Manager type comprises VirtualCenterConfig, CnsConfig, VolumeManager and VirtualCenterManager
+// Manager type comprises VirtualCenterConfig, CnsConfig, VolumeManager and VirtualCenterManager.
+// VcenterConfig and VolumeManager are the ones of the first vCenter, VolumeManagers maps the
+// hosts of all vCenters to their VolumeManager when more than one vCenter is configured.
+// CnsConfig is the initial config, it is read with GetCnsConfig as it may be reloaded.
 type Manager struct {
 	VcenterConfig  *cnsvsphere.VirtualCenterConfig
 	CnsConfig      *config.Config
 	VolumeManager  cnsvolume.Manager
+	VolumeManagers map[string]cnsvolume.Manager
 	VcenterManager cnsvsphere.VirtualCenterManager
+	cnsConfigLock  sync.RWMutex
+}
+
+// InvalidParametersError is the error of a volume which can not be created with the
+// parameters of its StorageClass. It is returned to the CO as an InvalidArgument error.
+type InvalidParametersError struct {
+	Message string
+}
+
+func (e *InvalidParametersError) Error() string {
+	return e.Message
 }
 
 // CreateVolumeSpec is the Volume Spec used by CSI driver
 type CreateVolumeSpec struct {
-	Name              string
-	StoragePolicyName string
-	StoragePolicyID   string
-	DatastoreURL      string
-	CapacityMB        int64
+	Name                 string
+	StoragePolicyName    string
+	StoragePolicyID      string
+	DatastoreURL         string
+	DatastoreClusterName string
+	SiteAffinity         string
+	CapacityMB           int64
+	// DatastoreType is the type of the host-local datastores the volume is placed on,
+	// vsphere.VsanDirectDatastoreType or vsphere.PmemDatastoreType, if set
+	DatastoreType string
+	// SharedDatastoreTypes are the summary types of the shared datastores the volume
+	// may be placed on, of the datastoretype parameter. Any type is allowed if empty.
+	SharedDatastoreTypes []string
+	// SelectDatastore, if set, chooses the datastore the volume is placed on when neither
+	// DatastoreURL, DatastoreClusterName nor DatastoreType pin it, rather than CNS. It is
+	// passed the candidate datastores by decreasing free space.
+	SelectDatastore func(ctx context.Context, datastores []*cnsvsphere.DatastoreInfo) (*cnsvsphere.DatastoreInfo, error)
 }
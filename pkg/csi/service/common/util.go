@@ -18,37 +18,178 @@ package common
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
+// unsupportedVolumeNameChars matches characters which are not allowed in CNS volume names
+var unsupportedVolumeNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// volumeIDPattern matches First Class Disk IDs, which are used as CNS volume IDs
+var volumeIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// volumePathPattern matches the VMDK paths with which in-tree vSphere volumes are referenced
+var volumePathPattern = regexp.MustCompile(`^\[[^\]]+\] .+\.vmdk$`)
+
+// volumeNameHashLength is the number of hex characters of the name hash appended to sanitized volume names
+const volumeNameHashLength = 10
+
+// GetCnsConfig returns the current config of the controller
+func (manager *Manager) GetCnsConfig() *config.Config {
+	manager.cnsConfigLock.RLock()
+	defer manager.cnsConfigLock.RUnlock()
+	return manager.CnsConfig
+}
+
+// SetCnsConfig replaces the config of the controller with the reloaded config cfg
+func (manager *Manager) SetCnsConfig(cfg *config.Config) {
+	manager.cnsConfigLock.Lock()
+	defer manager.cnsConfigLock.Unlock()
+	manager.CnsConfig = cfg
+}
+
 // GetVCenter returns VirtualCenter object from specified Manager object.
 // Before returning VirtualCenter object, vcenter connection is established if session doesn't exist.
 func GetVCenter(ctx context.Context, manager *Manager) (*cnsvsphere.VirtualCenter, error) {
-	var err error
-	vcenter, err := manager.VcenterManager.GetVirtualCenter(manager.VcenterConfig.Host)
+	return GetVCenterByHost(ctx, manager, manager.VcenterConfig.Host)
+}
+
+// GetVCenterByHost returns the VirtualCenter object of the vCenter host, or of the first
+// vCenter if host is unknown, connected if the session doesn't exist.
+func GetVCenterByHost(ctx context.Context, manager *Manager, host string) (*cnsvsphere.VirtualCenter, error) {
+	if _, ok := manager.VolumeManagers[host]; !ok {
+		host = manager.VcenterConfig.Host
+	}
+	vcenter, err := manager.VcenterManager.GetVirtualCenter(host)
 	if err != nil {
-		klog.Errorf("Failed to get VirtualCenter instance for host: %q. err=%v", manager.VcenterConfig.Host, err)
+		klog.Errorf("Failed to get VirtualCenter instance for host: %q. err=%v", host, err)
 		return nil, err
 	}
 	err = vcenter.Connect(ctx)
 	if err != nil {
-		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", manager.VcenterConfig.Host, err)
+		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", host, err)
 		return nil, err
 	}
 	return vcenter, nil
 }
 
+// GetVolumeManager returns the VolumeManager of the vCenter host, or the VolumeManager
+// of the first vCenter if host is unknown.
+func GetVolumeManager(manager *Manager, host string) cnsvolume.Manager {
+	if volumeManager, ok := manager.VolumeManagers[host]; ok {
+		return volumeManager
+	}
+	return manager.VolumeManager
+}
+
+// GetVolumeManagerForVolume returns the VolumeManager of the vCenter which has the volume.
+// With a single vCenter, no query is made. The VolumeManager of the first vCenter is returned
+// if no vCenter has the volume.
+func GetVolumeManagerForVolume(ctx context.Context, manager *Manager, volumeID string) (cnsvolume.Manager, error) {
+	if len(manager.VolumeManagers) <= 1 {
+		return manager.VolumeManager, nil
+	}
+	host, err := getVolumeHost(ctx, manager, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	return GetVolumeManager(manager, host), nil
+}
+
+// getVolumeHost returns the host of the vCenter the volume volumeID is on,
+// or "" if the volume is not found on any vCenter. The CNS of each vCenter server
+// is queried once. If the server is configured in more than one section, the
+// section whose datacenters hold the datastore of the volume is returned.
+func getVolumeHost(ctx context.Context, manager *Manager, volumeID string) (string, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	var hosts []string
+	for host := range manager.VolumeManagers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	hostsByServer := make(map[string][]string)
+	var servers []string
+	for _, host := range hosts {
+		server := getVirtualCenterServer(manager, host)
+		if _, ok := hostsByServer[server]; !ok {
+			servers = append(servers, server)
+		}
+		hostsByServer[server] = append(hostsByServer[server], host)
+	}
+	for _, server := range servers {
+		host := hostsByServer[server][0]
+		queryResult, err := manager.VolumeManagers[host].QueryVolume(queryFilter)
+		if err != nil {
+			klog.Errorf("QueryVolume failed for volumeID: %s on vCenter %q, err: %+v", volumeID, server, err)
+			return "", err
+		}
+		if len(queryResult.Volumes) > 0 {
+			if len(hostsByServer[server]) > 1 {
+				host = getDatastoreHost(ctx, manager, hostsByServer[server], queryResult.Volumes[0].DatastoreUrl)
+			}
+			klog.V(4).Infof("Volume %s found on vCenter %q", volumeID, host)
+			return host, nil
+		}
+	}
+	return "", nil
+}
+
+// getVirtualCenterServer returns the address of the vCenter configured in the section host
+func getVirtualCenterServer(manager *Manager, host string) string {
+	if vc, err := manager.VcenterManager.GetVirtualCenter(host); err == nil && vc.Config.Server != "" {
+		return vc.Config.Server
+	}
+	return host
+}
+
+// getDatastoreHost returns the section of hosts, all configuring the same vCenter, whose
+// datacenters hold the datastore datastoreURL, or the first one if none does
+func getDatastoreHost(ctx context.Context, manager *Manager, hosts []string, datastoreURL string) string {
+	for _, host := range hosts {
+		vc, err := GetVCenterByHost(ctx, manager, host)
+		if err != nil {
+			continue
+		}
+		datacenters, err := vc.GetDatacenters(ctx)
+		if err != nil {
+			klog.Warningf("Failed to get datacenters of vCenter %q. err: %v", host, err)
+			continue
+		}
+		for _, dc := range datacenters {
+			if _, err := dc.GetDatastoreByURL(ctx, datastoreURL); err == nil {
+				return host
+			}
+		}
+	}
+	return hosts[0]
+}
+
 // GetUUIDFromProviderID Returns VM UUID from Node's providerID
 func GetUUIDFromProviderID(providerID string) string {
 	return strings.TrimPrefix(providerID, ProviderPrefix)
 }
 
+// IsValidProviderID returns true if providerID is ProviderPrefix followed by the BIOS UUID
+// of a VM, which has the same format as a First Class Disk ID.
+func IsValidProviderID(providerID string) bool {
+	return strings.HasPrefix(providerID, ProviderPrefix) && volumeIDPattern.MatchString(GetUUIDFromProviderID(providerID))
+}
+
 // FormatDiskUUID removes any spaces and hyphens in UUID
 // Example UUID input is 42375390-71f9-43a3-a770-56803bcd7baa and output after format is 4237539071f943a3a77056803bcd7baa
 func FormatDiskUUID(uuid string) string {
@@ -84,6 +225,13 @@ func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
 				return true
 			}
 		}
+		if cap.GetBlock() != nil {
+			for _, c := range MultiWriterBlockVolumeCaps {
+				if c.GetMode() == cap.AccessMode.GetMode() {
+					return true
+				}
+			}
+		}
 		return false
 	}
 	foundAll := true
@@ -94,3 +242,105 @@ func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
 	}
 	return foundAll
 }
+
+// IsBlockVolumeRequest returns true if any of the specified volume capabilities
+// requests the volume to be exposed as a raw block device.
+func IsBlockVolumeRequest(volCaps []*csi.VolumeCapability) bool {
+	for _, c := range volCaps {
+		if c.GetBlock() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFileVolumeRequest returns true if any of the specified volume capabilities
+// requests a filesystem volume which is shared across multiple nodes.
+// Such volumes need to be backed by a file share rather than a block volume.
+func IsFileVolumeRequest(volCaps []*csi.VolumeCapability) bool {
+	for _, c := range volCaps {
+		if c.GetBlock() != nil {
+			continue
+		}
+		switch c.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			return true
+		}
+	}
+	return false
+}
+
+// IsMultiWriterBlockVolume returns true if the volume capability requests a raw
+// block volume which is written to concurrently from multiple nodes.
+func IsMultiWriterBlockVolume(volCap *csi.VolumeCapability) bool {
+	return volCap.GetBlock() != nil &&
+		volCap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+}
+
+// IsValidFsType returns true if fsType is one of the SupportedFsTypes.
+func IsValidFsType(fsType string) bool {
+	for _, supportedFsType := range SupportedFsTypes {
+		if strings.ToLower(fsType) == supportedFsType {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateMountFlags returns an error naming the first of mountFlags which is
+// neither one of the SupportedMountOptions nor of the SupportedMountOptionKeys.
+func ValidateMountFlags(mountFlags []string) error {
+	for _, mountFlag := range mountFlags {
+		option := mountFlag
+		supported := SupportedMountOptions
+		if i := strings.Index(mountFlag, "="); i >= 0 {
+			option = mountFlag[:i]
+			supported = SupportedMountOptionKeys
+		}
+		isSupported := false
+		for _, supportedOption := range supported {
+			if option == supportedOption {
+				isSupported = true
+				break
+			}
+		}
+		if !isSupported {
+			return fmt.Errorf("mount option %q is not supported. Supported mount options: %v, %v",
+				mountFlag, SupportedMountOptions, SupportedMountOptionKeys)
+		}
+	}
+	return nil
+}
+
+// SanitizeVolumeName returns a CNS volume name for the given name.
+// Names which contain unsupported characters or exceed MaxVolumeNameLength
+// have those characters replaced and are truncated, and a hash of the original
+// name is appended so that different names do not map to the same volume name.
+// The same name always maps to the same volume name.
+func SanitizeVolumeName(name string) string {
+	sanitized := unsupportedVolumeNameChars.ReplaceAllString(name, "-")
+	if sanitized == name && len(name) <= MaxVolumeNameLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(hash[:])[:volumeNameHashLength]
+	if len(sanitized) > MaxVolumeNameLength-len(suffix) {
+		sanitized = sanitized[:MaxVolumeNameLength-len(suffix)]
+	}
+	klog.V(4).Infof("Volume name %q is sanitized to %q", name, sanitized+suffix)
+	return sanitized + suffix
+}
+
+// IsValidVolumeID returns true if volumeID has the format of a First Class Disk ID,
+// e.g. "5c6a09e6-2f5c-4d14-9a44-7d8e0a2b3c4d".
+func IsValidVolumeID(volumeID string) bool {
+	return volumeIDPattern.MatchString(volumeID)
+}
+
+// IsVolumePath returns true if volumeID is the VMDK path of an in-tree vSphere volume,
+// e.g. "[vsanDatastore] kubevols/kubernetes-dynamic-pvc-1.vmdk".
+func IsVolumePath(volumeID string) bool {
+	return volumePathPattern.MatchString(volumeID)
+}
@@ -20,39 +20,142 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/davecgh/go-spew/spew"
 	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/find"
 	vim25types "github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
-// CreateVolumeUtil is the helper function to create CNS volume
-func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (string, error) {
-	vc, err := GetVCenter(ctx, manager)
+// CreateVolumeUtil is the helper function to create CNS volume. It returns the ID of the
+// volume and the vCenter it is created on.
+func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (
+	string, *vsphere.VirtualCenter, error) {
+	host := getVirtualCenterHost(manager, spec, sharedDatastores)
+	sharedDatastores = getDatastoresOnVirtualCenter(sharedDatastores, host)
+	vc, err := GetVCenterByHost(ctx, manager, host)
 	if err != nil {
 		klog.Errorf("Failed to get vCenter from Manager, err: %+v", err)
-		return "", err
+		return "", nil, err
 	}
-	if spec.StoragePolicyName != "" {
-		// Get Storage Policy ID from Storage Policy Name
+	if spec.StoragePolicyName != "" || spec.StoragePolicyID != "" {
 		err = vc.ConnectPbm(ctx)
 		if err != nil {
 			klog.Errorf("Error occurred while connecting to PBM, err: %+v", err)
-			return "", err
+			return "", nil, err
 		}
+	}
+	if spec.StoragePolicyName != "" {
+		// Get Storage Policy ID from Storage Policy Name
 		spec.StoragePolicyID, err = vc.GetStoragePolicyIDByName(ctx, spec.StoragePolicyName)
 		if err != nil {
 			klog.Errorf("Error occurred while getting Profile Id from Profile Name: %s, err: %+v", spec.StoragePolicyName, err)
-			return "", err
+			return "", nil, err
+		}
+	}
+	if spec.SiteAffinity != "" {
+		// Site affinity on stretched vSAN clusters is set by the vSAN locality rule of the storage policy
+		if spec.StoragePolicyID == "" {
+			errMsg := fmt.Sprintf("Site affinity: %s specified in the storage class requires a storage policy.", spec.SiteAffinity)
+			klog.Errorf(errMsg)
+			return "", nil, &InvalidParametersError{Message: errMsg}
+		}
+		locality, err := vc.GetVsanLocality(ctx, spec.StoragePolicyID)
+		if err != nil {
+			klog.Errorf("Failed to get vSAN locality of storage policy: %s, err: %+v", spec.StoragePolicyID, err)
+			return "", nil, err
+		}
+		if locality != SiteAffinityToVsanLocality[spec.SiteAffinity] {
+			errMsg := fmt.Sprintf("Site affinity: %s specified in the storage class does not match the vSAN locality %q of the storage policy: %s.",
+				spec.SiteAffinity, locality, spec.StoragePolicyID)
+			klog.Errorf(errMsg)
+			return "", nil, &InvalidParametersError{Message: errMsg}
 		}
 	}
 	var datastores []vim25types.ManagedObjectReference
-	if spec.DatastoreURL == "" {
+	if spec.DatastoreClusterName != "" {
+		// Place the volume on the best member of the datastore cluster specified in the StorageClass
+		datastore, err := selectDatastoreClusterMember(ctx, vc, manager, spec, sharedDatastores)
+		if err != nil {
+			return "", nil, err
+		}
+		datastores = append(datastores, datastore.Reference())
+	} else if spec.DatastoreType != "" {
+		// Place the volume on a vSAN Direct or PMem datastore of the host of the nodes
+		datastore, err := selectHostLocalDatastore(ctx, vc, manager, spec, sharedDatastores)
+		if err != nil {
+			return "", nil, err
+		}
+		datastores = append(datastores, datastore.Reference())
+	} else if spec.DatastoreURL == "" {
 		//  If DatastoreURL is not specified in StorageClass, get all shared datastores
-		datastores = getDatastoreMoRefs(sharedDatastores)
+		//  permitted by the allowed/denied datastores configuration
+		permittedDatastores := filterPermittedDatastores(manager.GetCnsConfig(), sharedDatastores)
+		if len(permittedDatastores) == 0 {
+			errMsg := fmt.Sprintf("None of the shared datastores %v are permitted by the allowed/denied datastores configuration.",
+				getDatastoreURLs(sharedDatastores))
+			klog.Errorf(errMsg)
+			return "", nil, errors.New(errMsg)
+		}
+		if manager.GetCnsConfig().Global.HostLocalTopology {
+			// Volumes are only bound to a host when vSAN Direct or PMem datastores are requested
+			permittedDatastores, err = excludeHostLocalDatastores(ctx, permittedDatastores)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(permittedDatastores) == 0 {
+				errMsg := fmt.Sprintf("The shared datastores %v are only accessible from a single host, volumes are placed on "+
+					"host-local datastores only with the %s or %s parameter.", getDatastoreURLs(sharedDatastores), AttributeVsanDirect, AttributePmem)
+				klog.Errorf(errMsg)
+				return "", nil, errors.New(errMsg)
+			}
+		}
+		if !IsVvolSupported(vc.Client.ServiceContent.About.ApiVersion) {
+			// CNS of older vCenters fails to place volumes on vVol datastores
+			_, permittedDatastores, err = partitionDatastoresByType(ctx, permittedDatastores, vsphere.VvolDatastoreType)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(permittedDatastores) == 0 {
+				errMsg := fmt.Sprintf("The shared datastores %v are Virtual Volumes datastores, which require vCenter %d.0.",
+					getDatastoreURLs(sharedDatastores), MinVvolVCenterMajor)
+				klog.Errorf(errMsg)
+				return "", nil, errors.New(errMsg)
+			}
+		}
+		if len(spec.SharedDatastoreTypes) > 0 {
+			permittedDatastores, err = filterDatastoresByType(ctx, permittedDatastores, spec.SharedDatastoreTypes...)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(permittedDatastores) == 0 {
+				errMsg := fmt.Sprintf("None of the shared datastores %v are of the datastore type %v specified in the storage class.",
+					getDatastoreURLs(sharedDatastores), spec.SharedDatastoreTypes)
+				klog.Errorf(errMsg)
+				return "", nil, errors.New(errMsg)
+			}
+		}
+		if spec.SelectDatastore != nil {
+			datastore, err := selectSharedDatastore(ctx, vc, spec, permittedDatastores)
+			if err != nil {
+				return "", nil, err
+			}
+			permittedDatastores = []*vsphere.DatastoreInfo{datastore}
+		}
+		datastores = getDatastoreMoRefs(permittedDatastores)
 	} else {
+		if !isDatastorePermitted(manager.GetCnsConfig(), spec.DatastoreURL) {
+			errMsg := fmt.Sprintf("DatastoreURL: %s specified in the storage class is not permitted by the allowed/denied datastores configuration.",
+				spec.DatastoreURL)
+			klog.Errorf(errMsg)
+			return "", nil, errors.New(errMsg)
+		}
 		// Check datastore specified in the StorageClass should be shared datastore across all nodes.
 
 		// vc.GetDatacenters returns datacenters found on the VirtualCenter.
@@ -62,7 +165,7 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 		datacenters, err := vc.GetDatacenters(ctx)
 		if err != nil {
 			klog.Errorf("Failed to find datacenters from VC: %+v, Error: %+v", vc.Config.Host, err)
-			return "", err
+			return "", nil, err
 		}
 		isSharedDatastoreURL := false
 		var datastoreObj *vsphere.Datastore
@@ -85,15 +188,46 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 		if datastoreObj == nil {
 			errMsg := fmt.Sprintf("DatastoreURL: %s specified in the storage class is not found.", spec.DatastoreURL)
 			klog.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", nil, errors.New(errMsg)
 		}
-		if isSharedDatastoreURL {
-			datastores = append(datastores, datastoreObj.Reference())
-		} else {
+		if !isSharedDatastoreURL {
 			errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is not accessible to all nodes.", spec.DatastoreURL)
 			klog.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", nil, errors.New(errMsg)
 		}
+		dsType, err := datastoreObj.GetDatastoreType(ctx)
+		if err != nil {
+			klog.Errorf("Failed to get the type of datastore %s. err: %+v", spec.DatastoreURL, err)
+			return "", nil, err
+		}
+		if dsType == vsphere.VvolDatastoreType && !IsVvolSupported(vc.Client.ServiceContent.About.ApiVersion) {
+			errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is a Virtual Volumes datastore, which requires vCenter %d.0.",
+				spec.DatastoreURL, MinVvolVCenterMajor)
+			klog.Errorf(errMsg)
+			return "", nil, errors.New(errMsg)
+		}
+		if len(spec.SharedDatastoreTypes) > 0 && !isDatastoreType(dsType, spec.SharedDatastoreTypes) {
+			errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is of type %s, not of the datastore type %v specified in the storage class.",
+				spec.DatastoreURL, dsType, spec.SharedDatastoreTypes)
+			klog.Errorf(errMsg)
+			return "", nil, errors.New(errMsg)
+		}
+		if spec.StoragePolicyID != "" {
+			// Check datastore specified in the StorageClass is compatible with the storage policy
+			compatibleDatastores, err := vc.GetCompatibleDatastores(ctx, spec.StoragePolicyID,
+				[]*vsphere.DatastoreInfo{{Datastore: datastoreObj}})
+			if err != nil {
+				klog.Errorf("Failed to check compatibility of datastore: %s with storage policy: %s, err: %+v", spec.DatastoreURL, spec.StoragePolicyID, err)
+				return "", nil, err
+			}
+			if len(compatibleDatastores) == 0 {
+				errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is not compatible with the storage policy: %s.",
+					spec.DatastoreURL, spec.StoragePolicyID)
+				klog.Errorf(errMsg)
+				return "", nil, errors.New(errMsg)
+			}
+		}
+		datastores = append(datastores, datastoreObj.Reference())
 	}
 	createSpec := &cnstypes.CnsVolumeCreateSpec{
 		Name:       spec.Name,
@@ -105,7 +239,7 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 			},
 		},
 		Metadata: cnstypes.CnsVolumeMetadata{
-			ContainerCluster: vsphere.GetContainerCluster(manager.CnsConfig.Global.ClusterID, manager.CnsConfig.VirtualCenter[vc.Config.Host].User),
+			ContainerCluster: getContainerCluster(manager.GetCnsConfig(), vc),
 		},
 	}
 	if spec.StoragePolicyID != "" {
@@ -114,13 +248,13 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 		}
 		createSpec.Profile = append(createSpec.Profile, profileSpec)
 	}
-	klog.V(4).Infof("vSphere CNS driver creating volume %s with create spec %+v", spec.Name, spew.Sdump(createSpec))
-	volumeID, err := manager.VolumeManager.CreateVolume(createSpec)
+	klog.V(4).Infof("vSphere CNS driver creating volume %s on vCenter %q with create spec %+v", spec.Name, host, spew.Sdump(createSpec))
+	volumeID, err := GetVolumeManager(manager, host).CreateVolume(createSpec)
 	if err != nil {
 		klog.Errorf("Failed to create disk %s with error %+v", spec.Name, err)
-		return "", err
+		return "", nil, err
 	}
-	return volumeID.Id, nil
+	return volumeID.Id, vc, nil
 }
 
 // AttachVolumeUtil is the helper function to attach CNS volume to specified vm
@@ -128,7 +262,7 @@ func AttachVolumeUtil(ctx context.Context, manager *Manager,
 	vm *vsphere.VirtualMachine,
 	volumeID string) (string, error) {
 	klog.V(4).Infof("vSphere CNS driver is attaching volume: %s to node vm: %s", volumeID, vm.InventoryPath)
-	diskUUID, err := manager.VolumeManager.AttachVolume(vm, volumeID)
+	diskUUID, err := GetVolumeManager(manager, vm.VirtualCenterHost).AttachVolume(vm, volumeID)
 	if err != nil {
 		klog.Errorf("Failed to attach disk %s with err %+v", volumeID, err)
 		return "", err
@@ -137,13 +271,50 @@ func AttachVolumeUtil(ctx context.Context, manager *Manager,
 	return diskUUID, nil
 }
 
+// AttachMultiWriterVolumeUtil is the helper function to attach CNS volume on the datastore
+// datastoreURL to specified vm with the disk in multi-writer sharing mode
+func AttachMultiWriterVolumeUtil(ctx context.Context, manager *Manager,
+	vm *vsphere.VirtualMachine,
+	volumeID string, datastoreURL string) (string, error) {
+	klog.V(4).Infof("vSphere CNS driver is attaching volume: %s to node vm: %s in multi-writer mode", volumeID, vm.InventoryPath)
+	controllerType := manager.GetCnsConfig().Global.AttachControllerType
+	if controllerType == "" {
+		controllerType = config.DefaultAttachControllerType
+	}
+	unlock := vm.LockDeviceChanges()
+	defer unlock()
+	if err := vm.EnsureFreeSCSISlots(ctx, controllerType, []string{volumeID}); err != nil {
+		klog.Errorf("Failed to find a free SCSI slot for disk %s on VM %v. err: %+v", volumeID, vm, err)
+		return "", err
+	}
+	datastore, err := vm.Datacenter.GetDatastoreByURL(ctx, datastoreURL)
+	if err != nil {
+		klog.Errorf("Failed to find datastore %s of disk %s. err: %+v", datastoreURL, volumeID, err)
+		return "", err
+	}
+	diskUUID, err := cnsvolume.AttachDiskWithSharingMode(ctx, vm, volumeID, datastore, vim25types.VirtualDiskSharingSharingMultiWriter)
+	if err != nil {
+		klog.Errorf("Failed to attach disk %s in multi-writer mode with err %+v", volumeID, err)
+		return "", err
+	}
+	klog.V(4).Infof("Successfully attached disk %s to VM %v in multi-writer mode. Disk UUID is %s", volumeID, vm, diskUUID)
+	return diskUUID, nil
+}
+
 // DetachVolumeUtil is the helper function to detach CNS volume from specified vm
 func DetachVolumeUtil(ctx context.Context, manager *Manager,
 	vm *vsphere.VirtualMachine,
 	volumeID string) error {
 	klog.V(4).Infof("vSphere CNS driver is detaching volume: %s from node vm: %s", volumeID, vm.InventoryPath)
-	err := manager.VolumeManager.DetachVolume(vm, volumeID)
+	err := GetVolumeManager(manager, vm.VirtualCenterHost).DetachVolume(vm, volumeID)
 	if err != nil {
+		// The disks of a deleted VM can not be detached, nor are they attached to any other VM,
+		// so the volume is detached as far as the node is concerned. Detaching from an orphaned
+		// VM is retried, its disks are still attached once its host reconnects.
+		if deleted, deletedErr := vm.IsDeleted(ctx); deletedErr == nil && deleted {
+			klog.Warningf("VM %v is deleted, considering disk %s detached. Detach err: %+v", vm, volumeID, err)
+			return nil
+		}
 		klog.Errorf("Failed to detach disk %s with err %+v", volumeID, err)
 		return err
 	}
@@ -153,9 +324,12 @@ func DetachVolumeUtil(ctx context.Context, manager *Manager,
 
 // DeleteVolumeUtil is the helper function to delete CNS volume for given volumeId
 func DeleteVolumeUtil(ctx context.Context, manager *Manager, volumeID string, deleteDisk bool) error {
-	var err error
 	klog.V(4).Infof("vSphere Cloud Provider deleting volume: %s", volumeID)
-	err = manager.VolumeManager.DeleteVolume(volumeID, deleteDisk)
+	volumeManager, err := GetVolumeManagerForVolume(ctx, manager, volumeID)
+	if err != nil {
+		return err
+	}
+	err = volumeManager.DeleteVolume(volumeID, deleteDisk)
 	if err != nil {
 		klog.Errorf("Failed to delete disk %s with error %+v", volumeID, err)
 		return err
@@ -164,6 +338,450 @@ func DeleteVolumeUtil(ctx context.Context, manager *Manager, volumeID string, de
 	return nil
 }
 
+// RegisterVolumeUtil is the helper function to register a pre-existing First Class Disk
+// with CNS of the vCenter host, for statically provisioned volumes whose CNS metadata does
+// not exist yet. It is a no-op if CNS already knows about the volume.
+func RegisterVolumeUtil(ctx context.Context, manager *Manager, host string, volumeID string) error {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	volumeManager := GetVolumeManager(manager, host)
+	queryResult, err := volumeManager.QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volumeID: %s, err: %+v", volumeID, err)
+		return err
+	}
+	if len(queryResult.Volumes) > 0 {
+		return nil
+	}
+	vc, err := GetVCenterByHost(ctx, manager, host)
+	if err != nil {
+		klog.Errorf("Failed to get vCenter from Manager, err: %+v", err)
+		return err
+	}
+	createSpec := &cnstypes.CnsVolumeCreateSpec{
+		Name:       SanitizeVolumeName(volumeID),
+		VolumeType: BlockVolumeType,
+		BackingObjectDetails: &cnstypes.CnsBlockBackingDetails{
+			BackingDiskId: volumeID,
+		},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: getContainerCluster(manager.GetCnsConfig(), vc),
+		},
+	}
+	klog.V(2).Infof("vSphere CNS driver registering statically provisioned volume %s with create spec %+v", volumeID, spew.Sdump(createSpec))
+	_, err = volumeManager.CreateVolume(createSpec)
+	if err != nil {
+		klog.Errorf("Failed to register disk %s with CNS. err: %+v", volumeID, err)
+		return err
+	}
+	return nil
+}
+
+// selectDatastoreClusterMember returns the member of the datastore cluster specified in spec
+// with the most free space, among the shared datastores which volumes may be provisioned on
+// and which are compatible with the storage policy in spec.
+func selectDatastoreClusterMember(ctx context.Context, vc *vsphere.VirtualCenter, manager *Manager, spec *CreateVolumeSpec,
+	sharedDatastores []*vsphere.DatastoreInfo) (*vsphere.DatastoreInfo, error) {
+	members, err := getDatastoreClusterMembers(ctx, vc, spec.DatastoreClusterName, filterPermittedDatastores(manager.GetCnsConfig(), sharedDatastores))
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		errMsg := fmt.Sprintf("Datastore cluster: %s specified in the storage class has no member datastores which are accessible to all nodes "+
+			"and permitted by the allowed/denied datastores configuration.", spec.DatastoreClusterName)
+		klog.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	if spec.StoragePolicyID != "" {
+		members, err = vc.GetCompatibleDatastores(ctx, spec.StoragePolicyID, members)
+		if err != nil {
+			klog.Errorf("Failed to check compatibility of datastore cluster: %s with storage policy: %s, err: %+v", spec.DatastoreClusterName, spec.StoragePolicyID, err)
+			return nil, err
+		}
+		if len(members) == 0 {
+			errMsg := fmt.Sprintf("Datastore cluster: %s specified in the storage class has no member datastores compatible with the storage policy: %s.",
+				spec.DatastoreClusterName, spec.StoragePolicyID)
+			klog.Errorf(errMsg)
+			return nil, errors.New(errMsg)
+		}
+	}
+	selected := members[0]
+	for _, member := range members[1:] {
+		if member.Info.FreeSpace > selected.Info.FreeSpace {
+			selected = member
+		}
+	}
+	klog.V(4).Infof("Selected datastore: %s from datastore cluster: %s", selected.Info.Url, spec.DatastoreClusterName)
+	return selected, nil
+}
+
+// selectSharedDatastore returns the datastore spec.SelectDatastore chooses among the shared datastores
+// the volume of spec may be placed on, which are the ones compatible with the storage policy in spec.
+// They are passed on by decreasing free space, excluding those which cannot hold the volume unless
+// none can, so that CNS would have placed the volume on any of them.
+func selectSharedDatastore(ctx context.Context, vc *vsphere.VirtualCenter, spec *CreateVolumeSpec,
+	datastores []*vsphere.DatastoreInfo) (*vsphere.DatastoreInfo, error) {
+	var err error
+	if spec.StoragePolicyID != "" {
+		compatibleDatastores := datastores
+		datastores, err = vc.GetCompatibleDatastores(ctx, spec.StoragePolicyID, compatibleDatastores)
+		if err != nil {
+			klog.Errorf("Failed to check compatibility of datastores: %v with storage policy: %s, err: %+v",
+				getDatastoreURLs(compatibleDatastores), spec.StoragePolicyID, err)
+			return nil, err
+		}
+		if len(datastores) == 0 {
+			errMsg := fmt.Sprintf("None of the shared datastores %v are compatible with the storage policy: %s.",
+				getDatastoreURLs(compatibleDatastores), spec.StoragePolicyID)
+			klog.Errorf(errMsg)
+			return nil, errors.New(errMsg)
+		}
+	}
+	var candidates []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if datastore.Info.FreeSpace >= spec.CapacityMB*MbInBytes {
+			candidates = append(candidates, datastore)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = datastores
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Info.FreeSpace > candidates[j].Info.FreeSpace
+	})
+	selected, err := spec.SelectDatastore(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Selected datastore: %s for volume: %s", selected.Info.Url, spec.Name)
+	return selected, nil
+}
+
+// selectHostLocalDatastore returns the datastore of type spec.DatastoreType with the most free space
+// which can hold the volume of spec, among the shared datastores which volumes may be provisioned on
+// and which are compatible with the storage policy in spec. vSAN Direct and PMem datastores are only
+// accessible from their host, so they are only shared by the nodes of the host-local topology a
+// volume is requested in.
+func selectHostLocalDatastore(ctx context.Context, vc *vsphere.VirtualCenter, manager *Manager, spec *CreateVolumeSpec,
+	sharedDatastores []*vsphere.DatastoreInfo) (*vsphere.DatastoreInfo, error) {
+	candidates, err := filterDatastoresByType(ctx, filterPermittedDatastores(manager.GetCnsConfig(), sharedDatastores), spec.DatastoreType)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		errMsg := fmt.Sprintf("None of the shared datastores %v are %s datastores permitted by the allowed/denied datastores configuration. "+
+			"Volumes on %s datastores require the host-local topology.", getDatastoreURLs(sharedDatastores), spec.DatastoreType, spec.DatastoreType)
+		klog.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	if spec.StoragePolicyID != "" {
+		candidates, err = vc.GetCompatibleDatastores(ctx, spec.StoragePolicyID, candidates)
+		if err != nil {
+			klog.Errorf("Failed to get %s datastores compatible with storage policy: %s, err: %+v", spec.DatastoreType, spec.StoragePolicyID, err)
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			errMsg := fmt.Sprintf("None of the %s datastores are compatible with the storage policy: %s.", spec.DatastoreType, spec.StoragePolicyID)
+			klog.Errorf(errMsg)
+			return nil, errors.New(errMsg)
+		}
+	}
+	var selected *vsphere.DatastoreInfo
+	for _, candidate := range candidates {
+		if candidate.Info.FreeSpace < spec.CapacityMB*MbInBytes {
+			continue
+		}
+		if selected == nil || candidate.Info.FreeSpace > selected.Info.FreeSpace {
+			selected = candidate
+		}
+	}
+	if selected == nil {
+		// Reported as a fault, so that the volume is rescheduled to another node
+		return nil, &cnsvolume.FaultError{
+			FaultType: "NoDiskSpace",
+			Message: fmt.Sprintf("None of the %s datastores %v has %d MB of free space",
+				spec.DatastoreType, getDatastoreURLs(candidates), spec.CapacityMB),
+		}
+	}
+	klog.V(4).Infof("Selected %s datastore: %s", spec.DatastoreType, selected.Info.Url)
+	return selected, nil
+}
+
+// filterDatastoresByType returns the datastores of one of datastoreTypes among datastores
+func filterDatastoresByType(ctx context.Context, datastores []*vsphere.DatastoreInfo, datastoreTypes ...string) ([]*vsphere.DatastoreInfo, error) {
+	filtered, _, err := partitionDatastoresByType(ctx, datastores, datastoreTypes...)
+	return filtered, err
+}
+
+// partitionDatastoresByType splits datastores into those of one of datastoreTypes and the others
+func partitionDatastoresByType(ctx context.Context, datastores []*vsphere.DatastoreInfo, datastoreTypes ...string) (
+	[]*vsphere.DatastoreInfo, []*vsphere.DatastoreInfo, error) {
+	dsTypes, err := vsphere.GetDatastoreTypes(ctx, datastores)
+	if err != nil {
+		return nil, nil, err
+	}
+	var matching, others []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if isDatastoreType(dsTypes[datastore.Info.Url], datastoreTypes) {
+			matching = append(matching, datastore)
+		} else {
+			others = append(others, datastore)
+		}
+	}
+	return matching, others, nil
+}
+
+// excludeHostLocalDatastores returns the datastores which are accessible from more than one host
+func excludeHostLocalDatastores(ctx context.Context, datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	var shared []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		isHostLocal, err := datastore.IsHostLocal(ctx)
+		if err != nil {
+			klog.Errorf("Failed to check if datastore %s is host-local. err: %+v", datastore.Info.Url, err)
+			return nil, err
+		}
+		if !isHostLocal {
+			shared = append(shared, datastore)
+		}
+	}
+	return shared, nil
+}
+
+// isDatastoreType returns true if dsType is one of datastoreTypes
+func isDatastoreType(dsType string, datastoreTypes []string) bool {
+	for _, datastoreType := range datastoreTypes {
+		if dsType == datastoreType {
+			return true
+		}
+	}
+	return false
+}
+
+// getDatastoreClusterMembers returns the datastores which are members of the datastore cluster
+// with the given name. Storage DRS recommendations are not requested for volumes, so members are
+// selected the same way whether or not Storage DRS is enabled on the datastore cluster.
+func getDatastoreClusterMembers(ctx context.Context, vc *vsphere.VirtualCenter, datastoreClusterName string,
+	datastores []*vsphere.DatastoreInfo) ([]*vsphere.DatastoreInfo, error) {
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		klog.Errorf("Failed to find datacenters from VC: %+v, Error: %+v", vc.Config.Host, err)
+		return nil, err
+	}
+	found := false
+	memberRefs := make(map[vim25types.ManagedObjectReference]bool)
+	for _, datacenter := range datacenters {
+		refs, sdrsEnabled, err := datacenter.GetDatastoreClusterMembers(ctx, datastoreClusterName)
+		if err != nil {
+			if _, ok := err.(*find.NotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		klog.V(4).Infof("Datastore cluster: %s in datacenter %q has members %v, Storage DRS enabled: %t",
+			datastoreClusterName, datacenter.InventoryPath, refs, sdrsEnabled)
+		for _, ref := range refs {
+			memberRefs[ref] = true
+		}
+	}
+	if !found {
+		errMsg := fmt.Sprintf("Datastore cluster: %s specified in the storage class is not found.", datastoreClusterName)
+		klog.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	var members []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if memberRefs[datastore.Reference()] {
+			members = append(members, datastore)
+		}
+	}
+	return members, nil
+}
+
+// GetCapacityUtil returns the capacity in bytes available for a new volume with the given spec.
+// A volume is placed on a single datastore, so this is the largest free space among the shared
+// datastores which the volume could be provisioned on.
+func GetCapacityUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (int64, error) {
+	host := getVirtualCenterHost(manager, spec, sharedDatastores)
+	datastores := filterPermittedDatastores(manager.GetCnsConfig(), getDatastoresOnVirtualCenter(sharedDatastores, host))
+	vc, err := GetVCenterByHost(ctx, manager, host)
+	if err != nil {
+		klog.Errorf("Failed to get vCenter from Manager, err: %+v", err)
+		return 0, err
+	}
+	if !IsVvolSupported(vc.Client.ServiceContent.About.ApiVersion) {
+		// CNS of older vCenters fails to place volumes on vVol datastores
+		_, datastores, err = partitionDatastoresByType(ctx, datastores, vsphere.VvolDatastoreType)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if spec.DatastoreClusterName != "" {
+		datastores, err = getDatastoreClusterMembers(ctx, vc, spec.DatastoreClusterName, datastores)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if spec.DatastoreType != "" {
+		datastores, err = filterDatastoresByType(ctx, datastores, spec.DatastoreType)
+		if err != nil {
+			return 0, err
+		}
+	} else if spec.DatastoreURL == "" && manager.GetCnsConfig().Global.HostLocalTopology {
+		datastores, err = excludeHostLocalDatastores(ctx, datastores)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(spec.SharedDatastoreTypes) > 0 {
+		datastores, err = filterDatastoresByType(ctx, datastores, spec.SharedDatastoreTypes...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if spec.DatastoreURL != "" {
+		var specifiedDatastores []*vsphere.DatastoreInfo
+		for _, datastore := range datastores {
+			if datastore.Info.Url == spec.DatastoreURL {
+				specifiedDatastores = append(specifiedDatastores, datastore)
+			}
+		}
+		datastores = specifiedDatastores
+	}
+	if len(datastores) == 0 {
+		return 0, nil
+	}
+	if spec.StoragePolicyName != "" || spec.StoragePolicyID != "" {
+		err = vc.ConnectPbm(ctx)
+		if err != nil {
+			klog.Errorf("Error occurred while connecting to PBM, err: %+v", err)
+			return 0, err
+		}
+		storagePolicyID := spec.StoragePolicyID
+		if spec.StoragePolicyName != "" {
+			storagePolicyID, err = vc.GetStoragePolicyIDByName(ctx, spec.StoragePolicyName)
+			if err != nil {
+				klog.Errorf("Error occurred while getting Profile Id from Profile Name: %s, err: %+v", spec.StoragePolicyName, err)
+				return 0, err
+			}
+		}
+		datastores, err = vc.GetCompatibleDatastores(ctx, storagePolicyID, datastores)
+		if err != nil {
+			klog.Errorf("Failed to get datastores compatible with storage policy: %s, err: %+v", storagePolicyID, err)
+			return 0, err
+		}
+	}
+	var capacity int64
+	for _, datastore := range datastores {
+		if datastore.Info.FreeSpace > capacity {
+			capacity = datastore.Info.FreeSpace
+		}
+	}
+	return capacity, nil
+}
+
+// IsEncryptionCompatibleUtil returns false if the volume has an encryption storage policy and
+// the node VM is not encrypted, as encrypted volumes can only be attached to encrypted VMs.
+func IsEncryptionCompatibleUtil(ctx context.Context, manager *Manager, vm *vsphere.VirtualMachine, volumeID string) (bool, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := GetVolumeManager(manager, vm.VirtualCenterHost).QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volumeID: %s, err: %+v", volumeID, err)
+		return false, err
+	}
+	if len(queryResult.Volumes) == 0 || queryResult.Volumes[0].StoragePolicyId == "" {
+		return true, nil
+	}
+	storagePolicyID := queryResult.Volumes[0].StoragePolicyId
+	vc, err := GetVCenterByHost(ctx, manager, vm.VirtualCenterHost)
+	if err != nil {
+		klog.Errorf("Failed to get vCenter from Manager, err: %+v", err)
+		return false, err
+	}
+	err = vc.ConnectPbm(ctx)
+	if err != nil {
+		klog.Errorf("Error occurred while connecting to PBM, err: %+v", err)
+		return false, err
+	}
+	isEncryptionPolicy, err := vc.IsEncryptionPolicy(ctx, storagePolicyID)
+	if err != nil {
+		return false, err
+	}
+	if !isEncryptionPolicy {
+		return true, nil
+	}
+	isEncrypted, err := vm.IsEncrypted(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !isEncrypted {
+		klog.Errorf("Volume %s with encryption storage policy %s can not be attached to vm %s which is not encrypted", volumeID, storagePolicyID, vm.String())
+	}
+	return isEncrypted, nil
+}
+
+// IsDatastoreAccessibleUtil returns true if the datastore of the volume is accessible from the
+// host of vm, along with the URL of the datastore
+func IsDatastoreAccessibleUtil(ctx context.Context, manager *Manager, vm *vsphere.VirtualMachine, volumeID string) (bool, string, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}
+	queryResult, err := GetVolumeManager(manager, vm.VirtualCenterHost).QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("QueryVolume failed for volumeID: %s, err: %+v", volumeID, err)
+		return false, "", err
+	}
+	if len(queryResult.Volumes) == 0 || queryResult.Volumes[0].DatastoreUrl == "" {
+		return true, "", nil
+	}
+	datastoreURL := queryResult.Volumes[0].DatastoreUrl
+	accessibleDatastores, err := vm.GetAllAccessibleDatastores(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get accessible datastores of vm %s, err: %+v", vm.String(), err)
+		return false, datastoreURL, err
+	}
+	for _, datastore := range accessibleDatastores {
+		if datastore.Info.Url == datastoreURL {
+			return true, datastoreURL, nil
+		}
+	}
+	klog.Errorf("Datastore %s of volume %s is not accessible from the host of vm %s", datastoreURL, volumeID, vm.String())
+	return false, datastoreURL, nil
+}
+
+// getVirtualCenterHost returns the host of the vCenter to provision the volume of spec on: the
+// vCenter of the datastore specified in spec, or else of the first of sharedDatastores, which are
+// ordered by topology preference. With a single vCenter, its host is returned.
+func getVirtualCenterHost(manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) string {
+	if len(manager.VolumeManagers) <= 1 {
+		return manager.VcenterConfig.Host
+	}
+	for _, datastore := range sharedDatastores {
+		if datastore.Datastore == nil || datastore.Datacenter == nil {
+			continue
+		}
+		if spec.DatastoreURL == "" || datastore.Info.Url == spec.DatastoreURL {
+			return datastore.Datacenter.VirtualCenterHost
+		}
+	}
+	return manager.VcenterConfig.Host
+}
+
+// getDatastoresOnVirtualCenter returns the datastores on the vCenter host. Datastores whose
+// vCenter is unknown are returned as well.
+func getDatastoresOnVirtualCenter(datastores []*vsphere.DatastoreInfo, host string) []*vsphere.DatastoreInfo {
+	var datastoresOnVirtualCenter []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if datastore.Datastore == nil || datastore.Datacenter == nil || datastore.Datacenter.VirtualCenterHost == host {
+			datastoresOnVirtualCenter = append(datastoresOnVirtualCenter, datastore)
+		}
+	}
+	return datastoresOnVirtualCenter
+}
+
 // Helper function to get DatastoreMoRefs
 func getDatastoreMoRefs(datastores []*vsphere.DatastoreInfo) []vim25types.ManagedObjectReference {
 	var datastoreMoRefs []vim25types.ManagedObjectReference
@@ -172,3 +790,57 @@ func getDatastoreMoRefs(datastores []*vsphere.DatastoreInfo) []vim25types.Manage
 	}
 	return datastoreMoRefs
 }
+
+// getDatastoreURLs returns URLs of the given datastores
+func getDatastoreURLs(datastores []*vsphere.DatastoreInfo) []string {
+	var datastoreURLs []string
+	for _, datastore := range datastores {
+		datastoreURLs = append(datastoreURLs, datastore.Info.Url)
+	}
+	return datastoreURLs
+}
+
+// filterPermittedDatastores returns the datastores which volumes may be provisioned on
+// according to the allowed/denied datastores configuration
+func filterPermittedDatastores(cfg *config.Config, datastores []*vsphere.DatastoreInfo) []*vsphere.DatastoreInfo {
+	var permittedDatastores []*vsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if isDatastorePermitted(cfg, datastore.Info.Url) {
+			permittedDatastores = append(permittedDatastores, datastore)
+		} else {
+			klog.V(4).Infof("Datastore %q is excluded by the allowed/denied datastores configuration", datastore.Info.Url)
+		}
+	}
+	return permittedDatastores
+}
+
+// isDatastorePermitted returns true if volumes may be provisioned on the datastore with datastoreURL.
+// A datastore listed in DeniedDatastores is never permitted. If AllowedDatastores is set,
+// only datastores listed there are permitted.
+func isDatastorePermitted(cfg *config.Config, datastoreURL string) bool {
+	if cfg == nil {
+		return true
+	}
+	if containsDatastoreURL(cfg.Global.DeniedDatastores, datastoreURL) {
+		return false
+	}
+	if strings.TrimSpace(cfg.Global.AllowedDatastores) == "" {
+		return true
+	}
+	return containsDatastoreURL(cfg.Global.AllowedDatastores, datastoreURL)
+}
+
+// containsDatastoreURL returns true if the comma separated datastoreURLs contains datastoreURL
+func containsDatastoreURL(datastoreURLs string, datastoreURL string) bool {
+	for _, url := range strings.Split(datastoreURLs, ",") {
+		if strings.TrimSpace(url) == datastoreURL {
+			return true
+		}
+	}
+	return false
+}
+
+// getContainerCluster returns the container cluster of the volumes of cfg on the vCenter vc
+func getContainerCluster(cfg *config.Config, vc *vsphere.VirtualCenter) cnstypes.CnsContainerCluster {
+	return vsphere.GetContainerCluster(cfg.Global.ClusterID, cfg.VirtualCenter[vc.Config.Host].User)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"github.com/akutz/gofsutil"
+	"k8s.io/klog"
+)
+
+// stagingMountDir is the name of the directory the kubelet stages volumes to
+const stagingMountDir = "globalmount"
+
+// DrainNode flushes the filesystems of the volumes staged on this node and
+// unstages the volumes which are no longer published to any pod, so that their
+// disks can be detached cleanly before the node is powered off.
+// An error is returned if any staged volume could not be unstaged, in which
+// case the node is not ready for its disks to be detached yet.
+func DrainNode(ctx context.Context) error {
+	mnts, err := gofsutil.GetMounts(ctx)
+	if err != nil {
+		klog.Errorf("failed to list mounts to drain the node. err: %v", err)
+		return err
+	}
+	driverMnts := getDriverMounts(mnts, getKubeletDir())
+	// Flush dirty pages of all volumes, including the ones still in use
+	syscall.Sync()
+
+	unpublished, published := getStagingMounts(driverMnts)
+	for _, m := range published {
+		klog.Warningf("volume staged to %q is still published, not unstaging it", m.Path)
+	}
+	failed := 0
+	for _, m := range unpublished {
+		klog.V(2).Infof("unstaging volume staged to %q from device %q", m.Path, m.Device)
+		if err := gofsutil.Unmount(ctx, m.Path); err != nil {
+			klog.Errorf("failed to unmount %q. err: %v", m.Path, err)
+			failed++
+			continue
+		}
+		dev := &Device{FullPath: m.Device, Name: filepath.Base(m.Device)}
+		if isLuksMapper(dev) {
+			if err := closeLuksDevice(ctx, dev.Name); err != nil {
+				klog.Errorf("failed to close LUKS device %q. err: %v", dev.Name, err)
+				failed++
+			}
+		}
+	}
+	if len(published)+failed > 0 {
+		return fmt.Errorf("%d of %d staged volumes are not ready for detach",
+			len(published)+failed, len(published)+len(unpublished))
+	}
+	klog.V(2).Infof("all %d staged volumes are unstaged and ready for detach", len(unpublished))
+	return nil
+}
+
+// getStagingMounts splits the staging mounts in driverMnts into the ones
+// whose device is not mounted anywhere else and the ones which are still published
+func getStagingMounts(driverMnts []gofsutil.Info) (unpublished []gofsutil.Info, published []gofsutil.Info) {
+	deviceMnts := make(map[string]int)
+	for _, m := range driverMnts {
+		deviceMnts[m.Device]++
+	}
+	for _, m := range driverMnts {
+		if filepath.Base(m.Path) != stagingMountDir {
+			continue
+		}
+		if deviceMnts[m.Device] > 1 {
+			published = append(published, m)
+		} else {
+			unpublished = append(unpublished, m)
+		}
+	}
+	return unpublished, published
+}
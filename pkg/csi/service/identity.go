@@ -18,8 +18,12 @@ package service
 
 import (
 	"context"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 )
 
 // set via ldflags
@@ -30,6 +34,14 @@ func (s *service) Probe(
 	req *csi.ProbeRequest) (
 	*csi.ProbeResponse, error) {
 
+	// The controller is unhealthy if it can't reach a vCenter, so that it is restarted
+	// and logs in again instead of failing all volume operations
+	if !strings.EqualFold(s.mode, "node") && s.cs != nil {
+		if err := s.cs.CheckHealth(ctx); err != nil {
+			klog.Errorf("Probe failed with err: %v", err)
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
 	return &csi.ProbeResponse{}, nil
 }
 
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/akutz/gofsutil"
+	"k8s.io/klog"
+)
+
+const (
+	// luksMapperPrefix is the prefix of the device-mapper names of LUKS devices opened by the driver
+	luksMapperPrefix = "luks-"
+	// luksFormat is the format reported by lsblk for LUKS devices
+	luksFormat = "crypto_LUKS"
+)
+
+// luksMapperName returns the device-mapper name of the opened LUKS device for diskID
+func luksMapperName(diskID string) string {
+	return luksMapperPrefix + diskID
+}
+
+// isLuksMapper returns true if dev is a LUKS device opened by openLuksDevice
+func isLuksMapper(dev *Device) bool {
+	return strings.HasPrefix(dev.Name, luksMapperPrefix) &&
+		filepath.Dir(dev.FullPath) == devMapperDir
+}
+
+// openLuksDevice opens the LUKS device on devicePath as mapperName with passphrase and
+// returns the path of the opened device. An unformatted device is formatted with LUKS
+// first, while a device which holds any other data is never formatted.
+func openLuksDevice(ctx context.Context, devicePath string, mapperName string, passphrase string) (string, error) {
+	mapperPath := filepath.Join(devMapperDir, mapperName)
+	if _, err := os.Stat(mapperPath); err == nil {
+		klog.V(4).Infof("LUKS device %s is already open as %s", devicePath, mapperPath)
+		return mapperPath, nil
+	}
+	existingFormat, err := gofsutil.GetDiskFormat(ctx, devicePath)
+	if err != nil {
+		return "", fmt.Errorf("could not determine if device %s is formatted: %v", devicePath, err)
+	}
+	switch existingFormat {
+	case luksFormat:
+	case "":
+		klog.V(2).Infof("formatting device %s with LUKS", devicePath)
+		if err := runCryptsetup(ctx, passphrase, "-q", "luksFormat", "--type", "luks2", "--key-file=-", devicePath); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("device %s already contains %s, can not be formatted with LUKS", devicePath, existingFormat)
+	}
+	if err := runCryptsetup(ctx, passphrase, "luksOpen", "--key-file=-", devicePath, mapperName); err != nil {
+		return "", err
+	}
+	klog.V(2).Infof("opened LUKS device %s as %s", devicePath, mapperPath)
+	return mapperPath, nil
+}
+
+// closeLuksDevice closes the opened LUKS device mapperName
+func closeLuksDevice(ctx context.Context, mapperName string) error {
+	if err := runCryptsetup(ctx, "", "luksClose", mapperName); err != nil {
+		return err
+	}
+	klog.V(2).Infof("closed LUKS device %s", mapperName)
+	return nil
+}
+
+// runCryptsetup runs cryptsetup with args, passing passphrase on stdin
+func runCryptsetup(ctx context.Context, passphrase string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "cryptsetup", args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v, output: %s", args[0], err, string(out))
+	}
+	return nil
+}
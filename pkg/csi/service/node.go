@@ -20,11 +20,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/akutz/gofsutil"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -40,6 +43,7 @@ import (
 	"k8s.io/kubernetes/pkg/volume/util/fs"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/logger"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
@@ -47,9 +51,27 @@ import (
 const (
 	devDiskID   = "/dev/disk/by-id"
 	blockPrefix = "wwn-0x"
-	dmiDir      = "/sys/class/dmi"
+	// scsiPrefix is used instead of blockPrefix by some udev rules
+	scsiPrefix  = "scsi-3"
+	scsiHostDir = "/sys/class/scsi_host"
+	// devMapperDir contains the device-mapper devices by name
+	devMapperDir = "/dev/mapper"
+	// multipathUUIDPrefix is the prefix of the device-mapper UUID of multipath devices
+	multipathUUIDPrefix = "mpath-"
+	dmiDir              = "/sys/class/dmi"
+	sysBlockDir         = "/sys/class/block"
+
+	// diskDiscoveryInitialDelay is the delay before looking for a disk which is not
+	// found after attach again, doubled after every attempt
+	diskDiscoveryInitialDelay = 500 * time.Millisecond
+	// diskDiscoveryMaxAttempts is the number of times a disk is looked for before
+	// it is considered not attached, waiting about 15s in total
+	diskDiscoveryMaxAttempts = 6
 )
 
+// readOnlyRemountFlags are the mount options used to make a bind mount read-only
+var readOnlyRemountFlags = []string{"remount", "bind", "ro"}
+
 func (s *service) NodeStageVolume(
 	ctx context.Context,
 	req *csi.NodeStageVolumeRequest) (
@@ -104,8 +126,27 @@ func (s *service) NodeStageVolume(
 		ro = true
 	}
 
+	// Encrypted volumes are staged through the opened LUKS device
+	if req.VolumeContext[common.AttributeLuksEncryption] == "true" {
+		passphrase := req.GetSecrets()[common.LuksPassphraseKey]
+		if passphrase == "" {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"key %q required in node stage secret of LUKS encrypted volume: %s", common.LuksPassphraseKey, volID)
+		}
+		mapperPath, err := openLuksDevice(ctx, dev.FullPath, luksMapperName(diskID), passphrase)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error opening LUKS device for volume: %s, err: %s", volID, err.Error())
+		}
+		dev, err = getDevice(mapperPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error getting LUKS device for volume: %s, err: %s", volID, err.Error())
+		}
+	}
+
 	// Get mounts to check if already staged
-	mnts, err := gofsutil.GetDevMounts(context.Background(), dev.RealDev)
+	mnts, err := getDevMounts(dev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -125,6 +166,15 @@ func (s *service) NodeStageVolume(
 		if fs == "" {
 			fs = fsType
 		}
+		if attributes[common.AttributePmem] == "true" && (fs == "ext4" || fs == "xfs") {
+			// Persistent memory is accessed directly, bypassing the page cache, if the
+			// device supports it. PMem disks attached as SCSI disks don't.
+			if supportsDax(dev.RealDev, sysBlockDir) {
+				mntFlags = append(mntFlags, "dax")
+			} else {
+				klog.V(2).Infof("Device %s of PMem volume: %s does not support DAX", dev.RealDev, volID)
+			}
+		}
 
 		// If read-only access mode, we don't allow formatting
 		if ro {
@@ -136,9 +186,13 @@ func (s *service) NodeStageVolume(
 			}
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
-		if err := gofsutil.FormatAndMount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
+		mkfsOptions := strings.Fields(attributes[common.AttributeMkfsOptions])
+		if err := formatDevice(ctx, dev.FullPath, fs, mkfsOptions); err != nil {
+			return nil, err
+		}
+		if err := gofsutil.Mount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
 			return nil, status.Errorf(codes.Internal,
-				"error with format and mount during staging: %s",
+				"error with mount during staging: %s",
 				err.Error())
 		}
 		return &csi.NodeStageVolumeResponse{}, nil
@@ -204,7 +258,7 @@ func (s *service) NodeUnstageVolume(
 	klog.V(2).Infof("found device. volID: %q, path: %q, block: %q, target: %q", volID, dev.FullPath, dev.RealDev, target)
 
 	// Get mounts for device
-	mnts, err := gofsutil.GetDevMounts(context.Background(), dev.RealDev)
+	mnts, err := getDevMounts(dev)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
@@ -226,6 +280,13 @@ func (s *service) NodeUnstageVolume(
 			"Error unmounting target: %s", err.Error())
 	}
 
+	if isLuksMapper(dev) {
+		if err := closeLuksDevice(ctx, dev.Name); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"Error closing LUKS device: %s", err.Error())
+		}
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -249,24 +310,43 @@ func (s *service) NodePublishVolume(
 		return nil, err
 	}
 
-	// Get underlying block device
-	dev, err := getDevice(volPath)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error getting block device for volume: %s, err: %s",
-			volID, err.Error())
-	}
 	// check for Block vs Mount
 	volCap := req.GetVolumeCapability()
 	if _, ok := volCap.GetAccessType().(*csi.VolumeCapability_Block); ok {
+		// Get underlying block device
+		dev, err := getDevice(volPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error getting block device for volume: %s, err: %s",
+				volID, err.Error())
+		}
 		// bind mount device to target
 		return publishBlockVol(ctx, req, dev)
 	}
 
-	// Volume must be a mount volume
+	// Volume must be a mount volume, get the device it is staged on
+	dev, err := getStagedDevice(volPath, diskID, req.GetVolumeContext(), devMapperDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"Volume ID: %s does not appear staged to %s", volID, req.GetStagingTargetPath())
+		}
+		return nil, status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			volID, err.Error())
+	}
 	return publishMountVol(ctx, req, dev)
 }
 
+// getStagedDevice returns the device the filesystem of the mount volume on volPath is
+// staged on, which is the opened LUKS device in mapperDir for encrypted volumes
+func getStagedDevice(volPath string, diskID string, volumeContext map[string]string, mapperDir string) (*Device, error) {
+	if volumeContext[common.AttributeLuksEncryption] == "true" {
+		return getDevice(filepath.Join(mapperDir, luksMapperName(diskID)))
+	}
+	return getDevice(volPath)
+}
+
 func (s *service) NodeUnpublishVolume(
 	ctx context.Context,
 	req *csi.NodeUnpublishVolumeRequest) (
@@ -334,11 +414,21 @@ func (s *service) NodeGetVolumeStats(
 	*csi.NodeGetVolumeStatsResponse, error) {
 
 	var err error
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is empty")
+	}
 	targetPath := req.GetVolumePath()
 	if targetPath == "" {
 		err = fmt.Errorf("targetpath %v is empty", targetPath)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	targetStat, err := os.Stat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "targetpath %v does not exist", targetPath)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat targetpath %v: %v", targetPath, err)
+	}
 
 	dev, err := getDevFromMount(targetPath)
 	if err != nil {
@@ -352,6 +442,23 @@ func (s *service) NodeGetVolumeStats(
 
 	//TODO Check that the matching device is a vSphere volume, and that the volID matches the mount point
 
+	if !targetStat.IsDir() {
+		// Raw block volumes are bind mounted on a file, only the device size is known
+		size, err := getBlockSizeBytes(dev.RealDev)
+		if err != nil {
+			klog.Errorf("failed to get size of block device %s: %v", dev.RealDev, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: size,
+					Unit:  csipbv1.VolumeUsage_BYTES,
+				},
+			},
+		}, nil
+	}
+
 	volMetrics, err := getMetrics(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -427,6 +534,56 @@ func getMetrics(path string) (*k8svol.Metrics, error) {
 	return metrics, nil
 }
 
+// formatDevice formats devicePath with fsType, unless it already contains a filesystem.
+// A device formatted with a different filesystem than fsType is never reformatted.
+func formatDevice(ctx context.Context, devicePath string, fsType string, mkfsOptions []string) error {
+	existingFormat, err := gofsutil.GetDiskFormat(ctx, devicePath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"could not determine if device %s is formatted: %s", devicePath, err.Error())
+	}
+	if existingFormat != "" {
+		if existingFormat != fsType {
+			return status.Errorf(codes.FailedPrecondition,
+				"device %s already contains %s, can not be mounted as %s", devicePath, existingFormat, fsType)
+		}
+		klog.V(4).Infof("device %s is already formatted with %s", devicePath, fsType)
+		return nil
+	}
+	args := getMkfsArgs(devicePath, fsType, mkfsOptions)
+	klog.V(2).Infof("formatting device %s with mkfs.%s %v", devicePath, fsType, args)
+	if out, err := exec.CommandContext(ctx, "mkfs."+fsType, args...).CombinedOutput(); err != nil {
+		return status.Errorf(codes.Internal,
+			"error formatting device %s with %s: %s, output: %s", devicePath, fsType, err.Error(), string(out))
+	}
+	return nil
+}
+
+// getMkfsArgs returns the arguments to mkfs.<fsType> for formatting devicePath
+func getMkfsArgs(devicePath string, fsType string, mkfsOptions []string) []string {
+	var args []string
+	if fsType == "ext3" || fsType == "ext4" {
+		// Volumes are whole disks, force mke2fs not to ask for confirmation
+		args = append(args, "-F")
+	}
+	args = append(args, mkfsOptions...)
+	return append(args, devicePath)
+}
+
+// getBlockSizeBytes returns the size in bytes of the block device at devicePath
+func getBlockSizeBytes(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek to the end of %s: %v", devicePath, err)
+	}
+	return size, nil
+}
+
 func (s *service) NodeGetCapabilities(
 	ctx context.Context,
 	req *csi.NodeGetCapabilitiesRequest) (
@@ -478,70 +635,124 @@ func (s *service) NodeGetInfo(
 	}
 	var accessibleTopology map[string]string
 	topology := &csi.Topology{}
-
-	if cfg.Labels.Zone != "" && cfg.Labels.Region != "" {
-		klog.V(2).Infof("Config file provided to node daemonset with zones and regions. Assuming topology aware cluster.")
-		vcenterconfig, err := cnsvsphere.GetVirtualCenterConfig(cfg)
-		if err != nil {
-			klog.Errorf("Failed to get VirtualCenterConfig from cns config. err=%v", err)
-			return nil, status.Errorf(codes.Internal, err.Error())
-		}
-		vcManager := cnsvsphere.GetVirtualCenterManager()
-		vcenter, err := vcManager.RegisterVirtualCenter(vcenterconfig)
-		if err != nil {
-			klog.Errorf("Failed to register vcenter with virtualCenterManager.")
-			return nil, status.Errorf(codes.Internal, err.Error())
-		}
-		defer vcManager.UnregisterAllVirtualCenters()
-		//Connect to vCenter
-		err = vcenter.Connect(ctx)
-		if err != nil {
-			klog.Errorf("Failed to connect to vcenter host: %s. err=%v", vcenter.Config.Host, err)
+	isTopologyAware := cfg.Labels.Zone != "" && cfg.Labels.Region != ""
+	maxVolumesPerNode := int64(cfg.Global.MaxVolumesPerNode)
+
+	if isTopologyAware || cfg.Global.HostLocalTopology || maxVolumesPerNode <= 0 {
+		// The node only needs the sessions while getting its info
+		defer cnsvsphere.GetVirtualCenterManager().UnregisterAllVirtualCenters()
+		nodeVM, err := connectNodeVM(ctx, cfg, nodeID)
+		if err != nil && (isTopologyAware || cfg.Global.HostLocalTopology) {
 			return nil, status.Errorf(codes.Internal, err.Error())
+		} else if err != nil {
+			// The volume limit is only a scheduling hint, the node is registered without
+			// one rather than failing the registration while vCenter is not reachable
+			klog.Warningf("Failed to get the VM of node %q, registering it without a volume limit. err=%v", nodeID, err)
+			return &csi.NodeGetInfoResponse{
+				NodeId:             nodeID,
+				AccessibleTopology: topology,
+			}, nil
 		}
-		// Get VM UUID
-		uuid, err := getSystemUUID()
-		if err != nil {
-			klog.Errorf("Failed to get system uuid for node VM")
-			return nil, status.Errorf(codes.Internal, err.Error())
+		if maxVolumesPerNode <= 0 {
+			// Not configured, derive the limit from the node VM. It is only a scheduling
+			// hint, so the node is registered without a limit if it can not be derived.
+			maxVolumesPerNode, err = nodeVM.GetMaxVolumes(ctx, cfg.Global.AttachControllerType)
+			if err != nil {
+				klog.Warningf("Failed to get max volumes for node VM: %v, err: %v", nodeVM.Reference(), err)
+				maxVolumesPerNode = 0
+			}
 		}
-		klog.V(4).Infof("Successfully retrieved uuid:%s  from the node: %s", uuid, nodeID)
-		nodeVM, err := cnsvsphere.GetVirtualMachineByUUID(uuid, false)
-		if err != nil || nodeVM == nil {
-			klog.Errorf("Failed to get nodeVM for uuid: %s. err: %+v", uuid, err)
-			uuid, err = convertUUID(uuid)
+		if isTopologyAware {
+			klog.V(2).Infof("Config file provided to node daemonset with zones and regions. Assuming topology aware cluster.")
+			zone, region, err := nodeVM.GetZoneRegion(ctx, cfg.Labels.Zone, cfg.Labels.Region)
 			if err != nil {
-				klog.Errorf("convertUUID failed with error: %v", err)
+				klog.Errorf("Failed to get accessibleTopology for vm: %v, err: %v", nodeVM.Reference(), err)
 				return nil, status.Errorf(codes.Internal, err.Error())
 			}
-			nodeVM, err = cnsvsphere.GetVirtualMachineByUUID(uuid, false)
-			if err != nil || nodeVM == nil {
-				klog.Errorf("Failed to get nodeVM for uuid: %s. err: %+v", uuid, err)
-				return nil, status.Errorf(codes.Internal, err.Error())
+			klog.V(4).Infof("zone: [%s], region: [%s], Node VM: [%s]", zone, region, nodeID)
+			if zone != "" && region != "" {
+				accessibleTopology = make(map[string]string)
+				accessibleTopology[csitypes.LabelRegionFailureDomain] = region
+				accessibleTopology[csitypes.LabelZoneFailureDomain] = zone
+				labels, err := nodeVM.GetTopologyLabels(ctx, cnsconfig.GetTopologyCategories(cfg))
+				if err != nil {
+					klog.Errorf("Failed to get topology labels for vm: %v, err: %v", nodeVM.Reference(), err)
+					return nil, status.Errorf(codes.Internal, err.Error())
+				}
+				for category, tag := range labels {
+					accessibleTopology[csitypes.LabelTopologyPrefix+category] = tag
+				}
 			}
 		}
-		zone, region, err := nodeVM.GetZoneRegion(ctx, cfg.Labels.Zone, cfg.Labels.Region)
-		if err != nil {
-			klog.Errorf("Failed to get accessibleTopology for vm: %v, err: %v", nodeVM.Reference(), err)
-			return nil, status.Errorf(codes.Internal, err.Error())
-		}
-		klog.V(4).Infof("zone: [%s], region: [%s], Node VM: [%s]", zone, region, nodeID)
-		if zone != "" && region != "" {
-			accessibleTopology = make(map[string]string)
-			accessibleTopology[csitypes.LabelRegionFailureDomain] = region
-			accessibleTopology[csitypes.LabelZoneFailureDomain] = zone
+		if cfg.Global.HostLocalTopology {
+			host, err := nodeVM.GetHostTopologyValue(ctx)
+			if err != nil {
+				klog.Errorf("Failed to get host topology of vm: %v, err: %v", nodeVM.Reference(), err)
+				return nil, status.Errorf(codes.Internal, err.Error())
+			}
+			if accessibleTopology == nil {
+				accessibleTopology = make(map[string]string)
+			}
+			accessibleTopology[csitypes.LabelHostTopology] = host
 		}
 	}
 	if len(accessibleTopology) > 0 {
 		topology.Segments = accessibleTopology
 	}
+	klog.V(4).Infof("max volumes: %d, Node VM: [%s]", maxVolumesPerNode, nodeID)
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:             nodeID,
+		MaxVolumesPerNode:  maxVolumesPerNode,
 		AccessibleTopology: topology,
 	}, nil
 }
 
+// connectNodeVM connects to the vCenters of cfg and returns the VM of this node,
+// which is looked up on all of them
+func connectNodeVM(ctx context.Context, cfg *cnsconfig.Config, nodeID string) (*cnsvsphere.VirtualMachine, error) {
+	vcenterconfigs, err := cnsvsphere.GetVirtualCenterConfigs(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfig from cns config. err=%v", err)
+		return nil, err
+	}
+	for _, vcenterconfig := range vcenterconfigs {
+		if _, err = cnsvsphere.ConnectVirtualCenter(ctx, vcenterconfig); err != nil {
+			klog.Errorf("Failed to connect to vcenter host: %s. err=%v", vcenterconfig.Host, err)
+			return nil, err
+		}
+	}
+	return getNodeVM(nodeID)
+}
+
+// getNodeVM returns the VM of this node, looked up by its system UUID
+func getNodeVM(nodeID string) (*cnsvsphere.VirtualMachine, error) {
+	uuid, err := getSystemUUID()
+	if err != nil {
+		klog.Errorf("Failed to get system uuid for node VM")
+		return nil, err
+	}
+	klog.V(4).Infof("Successfully retrieved uuid:%s  from the node: %s", uuid, nodeID)
+	nodeVM, err := cnsvsphere.GetVirtualMachineByUUID(uuid, false)
+	if err != nil || nodeVM == nil {
+		klog.Errorf("Failed to get nodeVM for uuid: %s. err: %+v", uuid, err)
+		uuid, err = convertUUID(uuid)
+		if err != nil {
+			klog.Errorf("convertUUID failed with error: %v", err)
+			return nil, err
+		}
+		nodeVM, err = cnsvsphere.GetVirtualMachineByUUID(uuid, false)
+		if err != nil || nodeVM == nil {
+			klog.Errorf("Failed to get nodeVM for uuid: %s. err: %+v", uuid, err)
+			if err == nil {
+				err = cnsvsphere.ErrVMNotFound
+			}
+			return nil, err
+		}
+	}
+	return nodeVM, nil
+}
+
 func publishMountVol(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest,
@@ -595,7 +806,7 @@ func publishMountVol(
 				}
 
 				// Existing mount satisfies request
-				klog.V(3).Infof("volume already published to target. volumePath: %q, device: %q, req: %v", dev.FullPath, dev.RealDev, req)
+				klog.V(3).Infof("volume already published to target. volumePath: %q, device: %q, req: %s", dev.FullPath, dev.RealDev, logger.Redact(req))
 				return &csi.NodePublishVolumeResponse{}, nil
 			}
 		}
@@ -605,19 +816,39 @@ func publishMountVol(
 	}
 
 	// Do the bind mount to publish the volume
-	if ro {
-		mntFlags = append(mntFlags, "ro")
-	}
-
 	if err := gofsutil.BindMount(ctx, stagingTarget, target, mntFlags...); err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"error publish volume to target path: %s",
 			err.Error())
 	}
+	if ro {
+		if err := remountReadOnly(ctx, target); err != nil {
+			// Don't leave a writable mount behind for a read-only request
+			if unmountErr := gofsutil.Unmount(ctx, target); unmountErr != nil {
+				klog.Errorf("failed to unmount %q after read-only remount failure. err: %v", target, unmountErr)
+			}
+			return nil, status.Errorf(codes.Internal,
+				"error making published volume read-only: %s",
+				err.Error())
+		}
+	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// remountReadOnly makes the bind mount at target read-only.
+// gofsutil remounts bind mounts without the "bind" flag, which applies
+// "ro" to the whole filesystem, including the staging mount and every
+// other publish of the volume. Remounting with "bind" only changes the
+// flags of the mount at target.
+func remountReadOnly(ctx context.Context, target string) error {
+	args := gofsutil.MakeMountArgs(ctx, "", target, "", readOnlyRemountFlags...)
+	if out, err := exec.CommandContext(ctx, "mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s failed: %v, output: %s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
 func publishBlockVol(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest,
@@ -626,6 +857,11 @@ func publishBlockVol(
 
 	// We are responsible for creating target file, per spec
 	target := req.GetTargetPath()
+	// The parent directory of the target file is not guaranteed to exist
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"Unable to create parent directory for target file: %s, err: %v", target, err)
+	}
 	_, err := mkfile(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
@@ -706,6 +942,25 @@ func getDevice(path string) (*Device, error) {
 			"%s is not a block device", path)
 	}
 
+	// Disks claimed by dm-multipath must only be accessed through the multipath device
+	mpathName, err := getMultipathDevice(d, sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+	if mpathName != "" {
+		mapperPath := filepath.Join(devMapperDir, mpathName)
+		mapperDev, err := filepath.EvalSymlinks(mapperPath)
+		if err != nil {
+			return nil, err
+		}
+		klog.V(2).Infof("device %s is claimed by multipath device %s", d, mapperPath)
+		return &Device{
+			Name:     mpathName,
+			FullPath: mapperPath,
+			RealDev:  mapperDev,
+		}, nil
+	}
+
 	return &Device{
 		Name:     fi.Name(),
 		FullPath: path,
@@ -713,6 +968,45 @@ func getDevice(path string) (*Device, error) {
 	}, nil
 }
 
+// supportsDax returns true if the block device devicePath supports direct access (DAX),
+// as told by its queue attributes in sysBlockPath
+func supportsDax(devicePath string, sysBlockPath string) bool {
+	dax, err := ioutil.ReadFile(filepath.Join(sysBlockPath, filepath.Base(devicePath), "queue", "dax"))
+	return err == nil && strings.TrimSpace(string(dax)) == "1"
+}
+
+// getMultipathDevice returns the name of the dm-multipath device holding
+// devicePath, or "" if the device is not claimed by multipath.
+// sysBlockPath is the sysfs block class directory, parameterized for testing purposes
+func getMultipathDevice(devicePath string, sysBlockPath string) (string, error) {
+	holders, err := ioutil.ReadDir(filepath.Join(sysBlockPath, filepath.Base(devicePath), "holders"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, holder := range holders {
+		dmDir := filepath.Join(sysBlockPath, holder.Name(), "dm")
+		uuid, err := ioutil.ReadFile(filepath.Join(dmDir, "uuid"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if !strings.HasPrefix(strings.TrimSpace(string(uuid)), multipathUUIDPrefix) {
+			continue
+		}
+		name, err := ioutil.ReadFile(filepath.Join(dmDir, "name"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(name)), nil
+	}
+	return "", nil
+}
+
 // The files parameter is optional for testing purposes
 func getDiskPath(id string, files []os.FileInfo) (string, error) {
 	var (
@@ -729,15 +1023,37 @@ func getDiskPath(id string, files []os.FileInfo) (string, error) {
 		devs = files
 	}
 
-	targetDisk := blockPrefix + id
+	id = common.FormatDiskUUID(id)
+	wwnDisk := blockPrefix + id
+	scsiDisk := scsiPrefix + id
 
+	// Prefer the wwn link, fall back to the scsi link if udev did not create it
+	var scsiDiskPath string
 	for _, f := range devs {
-		if f.Name() == targetDisk {
+		name := strings.ToLower(f.Name())
+		if name == wwnDisk {
 			return filepath.Join(devDiskID, f.Name()), nil
 		}
+		if name == scsiDisk {
+			scsiDiskPath = filepath.Join(devDiskID, f.Name())
+		}
 	}
 
-	return "", nil
+	return scsiDiskPath, nil
+}
+
+// rescanSCSIHosts makes all SCSI hosts scan for new devices
+func rescanSCSIHosts() error {
+	scanFiles, err := filepath.Glob(filepath.Join(scsiHostDir, "host*", "scan"))
+	if err != nil {
+		return err
+	}
+	for _, scanFile := range scanFiles {
+		if err := ioutil.WriteFile(scanFile, []byte("- - -"), 0200); err != nil {
+			return fmt.Errorf("failed to rescan SCSI host %s: %v", filepath.Base(filepath.Dir(scanFile)), err)
+		}
+	}
+	return nil
 }
 
 func contains(list []string, item string) bool {
@@ -751,19 +1067,30 @@ func contains(list []string, item string) bool {
 
 func verifyVolumeAttached(diskID string) (string, error) {
 
-	// Check that volume is attached
-	volPath, err := getDiskPath(diskID, nil)
-	if err != nil {
-		return "", status.Errorf(codes.Internal,
-			"Error trying to read attached disks: %v", err)
-	}
-	if volPath == "" {
-		return "", status.Errorf(codes.NotFound,
-			"disk: %s not attached to node", diskID)
+	// Check that volume is attached. The disk may show up some time after
+	// the hot-add completed on slow hosts, so rescan and retry before giving up.
+	delay := diskDiscoveryInitialDelay
+	for attempt := 1; ; attempt++ {
+		volPath, err := getDiskPath(diskID, nil)
+		if err != nil {
+			return "", status.Errorf(codes.Internal,
+				"Error trying to read attached disks: %v", err)
+		}
+		if volPath != "" {
+			klog.V(2).Infof("found disk. diskID: %q, path: %q", diskID, volPath)
+			return volPath, nil
+		}
+		if attempt == diskDiscoveryMaxAttempts {
+			return "", status.Errorf(codes.NotFound,
+				"disk: %s not attached to node", diskID)
+		}
+		klog.V(2).Infof("disk: %s not found, rescanning SCSI hosts. attempt: %d/%d", diskID, attempt, diskDiscoveryMaxAttempts)
+		if err := rescanSCSIHosts(); err != nil {
+			klog.Warningf("Failed to rescan SCSI hosts: %v", err)
+		}
+		time.Sleep(delay)
+		delay *= 2
 	}
-
-	klog.V(2).Infof("found disk. diskID: %q, path: %q", diskID, volPath)
-	return volPath, nil
 }
 
 func verifyTargetDir(target string) error {
@@ -854,6 +1181,9 @@ func ensureMountVol(volCap *csi.VolumeCapability) (string, []string, error) {
 	}
 	fs := mountVol.GetFsType()
 	mntFlags := mountVol.GetMountFlags()
+	if err := common.ValidateMountFlags(mntFlags); err != nil {
+		return "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	return fs, mntFlags, nil
 }
@@ -863,18 +1193,38 @@ func getDevMounts(
 	sysDevice *Device) ([]gofsutil.Info, error) {
 
 	ctx := context.Background()
-	devMnts := make([]gofsutil.Info, 0)
-
 	mnts, err := gofsutil.GetMounts(ctx)
 	if err != nil {
-		return devMnts, err
+		return make([]gofsutil.Info, 0), err
 	}
+	return filterDevMounts(mnts, sysDevice), nil
+}
+
+// filterDevMounts returns the mounts of mnts of sysDevice. Device mapper devices are
+// listed in the mount table under their /dev/mapper name, so the devices of the mounts
+// are compared with their symlinks resolved.
+func filterDevMounts(mnts []gofsutil.Info, sysDevice *Device) []gofsutil.Info {
+	devMnts := make([]gofsutil.Info, 0)
 	for _, m := range mnts {
-		if m.Device == sysDevice.RealDev || (m.Device == "devtmpfs" && m.Source == sysDevice.RealDev) {
+		if resolveDevice(m.Device) == sysDevice.RealDev ||
+			(m.Device == "devtmpfs" && resolveDevice(m.Source) == sysDevice.RealDev) {
 			devMnts = append(devMnts, m)
 		}
 	}
-	return devMnts, nil
+	return devMnts
+}
+
+// resolveDevice returns the device path with its symlinks resolved, or the path itself
+// if it can not be resolved, e.g. for the devices of pseudo filesystems
+func resolveDevice(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
 }
 
 func getSystemUUID() (string, error) {
@@ -914,7 +1264,7 @@ func getDiskID(volID string, pubCtx map[string]string) (string, error) {
 			"Attribute: %s required in publish context",
 			common.AttributeFirstClassDiskUUID)
 	}
-	return pubCtx[common.AttributeFirstClassDiskUUID], nil
+	return common.FormatDiskUUID(pubCtx[common.AttributeFirstClassDiskUUID]), nil
 }
 
 func getDevFromMount(target string) (*Device, error) {
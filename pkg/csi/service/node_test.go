@@ -17,10 +17,19 @@ limitations under the License.
 package service
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
 func TestGetDisk(t *testing.T) {
@@ -70,6 +79,216 @@ func TestGetDisk(t *testing.T) {
 	}
 }
 
+func TestGetDiskScsiLink(t *testing.T) {
+	devs := []os.FileInfo{
+		&FakeFileInfo{name: "scsi-36000c29702438570234875"},
+		&FakeFileInfo{name: "wwn-0x6000c29702345804753484"},
+	}
+	// Disk UUIDs are matched regardless of case and dashes
+	d, err := getDiskPath("6000C297-0243-8570-234875", devs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := filepath.Join(devDiskID, "scsi-36000c29702438570234875")
+	if d != disk {
+		t.Errorf("Expected disk: %s got: %s", disk, d)
+	}
+
+	// wwn link is preferred over scsi link
+	devs = append(devs, &FakeFileInfo{name: "wwn-0x6000c29702438570234875"})
+	d, err = getDiskPath("6000c29702438570234875", devs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk = filepath.Join(devDiskID, "wwn-0x6000c29702438570234875")
+	if d != disk {
+		t.Errorf("Expected disk: %s got: %s", disk, d)
+	}
+}
+
+func TestGetMultipathDevice(t *testing.T) {
+	sysBlock, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysBlock)
+	// sdb is claimed by multipath device dm-0, sdc is used by LVM volume dm-1, sdd is unused
+	files := map[string]string{
+		"dm-0/dm/uuid": "mpath-36000c29702438570234875\n",
+		"dm-0/dm/name": "mpatha\n",
+		"dm-1/dm/uuid": "LVM-ZkHYz1ZZ3pjz\n",
+		"dm-1/dm/name": "vg-lv\n",
+	}
+	for file, content := range files {
+		if err = os.MkdirAll(filepath.Join(sysBlock, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(sysBlock, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"sdb/holders/dm-0", "sdc/holders/dm-1", "sdd/holders"} {
+		if err = os.MkdirAll(filepath.Join(sysBlock, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		device string
+		mpath  string
+	}{
+		{device: "/dev/sdb", mpath: "mpatha"},
+		{device: "/dev/sdc", mpath: ""},
+		{device: "/dev/sdd", mpath: ""},
+		{device: "/dev/sde", mpath: ""},
+	}
+	for _, tt := range tests {
+		mpath, err := getMultipathDevice(tt.device, sysBlock)
+		if err != nil {
+			t.Errorf("Unexpected error for device %s: %v", tt.device, err)
+		}
+		if mpath != tt.mpath {
+			t.Errorf("Expected multipath device for %s: %q got: %q", tt.device, tt.mpath, mpath)
+		}
+	}
+}
+
+func TestSupportsDax(t *testing.T) {
+	sysBlock, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sysBlock)
+	// pmem0 is an NVDIMM namespace, sdb is a PMem disk attached as a SCSI disk
+	files := map[string]string{
+		"pmem0/queue/dax": "1\n",
+		"sdb/queue/dax":   "0\n",
+	}
+	for file, content := range files {
+		if err = os.MkdirAll(filepath.Join(sysBlock, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(sysBlock, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]bool{
+		"/dev/pmem0": true,
+		"/dev/sdb":   false,
+		"/dev/sdc":   false,
+	}
+	for device, expected := range tests {
+		if dax := supportsDax(device, sysBlock); dax != expected {
+			t.Errorf("Expected DAX support of %s to be %t, got %t", device, expected, dax)
+		}
+	}
+}
+
+func TestGetBlockSizeBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	size := int64(4 * 1024 * 1024)
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := getBlockSizeBytes(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != size {
+		t.Errorf("Expected size: %d got: %d", size, got)
+	}
+	if _, err = getBlockSizeBytes(filepath.Join(os.TempDir(), "does-not-exist")); err == nil {
+		t.Errorf("Expected error for device which does not exist")
+	}
+}
+
+func TestGetMkfsArgs(t *testing.T) {
+	tests := []struct {
+		fsType      string
+		mkfsOptions []string
+		args        []string
+	}{
+		{
+			fsType: "ext4",
+			args:   []string{"-F", "/dev/sdb"},
+		},
+		{
+			fsType:      "ext3",
+			mkfsOptions: []string{"-b", "4096"},
+			args:        []string{"-F", "-b", "4096", "/dev/sdb"},
+		},
+		{
+			fsType: "xfs",
+			args:   []string{"/dev/sdb"},
+		},
+		{
+			fsType:      "xfs",
+			mkfsOptions: []string{"-m", "reflink=1", "-i", "size=512"},
+			args:        []string{"-m", "reflink=1", "-i", "size=512", "/dev/sdb"},
+		},
+	}
+
+	for _, tt := range tests {
+		args := getMkfsArgs("/dev/sdb", tt.fsType, tt.mkfsOptions)
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("Expected mkfs.%s args: %v got: %v", tt.fsType, tt.args, args)
+		}
+	}
+}
+
+func TestEnsureMountVol(t *testing.T) {
+	tests := []struct {
+		mountFlags []string
+		valid      bool
+	}{
+		{
+			mountFlags: []string{"noatime", "nodev", "nosuid"},
+			valid:      true,
+		},
+		{
+			mountFlags: []string{"data=ordered", "commit=30"},
+			valid:      true,
+		},
+		{
+			mountFlags: []string{"noatime", "suid"},
+			valid:      false,
+		},
+		{
+			mountFlags: []string{"bind"},
+			valid:      false,
+		},
+		{
+			mountFlags: []string{"uid=0"},
+			valid:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		volCap := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     "ext4",
+					MountFlags: tt.mountFlags,
+				},
+			},
+		}
+		_, _, err := ensureMountVol(volCap)
+		if tt.valid && err != nil {
+			t.Errorf("Expected mount flags %v to be valid, got err: %v", tt.mountFlags, err)
+		}
+		if !tt.valid && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected mount flags %v to fail with %v, got err: %v", tt.mountFlags, codes.InvalidArgument, err)
+		}
+	}
+}
+
 type FakeFileInfo struct {
 	name string
 }
@@ -97,3 +316,126 @@ func (fi *FakeFileInfo) IsDir() bool {
 func (fi *FakeFileInfo) Sys() interface{} {
 	return nil
 }
+
+func TestGetStaleMounts(t *testing.T) {
+	kubeletDir, err := ioutil.TempDir("", "kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kubeletDir)
+
+	newVolume := func(name string, driverName string) string {
+		volDir := filepath.Join(kubeletDir, "pods", "pod-1", "volumes", "kubernetes.io~csi", name)
+		if err := os.MkdirAll(volDir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(`{"driverName":"` + driverName + `"}`)
+		if err := ioutil.WriteFile(filepath.Join(volDir, volDataFileName), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(volDir, "mount")
+	}
+	staleMnt := gofsutil.Info{Device: "/dev/not-a-disk", Path: newVolume("pv-stale", Name)}
+	mnts := []gofsutil.Info{
+		staleMnt,
+		{Device: "/dev/null", Path: newVolume("pv-attached", Name)},
+		{Device: "/dev/not-a-disk", Path: newVolume("pv-other-driver", "other.csi.k8s.io")},
+		{Device: "/dev/not-a-disk", Path: "/mnt/data"},
+	}
+
+	staleMnts := getStaleMounts(mnts, kubeletDir)
+	if !reflect.DeepEqual(staleMnts, []gofsutil.Info{staleMnt}) {
+		t.Errorf("expected stale mounts %v, got %v", []gofsutil.Info{staleMnt}, staleMnts)
+	}
+}
+
+func TestGetStagingMounts(t *testing.T) {
+	staged := gofsutil.Info{Device: "/dev/sdb", Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"}
+	stagedInUse := gofsutil.Info{Device: "/dev/sdc", Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-2/globalmount"}
+	published := gofsutil.Info{Device: "/dev/sdc", Path: "/var/lib/kubelet/pods/pod-1/volumes/kubernetes.io~csi/pv-2/mount"}
+
+	unpublished, inUse := getStagingMounts([]gofsutil.Info{staged, stagedInUse, published})
+	if !reflect.DeepEqual(unpublished, []gofsutil.Info{staged}) {
+		t.Errorf("expected unpublished staging mounts %v, got %v", []gofsutil.Info{staged}, unpublished)
+	}
+	if !reflect.DeepEqual(inUse, []gofsutil.Info{stagedInUse}) {
+		t.Errorf("expected published staging mounts %v, got %v", []gofsutil.Info{stagedInUse}, inUse)
+	}
+}
+
+func TestFilterDevMounts(t *testing.T) {
+	devDir, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(devDir)
+	// The multipath device dm-0 is mounted under its /dev/mapper name
+	dm0 := filepath.Join(devDir, "dm-0")
+	if err = ioutil.WriteFile(dm0, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(devDir, "mapper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mapperPath := filepath.Join(devDir, "mapper", "mpatha")
+	if err = os.Symlink("../dm-0", mapperPath); err != nil {
+		t.Fatal(err)
+	}
+
+	staged := gofsutil.Info{Device: mapperPath, Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"}
+	published := gofsutil.Info{Device: dm0, Path: "/var/lib/kubelet/pods/pod-1/volumes/kubernetes.io~csi/pv-1/mount"}
+	block := gofsutil.Info{Device: "devtmpfs", Source: mapperPath, Path: "/var/lib/kubelet/pods/pod-2/volumes/kubernetes.io~csi/pv-1/mount"}
+	other := gofsutil.Info{Device: "/dev/sdb", Path: "/mnt/data"}
+	proc := gofsutil.Info{Device: "proc", Path: "/proc"}
+
+	realDev, err := filepath.EvalSymlinks(dm0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &Device{Name: "mpatha", FullPath: mapperPath, RealDev: realDev}
+	devMnts := filterDevMounts([]gofsutil.Info{staged, published, block, other, proc}, dev)
+	if expected := []gofsutil.Info{staged, published, block}; !reflect.DeepEqual(devMnts, expected) {
+		t.Errorf("expected mounts %v, got %v", expected, devMnts)
+	}
+}
+
+func TestGetStagedDevice(t *testing.T) {
+	mapperDir, err := ioutil.TempDir("", "mapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mapperDir)
+	// The disk is /dev/zero, NodeStageVolume opened its LUKS device as /dev/null
+	diskID := "6000c29702438570234875"
+	luksPath := filepath.Join(mapperDir, luksMapperName(diskID))
+	if err = os.Symlink("/dev/null", luksPath); err != nil {
+		t.Fatal(err)
+	}
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"
+	mnts := []gofsutil.Info{{Device: luksPath, Path: stagingPath}}
+
+	encrypted := map[string]string{common.AttributeLuksEncryption: "true"}
+	dev, err := getStagedDevice("/dev/zero", diskID, encrypted, mapperDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.RealDev != "/dev/null" {
+		t.Errorf("Expected the LUKS device /dev/null of the encrypted volume, got %s", dev.RealDev)
+	}
+	if devMnts := filterDevMounts(mnts, dev); len(devMnts) != 1 || devMnts[0].Path != stagingPath {
+		t.Errorf("Expected the encrypted volume to be staged to %s, got mounts %v", stagingPath, devMnts)
+	}
+
+	dev, err = getStagedDevice("/dev/zero", diskID, map[string]string{}, mapperDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.RealDev != "/dev/zero" {
+		t.Errorf("Expected the disk /dev/zero of the unencrypted volume, got %s", dev.RealDev)
+	}
+
+	// The LUKS device is not open before the volume is staged
+	if _, err = getStagedDevice("/dev/zero", "6000c29702345804753484", encrypted, mapperDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the LUKS device of an unstaged volume not to exist, got err: %v", err)
+	}
+}
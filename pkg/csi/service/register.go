@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/cns"
+)
+
+// RegisterDisks registers the legacy virtual disks listed in the file listPath, one
+// datastore path such as "[vsanDatastore] kubevols/disk-1.vmdk" per line, as volumes
+// of the cluster and writes the manifests of their PersistentVolumes to out.
+// The disks are listed on stdin if listPath is "-". Empty lines and lines
+// starting with "#" are ignored.
+func RegisterDisks(ctx context.Context, listPath string, out io.Writer) error {
+	list := os.Stdin
+	if listPath != "-" {
+		f, err := os.Open(listPath)
+		if err != nil {
+			klog.Errorf("failed to open the list of disks to register. err: %v", err)
+			return err
+		}
+		defer f.Close()
+		list = f
+	}
+	var volumePaths []string
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		volumePaths = append(volumePaths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		klog.Errorf("failed to read the list of disks to register. err: %v", err)
+		return err
+	}
+
+	path := os.Getenv(cnsconfig.EnvCloudConfig)
+	if path == "" {
+		path = cnsconfig.DefaultCloudConfigPath
+	}
+	cfg, err := cnsconfig.GetCnsconfig(path)
+	if err != nil {
+		klog.Errorf("failed to read cnsconfig. err: %v", err)
+		return err
+	}
+	return cns.RegisterDisks(ctx, cfg, volumePaths, out)
+}
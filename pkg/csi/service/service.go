@@ -29,12 +29,14 @@ import (
 
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/cns"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/wcpguest"
 	vTypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
 
 const (
 	// Name is the name of this CSI SP.
-	Name = "csi.vsphere.vmware.com"
+	Name = common.VSphereCSIDriverName
 
 	// UnixSocketPrefix is the prefix before the path on disk
 	UnixSocketPrefix = "unix://"
@@ -74,10 +76,20 @@ func New() Service {
 }
 
 func (s *service) GetController() csi.ControllerServer {
-	s.cs = cns.New()
+	// The volumes of guest clusters are provisioned through their supervisor cluster
+	if isGuestCluster() {
+		s.cs = wcpguest.New()
+	} else {
+		s.cs = cns.New()
+	}
 	return s.cs
 }
 
+// isGuestCluster returns true if the driver is the paravirtual driver of a guest cluster
+func isGuestCluster() bool {
+	return strings.EqualFold(os.Getenv(common.EnvClusterFlavor), common.ClusterFlavorGuest)
+}
+
 func (s *service) BeforeServe(
 	ctx context.Context, sp *gocsi.StoragePlugin, lis net.Listener) error {
 
@@ -91,6 +103,16 @@ func (s *service) BeforeServe(
 	// Get the SP's operating mode.
 	s.mode = csictx.Getenv(ctx, gocsi.EnvVarMode)
 
+	if err := configureTLS(ctx, sp); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(s.mode, "controller") {
+		// Node service is needed, clean up mounts left behind
+		// by volumes detached while the node plugin was down
+		cleanupStaleMounts(ctx)
+	}
+
 	if !strings.EqualFold(s.mode, "node") {
 		// Controller service is needed
 		var cfg *cnsconfig.Config
@@ -98,7 +120,11 @@ func (s *service) BeforeServe(
 		if cfgPath == "" {
 			cfgPath = cnsconfig.DefaultCloudConfigPath
 		}
-		cfg, err := cnsconfig.GetCnsconfig(cfgPath)
+		getConfig := cnsconfig.GetCnsconfig
+		if isGuestCluster() {
+			getConfig = cnsconfig.GetGCconfig
+		}
+		cfg, err := getConfig(cfgPath)
 		if err != nil {
 			klog.Errorf("Failed to read cnsconfig. Error: %v", err)
 			return err
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+const (
+	// EnvTLSCertFile contains the path of the certificate the CSI endpoint is served with.
+	// The endpoint is served without TLS if it is not set.
+	EnvTLSCertFile = "VSPHERE_CSI_TLS_CERT_FILE"
+	// EnvTLSKeyFile contains the path of the private key of the certificate.
+	EnvTLSKeyFile = "VSPHERE_CSI_TLS_KEY_FILE"
+)
+
+// configureTLS makes sp serve the CSI endpoint over TLS, with the minimum TLS version
+// and the cipher suites of the environment, if a certificate is configured and the
+// endpoint is a TCP address. The sidecars connect to unix socket endpoints without TLS.
+func configureTLS(ctx context.Context, sp *gocsi.StoragePlugin) error {
+	certFile := csictx.Getenv(ctx, EnvTLSCertFile)
+	if certFile == "" {
+		return nil
+	}
+	if endpoint := csictx.Getenv(ctx, gocsi.EnvVarEndpoint); !isTCPEndpoint(endpoint) {
+		klog.Warningf("Serving the CSI endpoint %q without TLS, TLS is only used for TCP endpoints", endpoint)
+		return nil
+	}
+	tlsConfig, err := cnsconfig.NewTLSConfig(
+		csictx.Getenv(ctx, cnsconfig.EnvTLSMinVersion), csictx.Getenv(ctx, cnsconfig.EnvTLSCipherSuites))
+	if err != nil {
+		klog.Errorf("Invalid TLS settings. Err: %v", err)
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, csictx.Getenv(ctx, EnvTLSKeyFile))
+	if err != nil {
+		klog.Errorf("Failed to load the TLS certificate %q. Err: %v", certFile, err)
+		return err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	sp.ServerOpts = append(sp.ServerOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	klog.V(2).Infof("Serving the CSI endpoint over TLS with certificate %q", certFile)
+	return nil
+}
+
+// isTCPEndpoint returns true if the CSI endpoint is a TCP address, e.g. "tcp://0.0.0.0:10000".
+// Endpoints without a protocol are paths of unix sockets.
+func isTCPEndpoint(endpoint string) bool {
+	parts := strings.SplitN(endpoint, "://", 2)
+	return len(parts) == 2 && strings.HasPrefix(strings.ToLower(parts[0]), "tcp")
+}
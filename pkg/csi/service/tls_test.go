@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"testing"
+
+	"github.com/rexray/gocsi"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	sp := &gocsi.StoragePlugin{}
+	if err := configureTLS(context.Background(), sp); err != nil || len(sp.ServerOpts) != 0 {
+		t.Fatalf("Expected no TLS without a certificate, got %d server options, err %v", len(sp.ServerOpts), err)
+	}
+
+	os.Setenv(EnvTLSCertFile, "/nonexistent/tls.crt")
+	os.Setenv(cnsconfig.EnvTLSMinVersion, "VersionTLS99")
+	os.Setenv(gocsi.EnvVarEndpoint, "unix:///csi/csi.sock")
+	defer os.Unsetenv(EnvTLSCertFile)
+	defer os.Unsetenv(cnsconfig.EnvTLSMinVersion)
+	defer os.Unsetenv(gocsi.EnvVarEndpoint)
+	if err := configureTLS(context.Background(), sp); err != nil || len(sp.ServerOpts) != 0 {
+		t.Fatalf("Expected no TLS on a unix socket, got %d server options, err %v", len(sp.ServerOpts), err)
+	}
+
+	os.Setenv(gocsi.EnvVarEndpoint, "tcp://0.0.0.0:10000")
+	if err := configureTLS(context.Background(), sp); err == nil {
+		t.Fatal("Expected an error for an unknown TLS version")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := cnsconfig.NewTLSConfig("VersionTLS12",
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected minimum version %x, got %x", tls.VersionTLS12, tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 2 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("Unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if _, err := cnsconfig.NewTLSConfig("", "TLS_RSA_WITH_RC4_128_MD5"); err == nil {
+		t.Error("Expected an error for an unknown cipher suite")
+	}
+}
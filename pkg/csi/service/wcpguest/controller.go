@@ -0,0 +1,418 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wcpguest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+// pollInterval is the interval at which the phase of supervisor PersistentVolumeClaims is checked
+const pollInterval = time.Second
+
+var (
+	// provisionTimeout is the time CreateVolume waits for a supervisor PersistentVolumeClaim to be
+	// bound. The external-provisioner retries CreateVolume, which waits for the same claim again.
+	provisionTimeout = time.Minute
+	// attachTimeout is the time ControllerPublishVolume and ControllerUnpublishVolume wait for
+	// the supervisor to attach or detach a volume. The external-attacher retries them as well.
+	attachTimeout = time.Minute
+
+	// controllerCaps represents the capability of controller service
+	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	}
+)
+
+// controller is the paravirtual controller of a guest cluster. It provisions the volumes of the
+// guest cluster as PersistentVolumeClaims in its supervisor namespace, whose names are the IDs
+// of the volumes in the guest cluster, and requests their attachment to the guest node VMs with
+// CnsNodeVmAttachments.
+type controller struct {
+	supervisorClient        clientset.Interface
+	supervisorDynamicClient dynamic.Interface
+	supervisorNamespace     string
+	// guestClient is the client of the guest cluster, whose nodes have the UUIDs of their VMs
+	guestClient clientset.Interface
+	// tanzuKubernetesClusterUID prefixes the names of the supervisor PersistentVolumeClaims
+	tanzuKubernetesClusterUID string
+}
+
+// New creates a paravirtual controller for a guest cluster
+func New() csitypes.Controller {
+	return &controller{}
+}
+
+// Init creates the client of the supervisor cluster configured in the GC section of config
+func (c *controller) Init(config *cnsconfig.Config) error {
+	klog.Infof("Initializing paravirtual controller of TanzuKubernetesCluster %q", config.GC.TanzuKubernetesClusterName)
+	restConfig, namespace, err := cnsconfig.GetSupervisorClientConfig(config)
+	if err != nil {
+		klog.Errorf("Failed to get the client config of the supervisor cluster. err=%v", err)
+		return err
+	}
+	c.supervisorClient, err = clientset.NewForConfig(restConfig)
+	if err != nil {
+		klog.Errorf("Failed to create the client of the supervisor cluster. err=%v", err)
+		return err
+	}
+	c.supervisorDynamicClient, err = dynamic.NewForConfig(restConfig)
+	if err != nil {
+		klog.Errorf("Failed to create the dynamic client of the supervisor cluster. err=%v", err)
+		return err
+	}
+	c.guestClient, err = k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. err=%v", err)
+		return err
+	}
+	c.supervisorNamespace = namespace
+	c.tanzuKubernetesClusterUID = config.GC.TanzuKubernetesClusterUID
+	return nil
+}
+
+// CheckHealth returns an error if the API server of the supervisor cluster can't be reached
+func (c *controller) CheckHealth(ctx context.Context) error {
+	if c.supervisorClient == nil {
+		return nil
+	}
+	_, err := c.supervisorClient.Discovery().ServerVersion()
+	return err
+}
+
+// CreateVolume creates a PersistentVolumeClaim in the supervisor namespace with the
+// StorageClass of the svstorageclass parameter and waits for it to be bound
+func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
+	*csi.CreateVolumeResponse, error) {
+	if err := validateGuestClusterCreateVolumeRequest(req); err != nil {
+		klog.Errorf("Failed to validate Create Volume Request with err: %v", err)
+		return nil, err
+	}
+	// Volume Size - Default is 10 GiB
+	volSizeBytes := int64(common.DefaultGbDiskSize * common.GbInBytes)
+	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
+		volSizeBytes = req.GetCapacityRange().GetRequiredBytes()
+	}
+	var storageClassName string
+	for paramName, paramValue := range req.Parameters {
+		if strings.ToLower(paramName) == common.AttributeSupervisorStorageClass {
+			storageClassName = paramValue
+		}
+	}
+
+	pvcName := c.tanzuKubernetesClusterUID + "-" + req.Name
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pvcName,
+			Namespace: c.supervisorNamespace,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: *resource.NewQuantity(volSizeBytes, resource.BinarySI),
+				},
+			},
+			StorageClassName: &storageClassName,
+		},
+	}
+	_, err := c.supervisorClient.CoreV1().PersistentVolumeClaims(c.supervisorNamespace).Create(pvc)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		msg := fmt.Sprintf("Failed to create PersistentVolumeClaim %q in supervisor namespace %q. Error: %+v", pvcName, c.supervisorNamespace, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	// A repeated request waits for the claim created by the first one
+	pvc, err = c.waitForBound(ctx, pvcName)
+	if err != nil {
+		return nil, err
+	}
+	capacity := pvc.Status.Capacity[v1.ResourceStorage]
+	klog.V(2).Infof("Volume %q is provisioned as PersistentVolumeClaim %q in supervisor namespace %q", req.Name, pvcName, c.supervisorNamespace)
+	attributes := make(map[string]string)
+	attributes[common.AttributeDiskType] = common.DiskTypeString
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      pvcName,
+			CapacityBytes: capacity.Value(),
+			VolumeContext: attributes,
+		},
+	}, nil
+}
+
+// waitForBound waits for the supervisor PersistentVolumeClaim pvcName to be bound. The reason of
+// the last warning event of the claim, e.g. that the StorageClass does not exist in the supervisor
+// cluster, is returned if it is not bound within provisionTimeout or before ctx is done.
+func (c *controller) waitForBound(ctx context.Context, pvcName string) (*v1.PersistentVolumeClaim, error) {
+	ctx, cancel := context.WithTimeout(ctx, provisionTimeout)
+	defer cancel()
+	var pvc *v1.PersistentVolumeClaim
+	err := wait.PollImmediateUntil(pollInterval, func() (bool, error) {
+		var err error
+		pvc, err = c.supervisorClient.CoreV1().PersistentVolumeClaims(c.supervisorNamespace).Get(pvcName, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Failed to get PersistentVolumeClaim %q in supervisor namespace %q. Error: %+v", pvcName, c.supervisorNamespace, err)
+			return false, nil
+		}
+		return pvc.Status.Phase == v1.ClaimBound || pvc.Status.Phase == v1.ClaimLost, nil
+	}, ctx.Done())
+	if err == nil && pvc.Status.Phase == v1.ClaimLost {
+		msg := fmt.Sprintf("PersistentVolumeClaim %q in supervisor namespace %q lost its volume", pvcName, c.supervisorNamespace)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("PersistentVolumeClaim %q in supervisor namespace %q is not bound after %v", pvcName, c.supervisorNamespace, provisionTimeout)
+		if reason := c.getFailureReason(pvcName); reason != "" {
+			msg = fmt.Sprintf("%s: %s", msg, reason)
+		}
+		klog.Error(msg)
+		return nil, status.Error(codes.DeadlineExceeded, msg)
+	}
+	return pvc, nil
+}
+
+// getFailureReason returns the message of the last warning event of the supervisor
+// PersistentVolumeClaim pvcName, or an empty string if there is none.
+func (c *controller) getFailureReason(pvcName string) string {
+	selector := fields.Set{
+		"involvedObject.kind": "PersistentVolumeClaim",
+		"involvedObject.name": pvcName,
+		"type":                v1.EventTypeWarning,
+	}.AsSelector().String()
+	events, err := c.supervisorClient.CoreV1().Events(c.supervisorNamespace).List(metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		klog.Warningf("Failed to list the events of PersistentVolumeClaim %q in supervisor namespace %q. Error: %+v", pvcName, c.supervisorNamespace, err)
+		return ""
+	}
+	var last *v1.Event
+	for i, event := range events.Items {
+		if event.Type == v1.EventTypeWarning && (last == nil || last.LastTimestamp.Before(&event.LastTimestamp)) {
+			last = &events.Items[i]
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", last.Reason, last.Message)
+}
+
+// DeleteVolume deletes the supervisor PersistentVolumeClaim of the volume
+func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
+	*csi.DeleteVolumeResponse, error) {
+	if err := common.ValidateDeleteVolumeRequest(req); err != nil {
+		return nil, err
+	}
+	err := c.supervisorClient.CoreV1().PersistentVolumeClaims(c.supervisorNamespace).Delete(req.VolumeId, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		msg := fmt.Sprintf("Failed to delete PersistentVolumeClaim %q in supervisor namespace %q. Error: %+v", req.VolumeId, c.supervisorNamespace, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume creates a CnsNodeVmAttachment in the supervisor namespace and waits for
+// the supervisor to attach the volume to the VM of the guest node, for at most attachTimeout
+func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
+	*csi.ControllerPublishVolumeResponse, error) {
+	if err := common.ValidateControllerPublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+	node, err := c.guestClient.CoreV1().Nodes().Get(req.NodeId, metav1.GetOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get node %q. Error: %+v", req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if !common.IsValidProviderID(node.Spec.ProviderID) {
+		msg := fmt.Sprintf("Node %q has no valid providerID, got %q", req.NodeId, node.Spec.ProviderID)
+		klog.Error(msg)
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+	attachments := c.supervisorDynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(c.supervisorNamespace)
+	name := getNodeVMAttachmentName(req.NodeId, req.VolumeId)
+	attachment := &unstructured.Unstructured{}
+	attachment.SetAPIVersion(common.NodeVMAttachmentGVR.GroupVersion().String())
+	attachment.SetKind("CnsNodeVmAttachment")
+	attachment.SetName(name)
+	attachment.Object["spec"] = map[string]interface{}{
+		"nodeuuid":   common.GetUUIDFromProviderID(node.Spec.ProviderID),
+		"volumename": req.VolumeId,
+	}
+	if _, err = attachments.Create(attachment, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		msg := fmt.Sprintf("Failed to create CnsNodeVmAttachment %q in supervisor namespace %q. Error: %+v", name, c.supervisorNamespace, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	pollCtx, cancel := context.WithTimeout(ctx, attachTimeout)
+	defer cancel()
+	var diskUUID, attachErr string
+	err = wait.PollImmediateUntil(pollInterval, func() (bool, error) {
+		attachment, err := attachments.Get(name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("Failed to get CnsNodeVmAttachment %q in supervisor namespace %q. Error: %+v", name, c.supervisorNamespace, err)
+			return false, nil
+		}
+		attached, _, _ := unstructured.NestedBool(attachment.Object, "status", "attached")
+		diskUUID, _, _ = unstructured.NestedString(attachment.Object, "status", "metadata", common.AttributeFirstClassDiskUUID)
+		attachErr, _, _ = unstructured.NestedString(attachment.Object, "status", "error")
+		return attached && diskUUID != "", nil
+	}, pollCtx.Done())
+	if err != nil {
+		msg := fmt.Sprintf("Volume %q is not attached to node %q after %v", req.VolumeId, req.NodeId, attachTimeout)
+		if attachErr != "" {
+			msg = fmt.Sprintf("%s: %s", msg, attachErr)
+		}
+		klog.Error(msg)
+		return nil, status.Error(codes.DeadlineExceeded, msg)
+	}
+	publishInfo := make(map[string]string)
+	publishInfo[common.AttributeDiskType] = common.DiskTypeString
+	publishInfo[common.AttributeFirstClassDiskUUID] = diskUUID
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishInfo}, nil
+}
+
+// ControllerUnpublishVolume deletes the CnsNodeVmAttachment of the volume and the node and waits
+// for the supervisor to detach the volume, after which the CnsNodeVmAttachment is gone, for at
+// most attachTimeout
+func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (
+	*csi.ControllerUnpublishVolumeResponse, error) {
+	if err := common.ValidateControllerUnpublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+	attachments := c.supervisorDynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(c.supervisorNamespace)
+	name := getNodeVMAttachmentName(req.NodeId, req.VolumeId)
+	err := attachments.Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		msg := fmt.Sprintf("Failed to delete CnsNodeVmAttachment %q in supervisor namespace %q. Error: %+v", name, c.supervisorNamespace, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	pollCtx, cancel := context.WithTimeout(ctx, attachTimeout)
+	defer cancel()
+	var detachErr string
+	err = wait.PollImmediateUntil(pollInterval, func() (bool, error) {
+		attachment, err := attachments.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		} else if err != nil {
+			klog.Warningf("Failed to get CnsNodeVmAttachment %q in supervisor namespace %q. Error: %+v", name, c.supervisorNamespace, err)
+			return false, nil
+		}
+		detachErr, _, _ = unstructured.NestedString(attachment.Object, "status", "error")
+		return false, nil
+	}, pollCtx.Done())
+	if err != nil {
+		msg := fmt.Sprintf("Volume %q is not detached from node %q after %v", req.VolumeId, req.NodeId, attachTimeout)
+		if detachErr != "" {
+			msg = fmt.Sprintf("%s: %s", msg, detachErr)
+		}
+		klog.Error(msg)
+		return nil, status.Error(codes.DeadlineExceeded, msg)
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// getNodeVMAttachmentName returns the name of the CnsNodeVmAttachment of the volume volumeID
+// and the guest node nodeName
+func getNodeVMAttachmentName(nodeName string, volumeID string) string {
+	return nodeName + "-" + volumeID
+}
+
+// ValidateVolumeCapabilities returns the capabilities of the volume.
+func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (
+	*csi.ValidateVolumeCapabilitiesResponse, error) {
+
+	volCaps := req.GetVolumeCapabilities()
+	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
+	if common.IsValidVolumeCapabilities(volCaps) {
+		confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: confirmed,
+	}, nil
+}
+
+func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
+	*csi.ListVolumesResponse, error) {
+
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
+	*csi.GetCapacityResponse, error) {
+
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
+	*csi.ControllerGetCapabilitiesResponse, error) {
+
+	var caps []*csi.ControllerServiceCapability
+	for _, cap := range controllerCaps {
+		c := &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: cap,
+				},
+			},
+		}
+		caps = append(caps, c)
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
+	*csi.CreateSnapshotResponse, error) {
+
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
+	*csi.DeleteSnapshotResponse, error) {
+
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
+	*csi.ListSnapshotsResponse, error) {
+
+	return nil, status.Error(codes.Unimplemented, "")
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wcpguest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// validateGuestClusterCreateVolumeRequest is the helper function to validate
+// CreateVolumeRequest for the paravirtual CSI driver of a guest cluster.
+// Function returns error if validation fails otherwise returns nil.
+func validateGuestClusterCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
+	storageClassName := ""
+	for paramName, paramValue := range req.GetParameters() {
+		paramName = strings.ToLower(paramName)
+		if strings.HasPrefix(paramName, common.CSIParameterPrefix) {
+			continue
+		}
+		if paramName == common.AttributeFsType {
+			if paramValue != "" && !common.IsValidFsType(paramValue) {
+				msg := fmt.Sprintf("Volume parameter %s: %q is not supported. Supported fsTypes: %v", paramName, paramValue, common.SupportedFsTypes)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+			continue
+		}
+		if paramName != common.AttributeSupervisorStorageClass {
+			msg := fmt.Sprintf("Volume parameter %s is not a valid guest cluster CSI parameter.", paramName)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+		storageClassName = paramValue
+	}
+	if storageClassName == "" {
+		msg := fmt.Sprintf("Volume parameter %s is required.", common.AttributeSupervisorStorageClass)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if req.GetVolumeContentSource() != nil {
+		msg := "Creating a volume from a snapshot or another volume is not supported."
+		return status.Error(codes.Unimplemented, msg)
+	}
+	if common.IsFileVolumeRequest(req.GetVolumeCapabilities()) {
+		msg := "Volumes with multi-node access modes are not supported in guest clusters."
+		return status.Error(codes.Unimplemented, msg)
+	}
+	return common.ValidateCreateVolumeRequest(req)
+}
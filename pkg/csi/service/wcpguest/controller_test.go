@@ -0,0 +1,207 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wcpguest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+const (
+	testSupervisorNamespace = "test-namespace"
+	testClusterUID          = "0c3dbe8d-5c7b-4b4f-9f35-c4a6d3a0a4a1"
+)
+
+// newTestController returns a controller whose supervisor binds the claims of the
+// StorageClass "gold" when they are created
+func newTestController() (*controller, *testclient.Clientset) {
+	supervisorClient := testclient.NewSimpleClientset()
+	supervisorClient.PrependReactor("create", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pvc := action.(k8stesting.CreateAction).GetObject().(*v1.PersistentVolumeClaim)
+		if *pvc.Spec.StorageClassName == "gold" {
+			pvc.Status.Phase = v1.ClaimBound
+			pvc.Status.Capacity = pvc.Spec.Resources.Requests
+		}
+		return false, nil, nil
+	})
+	return &controller{
+		supervisorClient:          supervisorClient,
+		supervisorNamespace:       testSupervisorNamespace,
+		tanzuKubernetesClusterUID: testClusterUID,
+	}, supervisorClient
+}
+
+func createVolumeRequest(name string, storageClass string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name: name,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: common.GbInBytes,
+		},
+		Parameters: map[string]string{
+			common.AttributeSupervisorStorageClass: storageClass,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	}
+}
+
+func TestCreateDeleteVolume(t *testing.T) {
+	ctx := context.Background()
+	c, supervisorClient := newTestController()
+
+	resp, err := c.CreateVolume(ctx, createVolumeRequest("pvc-1", "gold"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := testClusterUID + "-pvc-1"
+	if resp.Volume.VolumeId != volumeID || resp.Volume.CapacityBytes != common.GbInBytes {
+		t.Fatalf("Expected volume %q of 1 GiB, got %+v", volumeID, resp.Volume)
+	}
+	// A repeated request returns the same volume
+	if resp, err = c.CreateVolume(ctx, createVolumeRequest("pvc-1", "gold")); err != nil || resp.Volume.VolumeId != volumeID {
+		t.Fatalf("Expected volume %q again, got %+v, err: %v", volumeID, resp, err)
+	}
+
+	if _, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = supervisorClient.CoreV1().PersistentVolumeClaims(testSupervisorNamespace).Get(volumeID, metav1.GetOptions{}); err == nil {
+		t.Fatalf("Expected PersistentVolumeClaim %q to be deleted", volumeID)
+	}
+	// Deleting a deleted volume succeeds
+	if _, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateVolumeFailure(t *testing.T) {
+	defer func(timeout time.Duration) { provisionTimeout = timeout }(provisionTimeout)
+	provisionTimeout = 2 * time.Second
+	ctx := context.Background()
+	c, supervisorClient := newTestController()
+
+	if _, err := c.CreateVolume(ctx, createVolumeRequest("pvc-2", "")); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument without a supervisor StorageClass, got %v", err)
+	}
+
+	pvcName := testClusterUID + "-pvc-2"
+	event := &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: pvcName + ".1", Namespace: testSupervisorNamespace},
+		InvolvedObject: v1.ObjectReference{Kind: "PersistentVolumeClaim", Name: pvcName, Namespace: testSupervisorNamespace},
+		Type:           v1.EventTypeWarning,
+		Reason:         "ProvisioningFailed",
+		Message:        `storageclass.storage.k8s.io "silver" not found`,
+	}
+	if _, err := supervisorClient.CoreV1().Events(testSupervisorNamespace).Create(event); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.CreateVolume(ctx, createVolumeRequest("pvc-2", "silver"))
+	if status.Code(err) != codes.DeadlineExceeded || !strings.Contains(err.Error(), event.Message) {
+		t.Fatalf("Expected DeadlineExceeded with the reason of the supervisor event, got %v", err)
+	}
+
+	// The wait ends with the call, long before provisionTimeout
+	provisionTimeout = time.Hour
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = c.CreateVolume(cancelledCtx, createVolumeRequest("pvc-2", "silver")); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded for a cancelled call, got %v", err)
+	}
+}
+
+func TestPublishUnpublishVolume(t *testing.T) {
+	defer func(timeout time.Duration) { attachTimeout = timeout }(attachTimeout)
+	attachTimeout = 2 * time.Second
+	ctx := context.Background()
+	c, _ := newTestController()
+	nodeUUID := "4237c3a6-b6d8-4b2e-8a4d-3c0e2f6a1b7d"
+	c.guestClient = testclient.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       v1.NodeSpec{ProviderID: common.ProviderPrefix + nodeUUID},
+	})
+	// The supervisor attaches the volumes of the CnsNodeVmAttachments as soon as they are created
+	supervisorDynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	supervisorDynamicClient.PrependReactor("create", "cnsnodevmattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attachment := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		attachment.Object["status"] = map[string]interface{}{
+			"attached": true,
+			"metadata": map[string]interface{}{common.AttributeFirstClassDiskUUID: "6000c29e8f1d2c3b"},
+		}
+		return false, nil, nil
+	})
+	c.supervisorDynamicClient = supervisorDynamicClient
+
+	volumeID := testClusterUID + "-pvc-1"
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   "node-1",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	resp, err := c.ControllerPublishVolume(ctx, publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PublishContext[common.AttributeFirstClassDiskUUID] != "6000c29e8f1d2c3b" {
+		t.Fatalf("Expected the disk UUID of the supervisor attachment, got %+v", resp.PublishContext)
+	}
+	attachments := supervisorDynamicClient.Resource(common.NodeVMAttachmentGVR).Namespace(testSupervisorNamespace)
+	attachment, err := attachments.Get("node-1-"+volumeID, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid, _, _ := unstructured.NestedString(attachment.Object, "spec", "nodeuuid"); uuid != nodeUUID {
+		t.Fatalf("Expected the CnsNodeVmAttachment for node VM %s, got %+v", nodeUUID, attachment.Object)
+	}
+	// A repeated request uses the same CnsNodeVmAttachment
+	if _, err = c.ControllerPublishVolume(ctx, publishReq); err != nil {
+		t.Fatal(err)
+	}
+
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node-1"}
+	if _, err = c.ControllerUnpublishVolume(ctx, unpublishReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = attachments.Get("node-1-"+volumeID, metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected the CnsNodeVmAttachment to be deleted")
+	}
+	// Unpublishing a detached volume succeeds
+	if _, err = c.ControllerUnpublishVolume(ctx, unpublishReq); err != nil {
+		t.Fatal(err)
+	}
+}
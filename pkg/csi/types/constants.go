@@ -21,4 +21,10 @@ const (
 	LabelRegionFailureDomain = "failure-domain.beta.kubernetes.io/region"
 	// LabelZoneFailureDomain is label placed on nodes and PV containing zone detail
 	LabelZoneFailureDomain = "failure-domain.beta.kubernetes.io/zone"
+	// LabelTopologyPrefix prefixes the tag category of an additional topology level
+	// in the topology keys of nodes and PVs
+	LabelTopologyPrefix = "topology.csi.vmware.com/"
+	// LabelHostTopology is the topology key of the ESXi host of nodes and of PVs on host-local datastores,
+	// its value is the hardware UUID of the host
+	LabelHostTopology = "csi.vsphere.vmware.com/host"
 )
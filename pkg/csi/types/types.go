@@ -17,6 +17,8 @@ limitations under the License.
 package types
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
@@ -26,4 +28,6 @@ import (
 type Controller interface {
 	csi.ControllerServer
 	Init(config *config.Config) error
+	// CheckHealth returns an error if the connection to a vCenter is broken
+	CheckHealth(ctx context.Context) error
 }
@@ -91,6 +91,11 @@ func (im *InformerManager) AddPodListener(add func(obj interface{}), update func
 	})
 }
 
+// GetNodeLister returns Node Lister for the calling informer manager
+func (im *InformerManager) GetNodeLister() corelisters.NodeLister {
+	return im.informerFactory.Core().V1().Nodes().Lister()
+}
+
 // GetPVLister returns Persistent Volume Lister for the calling informer manager
 func (im *InformerManager) GetPVLister() corelisters.PersistentVolumeLister {
 	return im.informerFactory.Core().V1().PersistentVolumes().Lister()
@@ -106,3 +111,15 @@ func (im *InformerManager) Listen() (stopCh <-chan struct{}) {
 	go im.informerFactory.Start(im.stopCh)
 	return im.stopCh
 }
+
+// WaitForCacheSync waits until the caches of the listened Informers are synced. It returns
+// false if the Informers are stopped before then.
+func (im *InformerManager) WaitForCacheSync() bool {
+	var synced []cache.InformerSynced
+	for _, informer := range []cache.SharedInformer{im.nodeInformer, im.pvcInformer, im.pvInformer, im.podInformer} {
+		if informer != nil {
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+	return cache.WaitForCacheSync(im.stopCh, synced...)
+}
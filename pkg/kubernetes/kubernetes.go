@@ -22,10 +22,15 @@ import (
 
 	"k8s.io/klog"
 
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
@@ -38,6 +43,26 @@ func init() {
 
 // NewClient creates a newk8s client based on a service account
 func NewClient() (clientset.Interface, error) {
+	config, err := getRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return clientset.NewForConfig(config)
+}
+
+// NewDynamicClient creates a new dynamic client based on a service account,
+// used to access custom resources
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := getRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// getRestConfig returns the config from the kubeconfig file if one is given,
+// otherwise the in-cluster config
+func getRestConfig() (*restclient.Config, error) {
 	kubecfgPath := os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
 	if *kubeconfig != "" {
 		kubecfgPath = *kubeconfig
@@ -60,8 +85,7 @@ func NewClient() (clientset.Interface, error) {
 			return nil, err
 		}
 	}
-
-	return clientset.NewForConfig(config)
+	return config, nil
 }
 
 // CreateKubernetesClientFromConfig creaates a newk8s client from given kubeConfig file
@@ -91,3 +115,12 @@ func GetNodeVMUUID(k8sclient clientset.Interface, nodeName string) (string, erro
 	klog.V(2).Infof("Retrieved node UUID: %q for the node: %q", k8sNodeUUID, nodeName)
 	return k8sNodeUUID, nil
 }
+
+// NewEventRecorder creates an event recorder which posts events for the given component
+// to the API server using the specified k8s client
+func NewEventRecorder(k8sclient clientset.Interface, component string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sclient.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
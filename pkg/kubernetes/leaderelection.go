@@ -0,0 +1,79 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubernetes
+
+import (
+	"context"
+	"os"
+	"time"
+
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+const (
+	// Default timings of the leader election, as used by the CSI sidecars
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 5 * time.Second
+)
+
+// RunWithLeaderElection runs run once this process holds the Lease lockName in
+// namespace, so that only one of multiple replicas is active at a time.
+// The process exits when the lease is lost, since run can not be interrupted.
+func RunWithLeaderElection(k8sclient clientset.Interface, lockName string, namespace string, run func()) error {
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Errorf("Failed to get hostname for leader election identity. Err: %v", err)
+		return err
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, lockName,
+		k8sclient.CoreV1(), k8sclient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		klog.Errorf("Failed to create lock %q for leader election. Err: %v", lockName, err)
+		return err
+	}
+	leaderElector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Name:          lockName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.V(2).Infof("%s became leader, starting", identity)
+				run()
+			},
+			OnStoppedLeading: func() {
+				klog.Fatalf("%s is no longer the leader of %q, exiting", identity, lockName)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.V(2).Infof("%s is the leader of %q", leader, lockName)
+				}
+			},
+		},
+	})
+	if err != nil {
+		klog.Errorf("Failed to create leader elector for %q. Err: %v", lockName, err)
+		return err
+	}
+	leaderElector.Run(context.Background())
+	return nil
+}
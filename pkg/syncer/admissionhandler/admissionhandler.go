@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admissionhandler is a validating admission webhook for the StorageClasses
+// and PersistentVolumeClaims of the vSphere CSI driver, which rejects parameters that
+// would make volume provisioning fail when they are created rather than at the first
+// provisioning.
+package admissionhandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const (
+	// validatePath is the path of the webhook in the ValidatingWebhookConfiguration
+	validatePath = "/validate"
+	// maxRequestSize limits the size of admission reviews read from the API server
+	maxRequestSize = 1 << 20
+)
+
+// Serve serves the webhook at /validate on address with the TLS certificate and key in certFile
+// and keyFile. The vCenters of the config file named by VSPHERE_CSI_CONFIG are connected to when
+// objects are validated, so the webhook is served while vCenters are not reachable.
+func Serve(address, certFile, keyFile string) error {
+	cfgPath := os.Getenv(cnsconfig.EnvCloudConfig)
+	if cfgPath == "" {
+		cfgPath = cnsconfig.DefaultCloudConfigPath
+	}
+	cfg, err := cnsconfig.GetCnsconfig(cfgPath)
+	if err != nil {
+		klog.Errorf("Failed to parse config. Err: %v", err)
+		return err
+	}
+	vcconfigs, err := cnsvsphere.GetVirtualCenterConfigs(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get VirtualCenterConfigs. err=%v", err)
+		return err
+	}
+	var vcenters []*cnsvsphere.VirtualCenter
+	vcManager := cnsvsphere.GetVirtualCenterManager()
+	for _, vcconfig := range vcconfigs {
+		vcenter, err := vcManager.RegisterVirtualCenter(vcconfig)
+		if err == cnsvsphere.ErrVCAlreadyRegistered {
+			vcenter, err = vcManager.GetVirtualCenter(vcconfig.Host)
+		}
+		if err != nil {
+			klog.Errorf("Failed to register VirtualCenter %q. err=%v", vcconfig.Host, err)
+			return err
+		}
+		vcenters = append(vcenters, vcenter)
+	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return err
+	}
+	tlsConfig, err := cnsconfig.TLSConfig(cfg)
+	if err != nil {
+		klog.Errorf("Invalid TLS settings. Err: %v", err)
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(validatePath, New(vcenters, k8sclient))
+	server := &http.Server{
+		Addr:      address,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	klog.V(2).Infof("Serving admission webhook on %s", address)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Handler validates the StorageClasses and PersistentVolumeClaims of admission reviews.
+type Handler struct {
+	// vcenters are used for checking that storage policies and datastores exist
+	vcenters []*cnsvsphere.VirtualCenter
+	// k8sClient is used for getting the StorageClasses of PersistentVolumeClaims
+	k8sClient clientset.Interface
+}
+
+// New returns the Handler which validates objects with vcenters and k8sClient
+func New(vcenters []*cnsvsphere.VirtualCenter, k8sClient clientset.Interface) *Handler {
+	return &Handler{
+		vcenters:  vcenters,
+		k8sClient: k8sClient,
+	}
+}
+
+// ServeHTTP answers an AdmissionReview request with its AdmissionReview response.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		klog.Errorf("Failed to read admission review. Err: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		klog.Errorf("Failed to decode admission review. Err: %v", err)
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+	review.Response = h.review(r.Context(), review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	resp, err := json.Marshal(review)
+	if err != nil {
+		klog.Errorf("Failed to encode admission review. Err: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		klog.Errorf("Failed to write admission review. Err: %v", err)
+	}
+}
+
+// review returns the response of the admission request req, which is allowed
+// unless it is for an object with invalid parameters.
+func (h *Handler) review(ctx context.Context, req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	var err error
+	switch req.Kind.Kind {
+	case "StorageClass":
+		sc := &storagev1.StorageClass{}
+		if err = json.Unmarshal(req.Object.Raw, sc); err == nil {
+			err = h.validateStorageClass(ctx, sc)
+		}
+	case "PersistentVolumeClaim":
+		if req.Operation != admissionv1beta1.Create {
+			// The parameters of PVCs can't be changed once they are created
+			break
+		}
+		pvc := &v1.PersistentVolumeClaim{}
+		if err = json.Unmarshal(req.Object.Raw, pvc); err == nil {
+			err = h.validatePersistentVolumeClaim(ctx, pvc)
+		}
+	}
+	if err != nil {
+		klog.V(2).Infof("Rejected %s %s %s/%s: %v", req.Operation, req.Kind.Kind, req.Namespace, req.Name, err)
+		return &admissionv1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: fmt.Sprintf("%s is not valid for the vSphere CSI driver: %v", req.Kind.Kind, err),
+			},
+		}
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admissionhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// newTestHandler returns a Handler with vcsim and the StorageClass sc. The vCenters
+// in unreachable are checked after vcsim.
+func newTestHandler(t *testing.T, sc *storagev1.StorageClass, unreachable ...*cnsvsphere.VirtualCenter) (*Handler, func()) {
+	cfg, cleanup := config.FromEnvOrSim()
+	vcconfig, err := cnsvsphere.GetVirtualCenterConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcenter, err := cnsvsphere.GetVirtualCenterManager().RegisterVirtualCenter(vcconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcenters := append([]*cnsvsphere.VirtualCenter{vcenter}, unreachable...)
+	return New(vcenters, testclient.NewSimpleClientset(sc)), func() {
+		if err := cnsvsphere.GetVirtualCenterManager().UnregisterVirtualCenter(vcconfig.Host); err != nil {
+			t.Error(err)
+		}
+		cleanup()
+	}
+}
+
+// reviewObject sends obj of kind to handler in an AdmissionReview and returns the response
+func reviewObject(t *testing.T, handler *Handler, kind string, obj runtime.Object) *admissionv1beta1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := &admissionv1beta1.AdmissionReview{
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       types.UID("review-1"),
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", validatePath, bytes.NewReader(body)))
+	review = &admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), review); err != nil || review.Response == nil {
+		t.Fatalf("Failed to decode admission review %s: %v", recorder.Body.String(), err)
+	}
+	if review.Response.UID != "review-1" {
+		t.Errorf("Expected response for review-1, got %q", review.Response.UID)
+	}
+	return review.Response
+}
+
+func TestValidateStorageClass(t *testing.T) {
+	handler, cleanup := newTestHandler(t, &storagev1.StorageClass{})
+	defer cleanup()
+	datastoreURL := simulator.Map.Any("Datastore").(*simulator.Datastore).Info.GetDatastoreInfo().Url
+
+	tests := []struct {
+		name        string
+		provisioner string
+		params      map[string]string
+		allowed     bool
+	}{
+		{"other provisioner", "kubernetes.io/vsphere-volume", map[string]string{"diskformat": "thin"}, true},
+		{"no parameters", common.VSphereCSIDriverName, nil, true},
+		{"unknown parameter", common.VSphereCSIDriverName, map[string]string{"diskformat": "thin"}, false},
+		{"unsupported fsType", common.VSphereCSIDriverName, map[string]string{fsTypeParameter: "ntfs"}, false},
+		{"existing storage policy", common.VSphereCSIDriverName,
+			map[string]string{common.AttributeStoragePolicyName: "vSAN Default Storage Policy"}, true},
+		{"missing storage policy", common.VSphereCSIDriverName,
+			map[string]string{common.AttributeStoragePolicyName: "missing-policy"}, false},
+		{"existing datastore", common.VSphereCSIDriverName, map[string]string{common.AttributeDatastoreURL: datastoreURL}, true},
+		{"missing datastore", common.VSphereCSIDriverName, map[string]string{common.AttributeDatastoreURL: "ds:///vmfs/volumes/missing/"}, false},
+		{"mutually exclusive parameters", common.VSphereCSIDriverName,
+			map[string]string{common.AttributeDatastoreURL: datastoreURL, common.AttributeDatastoreClusterName: "cluster"}, false},
+	}
+	for _, test := range tests {
+		sc := &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "sc"},
+			Provisioner: test.provisioner,
+			Parameters:  test.params,
+		}
+		resp := reviewObject(t, handler, "StorageClass", sc)
+		if resp.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", test.name, test.allowed, resp)
+		}
+	}
+}
+
+func TestValidateStorageClassUnreachableVCenter(t *testing.T) {
+	unreachable := &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{
+		Host:     "127.0.0.1",
+		Port:     1,
+		Insecure: true,
+	}}
+	handler, cleanup := newTestHandler(t, &storagev1.StorageClass{}, unreachable)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		allowed bool
+	}{
+		{"storage policy in reachable vCenter",
+			map[string]string{common.AttributeStoragePolicyName: "vSAN Default Storage Policy"}, true},
+		{"storage policy not in reachable vCenter",
+			map[string]string{common.AttributeStoragePolicyName: "missing-policy"}, true},
+		{"datastore not in reachable vCenter",
+			map[string]string{common.AttributeDatastoreURL: "ds:///vmfs/volumes/missing/"}, true},
+		{"unknown parameter", map[string]string{"diskformat": "thin"}, false},
+	}
+	for _, test := range tests {
+		sc := &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "sc"},
+			Provisioner: common.VSphereCSIDriverName,
+			Parameters:  test.params,
+		}
+		resp := reviewObject(t, handler, "StorageClass", sc)
+		if resp.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", test.name, test.allowed, resp)
+		}
+	}
+}
+
+func TestValidatePersistentVolumeClaim(t *testing.T) {
+	sc := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "encrypted"},
+		Provisioner: common.VSphereCSIDriverName,
+		Parameters:  map[string]string{common.AttributeLuksEncryption: "true"},
+	}
+	handler, cleanup := newTestHandler(t, sc)
+	defer cleanup()
+
+	block := v1.PersistentVolumeBlock
+	filesystem := v1.PersistentVolumeFilesystem
+	tests := []struct {
+		name        string
+		volumeMode  *v1.PersistentVolumeMode
+		accessModes []v1.PersistentVolumeAccessMode
+		dataSource  *v1.TypedLocalObjectReference
+		allowed     bool
+	}{
+		{"ReadWriteOnce filesystem", &filesystem, []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}, nil, true},
+		{"ReadWriteMany filesystem", nil, []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}, nil, false},
+		{"encrypted block", &block, []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}, nil, false},
+		{"from snapshot", &filesystem, []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			&v1.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "snapshot"}, false},
+	}
+	for _, test := range tests {
+		pvc := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: "default"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &sc.Name,
+				VolumeMode:       test.volumeMode,
+				AccessModes:      test.accessModes,
+				DataSource:       test.dataSource,
+			},
+		}
+		resp := reviewObject(t, handler, "PersistentVolumeClaim", pvc)
+		if resp.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", test.name, test.allowed, resp)
+		}
+	}
+}
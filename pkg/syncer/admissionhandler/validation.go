@@ -0,0 +1,192 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admissionhandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// fsTypeParameter is the StorageClass parameter of the external-provisioner for the fsType of volumes
+const fsTypeParameter = common.CSIParameterPrefix + "fstype"
+
+// accessModes maps the access modes of PersistentVolumeClaims to the CSI access modes
+// requested by the external-provisioner.
+var accessModes = map[v1.PersistentVolumeAccessMode]csi.VolumeCapability_AccessMode_Mode{
+	v1.ReadWriteOnce: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	v1.ReadOnlyMany:  csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	v1.ReadWriteMany: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// validateStorageClass returns an error if sc is a StorageClass of the driver with
+// parameters or mount options which are not supported, or which name a storage
+// policy or datastore that does not exist.
+func (h *Handler) validateStorageClass(ctx context.Context, sc *storagev1.StorageClass) error {
+	if sc.Provisioner != common.VSphereCSIDriverName {
+		return nil
+	}
+	if err := common.ValidateVolumeParameters(sc.Parameters); err != nil {
+		return errors.New(status.Convert(err).Message())
+	}
+	if fsType := sc.Parameters[fsTypeParameter]; fsType != "" && !common.IsValidFsType(fsType) {
+		return fmt.Errorf("parameter %s: %q is not supported. Supported fsTypes: %v", fsTypeParameter, fsType, common.SupportedFsTypes)
+	}
+	if err := common.ValidateMountFlags(sc.MountOptions); err != nil {
+		return err
+	}
+	return h.validateStorage(ctx, sc.Parameters)
+}
+
+// validateStorage returns an error if the storage policy or the datastore named by params
+// does not exist in any vCenter. StorageClasses are not rejected when a vCenter can't be reached.
+func (h *Handler) validateStorage(ctx context.Context, params map[string]string) error {
+	for paramName, paramValue := range params {
+		if paramValue == "" {
+			continue
+		}
+		var err error
+		switch strings.ToLower(paramName) {
+		case common.AttributeStoragePolicyName:
+			err = h.findInVCenters(fmt.Sprintf("storage policy %q", paramValue), func(vc *cnsvsphere.VirtualCenter) (bool, error) {
+				if err := vc.ConnectPbm(ctx); err != nil {
+					return false, err
+				}
+				_, err := vc.GetStoragePolicyIDByName(ctx, paramValue)
+				return err == nil, nil
+			})
+		case common.AttributeStoragePolicyID:
+			err = h.findInVCenters(fmt.Sprintf("storage policy with ID %q", paramValue), func(vc *cnsvsphere.VirtualCenter) (bool, error) {
+				if err := vc.ConnectPbm(ctx); err != nil {
+					return false, err
+				}
+				exists, err := vc.StoragePolicyExists(ctx, paramValue)
+				return err == nil && exists, nil
+			})
+		case common.AttributeDatastoreURL:
+			err = h.findInVCenters(fmt.Sprintf("datastore with URL %q", paramValue), func(vc *cnsvsphere.VirtualCenter) (bool, error) {
+				if err := vc.Connect(ctx); err != nil {
+					return false, err
+				}
+				return hasDatastoreURL(ctx, vc, paramValue)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findInVCenters returns an error if find does not find what in any vCenter. The vCenters are
+// connected to by find in turn, until what is found. If find fails, what is not validated,
+// as the vCenter which has it may not be reachable.
+func (h *Handler) findInVCenters(what string, find func(vc *cnsvsphere.VirtualCenter) (bool, error)) error {
+	var hosts []string
+	for _, vc := range h.vcenters {
+		found, err := find(vc)
+		if err != nil {
+			klog.Warningf("Not validating %s, vCenter %q is not reachable. Err: %v", what, vc.Config.Host, err)
+			return nil
+		}
+		if found {
+			return nil
+		}
+		hosts = append(hosts, vc.Config.Host)
+	}
+	return fmt.Errorf("%s not found in vCenters %q", what, hosts)
+}
+
+// hasDatastoreURL returns true if a datacenter of vc has a datastore with datastoreURL.
+func hasDatastoreURL(ctx context.Context, vc *cnsvsphere.VirtualCenter, datastoreURL string) (bool, error) {
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, dc := range datacenters {
+		if _, err := dc.GetDatastoreByURL(ctx, datastoreURL); err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validatePersistentVolumeClaim returns an error if pvc requests a volume of a StorageClass
+// of the driver with a volume mode, access modes or data source which are not supported.
+func (h *Handler) validatePersistentVolumeClaim(ctx context.Context, pvc *v1.PersistentVolumeClaim) error {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return nil
+	}
+	sc, err := h.k8sClient.StorageV1().StorageClasses().Get(*pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		// The StorageClass may be created after the PVC
+		klog.V(4).Infof("Not validating PVC %s/%s, failed to get StorageClass %q. Err: %v",
+			pvc.Namespace, pvc.Name, *pvc.Spec.StorageClassName, err)
+		return nil
+	}
+	if sc.Provisioner != common.VSphereCSIDriverName {
+		return nil
+	}
+	if pvc.Spec.DataSource != nil {
+		return fmt.Errorf("creating a volume from %s %q is not supported", pvc.Spec.DataSource.Kind, pvc.Spec.DataSource.Name)
+	}
+	volCaps := volumeCapabilities(pvc)
+	if !common.IsValidVolumeCapabilities(volCaps) {
+		return fmt.Errorf("access modes %v are not supported", pvc.Spec.AccessModes)
+	}
+	if common.IsFileVolumeRequest(volCaps) {
+		return fmt.Errorf("access modes %v are only supported for volumes with volume mode %s", pvc.Spec.AccessModes, v1.PersistentVolumeBlock)
+	}
+	if common.IsBlockVolumeRequest(volCaps) {
+		for paramName, paramValue := range sc.Parameters {
+			if luksEncryption, _ := strconv.ParseBool(paramValue); luksEncryption && strings.ToLower(paramName) == common.AttributeLuksEncryption {
+				return fmt.Errorf("StorageClass %q with parameter %s is not supported for volumes with volume mode %s",
+					sc.Name, common.AttributeLuksEncryption, v1.PersistentVolumeBlock)
+			}
+		}
+	}
+	return nil
+}
+
+// volumeCapabilities returns the volume capabilities which the external-provisioner requests for pvc.
+func volumeCapabilities(pvc *v1.PersistentVolumeClaim) []*csi.VolumeCapability {
+	var volCaps []*csi.VolumeCapability
+	for _, accessMode := range pvc.Spec.AccessModes {
+		volCap := &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: accessModes[accessMode]},
+		}
+		if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == v1.PersistentVolumeBlock {
+			volCap.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		} else {
+			volCap.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+		}
+		volCaps = append(volCaps, volCap)
+	}
+	return volCaps
+}
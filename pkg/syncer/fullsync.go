@@ -18,17 +18,21 @@ package syncer
 
 import (
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
@@ -36,6 +40,12 @@ import (
 // triggerFullSync triggers full sync
 func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
 	klog.V(2).Infof("FullSync: start")
+	start := time.Now()
+	defer func() {
+		fullSyncDuration.Observe(time.Since(start).Seconds())
+	}()
+	// Apply pending metadata updates so that full sync compares against the latest metadata
+	metadataSyncer.metadataUpdates.flush()
 
 	// Get K8s PVs in State "Bound", "Available" or "Released"
 	k8sPVs, err := getPVsInBoundAvailableOrReleased(k8sclient)
@@ -51,18 +61,11 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	klog.V(4).Infof("FullSync: pvcToPodMap %v", pvcToPodMap)
 
 	//Call CNS QueryAll to get container volumes by cluster ID
-	queryFilter := cnstypes.CnsQueryFilter{
-		ContainerClusterIds: []string{
-			metadataSyncer.cfg.Global.ClusterID,
-		},
-	}
-	querySelection := cnstypes.CnsQuerySelection{}
-	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, querySelection)
+	cnsVolumeArray, err := queryAllVolumesInCluster(metadataSyncer)
 	if err != nil {
 		klog.Warningf("FullSync: failed to queryAllVolume with err %v", err)
 		return
 	}
-	cnsVolumeArray := queryAllResult.Volumes
 
 	// Initialize CNS volume maps
 	cnsVolumeToPodMap = make(map[string]string)
@@ -71,11 +74,28 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 
 	// Map K8s PV's to the operation that needs to be performed on them
 	k8sPVsMap := buildVolumeMap(k8sPVs, cnsVolumeArray, pvToPVCMap, pvcToPodMap, metadataSyncer)
+	if err := addMigratedVolumes(k8sPVsMap, metadataSyncer); err != nil {
+		klog.Warningf("FullSync: failed to get migrated in-tree volumes with err %v", err)
+		return
+	}
 	klog.V(4).Infof("FullSync: k8sPVMap %v", k8sPVsMap)
+	// Volumes without PV which never had one are orphans, reported and cleaned up
+	volumesWithoutPV := getVolumesWithoutPV(cnsVolumeArray, k8sPVsMap)
+	volumesWithoutPVMetadata := queryVolumeMetadata(getVolumeIds(volumesWithoutPV), metadataSyncer)
+	orphanVolumes := identifyOrphanVolumes(volumesWithoutPV, volumesWithoutPVMetadata)
+	orphanVolumesReported := reportOrphanVolumes(orphanVolumes, metadataSyncer)
+	publishNamespaceUsage(k8sclient, k8sPVs, cnsVolumeArray, metadataSyncer)
 
 	// Identify volumes to be created, updated and deleted
 	volToBeCreated, volToBeUpdated, volWithPvcEntryToBeDeleted, volWithPodEntryToBeDeleted := identifyVolumesToBeCreatedUpdated(k8sPVs, k8sPVsMap)
 	volToBeDeleted := identifyVolumesToBeDeleted(cnsVolumeArray, k8sPVsMap)
+	if orphanVolumesReported || metadataSyncer.isOrphanVolumeCleanupConfigured() {
+		// Keep orphan volumes in CNS while they are listed by the CnsOrphanVolumeReport or until
+		// cleanupOrphanVolumes deletes them with their disks. Unregistering them keeps their disks,
+		// which would then be leaked without being reported, also in dry-run mode.
+		// Volumes which had a PV are still unregistered.
+		volToBeDeleted = getVolumesWhichHadPV(volToBeDeleted, volumesWithoutPVMetadata)
+	}
 
 	// Construct the cns spec for create and update operations
 	createSpecArray := constructCnsCreateSpec(volToBeCreated, pvToPVCMap, pvcToPodMap, metadataSyncer)
@@ -90,6 +110,7 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	go fullSyncDeleteVolumes(volToBeDeleted, metadataSyncer, k8sclient, &wg)
 	go fullSyncUpdateVolumes(updateSpecArray, metadataSyncer, &wg)
 	wg.Wait()
+	cleanupOrphanVolumes(k8sclient, orphanVolumes, metadataSyncer)
 
 	cleanupCnsMaps(k8sPVsMap)
 	klog.V(4).Infof("FullSync: cnsDeletionMap at end of cycle: %v", cnsDeletionMap)
@@ -97,6 +118,97 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	klog.V(2).Infof("FullSync: end")
 }
 
+// queryAllVolumesInCluster returns all CNS volumes which belong to the cluster
+// Volumes are fetched in pages of at most cfg.Global.QueryLimit volumes
+// Only the fields needed by full sync are selected, metadata of volumes which
+// exist in K8s is queried separately by queryVolumeMetadata
+func queryAllVolumesInCluster(metadataSyncer *MetadataSyncInformer) ([]cnstypes.CnsVolume, error) {
+	return queryAllVolumesInClusterWithSelection(metadataSyncer,
+		string(cnstypes.QuerySelectionNameTypeVolumeName),
+		string(cnstypes.QuerySelectionNameTypeBackingObjectDetails),
+		querySelectionNameDatastoreURL)
+}
+
+// queryAllVolumesInClusterWithSelection returns all CNS volumes which belong to the cluster
+// with only the fields selectionNames selected
+func queryAllVolumesInClusterWithSelection(metadataSyncer *MetadataSyncInformer, selectionNames ...string) ([]cnstypes.CnsVolume, error) {
+	queryLimit := metadataSyncer.cfg.Global.QueryLimit
+	if queryLimit <= 0 {
+		queryLimit = cnsconfig.DefaultQueryLimit
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{
+			metadataSyncer.cfg.Global.ClusterID,
+		},
+		Cursor: &cnstypes.CnsCursor{
+			Offset: 0,
+			Limit:  int64(queryLimit),
+		},
+	}
+	querySelection := cnstypes.CnsQuerySelection{
+		Names: selectionNames,
+	}
+	var cnsVolumes []cnstypes.CnsVolume
+	for _, vc := range metadataSyncer.getVirtualCenters() {
+		queryAllResult, err := volumes.GetManager(vc).QueryAllVolume(queryFilter, querySelection)
+		if err != nil {
+			klog.Errorf("QueryAllVolume failed on vCenter %q. Err: %v", vc.Config.Host, err)
+			cnsFailures.WithLabelValues(cnsOperationQueryVolume).Inc()
+			return nil, err
+		}
+		for _, vol := range queryAllResult.Volumes {
+			metadataSyncer.volumeHosts.Store(vol.VolumeId.Id, vc)
+		}
+		cnsVolumes = append(cnsVolumes, queryAllResult.Volumes...)
+	}
+	return cnsVolumes, nil
+}
+
+// queryVolumeMetadata returns CNS volumes, including their metadata, for the given volume IDs
+// Each volume is queried on its vCenter, at most cfg.Global.MetadataBatchSize volumes in a single call
+func queryVolumeMetadata(volumeIds []cnstypes.CnsVolumeId, metadataSyncer *MetadataSyncInformer) map[string]cnstypes.CnsVolume {
+	cnsVolumeMap := make(map[string]cnstypes.CnsVolume)
+	batchSize := metadataSyncer.cfg.Global.MetadataBatchSize
+	if batchSize <= 0 {
+		batchSize = cnsconfig.DefaultMetadataBatchSize
+	}
+	var vcenters []*cnsvsphere.VirtualCenter
+	volumeIdsByVC := make(map[*cnsvsphere.VirtualCenter][]cnstypes.CnsVolumeId)
+	for _, volumeID := range volumeIds {
+		vc, err := metadataSyncer.getVolumeVirtualCenter(volumeID.Id)
+		if err != nil {
+			klog.Warningf("FullSync: failed to find the vCenter of volume %s with err %v", volumeID.Id, err)
+			continue
+		}
+		if _, ok := volumeIdsByVC[vc]; !ok {
+			vcenters = append(vcenters, vc)
+		}
+		volumeIdsByVC[vc] = append(volumeIdsByVC[vc], volumeID)
+	}
+	for _, vc := range vcenters {
+		vcVolumeIds := volumeIdsByVC[vc]
+		for start := 0; start < len(vcVolumeIds); start += batchSize {
+			end := start + batchSize
+			if end > len(vcVolumeIds) {
+				end = len(vcVolumeIds)
+			}
+			queryFilter := cnstypes.CnsQueryFilter{
+				VolumeIds: vcVolumeIds[start:end],
+			}
+			queryResult, err := volumes.GetManager(vc).QueryVolume(queryFilter)
+			if err != nil || queryResult == nil {
+				klog.Warningf("FullSync: failed to query metadata for volumes %v with err %v", vcVolumeIds[start:end], err)
+				cnsFailures.WithLabelValues(cnsOperationQueryVolume).Inc()
+				continue
+			}
+			for _, vol := range queryResult.Volumes {
+				cnsVolumeMap[vol.VolumeId.Id] = vol
+			}
+		}
+	}
+	return cnsVolumeMap
+}
+
 // getPVsInBoundAvailableOrReleased return PVs in Bound, Available or Released state
 func getPVsInBoundAvailableOrReleased(k8sclient clientset.Interface) ([]*v1.PersistentVolume, error) {
 	var pvsInDesiredState []*v1.PersistentVolume
@@ -106,7 +218,8 @@ func getPVsInBoundAvailableOrReleased(k8sclient clientset.Interface) ([]*v1.Pers
 		return nil, err
 	}
 	for index, pv := range allPVs.Items {
-		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == service.Name {
+		// PVs which reference an in-tree volume by its VMDK path are handled by addMigratedVolumes
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == service.Name && !common.IsVolumePath(pv.Spec.CSI.VolumeHandle) {
 			klog.V(4).Infof("FullSync: pv %v is in state %v", pv.Spec.CSI.VolumeHandle, pv.Status.Phase)
 			if pv.Status.Phase == v1.VolumeBound || pv.Status.Phase == v1.VolumeAvailable || pv.Status.Phase == v1.VolumeReleased {
 				pvsInDesiredState = append(pvsInDesiredState, &allPVs.Items[index])
@@ -141,9 +254,10 @@ func fullSyncCreateVolumes(createSpecArray []cnstypes.CnsVolumeCreateSpec, metad
 		}
 		if _, existsInK8s := currentK8sPVMap[createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId]; existsInK8s {
 			klog.V(4).Infof("FullSync: Calling CreateVolume for volume %s with id %s and create spec %+v", createSpec.Name, createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId, spew.Sdump(createSpec))
-			_, err := volumes.GetManager(metadataSyncer.vcenter).CreateVolume(&createSpec)
+			err := metadataSyncer.createVolume(&createSpec)
 			if err != nil {
 				klog.Warningf("FullSync: Failed to create disk %s with id %s. Err: %+v", createSpec.Name, createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId, err)
+				cnsFailures.WithLabelValues(cnsOperationCreateVolume).Inc()
 				continue
 			}
 		}
@@ -174,9 +288,10 @@ func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataS
 		// Delete volume if not present in currentK8sPVMap
 		if _, existsInK8s := currentK8sPVMap[volID.Id]; !existsInK8s {
 			klog.V(4).Infof("FullSync: Calling DeleteVolume for volume %v with delete disk %v", volID, deleteDisk)
-			err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volID.Id, deleteDisk)
+			err := metadataSyncer.deleteVolume(volID.Id, deleteDisk)
 			if err != nil {
 				klog.Warningf("FullSync: Failed to delete volume %s with error %+v", volID, err)
+				cnsFailures.WithLabelValues(cnsOperationDeleteVolume).Inc()
 				continue
 			}
 		}
@@ -185,27 +300,27 @@ func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataS
 }
 
 // fullSyncUpdateVolumes update metadata for volumes with given array of createSpec
+// The updates are sent to CNS in batches of at most cfg.Global.MetadataBatchSize volumes
 func fullSyncUpdateVolumes(updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec, metadataSyncer *MetadataSyncInformer, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for _, updateSpec := range updateSpecArray {
-		klog.V(4).Infof("FullSync: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(&updateSpec); err != nil {
-			klog.Warningf("FullSync:UpdateVolumeMetadata failed with err %v", err)
-		}
+		klog.V(4).Infof("FullSync: Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+		metadataSyncer.metadataUpdates.add(updateSpec)
 	}
+	metadataSyncer.metadataUpdates.flush()
 }
 
 // buildCnsUpdateMetadataList build metadata list for given PV
 // metadata list may include PV metadata, PVC metadata and POD metadata
-func buildCnsUpdateMetadataList(pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap) []cnstypes.BaseCnsEntityMetadata {
+func buildCnsUpdateMetadataList(pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap, metadataSyncer *MetadataSyncInformer) []cnstypes.BaseCnsEntityMetadata {
 	var metadataList []cnstypes.BaseCnsEntityMetadata
 
 	// get pv metadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, pv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, metadataSyncer.labelFilter.filter(pv.GetLabels()), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 	if pvc, ok := pvToPVCMap[pv.Name]; ok {
 		// get pvc metadata
-		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, pvc.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
+		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, metadataSyncer.labelFilter.filter(pvc.GetLabels()), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
 		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 		key := pvc.Namespace + "/" + pvc.Name
@@ -230,23 +345,22 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 	for _, vol := range cnsVolumeList {
 		cnsVolumeMap[vol.VolumeId.Id] = true
 	}
+	// Query metadata of all PVs which exist in both K8S and CNS cache
+	var volumeIds []cnstypes.CnsVolumeId
+	for _, pv := range pvList {
+		if cnsVolumeMap[pv.Spec.CSI.VolumeHandle] {
+			volumeIds = append(volumeIds, cnstypes.CnsVolumeId{Id: pv.Spec.CSI.VolumeHandle})
+		}
+	}
+	cnsVolumeMetadataMap := queryVolumeMetadata(volumeIds, metadataSyncer)
 	for _, pv := range pvList {
 		k8sPVMap[pv.Spec.CSI.VolumeHandle] = ""
 		if cnsVolumeMap[pv.Spec.CSI.VolumeHandle] {
 			// PV exist in both K8S and CNS cache, check metadata has been changed or not
-			queryFilter := cnstypes.CnsQueryFilter{
-				VolumeIds: []cnstypes.CnsVolumeId{
-					{
-						Id: pv.Spec.CSI.VolumeHandle,
-					},
-				},
-			}
-
-			queryResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
-			if err == nil && queryResult != nil && len(queryResult.Volumes) > 0 {
-				if &queryResult.Volumes[0].Metadata != nil {
-					cnsMetadata := queryResult.Volumes[0].Metadata.EntityMetadata
-					metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
+			if cnsVolume, ok := cnsVolumeMetadataMap[pv.Spec.CSI.VolumeHandle]; ok {
+				if &cnsVolume.Metadata != nil {
+					cnsMetadata := cnsVolume.Metadata.EntityMetadata
+					metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
 					k8sPVMap[pv.Spec.CSI.VolumeHandle] = getCnsUpdateOperationType(metadataList, cnsMetadata, pv.Name)
 				} else {
 					// metadata does not exist in CNS cache even the volume has an entry in CNS cache
@@ -267,6 +381,30 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 	return k8sPVMap
 }
 
+// addMigratedVolumes adds the volumes of the in-tree vSphere volumes migrated to CSI, which
+// have a CnsVSphereVolumeMigration, to k8sPVMap without an operation, so that they are neither
+// deleted from CNS nor reported as orphan volumes. The metadata of their PVs is not synced.
+func addMigratedVolumes(k8sPVMap map[string]string, metadataSyncer *MetadataSyncInformer) error {
+	if metadataSyncer.dynamicClient == nil {
+		return nil
+	}
+	migrations, err := metadataSyncer.dynamicClient.Resource(common.VolumeMigrationGVR).List(metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		// The CRD is only installed if CSI migration is enabled
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations.Items {
+		volumeID, _, _ := unstructured.NestedString(migration.Object, "spec", "volumeID")
+		if _, exists := k8sPVMap[volumeID]; volumeID != "" && !exists {
+			k8sPVMap[volumeID] = ""
+		}
+	}
+	return nil
+}
+
 // identifyVolumesToBeCreatedUpdated return list of PV need to be created and updated
 // volumes to be updated can be of three types -
 // 	1. volumes whose existing metadata needs to be updated/created
@@ -317,15 +455,29 @@ func identifyVolumesToBeDeleted(cnsVolumeList []cnstypes.CnsVolume, k8sPVMap map
 	return volToBeDeleted
 }
 
+// getVolumesWhichHadPV returns the volumes of volumeIds whose metadata in cnsVolumeMetadata,
+// by volume ID, has a PV entity. Orphan volumes and volumes whose metadata is unknown are left out.
+func getVolumesWhichHadPV(volumeIds []cnstypes.CnsVolumeId, cnsVolumeMetadata map[string]cnstypes.CnsVolume) []cnstypes.CnsVolumeId {
+	var volumesWhichHadPV []cnstypes.CnsVolumeId
+	for _, volumeID := range volumeIds {
+		if vol, ok := cnsVolumeMetadata[volumeID.Id]; ok && hadPersistentVolume(vol) {
+			volumesWhichHadPV = append(volumesWhichHadPV, volumeID)
+		} else {
+			klog.V(4).Infof("FullSync: volume %s is kept in CNS as it may be an orphan volume", volumeID.Id)
+		}
+	}
+	return volumesWhichHadPV
+}
+
 // constructCnsCreateSpec construct CnsVolumeCreateSpec for given list of PVs
 func constructCnsCreateSpec(pvList []*v1.PersistentVolume, pvToPVCMap pvcMap, pvcToPodMap podMap, metadataSyncer *MetadataSyncInformer) []cnstypes.CnsVolumeCreateSpec {
 	var createSpecArray []cnstypes.CnsVolumeCreateSpec
 	for _, pv := range pvList {
 		// Create new metadata spec
-		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
+		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
 		// volume exist in K8S, but not in CNS cache, need to create this volume
 		createSpec := cnstypes.CnsVolumeCreateSpec{
-			Name:       pv.Name,
+			Name:       common.SanitizeVolumeName(pv.Name),
 			VolumeType: common.BlockVolumeType,
 			Metadata: cnstypes.CnsVolumeMetadata{
 				ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
@@ -347,7 +499,7 @@ func constructCnsUpdateSpec(pvUpdateList []*v1.PersistentVolume, pvToPVCMap pvcM
 	var updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec
 	for _, pv := range pvUpdateList {
 		// Create new metadata spec with delete flag false
-		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap)
+		metadataList := buildCnsUpdateMetadataList(pv, pvToPVCMap, pvcToPodMap, metadataSyncer)
 		// volume exist in K8S and CNS cache, but metadata is different, need to update this volume
 		updateSpec := cnstypes.CnsVolumeMetadataUpdateSpec{
 			VolumeId: cnstypes.CnsVolumeId{
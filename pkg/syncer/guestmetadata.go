@@ -0,0 +1,208 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"reflect"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+// guestMetadataSyncer relays the metadata of the PVs, PVCs and Pods of a guest cluster to its
+// supervisor cluster as CnsVolumeMetadata objects, from which the supervisor syncer updates
+// CNS. The guest cluster has no access to vCenter.
+type guestMetadataSyncer struct {
+	// volumeMetadatas are the CnsVolumeMetadatas in the supervisor namespace of the guest cluster
+	volumeMetadatas dynamic.ResourceInterface
+	// clusterID is the UID of the TanzuKubernetesCluster of the guest cluster
+	clusterID string
+	pvLister  corelisters.PersistentVolumeLister
+	pvcLister corelisters.PersistentVolumeClaimLister
+}
+
+// initGuestCluster runs the metadata syncer of a guest cluster with the config at cfgPath
+func (metadataSyncer *MetadataSyncInformer) initGuestCluster(cfgPath string) error {
+	cfg, err := cnsconfig.GetGCconfig(cfgPath)
+	if err != nil {
+		klog.Errorf("Failed to parse config. Err: %v", err)
+		return err
+	}
+	restConfig, namespace, err := cnsconfig.GetSupervisorClientConfig(cfg)
+	if err != nil {
+		klog.Errorf("Failed to get the client config of the supervisor cluster. Err: %v", err)
+		return err
+	}
+	supervisorClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		klog.Errorf("Failed to create the dynamic client of the supervisor cluster. Err: %v", err)
+		return err
+	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return err
+	}
+	metadataSyncer.k8sInformerManager = k8s.NewInformer(k8sclient)
+	s := &guestMetadataSyncer{
+		volumeMetadatas: supervisorClient.Resource(common.VolumeMetadataGVR).Namespace(namespace),
+		clusterID:       cfg.GC.TanzuKubernetesClusterUID,
+		pvLister:        metadataSyncer.k8sInformerManager.GetPVLister(),
+		pvcLister:       metadataSyncer.k8sInformerManager.GetPVCLister(),
+	}
+	metadataSyncer.k8sInformerManager.AddPVListener(
+		func(obj interface{}) { s.pvUpdated(obj) },
+		func(oldObj interface{}, newObj interface{}) { s.pvUpdated(newObj) },
+		func(obj interface{}) { s.deleted(obj) })
+	metadataSyncer.k8sInformerManager.AddPVCListener(
+		func(obj interface{}) { s.pvcUpdated(obj) },
+		func(oldObj interface{}, newObj interface{}) { s.pvcUpdated(newObj) },
+		func(obj interface{}) { s.deleted(obj) })
+	metadataSyncer.k8sInformerManager.AddPodListener(
+		func(obj interface{}) { s.podUpdated(obj) },
+		func(oldObj interface{}, newObj interface{}) { s.podUpdated(newObj) },
+		func(obj interface{}) { s.deleted(obj) })
+	klog.V(2).Infof("Initialized metadata syncer of guest cluster %s", s.clusterID)
+	stopCh := metadataSyncer.k8sInformerManager.Listen()
+	<-(stopCh)
+	return nil
+}
+
+// pvUpdated relays the metadata of a PV of a vSphere CSI volume
+func (s *guestMetadataSyncer) pvUpdated(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if pv == nil || !ok || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+		return
+	}
+	s.update(pv.UID, string(cnstypes.CnsKubernetesEntityTypePV), pv.Name, "", pv.Labels, []string{pv.Spec.CSI.VolumeHandle})
+}
+
+// pvcUpdated relays the metadata of a bound PVC of a vSphere CSI volume
+func (s *guestMetadataSyncer) pvcUpdated(obj interface{}) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if pvc == nil || !ok || pvc.Status.Phase != v1.ClaimBound {
+		return
+	}
+	volumeName, ok := s.getVolumeName(pvc.Namespace, pvc.Name)
+	if !ok {
+		return
+	}
+	s.update(pvc.UID, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Name, pvc.Namespace, pvc.Labels, []string{volumeName})
+}
+
+// podUpdated relays the metadata of a Pod using vSphere CSI volumes
+func (s *guestMetadataSyncer) podUpdated(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if pod == nil || !ok || pod.Status.Phase == v1.PodPending {
+		return
+	}
+	var volumeNames []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		if volumeName, ok := s.getVolumeName(pod.Namespace, volume.PersistentVolumeClaim.ClaimName); ok {
+			volumeNames = append(volumeNames, volumeName)
+		}
+	}
+	if len(volumeNames) == 0 {
+		return
+	}
+	s.update(pod.UID, string(cnstypes.CnsKubernetesEntityTypePOD), pod.Name, pod.Namespace, nil, volumeNames)
+}
+
+// deleted deletes the CnsVolumeMetadata of a deleted PV, PVC or Pod
+func (s *guestMetadataSyncer) deleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		klog.Warningf("GuestMetadataSync: unrecognized object %+v", obj)
+		return
+	}
+	name := string(accessor.GetUID())
+	err = s.volumeMetadatas.Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Errorf("GuestMetadataSync: failed to delete CnsVolumeMetadata %s. Err: %v", name, err)
+	}
+}
+
+// getVolumeName returns the supervisor PVC of the vSphere CSI volume bound to the PVC
+// pvcName in namespace, which is the volume handle of the guest PV
+func (s *guestMetadataSyncer) getVolumeName(namespace string, pvcName string) (string, bool) {
+	pvc, err := s.pvcLister.PersistentVolumeClaims(namespace).Get(pvcName)
+	if err != nil || pvc.Spec.VolumeName == "" {
+		return "", false
+	}
+	pv, err := s.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil || pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+		return "", false
+	}
+	return pv.Spec.CSI.VolumeHandle, true
+}
+
+// update creates or updates the CnsVolumeMetadata of the guest object uid
+func (s *guestMetadataSyncer) update(uid types.UID, entityType string, entityName string, namespace string,
+	labels map[string]string, volumeNames []string) {
+	specLabels := make(map[string]interface{})
+	for k, v := range labels {
+		specLabels[k] = v
+	}
+	var specVolumeNames []interface{}
+	for _, volumeName := range volumeNames {
+		specVolumeNames = append(specVolumeNames, volumeName)
+	}
+	spec := map[string]interface{}{
+		"volumenames":    specVolumeNames,
+		"guestclusterid": s.clusterID,
+		"entitytype":     entityType,
+		"entityname":     entityName,
+		"namespace":      namespace,
+		"labels":         specLabels,
+	}
+	name := string(uid)
+	volumeMetadata, err := s.volumeMetadatas.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		volumeMetadata = &unstructured.Unstructured{}
+		volumeMetadata.SetAPIVersion(common.VolumeMetadataGVR.GroupVersion().String())
+		volumeMetadata.SetKind("CnsVolumeMetadata")
+		volumeMetadata.SetName(name)
+		volumeMetadata.Object["spec"] = spec
+		_, err = s.volumeMetadatas.Create(volumeMetadata, metav1.CreateOptions{})
+	} else if err == nil && !reflect.DeepEqual(volumeMetadata.Object["spec"], spec) {
+		volumeMetadata.Object["spec"] = spec
+		_, err = s.volumeMetadatas.Update(volumeMetadata, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		klog.Errorf("GuestMetadataSync: failed to update CnsVolumeMetadata of %s %s. Err: %v", entityType, entityName, err)
+	}
+}
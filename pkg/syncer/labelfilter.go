@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// labelFilter selects the PV, PVC and Pod labels which are synced to CNS.
+// Clusters with frequently changing labels, e.g. per deployment hashes, exclude
+// them to avoid constant metadata updates.
+type labelFilter struct {
+	included []*regexp.Regexp
+	excluded []*regexp.Regexp
+}
+
+// newLabelFilter returns a labelFilter for the comma separated label key
+// patterns included and excluded. Patterns are matched against the beginning
+// of label keys. Returns nil if no patterns are configured.
+func newLabelFilter(included string, excluded string) (*labelFilter, error) {
+	includedPatterns, err := compileLabelPatterns(included)
+	if err != nil {
+		return nil, err
+	}
+	excludedPatterns, err := compileLabelPatterns(excluded)
+	if err != nil {
+		return nil, err
+	}
+	if len(includedPatterns) == 0 && len(excludedPatterns) == 0 {
+		return nil, nil
+	}
+	return &labelFilter{included: includedPatterns, excluded: excludedPatterns}, nil
+}
+
+// compileLabelPatterns compiles the comma separated label key patterns, anchored at the start of the key
+func compileLabelPatterns(patterns string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")")
+		if err != nil {
+			return nil, fmt.Errorf("invalid label key pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// filter returns the labels whose keys are included and not excluded.
+// labels is returned unchanged if f is nil.
+func (f *labelFilter) filter(labels map[string]string) map[string]string {
+	if f == nil || labels == nil {
+		return labels
+	}
+	filtered := make(map[string]string)
+	for key, value := range labels {
+		if len(f.included) > 0 && !matchesAny(f.included, key) {
+			continue
+		}
+		if matchesAny(f.excluded, key) {
+			continue
+		}
+		filtered[key] = value
+	}
+	return filtered
+}
+
+// matchesAny returns true if key matches any of patterns
+func matchesAny(patterns []*regexp.Regexp, key string) bool {
+	for _, re := range patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync"
+
+	"github.com/davecgh/go-spew/spew"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// metadataBatcher collects the volume metadata updates of the informer handlers
+// and sends them to CNS in batches, instead of issuing one CNS call per PV, PVC
+// or Pod event. Volumes with pending updates are tracked in a rate limited
+// workqueue, so that failed updates are retried with backoff rather than waiting
+// for the next full sync.
+type metadataBatcher struct {
+	lock sync.Mutex
+	// pending maps volume IDs to their updates which are not sent yet, in the
+	// order they were added. At most one update per volume is sent in a batch,
+	// so that updates of a volume are applied in order.
+	pending map[string][]cnstypes.CnsVolumeMetadataUpdateSpec
+	queue   workqueue.RateLimitingInterface
+	// processLock serializes CNS calls, so that a flush does not overtake a
+	// batch of the worker
+	processLock sync.Mutex
+	batchSize   int
+	update      func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error
+	// dropped, if set, is called with the last error of an update which is
+	// dropped after maxMetadataUpdateRetries retries
+	dropped func(volumeID string, err error)
+}
+
+// failedUpdate is a metadata update which CNS failed to apply
+type failedUpdate struct {
+	spec cnstypes.CnsVolumeMetadataUpdateSpec
+	err  error
+}
+
+// newMetadataBatcher returns a metadataBatcher which sends at most batchSize
+// updates in a single call to update
+func newMetadataBatcher(batchSize int, update func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error) *metadataBatcher {
+	if batchSize <= 0 {
+		batchSize = cnsconfig.DefaultMetadataBatchSize
+	}
+	return &metadataBatcher{
+		pending:   make(map[string][]cnstypes.CnsVolumeMetadataUpdateSpec),
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), syncerComponentName),
+		batchSize: batchSize,
+		update:    update,
+	}
+}
+
+// add queues spec to be sent to CNS
+func (b *metadataBatcher) add(spec cnstypes.CnsVolumeMetadataUpdateSpec) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	volumeID := spec.VolumeId.Id
+	b.pending[volumeID] = append(b.pending[volumeID], spec)
+	b.queue.Add(volumeID)
+}
+
+// run sends the queued updates to CNS until stopCh is closed. The updates of
+// all volumes queued while a batch is sent are sent together in the next batch.
+func (b *metadataBatcher) run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		b.queue.ShutDown()
+	}()
+	for {
+		key, shutdown := b.queue.Get()
+		if shutdown {
+			return
+		}
+		volumeIDs := []string{key.(string)}
+		for len(volumeIDs) < b.batchSize && b.queue.Len() > 0 {
+			key, _ := b.queue.Get()
+			volumeIDs = append(volumeIDs, key.(string))
+		}
+		b.processLock.Lock()
+		failed := b.send(b.takeNext(volumeIDs))
+		for _, f := range failed {
+			b.retry(f)
+		}
+		b.processLock.Unlock()
+		for _, volumeID := range volumeIDs {
+			b.requeue(volumeID, failed)
+			b.queue.Done(volumeID)
+		}
+	}
+}
+
+// flush sends all pending updates to CNS before returning. Failed updates are
+// logged and dropped, full sync reconciles the metadata of these volumes.
+func (b *metadataBatcher) flush() {
+	b.processLock.Lock()
+	defer b.processLock.Unlock()
+	for {
+		b.lock.Lock()
+		var volumeIDs []string
+		for volumeID := range b.pending {
+			volumeIDs = append(volumeIDs, volumeID)
+		}
+		b.lock.Unlock()
+		if len(volumeIDs) == 0 {
+			return
+		}
+		for start := 0; start < len(volumeIDs); start += b.batchSize {
+			end := start + b.batchSize
+			if end > len(volumeIDs) {
+				end = len(volumeIDs)
+			}
+			b.send(b.takeNext(volumeIDs[start:end]))
+		}
+	}
+}
+
+// takeNext removes the oldest pending update of each of volumeIDs and returns them
+func (b *metadataBatcher) takeNext(volumeIDs []string) []cnstypes.CnsVolumeMetadataUpdateSpec {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var specs []cnstypes.CnsVolumeMetadataUpdateSpec
+	for _, volumeID := range volumeIDs {
+		volumeSpecs := b.pending[volumeID]
+		if len(volumeSpecs) == 0 {
+			// Already sent by a flush
+			continue
+		}
+		specs = append(specs, volumeSpecs[0])
+		if len(volumeSpecs) == 1 {
+			delete(b.pending, volumeID)
+		} else {
+			b.pending[volumeID] = volumeSpecs[1:]
+		}
+	}
+	return specs
+}
+
+// send sends specs to CNS in a single call and returns the failed updates by volume ID
+func (b *metadataBatcher) send(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]failedUpdate {
+	failed := make(map[string]failedUpdate)
+	if len(specs) == 0 {
+		return failed
+	}
+	klog.V(4).Infof("Calling UpdateVolumeMetadata for %d volume(s) with updateSpecs: %+v", len(specs), spew.Sdump(specs))
+	results := b.update(specs)
+	for _, spec := range specs {
+		if err := results[spec.VolumeId.Id]; err != nil {
+			klog.Errorf("UpdateVolumeMetadata failed for volume %s with err: %v", spec.VolumeId.Id, err)
+			cnsFailures.WithLabelValues(cnsOperationUpdateVolumeMetadata).Inc()
+			failed[spec.VolumeId.Id] = failedUpdate{spec: spec, err: err}
+			continue
+		}
+		for _, metadata := range spec.Metadata.EntityMetadata {
+			if entityMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata); ok {
+				entityUpdates.WithLabelValues(entityMetadata.EntityType).Inc()
+			}
+		}
+	}
+	return failed
+}
+
+// retry puts a failed update back in front of the pending updates of its volume,
+// unless it has been retried maxMetadataUpdateRetries times already
+func (b *metadataBatcher) retry(f failedUpdate) {
+	volumeID := f.spec.VolumeId.Id
+	if b.queue.NumRequeues(volumeID) >= maxMetadataUpdateRetries {
+		klog.Warningf("Dropping metadata update for volume %s after %d retries, full sync will reconcile it", volumeID, maxMetadataUpdateRetries)
+		if b.dropped != nil {
+			b.dropped(volumeID, f.err)
+		}
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[volumeID] = append([]cnstypes.CnsVolumeMetadataUpdateSpec{f.spec}, b.pending[volumeID]...)
+}
+
+// requeue queues volumeID again if it has pending updates, with backoff if its last update failed
+func (b *metadataBatcher) requeue(volumeID string, failed map[string]failedUpdate) {
+	b.lock.Lock()
+	_, hasPending := b.pending[volumeID]
+	b.lock.Unlock()
+	if _, ok := failed[volumeID]; ok && hasPending {
+		b.queue.AddRateLimited(volumeID)
+		return
+	}
+	b.queue.Forget(volumeID)
+	if hasPending {
+		b.queue.Add(volumeID)
+	}
+}
@@ -21,17 +21,20 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"reflect"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	csictx "github.com/rexray/gocsi/context"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog"
 
-	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
@@ -44,15 +47,35 @@ func NewInformer() *MetadataSyncInformer {
 	return &MetadataSyncInformer{}
 }
 
-// getFullSyncIntervalInMin return the FullSyncInterval
+// SetFullSyncInterval sets the interval between full syncs, overriding
+// FULL_SYNC_INTERVAL_MINUTES. It must be called before Init.
+func (metadataSyncer *MetadataSyncInformer) SetFullSyncInterval(interval time.Duration) {
+	metadataSyncer.fullSyncInterval = interval
+}
+
+// SetOrphanVolumeCleanup enables the deletion of CNS volumes, including their disks, which
+// never had a PV, for at least minAge. Volumes which once belonged to a PV, e.g. with the
+// Retain reclaim policy, are never deleted. A minAge of 0 disables the cleanup. In dryRun mode the
+// volumes which would be deleted are only logged. It must be called before Init.
+func (metadataSyncer *MetadataSyncInformer) SetOrphanVolumeCleanup(minAge time.Duration, dryRun bool) {
+	metadataSyncer.orphanVolumeCleanupAge = minAge
+	metadataSyncer.orphanVolumeCleanupDryRun = dryRun
+}
+
+// getFullSyncInterval returns the interval between full syncs
+// If it was set with SetFullSyncInterval, return that interval
 // If enviroment variable FULL_SYNC_INTERVAL_MINUTES is set and valid,
 // return the interval value read from enviroment variable
 // otherwise, use the default value 30 minutes
-func getFullSyncIntervalInMin() int {
+func (metadataSyncer *MetadataSyncInformer) getFullSyncInterval() time.Duration {
+	if metadataSyncer.fullSyncInterval > 0 {
+		klog.V(2).Infof("FullSync: fullSync interval is set to %v", metadataSyncer.fullSyncInterval)
+		return metadataSyncer.fullSyncInterval
+	}
 	fullSyncIntervalInMin := defaultFullSyncIntervalInMin
 	if v := os.Getenv(envFullSyncIntervalMinutes); v != "" {
 		if value, err := strconv.Atoi(v); err == nil {
-			if value <= 0 || value > defaultFullSyncIntervalInMin {
+			if value <= 0 {
 				msg := fmt.Sprintf("FullSync: FULL_SYNC_INTERVAL_MINUTES %s is not in valid range, will use the default interval", v)
 				klog.Warningf(msg)
 			} else {
@@ -64,7 +87,7 @@ func getFullSyncIntervalInMin() int {
 			klog.Warningf(msg)
 		}
 	}
-	return fullSyncIntervalInMin
+	return time.Duration(fullSyncIntervalInMin) * time.Minute
 }
 
 // Init initializes the Metadata Sync Informer
@@ -77,34 +100,40 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 	if cfgPath == "" {
 		cfgPath = cnsconfig.DefaultCloudConfigPath
 	}
+	if strings.EqualFold(os.Getenv(common.EnvClusterFlavor), common.ClusterFlavorGuest) {
+		return metadataSyncer.initGuestCluster(cfgPath)
+	}
 	metadataSyncer.cfg, err = cnsconfig.GetCnsconfig(cfgPath)
 	if err != nil {
 		klog.Errorf("Failed to parse config. Err: %v", err)
 		return err
 	}
+	metadataSyncer.labelFilter, err = newLabelFilter(metadataSyncer.cfg.Global.IncludedMetadataLabels, metadataSyncer.cfg.Global.ExcludedMetadataLabels)
+	if err != nil {
+		klog.Errorf("Failed to parse metadata label filter. Err: %v", err)
+		return err
+	}
 
-	metadataSyncer.vcconfig, err = cnsvsphere.GetVirtualCenterConfig(metadataSyncer.cfg)
+	vcconfigs, err := cnsvsphere.GetVirtualCenterConfigs(metadataSyncer.cfg)
 	if err != nil {
 		klog.Errorf("Failed to get VirtualCenterConfig. err=%v", err)
 		return err
 	}
+	metadataSyncer.vcconfig = vcconfigs[0]
 
 	// Initialize the virtual center manager
 	metadataSyncer.virtualcentermanager = cnsvsphere.GetVirtualCenterManager()
 
-	// Register virtual center manager
-	metadataSyncer.vcenter, err = metadataSyncer.virtualcentermanager.RegisterVirtualCenter(metadataSyncer.vcconfig)
-	if err != nil {
-		klog.Errorf("Failed to register VirtualCenter . err=%v", err)
-		return err
-	}
-
-	// Connect to VC
-	err = metadataSyncer.vcenter.Connect(ctx)
-	if err != nil {
-		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", metadataSyncer.vcconfig.Host, err)
-		return err
+	// Register and connect to each VC, metadata of volumes is synced with the VC which has the volume
+	for _, vcconfig := range vcconfigs {
+		vcenter, err := cnsvsphere.ConnectVirtualCenter(ctx, vcconfig)
+		if err != nil {
+			klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", vcconfig.Host, err)
+			return err
+		}
+		metadataSyncer.vcenters = append(metadataSyncer.vcenters, vcenter)
 	}
+	metadataSyncer.vcenter = metadataSyncer.vcenters[0]
 	// Create the kubernetes client from config
 	k8sclient, err := k8s.NewClient()
 	if err != nil {
@@ -112,20 +141,76 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 		return err
 	}
 
+	metadataSyncer.eventRecorder = k8s.NewEventRecorder(k8sclient, syncerComponentName)
+	metadataSyncer.dynamicClient, err = k8s.NewDynamicClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes dynamic client failed. Err: %v", err)
+		return err
+	}
+
 	// Initialize cnsDeletionMap used by Full Sync
 	cnsDeletionMap = make(map[string]bool)
 	// Initialize cnsCreationMap used by Full Sync
 	cnsCreationMap = make(map[string]bool)
 
-	ticker := time.NewTicker(time.Duration(getFullSyncIntervalInMin()) * time.Minute)
+	ticker := time.NewTicker(metadataSyncer.getFullSyncInterval())
+	// Full sync can also be triggered on demand by sending SIGUSR1 to the syncer,
+	// e.g. after the vCenter database has been restored from a backup
+	fullSyncTrigger := make(chan os.Signal, 1)
+	signal.Notify(fullSyncTrigger, syscall.SIGUSR1)
 	// Trigger full sync
 	go func() {
-		for range ticker.C {
-			klog.V(2).Infof("fullSync is triggered")
+		for {
+			select {
+			case <-ticker.C:
+				klog.V(2).Infof("fullSync is triggered")
+			case <-fullSyncTrigger:
+				klog.V(2).Infof("fullSync is triggered on demand")
+			}
 			triggerFullSync(k8sclient, metadataSyncer)
 		}
 	}()
 
+	metadataSyncer.volumes = newVolumeCache(volumeCacheTTL, metadataSyncer.queryVolume)
+	metadataSyncer.metadataUpdates = newMetadataBatcher(metadataSyncer.cfg.Global.MetadataBatchSize,
+		func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+			results := metadataSyncer.updateVolumesMetadata(specs)
+			for _, spec := range specs {
+				metadataSyncer.volumes.invalidate(spec.VolumeId.Id)
+			}
+			return results
+		})
+	metadataSyncer.metadataUpdates.dropped = metadataSyncer.recordMetadataUpdateFailure
+	if err := registerWorkqueueDepthMetric(metadataSyncer.metadataUpdates); err != nil {
+		klog.Warningf("Failed to register workqueue depth metric. Err: %v", err)
+	}
+	// Send the metadata updates queued by the informer handlers to CNS
+	stopMetadataUpdates := make(chan struct{})
+	defer close(stopMetadataUpdates)
+	go metadataSyncer.metadataUpdates.run(stopMetadataUpdates)
+	// Log in again when the vCenter credentials are rotated
+	stopCredentialsWatch := make(chan struct{})
+	defer close(stopCredentialsWatch)
+	for _, vcenter := range metadataSyncer.vcenters {
+		vcenter.WatchCredentials(stopCredentialsWatch)
+	}
+
+	privilegeCheckTicker := time.NewTicker(time.Duration(getPrivilegeCheckIntervalInMin()) * time.Minute)
+	// Periodically re-validate vCenter privileges
+	go func() {
+		for range privilegeCheckTicker.C {
+			triggerPrivilegeCheck(k8sclient, metadataSyncer)
+		}
+	}()
+
+	volumeHealthTicker := time.NewTicker(time.Duration(getVolumeHealthIntervalInMin()) * time.Minute)
+	// Periodically record the health of volumes on their PVCs
+	go func() {
+		for range volumeHealthTicker.C {
+			triggerVolumeHealthCheck(k8sclient, metadataSyncer)
+		}
+	}()
+
 	stopFullSync := make(chan bool, 1)
 
 	// Set up kubernetes resource listeners for metadata syncer
@@ -158,6 +243,9 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 	metadataSyncer.pvcLister = metadataSyncer.k8sInformerManager.GetPVCLister()
 	klog.V(2).Infof("Initialized metadata syncer")
 	stopCh := metadataSyncer.k8sInformerManager.Listen()
+	if metadataSyncer.cfg.Global.EnableGuestClusterMetadata {
+		metadataSyncer.watchVolumeMetadata(stopCh)
+	}
 	<-(stopCh)
 	<-(stopFullSync)
 	return nil
@@ -193,15 +281,15 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 		return
 	}
 
-	// Verify is old and new labels are not equal
-	if oldPvc.Status.Phase == v1.ClaimBound && reflect.DeepEqual(newPvc.Labels, oldPvc.Labels) {
+	// Verify is old and new labels are not equal, ignoring labels which are not synced to CNS
+	if oldPvc.Status.Phase == v1.ClaimBound && reflect.DeepEqual(metadataSyncer.labelFilter.filter(newPvc.Labels), metadataSyncer.labelFilter.filter(oldPvc.Labels)) {
 		klog.V(3).Infof("PVCUpdated: Old PVC and New PVC labels equal")
 		return
 	}
 
 	// Create updateSpec
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, newPvc.Labels, false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
+	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, metadataSyncer.labelFilter.filter(newPvc.Labels), false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
@@ -214,10 +302,8 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 		},
 	}
 
-	klog.V(4).Infof("PVCUpdated: Calling UpdateVolumeMetadata with updateSpec: %+v", spew.Sdump(updateSpec))
-	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-		klog.Errorf("PVCUpdated: UpdateVolumeMetadata failed with err %v", err)
-	}
+	klog.V(4).Infof("PVCUpdated: Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+	metadataSyncer.metadataUpdates.add(*updateSpec)
 }
 
 // pvDeleted deletes pvc metadata on VC when pvc has been deleted on K8s cluster
@@ -238,8 +324,8 @@ func pvcDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 		return
 	}
 
-	// Verify if pv is a vsphere csi volume
-	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+	// Verify if pv is a vsphere csi volume, migrated in-tree volumes are deleted by the controller
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name || common.IsVolumePath(pv.Spec.CSI.VolumeHandle) {
 		klog.V(3).Infof("PVCDeleted: Not a Vsphere CSI Volume")
 		return
 	}
@@ -265,10 +351,8 @@ func pvcDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 		},
 	}
 
-	klog.V(4).Infof("PVCDeleted: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-		klog.Errorf("PVCDeleted: UpdateVolumeMetadata failed with err %v", err)
-	}
+	klog.V(4).Infof("PVCDeleted: Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+	metadataSyncer.metadataUpdates.add(*updateSpec)
 }
 
 // pvUpdated updates volume metadata on VC when volume labels on K8S cluster have been updated
@@ -287,8 +371,9 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 	}
 	klog.V(4).Infof("PVUpdated: PV Updated from %+v to %+v", oldPv, newPv)
 
-	// Verify if pv is a vsphere csi volume
-	if oldPv.Spec.CSI == nil || newPv.Spec.CSI == nil || newPv.Spec.CSI.Driver != service.Name {
+	// Verify if pv is a vsphere csi volume, migrated in-tree volumes are not synced
+	if oldPv.Spec.CSI == nil || newPv.Spec.CSI == nil || newPv.Spec.CSI.Driver != service.Name ||
+		common.IsVolumePath(newPv.Spec.CSI.VolumeHandle) {
 		klog.V(3).Infof("PVUpdated: PV is not a Vsphere CSI Volume: %+v", newPv)
 		return
 	}
@@ -297,8 +382,8 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 		klog.V(3).Infof("PVUpdated: PV %s metadata is not updated since updated PV is in phase %s", newPv.Name, newPv.Status.Phase)
 		return
 	}
-	// Return if labels are unchanged
-	if oldPv.Status.Phase == v1.VolumeAvailable && reflect.DeepEqual(newPv.GetLabels(), oldPv.GetLabels()) {
+	// Return if labels synced to CNS are unchanged
+	if oldPv.Status.Phase == v1.VolumeAvailable && reflect.DeepEqual(metadataSyncer.labelFilter.filter(newPv.GetLabels()), metadataSyncer.labelFilter.filter(oldPv.GetLabels())) {
 		klog.V(3).Infof("PVUpdated: PV labels have not changed")
 		return
 	}
@@ -312,10 +397,20 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 	}
 
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, newPv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, metadataSyncer.labelFilter.filter(newPv.GetLabels()), false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 
-	if oldPv.Status.Phase == v1.VolumeAvailable || newPv.Spec.StorageClassName != "" {
+	registered := oldPv.Status.Phase == v1.VolumeAvailable || newPv.Spec.StorageClassName != ""
+	if !registered {
+		// A statically provisioned volume is registered in CNS by the first update of its PV,
+		// the metadata of the volume is updated by the later ones
+		_, found, err := metadataSyncer.volumes.get(newPv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			klog.Warningf("PVUpdated: Failed to query volume %s with error %+v", newPv.Spec.CSI.VolumeHandle, err)
+		}
+		registered = found
+	}
+	if registered {
 		updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
 			VolumeId: cnstypes.CnsVolumeId{
 				Id: newPv.Spec.CSI.VolumeHandle,
@@ -326,10 +421,8 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 			},
 		}
 
-		klog.V(4).Infof("PVUpdated: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-			klog.Errorf("PVUpdated: UpdateVolumeMetadata failed with err %v", err)
-		}
+		klog.V(4).Infof("PVUpdated: Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+		metadataSyncer.metadataUpdates.add(*updateSpec)
 	} else {
 		createSpec := &cnstypes.CnsVolumeCreateSpec{
 			Name:       oldPv.Name,
@@ -346,8 +439,8 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 		volumeOperationsLock.Lock()
 		defer volumeOperationsLock.Unlock()
 		klog.V(4).Infof("PVUpdated: vSphere provisioner creating volume %s with create spec %+v", oldPv.Name, spew.Sdump(createSpec))
-		_, err := volumes.GetManager(metadataSyncer.vcenter).CreateVolume(createSpec)
-
+		err := metadataSyncer.createVolume(createSpec)
+		metadataSyncer.volumes.invalidate(oldPv.Spec.CSI.VolumeHandle)
 		if err != nil {
 			klog.Errorf("PVUpdated: Failed to create disk %s with error %+v", oldPv.Name, err)
 		}
@@ -385,9 +478,14 @@ func pvDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	}
 	volumeOperationsLock.Lock()
 	defer volumeOperationsLock.Unlock()
+	// Apply pending metadata updates before the volume is deleted from CNS
+	metadataSyncer.metadataUpdates.flush()
 	klog.V(4).Infof("PVDeleted: vSphere provisioner deleting volume %v with delete disk %v", pv, deleteDisk)
-	if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(pv.Spec.CSI.VolumeHandle, deleteDisk); err != nil {
+	err := metadataSyncer.deleteVolume(pv.Spec.CSI.VolumeHandle, deleteDisk)
+	metadataSyncer.volumes.invalidate(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
 		klog.Errorf("PVDeleted: Failed to delete disk %s with error %+v", pv.Spec.CSI.VolumeHandle, err)
+		cnsFailures.WithLabelValues(cnsOperationDeleteVolume).Inc()
 		return
 	}
 }
@@ -481,12 +579,35 @@ func updatePodMetadata(pod *v1.Pod, metadataSyncer *MetadataSyncInformer, delete
 				},
 			}
 
-			klog.V(4).Infof("Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-			if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
-				msg := fmt.Sprintf("UpdateVolumeMetadata failed for volume %s with err: %v", volume.Name, err)
-				errorList = append(errorList, errors.New(msg))
-			}
+			klog.V(4).Infof("Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+			metadataSyncer.metadataUpdates.add(*updateSpec)
 		}
 	}
 	return errorList
 }
+
+// recordMetadataUpdateFailure raises a warning event with the CNS fault err on the PV of
+// volumeID and on its PVC, so that repeatedly failing metadata updates show up in
+// kubectl describe
+func (metadataSyncer *MetadataSyncInformer) recordMetadataUpdateFailure(volumeID string, err error) {
+	pvs, listErr := metadataSyncer.pvLister.List(labels.Everything())
+	if listErr != nil {
+		klog.Errorf("Failed to list PVs to record metadata update failure of volume %s. Err: %v", volumeID, listErr)
+		return
+	}
+	msg := fmt.Sprintf("Failed to update metadata of volume %s in CNS after %d retries: %v", volumeID, maxMetadataUpdateRetries, err)
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != volumeID {
+			continue
+		}
+		metadataSyncer.eventRecorder.Event(pv, v1.EventTypeWarning, metadataUpdateFailedReason, msg)
+		if pv.Spec.ClaimRef == nil {
+			return
+		}
+		pvc, pvcErr := metadataSyncer.pvcLister.PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name)
+		if pvcErr == nil {
+			metadataSyncer.eventRecorder.Event(pvc, v1.EventTypeWarning, metadataUpdateFailedReason, msg)
+		}
+		return
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// metricsNamespace prefixes the names of all syncer metrics
+	metricsNamespace = "vsphere_syncer"
+
+	// Values of the operation label of cnsFailures
+	cnsOperationCreateVolume         = "CreateVolume"
+	cnsOperationDeleteVolume         = "DeleteVolume"
+	cnsOperationUpdateVolumeMetadata = "UpdateVolumeMetadata"
+	cnsOperationQueryVolume          = "QueryVolume"
+)
+
+var (
+	// fullSyncDuration observes the duration of full sync cycles
+	fullSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "full_sync_duration_seconds",
+		Help:      "Duration of full syncs of volume metadata with CNS.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	// entityUpdates counts the entity metadata updates sent to CNS by entity type
+	entityUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "entity_updates_total",
+		Help:      "Number of PV, PVC and Pod metadata updates sent to CNS.",
+	}, []string{"entity_type"})
+	// cnsFailures counts failed CNS operations by operation
+	cnsFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cns_failures_total",
+		Help:      "Number of failed CNS operations.",
+	}, []string{"operation"})
+	// orphanVolumeCount is the number of CNS volumes of this cluster without a PV
+	orphanVolumeCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphan_volumes",
+		Help:      "Number of CNS volumes of this cluster without a PV, found by the last full sync.",
+	})
+	// orphanVolumesDeleted counts the orphan volumes deleted by the orphan volume cleanup
+	orphanVolumesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "orphan_volumes_deleted_total",
+		Help:      "Number of CNS volumes without a PV deleted with their disks.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(fullSyncDuration, entityUpdates, cnsFailures, orphanVolumeCount, orphanVolumesDeleted)
+}
+
+// registerWorkqueueDepthMetric exports the number of volumes waiting in the
+// metadata update workqueue of b
+func registerWorkqueueDepthMetric(b *metadataBatcher) error {
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workqueue_depth",
+		Help:      "Number of volumes with metadata updates waiting to be sent to CNS.",
+	}, func() float64 {
+		return float64(b.queue.Len())
+	}))
+}
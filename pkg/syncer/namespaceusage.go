@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sort"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// Name of the CnsNamespaceUsage object updated by the syncer in each namespace
+const namespaceUsageName = "vsphere-csi"
+
+// namespaceUsageGVR identifies the CnsNamespaceUsage custom resource, whose status
+// holds the datastore capacity used by the volumes of its namespace, so that vSphere
+// admins and vCenter UI plugins can see which namespaces consume which datastores
+var namespaceUsageGVR = schema.GroupVersionResource{
+	Group:    "cns.vmware.com",
+	Version:  "v1alpha1",
+	Resource: "cnsnamespaceusages",
+}
+
+// namespaceUsage is the capacity used by the volumes of a namespace
+type namespaceUsage struct {
+	volumeCount   int64
+	capacityBytes int64
+	// datastores maps datastore URLs to the usage of the namespace on the datastore
+	datastores map[string]*namespaceUsage
+}
+
+// add adds a volume of capacityBytes to the usage
+func (u *namespaceUsage) add(capacityBytes int64) {
+	u.volumeCount++
+	u.capacityBytes += capacityBytes
+}
+
+// getNamespaceUsage returns the usage of each namespace with volumes in pvList, by the
+// namespace of their claim. The datastores of the volumes are looked up in cnsVolumeList.
+func getNamespaceUsage(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsVolume) map[string]*namespaceUsage {
+	datastoreURLs := make(map[string]string)
+	for _, vol := range cnsVolumeList {
+		datastoreURLs[vol.VolumeId.Id] = vol.DatastoreUrl
+	}
+	usage := make(map[string]*namespaceUsage)
+	for _, pv := range pvList {
+		if pv.Spec.ClaimRef == nil || pv.Spec.CSI == nil {
+			continue
+		}
+		namespace := pv.Spec.ClaimRef.Namespace
+		if usage[namespace] == nil {
+			usage[namespace] = &namespaceUsage{datastores: make(map[string]*namespaceUsage)}
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		usage[namespace].add(capacity.Value())
+		datastoreURL, ok := datastoreURLs[pv.Spec.CSI.VolumeHandle]
+		if !ok {
+			continue
+		}
+		if usage[namespace].datastores[datastoreURL] == nil {
+			usage[namespace].datastores[datastoreURL] = &namespaceUsage{}
+		}
+		usage[namespace].datastores[datastoreURL].add(capacity.Value())
+	}
+	return usage
+}
+
+// publishNamespaceUsage updates the CnsNamespaceUsage of each namespace with volumes in
+// pvList, and deletes the ones of namespaces which no longer have volumes
+func publishNamespaceUsage(k8sclient clientset.Interface, pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsVolume, metadataSyncer *MetadataSyncInformer) {
+	if metadataSyncer.dynamicClient == nil {
+		return
+	}
+	usages := metadataSyncer.dynamicClient.Resource(namespaceUsageGVR)
+	now := metav1.Now()
+	usage := getNamespaceUsage(pvList, cnsVolumeList)
+	for namespace, nsUsage := range usage {
+		status := buildNamespaceUsageStatus(nsUsage, getStorageQuota(k8sclient, namespace), now)
+		if err := updateNamespaceUsage(usages.Namespace(namespace), status); err != nil {
+			klog.Errorf("FullSync: failed to update CnsNamespaceUsage in namespace %q. Err: %v", namespace, err)
+		}
+	}
+	existing, err := usages.Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("FullSync: failed to list CnsNamespaceUsages. Err: %v", err)
+		return
+	}
+	for _, u := range existing.Items {
+		if _, hasVolumes := usage[u.GetNamespace()]; hasVolumes || u.GetName() != namespaceUsageName {
+			continue
+		}
+		klog.V(4).Infof("FullSync: deleting CnsNamespaceUsage of namespace %q without volumes", u.GetNamespace())
+		if err := usages.Namespace(u.GetNamespace()).Delete(namespaceUsageName, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("FullSync: failed to delete CnsNamespaceUsage in namespace %q. Err: %v", u.GetNamespace(), err)
+		}
+	}
+}
+
+// getStorageQuota returns the lowest requests.storage limit of the resource quotas
+// in namespace, or nil if the storage requests of the namespace are not limited
+func getStorageQuota(k8sclient clientset.Interface, namespace string) *resource.Quantity {
+	quotas, err := k8sclient.CoreV1().ResourceQuotas(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("FullSync: failed to list resource quotas in namespace %q. Err: %v", namespace, err)
+		return nil
+	}
+	var storageQuota *resource.Quantity
+	for _, quota := range quotas.Items {
+		hard, ok := quota.Spec.Hard[v1.ResourceRequestsStorage]
+		if ok && (storageQuota == nil || hard.Cmp(*storageQuota) < 0) {
+			storageQuota = &hard
+		}
+	}
+	return storageQuota
+}
+
+// buildNamespaceUsageStatus returns the status of a CnsNamespaceUsage for nsUsage
+func buildNamespaceUsageStatus(nsUsage *namespaceUsage, storageQuota *resource.Quantity, updateTime metav1.Time) map[string]interface{} {
+	var datastoreURLs []string
+	for datastoreURL := range nsUsage.datastores {
+		datastoreURLs = append(datastoreURLs, datastoreURL)
+	}
+	sort.Strings(datastoreURLs)
+	datastores := []interface{}{}
+	for _, datastoreURL := range datastoreURLs {
+		dsUsage := nsUsage.datastores[datastoreURL]
+		datastores = append(datastores, map[string]interface{}{
+			"datastoreUrl": datastoreURL,
+			"volumeCount":  dsUsage.volumeCount,
+			"usedCapacity": resource.NewQuantity(dsUsage.capacityBytes, resource.BinarySI).String(),
+		})
+	}
+	status := map[string]interface{}{
+		"volumeCount":    nsUsage.volumeCount,
+		"usedCapacity":   resource.NewQuantity(nsUsage.capacityBytes, resource.BinarySI).String(),
+		"datastores":     datastores,
+		"lastUpdateTime": updateTime.UTC().Format(time.RFC3339),
+	}
+	if storageQuota != nil {
+		status["storageQuota"] = storageQuota.String()
+	}
+	return status
+}
+
+// updateNamespaceUsage sets the status of the CnsNamespaceUsage in the namespace of usages,
+// creating it if it does not exist
+func updateNamespaceUsage(usages dynamic.ResourceInterface, status map[string]interface{}) error {
+	usage, err := usages.Get(namespaceUsageName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		usage = &unstructured.Unstructured{}
+		usage.SetAPIVersion(namespaceUsageGVR.GroupVersion().String())
+		usage.SetKind("CnsNamespaceUsage")
+		usage.SetName(namespaceUsageName)
+		usage.Object["status"] = status
+		_, err = usages.Create(usage, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	usage.Object["status"] = status
+	_, err = usages.Update(usage, metav1.UpdateOptions{})
+	return err
+}
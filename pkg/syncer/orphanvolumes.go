@@ -0,0 +1,239 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// Event reason used when a CNS volume of this cluster is found without a PV
+	orphanVolumeReason = "CnsOrphanVolume"
+
+	// Name of the CnsOrphanVolumeReport object updated by the syncer
+	orphanVolumeReportName = "orphan-volumes"
+)
+
+// orphanVolumeReportGVR identifies the cluster scoped CnsOrphanVolumeReport custom
+// resource, whose status lists the CNS volumes of this cluster without a PV
+var orphanVolumeReportGVR = schema.GroupVersionResource{
+	Group:    "cns.vmware.com",
+	Version:  "v1alpha1",
+	Resource: "cnsorphanvolumereports",
+}
+
+// orphanVolumesFirstDetected maps the IDs of the orphan volumes found by the
+// last full sync to the time they were first found
+var orphanVolumesFirstDetected = make(map[string]metav1.Time)
+
+// getVolumesWithoutPV returns the volumes in cnsVolumeList which have no PV in k8sPVMap
+func getVolumesWithoutPV(cnsVolumeList []cnstypes.CnsVolume, k8sPVMap map[string]string) []cnstypes.CnsVolume {
+	var volumesWithoutPV []cnstypes.CnsVolume
+	for _, vol := range cnsVolumeList {
+		if _, existsInK8s := k8sPVMap[vol.VolumeId.Id]; !existsInK8s {
+			volumesWithoutPV = append(volumesWithoutPV, vol)
+		}
+	}
+	return volumesWithoutPV
+}
+
+// identifyOrphanVolumes returns the volumes of volumesWithoutPV which never had a PV: their
+// metadata in cnsVolumeMetadata, by volume ID, has no PV entity. These are left behind by
+// failed provisioning. A volume which had a PV, e.g. a retained volume whose PV was deleted
+// while the syncer missed it, is not an orphan, its disk may hold data which is kept.
+// Volumes whose metadata is unknown are not orphans either.
+func identifyOrphanVolumes(volumesWithoutPV []cnstypes.CnsVolume, cnsVolumeMetadata map[string]cnstypes.CnsVolume) []cnstypes.CnsVolume {
+	var orphanVolumes []cnstypes.CnsVolume
+	for _, vol := range volumesWithoutPV {
+		volWithMetadata, ok := cnsVolumeMetadata[vol.VolumeId.Id]
+		if !ok {
+			klog.V(4).Infof("FullSync: metadata of volume %s without PV is unknown, it is not reported as orphan", vol.VolumeId.Id)
+			continue
+		}
+		if hadPersistentVolume(volWithMetadata) {
+			klog.V(4).Infof("FullSync: volume %s without PV had a PV, it is not reported as orphan", vol.VolumeId.Id)
+			continue
+		}
+		orphanVolumes = append(orphanVolumes, vol)
+	}
+	return orphanVolumes
+}
+
+// hadPersistentVolume returns true if the CNS metadata of vol has a PV entity
+func hadPersistentVolume(vol cnstypes.CnsVolume) bool {
+	for _, entity := range vol.Metadata.EntityMetadata {
+		if k8sEntity, ok := entity.(*cnstypes.CnsKubernetesEntityMetadata); ok &&
+			k8sEntity.EntityType == string(cnstypes.CnsKubernetesEntityTypePV) {
+			return true
+		}
+	}
+	return false
+}
+
+// getVolumeIds returns the IDs of volumes
+func getVolumeIds(volumes []cnstypes.CnsVolume) []cnstypes.CnsVolumeId {
+	var volumeIds []cnstypes.CnsVolumeId
+	for _, vol := range volumes {
+		volumeIds = append(volumeIds, vol.VolumeId)
+	}
+	return volumeIds
+}
+
+// reportOrphanVolumes reports the CNS volumes of this cluster without a PV, which may be
+// leaked storage, in the orphan volumes metric and the status of the CnsOrphanVolumeReport.
+// A warning event is raised on the report for each volume found for the first time.
+// Returns true if the CnsOrphanVolumeReport was updated.
+func reportOrphanVolumes(orphanVolumes []cnstypes.CnsVolume, metadataSyncer *MetadataSyncInformer) bool {
+	now := metav1.Now()
+	firstDetected := make(map[string]metav1.Time)
+	var newOrphanVolumes []cnstypes.CnsVolume
+	for _, vol := range orphanVolumes {
+		if detected, ok := orphanVolumesFirstDetected[vol.VolumeId.Id]; ok {
+			firstDetected[vol.VolumeId.Id] = detected
+			continue
+		}
+		klog.Warningf("FullSync: CNS volume %q with id %s on datastore %q has no PV", vol.Name, vol.VolumeId.Id, vol.DatastoreUrl)
+		firstDetected[vol.VolumeId.Id] = now
+		newOrphanVolumes = append(newOrphanVolumes, vol)
+	}
+	orphanVolumesFirstDetected = firstDetected
+	orphanVolumeCount.Set(float64(len(orphanVolumes)))
+
+	if metadataSyncer.dynamicClient == nil {
+		return false
+	}
+	report, err := updateOrphanVolumeReport(metadataSyncer.dynamicClient, orphanVolumes, firstDetected, now)
+	if err != nil {
+		klog.Errorf("FullSync: failed to update CnsOrphanVolumeReport %q. Err: %v", orphanVolumeReportName, err)
+		return false
+	}
+	for _, vol := range newOrphanVolumes {
+		msg := fmt.Sprintf("CNS volume %q with id %s on datastore %q has no PV", vol.Name, vol.VolumeId.Id, vol.DatastoreUrl)
+		metadataSyncer.eventRecorder.Event(report, v1.EventTypeWarning, orphanVolumeReason, msg)
+	}
+	return true
+}
+
+// updateOrphanVolumeReport sets the status of the CnsOrphanVolumeReport to orphanVolumes,
+// creating the report if it does not exist, and returns the updated report
+func updateOrphanVolumeReport(dynamicClient dynamic.Interface, orphanVolumes []cnstypes.CnsVolume,
+	firstDetected map[string]metav1.Time, checkTime metav1.Time) (*unstructured.Unstructured, error) {
+	entries := []interface{}{}
+	for _, vol := range orphanVolumes {
+		entries = append(entries, map[string]interface{}{
+			"volumeId":          vol.VolumeId.Id,
+			"name":              vol.Name,
+			"datastoreUrl":      vol.DatastoreUrl,
+			"capacityInMb":      vol.BackingObjectDetails.CapacityInMb,
+			"firstDetectedTime": firstDetected[vol.VolumeId.Id].UTC().Format(time.RFC3339),
+		})
+	}
+	status := map[string]interface{}{
+		"orphanVolumes": entries,
+		"lastCheckTime": checkTime.UTC().Format(time.RFC3339),
+	}
+
+	reports := dynamicClient.Resource(orphanVolumeReportGVR)
+	report, err := reports.Get(orphanVolumeReportName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		report = &unstructured.Unstructured{}
+		report.SetAPIVersion(orphanVolumeReportGVR.GroupVersion().String())
+		report.SetKind("CnsOrphanVolumeReport")
+		report.SetName(orphanVolumeReportName)
+		report.Object["status"] = status
+		return reports.Create(report, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Object["status"] = status
+	return reports.Update(report, metav1.UpdateOptions{})
+}
+
+// isOrphanVolumeCleanupConfigured returns true if orphan volumes are handled by cleanupOrphanVolumes,
+// which deletes them with their disks or, in dry-run mode, only logs them
+func (metadataSyncer *MetadataSyncInformer) isOrphanVolumeCleanupConfigured() bool {
+	return metadataSyncer.orphanVolumeCleanupAge > 0
+}
+
+// cleanupOrphanVolumes deletes the orphan volumes, including their disks, which were first
+// found at least orphanVolumeCleanupAge ago. Orphan volumes never had a PV, they are left
+// behind by failed provisioning. In dry-run mode these volumes are only logged.
+func cleanupOrphanVolumes(k8sclient clientset.Interface, orphanVolumes []cnstypes.CnsVolume, metadataSyncer *MetadataSyncInformer) {
+	if metadataSyncer.orphanVolumeCleanupAge <= 0 || len(orphanVolumes) == 0 {
+		return
+	}
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	// List PVs in all phases, a volume may have got a PV since full sync listed the PVs
+	pvList, err := k8sclient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("FullSync: cleanupOrphanVolumes failed to get PVs from kubernetes. Err: %v", err)
+		return
+	}
+	pvVolumes := make(map[string]bool)
+	for _, pv := range pvList.Items {
+		if pv.Spec.CSI != nil {
+			pvVolumes[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+	expired := getExpiredOrphanVolumes(orphanVolumes, pvVolumes, orphanVolumesFirstDetected,
+		metadataSyncer.orphanVolumeCleanupAge, time.Now())
+	for _, vol := range expired {
+		if metadataSyncer.orphanVolumeCleanupDryRun {
+			klog.Warningf("FullSync: dry run, not deleting orphan volume %q with id %s on datastore %q", vol.Name, vol.VolumeId.Id, vol.DatastoreUrl)
+			continue
+		}
+		klog.V(2).Infof("FullSync: deleting orphan volume %q with id %s on datastore %q", vol.Name, vol.VolumeId.Id, vol.DatastoreUrl)
+		if err := metadataSyncer.deleteVolume(vol.VolumeId.Id, true); err != nil {
+			klog.Errorf("FullSync: failed to delete orphan volume %s. Err: %v", vol.VolumeId.Id, err)
+			cnsFailures.WithLabelValues(cnsOperationDeleteVolume).Inc()
+			continue
+		}
+		orphanVolumesDeleted.Inc()
+		delete(orphanVolumesFirstDetected, vol.VolumeId.Id)
+	}
+}
+
+// getExpiredOrphanVolumes returns the orphan volumes without a PV in pvVolumes which
+// were first detected at least minAge before now
+func getExpiredOrphanVolumes(orphanVolumes []cnstypes.CnsVolume, pvVolumes map[string]bool,
+	firstDetected map[string]metav1.Time, minAge time.Duration, now time.Time) []cnstypes.CnsVolume {
+	var expired []cnstypes.CnsVolume
+	for _, vol := range orphanVolumes {
+		if pvVolumes[vol.VolumeId.Id] {
+			continue
+		}
+		detected, ok := firstDetected[vol.VolumeId.Id]
+		if !ok || now.Sub(detected.Time) < minAge {
+			continue
+		}
+		expired = append(expired, vol)
+	}
+	return expired
+}
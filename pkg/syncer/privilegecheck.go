@@ -0,0 +1,211 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/vim25/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+const (
+	// Event reason used when a required vCenter privilege is no longer granted
+	privilegeRevokedReason = "VSpherePrivilegeRevoked"
+)
+
+// missingPrivileges tracks the privileges found missing on the entities of each
+// vCenter host during the last privilege check
+var missingPrivileges = make(map[string]map[types.ManagedObjectReference][]string)
+
+// getPrivilegeCheckIntervalInMin returns the interval at which vCenter privileges are re-validated
+// If environment variable PRIVILEGE_CHECK_INTERVAL_MINUTES is set and valid,
+// return the interval value read from environment variable
+// otherwise, use the default value 10 minutes
+func getPrivilegeCheckIntervalInMin() int {
+	privilegeCheckIntervalInMin := defaultPrivilegeCheckIntervalInMin
+	if v := os.Getenv(envPrivilegeCheckIntervalMinutes); v != "" {
+		if value, err := strconv.Atoi(v); err == nil && value > 0 {
+			privilegeCheckIntervalInMin = value
+			klog.V(2).Infof("PrivilegeCheck: privilege check interval is set to %d minutes", privilegeCheckIntervalInMin)
+		} else {
+			klog.Warningf("PrivilegeCheck: %s %s is invalid, will use the default interval", envPrivilegeCheckIntervalMinutes, v)
+		}
+	}
+	return privilegeCheckIntervalInMin
+}
+
+// triggerPrivilegeCheck re-validates the privileges of the user of each vCenter on the
+// datastores hosting volumes of this cluster, on the node VMs and on the vCenter root folder.
+// A warning event is raised on the affected PVs and Nodes when a privilege is found
+// to be revoked since the previous check.
+func triggerPrivilegeCheck(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	klog.V(2).Infof("PrivilegeCheck: start")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cnsVolumes, err := queryAllVolumesInCluster(metadataSyncer)
+	if err != nil {
+		klog.Errorf("PrivilegeCheck: failed to query volumes, datastores are not checked. err: %v", err)
+	}
+	pvs, err := k8sclient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("PrivilegeCheck: failed to list PVs, datastores are not checked. err: %v", err)
+		cnsVolumes = nil
+	}
+	nodes, err := k8sclient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("PrivilegeCheck: failed to list nodes, node VMs are not checked. err: %v", err)
+		nodes = &v1.NodeList{}
+	}
+	nodeVMs := getNodeVMs(nodes.Items)
+	for _, vc := range metadataSyncer.getVirtualCenters() {
+		if err := vc.Connect(ctx); err != nil {
+			klog.Errorf("PrivilegeCheck: failed to connect to vCenter: %q. err: %v", vc.Config.Host, err)
+			continue
+		}
+		// Map entities to the k8s objects that depend on them
+		entityObjects := make(map[types.ManagedObjectReference][]runtime.Object)
+		var datastores []types.ManagedObjectReference
+		if len(cnsVolumes) > 0 {
+			datastores, err = getDatastoresInUse(ctx, vc, cnsVolumes, pvs.Items, entityObjects)
+			if err != nil {
+				klog.Errorf("PrivilegeCheck: failed to get datastores in use on vCenter %q. err: %v", vc.Config.Host, err)
+			}
+		}
+		var vms []types.ManagedObjectReference
+		for _, nodeVM := range nodeVMs[vc.Config.Host] {
+			vms = append(vms, nodeVM.vm)
+			entityObjects[nodeVM.vm] = append(entityObjects[nodeVM.vm], nodeVM.node)
+		}
+		check := vc.CheckPrivileges(ctx, datastores, vms)
+		reportRevokedPrivileges(metadataSyncer, vc, check.Missing, entityObjects)
+	}
+	klog.V(2).Infof("PrivilegeCheck: end")
+}
+
+// reportRevokedPrivileges raises a warning event on the objects of entityObjects which depend on
+// entities whose privileges in missing were granted on vc during the previous check
+func reportRevokedPrivileges(metadataSyncer *MetadataSyncInformer, vc *cnsvsphere.VirtualCenter,
+	missing map[types.ManagedObjectReference][]string, entityObjects map[types.ManagedObjectReference][]runtime.Object) {
+	previousMissing := missingPrivileges[vc.Config.Host]
+	for entity, privIds := range missing {
+		revoked := getNewlyMissingPrivileges(previousMissing[entity], privIds)
+		if len(revoked) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("vCenter user %q is missing privileges %s on %s %q of vCenter %q",
+			vc.Config.Username, strings.Join(revoked, ", "), entity.Type, entity.Value, vc.Config.Host)
+		klog.Errorf("PrivilegeCheck: %s", msg)
+		for _, obj := range entityObjects[entity] {
+			metadataSyncer.eventRecorder.Event(obj, v1.EventTypeWarning, privilegeRevokedReason, msg)
+		}
+	}
+	for entity := range previousMissing {
+		if _, stillMissing := missing[entity]; !stillMissing {
+			klog.V(2).Infof("PrivilegeCheck: all required privileges are granted again on %s %q of vCenter %q",
+				entity.Type, entity.Value, vc.Config.Host)
+		}
+	}
+	missingPrivileges[vc.Config.Host] = missing
+}
+
+// getNewlyMissingPrivileges returns privileges in current which are not in previous
+func getNewlyMissingPrivileges(previous []string, current []string) []string {
+	var newlyMissing []string
+	previousSet := make(map[string]bool)
+	for _, privID := range previous {
+		previousSet[privID] = true
+	}
+	for _, privID := range current {
+		if !previousSet[privID] {
+			newlyMissing = append(newlyMissing, privID)
+		}
+	}
+	return newlyMissing
+}
+
+// getDatastoresInUse returns the datastores of vc hosting cnsVolumes.
+// The PVs in pvs backed by volumes on each datastore are added to entityObjects.
+func getDatastoresInUse(ctx context.Context, vc *cnsvsphere.VirtualCenter, cnsVolumes []cnstypes.CnsVolume,
+	pvs []v1.PersistentVolume, entityObjects map[types.ManagedObjectReference][]runtime.Object) ([]types.ManagedObjectReference, error) {
+	volumeToDatastoreURL := make(map[string]string)
+	for _, vol := range cnsVolumes {
+		volumeToDatastoreURL[vol.VolumeId.Id] = vol.DatastoreUrl
+	}
+	datastoreURLToRef, err := vc.GetDatastoresByURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+			continue
+		}
+		if dsRef, ok := datastoreURLToRef[volumeToDatastoreURL[pv.Spec.CSI.VolumeHandle]]; ok {
+			entityObjects[dsRef] = append(entityObjects[dsRef], &pvs[i])
+		}
+	}
+	datastoresInUse := make(map[types.ManagedObjectReference]bool)
+	for _, dsURL := range volumeToDatastoreURL {
+		if dsRef, ok := datastoreURLToRef[dsURL]; ok {
+			datastoresInUse[dsRef] = true
+		}
+	}
+	var datastores []types.ManagedObjectReference
+	for dsRef := range datastoresInUse {
+		datastores = append(datastores, dsRef)
+	}
+	return datastores, nil
+}
+
+// nodeVM is the VM backing a kubernetes node
+type nodeVM struct {
+	node *v1.Node
+	vm   types.ManagedObjectReference
+}
+
+// getNodeVMs returns the VMs backing nodes by the host of their vCenter
+func getNodeVMs(nodes []v1.Node) map[string][]nodeVM {
+	nodeVMs := make(map[string][]nodeVM)
+	for i, node := range nodes {
+		nodeUUID := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+		if nodeUUID == "" {
+			klog.V(4).Infof("PrivilegeCheck: skipping node %q without providerID", node.Name)
+			continue
+		}
+		vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+		if err != nil {
+			klog.Warningf("PrivilegeCheck: failed to find VM for node %q with UUID %q. err: %v", node.Name, nodeUUID, err)
+			continue
+		}
+		nodeVMs[vm.VirtualCenterHost] = append(nodeVMs[vm.VirtualCenterHost], nodeVM{node: &nodes[i], vm: vm.Reference()})
+	}
+	return nodeVMs
+}
@@ -20,9 +20,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/vmware/govmomi/simulator"
 
 	cnstypes "github.com/vmware/govmomi/cns/types"
@@ -30,13 +35,21 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	clientset "k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
@@ -118,6 +131,8 @@ func TestSyncerWorkflows(t *testing.T) {
 		virtualcentermanager: virtualCenterManager,
 		vcenter:              virtualCenter,
 	}
+	metadataSyncer.metadataUpdates = newMetadataBatcher(config.Global.MetadataBatchSize, volumeManager.UpdateVolumesMetadata)
+	metadataSyncer.volumes = newVolumeCache(volumeCacheTTL, volumeManager.QueryVolume)
 
 	// Create the kubernetes client
 	// Here we should use a faked client to avoid test inteference with running
@@ -200,6 +215,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	newPv := getPersistentVolumeSpec(volumeID.Id, v1.PersistentVolumeReclaimRetain, newLabel, v1.VolumeAvailable, "")
 
 	pvUpdated(oldPv, newPv, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 
 	// Verify pv label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -227,6 +243,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	newPv = getPersistentVolumeSpec(volumeID.Id, v1.PersistentVolumeReclaimRetain, newLabel, v1.VolumeAvailable, "")
 
 	pvUpdated(oldPv, newPv, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 
 	// Verify pv label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -249,6 +266,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	oldPvc := getPersistentVolumeClaimSpec(testNamespace, nil, pv.Name)
 	newPvc := getPersistentVolumeClaimSpec(testNamespace, newPVCLabel, pv.Name)
 	pvcUpdated(oldPvc, newPvc, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 
 	// Verify pvc label of volume matches that of updated metadata
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -268,6 +286,7 @@ func runMetadataSyncerTest(t *testing.T) {
 	oldPod := getPodSpec(pvc.Name, v1.PodPending)
 	newPod := getPodSpec(pvc.Name, v1.PodRunning)
 	podUpdated(oldPod, newPod, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 
 	// Verify pod name associated with volume matches updated pod name
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
@@ -279,6 +298,7 @@ func runMetadataSyncerTest(t *testing.T) {
 
 	// Test podDeleted workflow on VC
 	podDeleted(newPod, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
 		t.Fatal(err)
 	}
@@ -288,6 +308,7 @@ func runMetadataSyncerTest(t *testing.T) {
 
 	// Test pvcDelete workflow
 	pvcDeleted(newPvc, metadataSyncer)
+	metadataSyncer.metadataUpdates.flush()
 	if queryResult, err = metadataSyncer.vcenter.CnsClient.QueryVolume(ctx, queryFilter); err != nil {
 		t.Fatal(err)
 	}
@@ -693,3 +714,573 @@ func getPodSpec(pvcName string, phase v1.PodPhase) *v1.Pod {
 	}
 	return pod
 }
+
+func TestGetNewlyMissingPrivileges(t *testing.T) {
+	previous := []string{"Datastore.FileManagement"}
+	current := []string{"Datastore.FileManagement", "VirtualMachine.Config.AddExistingDisk"}
+	revoked := getNewlyMissingPrivileges(previous, current)
+	if len(revoked) != 1 || revoked[0] != "VirtualMachine.Config.AddExistingDisk" {
+		t.Fatalf("Expected only VirtualMachine.Config.AddExistingDisk to be newly missing, got %v", revoked)
+	}
+	if revoked = getNewlyMissingPrivileges(current, previous); len(revoked) != 0 {
+		t.Fatalf("Expected no newly missing privileges, got %v", revoked)
+	}
+}
+
+func TestReportRevokedPrivileges(t *testing.T) {
+	missingPrivileges = make(map[string]map[vimtypes.ManagedObjectReference][]string)
+	recorder := record.NewFakeRecorder(10)
+	informer := &MetadataSyncInformer{eventRecorder: recorder}
+	vc1 := &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc-1", Username: "user"}}
+	vc2 := &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc-2", Username: "user"}}
+	// Entities of different vCenters may have the same reference
+	vm := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	entityObjects := map[vimtypes.ManagedObjectReference][]runtime.Object{vm: {node}}
+	missing := map[vimtypes.ManagedObjectReference][]string{vm: cnsvsphere.NodeVMPrivileges}
+
+	reportRevokedPrivileges(informer, vc1, missing, entityObjects)
+	reportRevokedPrivileges(informer, vc1, missing, entityObjects)
+	reportRevokedPrivileges(informer, vc2, missing, entityObjects)
+	// Revoked privileges are reported once per vCenter
+	if len(recorder.Events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(recorder.Events))
+	}
+}
+
+func TestMetadataBatcher(t *testing.T) {
+	var batches [][]cnstypes.CnsVolumeMetadataUpdateSpec
+	b := newMetadataBatcher(2, func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+		batches = append(batches, specs)
+		return nil
+	})
+	// A batch holds at most 2 updates, and at most one update of a volume
+	for i, volumeID := range []string{"vol-1", "vol-2", "vol-3", "vol-3", "vol-4"} {
+		b.add(getTestUpdateSpec(volumeID, fmt.Sprintf("pv-%d", i)))
+	}
+	b.flush()
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("Expected batches of 2, 2 and 1 updates, got %v", batches)
+	}
+	if batches[2][0].VolumeId.Id != "vol-3" || getTestEntityName(batches[2][0]) != "pv-3" {
+		t.Fatalf("Expected the second update of vol-3 to be sent last, got %v", batches[2])
+	}
+	// Nothing is pending after a flush
+	batches = nil
+	b.flush()
+	if len(batches) != 0 {
+		t.Fatalf("Expected no batches, got %v", batches)
+	}
+}
+
+func TestMetadataBatcherRetry(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	done := make(chan string, 2)
+	b := newMetadataBatcher(10, func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+		lock.Lock()
+		defer lock.Unlock()
+		results := make(map[string]error)
+		for _, spec := range specs {
+			attempts++
+			if attempts == 1 {
+				// The first update fails and is retried before the second one
+				results[spec.VolumeId.Id] = fmt.Errorf("update failed")
+				continue
+			}
+			done <- getTestEntityName(spec)
+		}
+		return results
+	})
+	failures := testutil.ToFloat64(cnsFailures.WithLabelValues(cnsOperationUpdateVolumeMetadata))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	b.add(getTestUpdateSpec("vol-1", "pv-0"))
+	b.add(getTestUpdateSpec("vol-1", "pv-1"))
+	go b.run(stopCh)
+	for _, expected := range []string{"pv-0", "pv-1"} {
+		select {
+		case entityName := <-done:
+			if entityName != expected {
+				t.Fatalf("Expected update of %s, got %s", expected, entityName)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for update of %s", expected)
+		}
+	}
+	if diff := testutil.ToFloat64(cnsFailures.WithLabelValues(cnsOperationUpdateVolumeMetadata)) - failures; diff != 1 {
+		t.Fatalf("Expected 1 failed UpdateVolumeMetadata to be counted, got %v", diff)
+	}
+}
+
+func TestMetadataBatcherDropped(t *testing.T) {
+	b := newMetadataBatcher(10, func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+		results := make(map[string]error)
+		for _, spec := range specs {
+			results[spec.VolumeId.Id] = fmt.Errorf("cns fault")
+		}
+		return results
+	})
+	dropped := make(chan error, 1)
+	b.dropped = func(volumeID string, err error) {
+		dropped <- err
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	b.add(getTestUpdateSpec("vol-1", "pv-0"))
+	go b.run(stopCh)
+	select {
+	case err := <-dropped:
+		if err == nil || err.Error() != "cns fault" {
+			t.Fatalf("Expected the CNS fault of the dropped update, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the update to be dropped")
+	}
+}
+
+func TestVolumeCache(t *testing.T) {
+	queries := 0
+	c := newVolumeCache(time.Hour, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		queries++
+		result := &cnstypes.CnsQueryResult{}
+		if queryFilter.VolumeIds[0].Id == "vol-1" {
+			result.Volumes = append(result.Volumes, cnstypes.CnsVolume{VolumeId: queryFilter.VolumeIds[0]})
+		}
+		return result, nil
+	})
+	// Volumes which are found and which are not found are both queried once
+	for i := 0; i < 3; i++ {
+		if volume, found, err := c.get("vol-1"); err != nil || !found || volume.VolumeId.Id != "vol-1" {
+			t.Fatalf("Expected volume vol-1 to be found, got %v, %t, %v", volume, found, err)
+		}
+		if _, found, err := c.get("vol-2"); err != nil || found {
+			t.Fatalf("Expected volume vol-2 not to be found, got %t, %v", found, err)
+		}
+	}
+	if queries != 2 {
+		t.Fatalf("Expected 2 queries, got %d", queries)
+	}
+	c.invalidate("vol-1")
+	if _, _, err := c.get("vol-1"); err != nil || queries != 3 {
+		t.Fatalf("Expected an invalidated volume to be queried again, got %d queries, err: %v", queries, err)
+	}
+	// Expired volumes are queried again
+	c.ttl = 0
+	c.invalidate("vol-1")
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.get("vol-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queries != 5 {
+		t.Fatalf("Expected volumes to be queried again once expired, got %d queries", queries)
+	}
+}
+
+func TestVolumeCacheConcurrentGets(t *testing.T) {
+	var queries int32
+	release := make(chan struct{})
+	c := newVolumeCache(time.Hour, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		atomic.AddInt32(&queries, 1)
+		if queryFilter.VolumeIds[0].Id == "vol-1" {
+			<-release
+		}
+		return &cnstypes.CnsQueryResult{Volumes: []cnstypes.CnsVolume{{VolumeId: queryFilter.VolumeIds[0]}}}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, found, err := c.get("vol-1"); err != nil || !found {
+				t.Errorf("Expected volume vol-1 to be found, got %t, %v", found, err)
+			}
+		}()
+	}
+	// Other volumes are not held up by a slow query
+	for atomic.LoadInt32(&queries) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, found, err := c.get("vol-2"); err != nil || !found {
+		t.Fatalf("Expected volume vol-2 to be found, got %t, %v", found, err)
+	}
+	close(release)
+	wg.Wait()
+	if _, _, err := c.get("vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if queries := atomic.LoadInt32(&queries); queries != 2 {
+		t.Fatalf("Expected one query of each volume, got %d queries", queries)
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	f, err := newLabelFilter("app, example.com/", "pod-template-hash, .*/revision$")
+	if err != nil {
+		t.Fatalf("Failed to create label filter. Err: %v", err)
+	}
+	labels := map[string]string{
+		"app":                  "db",
+		"application":          "db",
+		"example.com/tier":     "backend",
+		"example.com/revision": "42",
+		"pod-template-hash":    "6d4cf56db6",
+		"release":              "stable",
+	}
+	expected := map[string]string{
+		"app":              "db",
+		"application":      "db",
+		"example.com/tier": "backend",
+	}
+	if filtered := f.filter(labels); !reflect.DeepEqual(filtered, expected) {
+		t.Fatalf("Expected labels %v, got %v", expected, filtered)
+	}
+	// Without patterns all labels are synced
+	if f, err = newLabelFilter("", " "); err != nil || f != nil {
+		t.Fatalf("Expected no label filter, got %v with err %v", f, err)
+	}
+	if filtered := f.filter(labels); !reflect.DeepEqual(filtered, labels) {
+		t.Fatalf("Expected labels %v, got %v", labels, filtered)
+	}
+	if _, err = newLabelFilter("", "app("); err == nil {
+		t.Fatalf("Expected invalid label key pattern to fail")
+	}
+}
+
+func TestReportOrphanVolumes(t *testing.T) {
+	orphanVolumesFirstDetected = make(map[string]metav1.Time)
+	recorder := record.NewFakeRecorder(10)
+	informer := &MetadataSyncInformer{
+		dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		eventRecorder: recorder,
+	}
+	cnsVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}, Name: "pvc-1"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}, Name: "pvc-2"},
+	}
+	k8sPVMap := map[string]string{"vol-1": ""}
+	volumesWithoutPV := getVolumesWithoutPV(cnsVolumes, k8sPVMap)
+	metadata := map[string]cnstypes.CnsVolume{"vol-2": cnsVolumes[1]}
+	// vol-2 is reported once, with a single event
+	for i := 0; i < 2; i++ {
+		if !reportOrphanVolumes(identifyOrphanVolumes(volumesWithoutPV, metadata), informer) {
+			t.Fatalf("Expected orphan volumes to be reported")
+		}
+	}
+	report, err := informer.dynamicClient.Resource(orphanVolumeReportGVR).Get(orphanVolumeReportName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get orphan volume report. Err: %v", err)
+	}
+	orphanVolumes, _, _ := unstructured.NestedSlice(report.Object, "status", "orphanVolumes")
+	if len(orphanVolumes) != 1 || orphanVolumes[0].(map[string]interface{})["volumeId"] != "vol-2" {
+		t.Fatalf("Expected vol-2 to be reported as orphan volume, got %v", orphanVolumes)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(recorder.Events))
+	}
+	if count := testutil.ToFloat64(orphanVolumeCount); count != 1 {
+		t.Fatalf("Expected 1 orphan volume to be counted, got %v", count)
+	}
+}
+
+func TestIdentifyOrphanVolumes(t *testing.T) {
+	pvEntity := &cnstypes.CnsKubernetesEntityMetadata{
+		CnsEntityMetadata: cnstypes.CnsEntityMetadata{EntityName: "pv-retained"},
+		EntityType:        string(cnstypes.CnsKubernetesEntityTypePV),
+	}
+	pvcEntity := &cnstypes.CnsKubernetesEntityMetadata{
+		CnsEntityMetadata: cnstypes.CnsEntityMetadata{EntityName: "pvc-1"},
+		EntityType:        string(cnstypes.CnsKubernetesEntityTypePVC),
+	}
+	volumesWithoutPV := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-leaked"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-pvc"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-retained"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-unknown"}},
+	}
+	metadata := map[string]cnstypes.CnsVolume{
+		"vol-leaked": {VolumeId: cnstypes.CnsVolumeId{Id: "vol-leaked"}},
+		"vol-pvc": {
+			VolumeId: cnstypes.CnsVolumeId{Id: "vol-pvc"},
+			Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{pvcEntity}},
+		},
+		"vol-retained": {
+			VolumeId: cnstypes.CnsVolumeId{Id: "vol-retained"},
+			Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{pvEntity, pvcEntity}},
+		},
+	}
+	// Only the volumes which never had a PV are orphans, never the ones with unknown metadata
+	var orphanVolumeIds []string
+	for _, vol := range identifyOrphanVolumes(volumesWithoutPV, metadata) {
+		orphanVolumeIds = append(orphanVolumeIds, vol.VolumeId.Id)
+	}
+	if expected := []string{"vol-leaked", "vol-pvc"}; !reflect.DeepEqual(orphanVolumeIds, expected) {
+		t.Fatalf("Expected orphan volumes %v, got %v", expected, orphanVolumeIds)
+	}
+}
+
+func TestGetVolumesWhichHadPV(t *testing.T) {
+	pvEntity := &cnstypes.CnsKubernetesEntityMetadata{
+		CnsEntityMetadata: cnstypes.CnsEntityMetadata{EntityName: "pv-retained"},
+		EntityType:        string(cnstypes.CnsKubernetesEntityTypePV),
+	}
+	volumeIds := []cnstypes.CnsVolumeId{{Id: "vol-leaked"}, {Id: "vol-retained"}, {Id: "vol-unknown"}}
+	metadata := map[string]cnstypes.CnsVolume{
+		"vol-leaked": {VolumeId: cnstypes.CnsVolumeId{Id: "vol-leaked"}},
+		"vol-retained": {
+			VolumeId: cnstypes.CnsVolumeId{Id: "vol-retained"},
+			Metadata: cnstypes.CnsVolumeMetadata{EntityMetadata: []cnstypes.BaseCnsEntityMetadata{pvEntity}},
+		},
+	}
+	// Only vol-retained is still unregistered while orphan volumes are kept in CNS
+	expected := []cnstypes.CnsVolumeId{{Id: "vol-retained"}}
+	if volumesWhichHadPV := getVolumesWhichHadPV(volumeIds, metadata); !reflect.DeepEqual(volumesWhichHadPV, expected) {
+		t.Fatalf("Expected volumes %v, got %v", expected, volumesWhichHadPV)
+	}
+}
+
+func TestAddMigratedVolumes(t *testing.T) {
+	informer := &MetadataSyncInformer{
+		dynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+	}
+	migration := &unstructured.Unstructured{}
+	migration.SetAPIVersion(common.VolumeMigrationGVR.GroupVersion().String())
+	migration.SetKind("CnsVSphereVolumeMigration")
+	migration.SetName("vol-2")
+	migration.Object["spec"] = map[string]interface{}{
+		"volumePath": "[vsanDatastore] kubevols/pvc-2.vmdk",
+		"volumeID":   "vol-2",
+	}
+	if _, err := informer.dynamicClient.Resource(common.VolumeMigrationGVR).Create(migration, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cnsVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}, Name: "pvc-1"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}, Name: "pvc-2"},
+	}
+	k8sPVMap := map[string]string{"vol-1": updateVolumeOperation}
+	if err := addMigratedVolumes(k8sPVMap, informer); err != nil {
+		t.Fatal(err)
+	}
+	if volumesWithoutPV := getVolumesWithoutPV(cnsVolumes, k8sPVMap); len(volumesWithoutPV) != 0 {
+		t.Fatalf("Expected no volumes without PV, got %v", volumesWithoutPV)
+	}
+	if k8sPVMap["vol-1"] != updateVolumeOperation {
+		t.Fatalf("Expected the operation of vol-1 to be kept, got %q", k8sPVMap["vol-1"])
+	}
+}
+
+func TestGetExpiredOrphanVolumes(t *testing.T) {
+	now := time.Now()
+	orphanVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-old"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-new"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-pv"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-unknown"}},
+	}
+	firstDetected := map[string]metav1.Time{
+		"vol-old": metav1.NewTime(now.Add(-2 * time.Hour)),
+		"vol-new": metav1.NewTime(now.Add(-time.Minute)),
+		"vol-pv":  metav1.NewTime(now.Add(-2 * time.Hour)),
+	}
+	// vol-pv has a PV in a phase which full sync does not list, e.g. Failed
+	pvVolumes := map[string]bool{"vol-pv": true}
+	expired := getExpiredOrphanVolumes(orphanVolumes, pvVolumes, firstDetected, time.Hour, now)
+	if len(expired) != 1 || expired[0].VolumeId.Id != "vol-old" {
+		t.Fatalf("Expected only vol-old to be expired, got %v", expired)
+	}
+}
+
+func TestGetNamespaceUsage(t *testing.T) {
+	newPV := func(volumeID string, namespace string, capacity string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+				},
+				ClaimRef: &v1.ObjectReference{Namespace: namespace},
+			},
+		}
+	}
+	pvList := []*v1.PersistentVolume{
+		newPV("vol-1", "ns-1", "1Gi"),
+		newPV("vol-2", "ns-1", "2Gi"),
+		newPV("vol-3", "ns-2", "4Gi"),
+	}
+	cnsVolumeList := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}, DatastoreUrl: "ds:///vmfs/volumes/ds-1/"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}, DatastoreUrl: "ds:///vmfs/volumes/ds-2/"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-3"}, DatastoreUrl: "ds:///vmfs/volumes/ds-1/"},
+	}
+	usage := getNamespaceUsage(pvList, cnsVolumeList)
+	if len(usage) != 2 || usage["ns-1"].volumeCount != 2 || len(usage["ns-1"].datastores) != 2 {
+		t.Fatalf("Expected 2 volumes on 2 datastores in ns-1, got %+v", usage)
+	}
+	status := buildNamespaceUsageStatus(usage["ns-1"], nil, metav1.Now())
+	if status["usedCapacity"] != "3Gi" || len(status["datastores"].([]interface{})) != 2 {
+		t.Fatalf("Expected 3Gi used on 2 datastores in ns-1, got %v", status)
+	}
+	if _, ok := status["storageQuota"]; ok {
+		t.Fatalf("Expected no storage quota in ns-1, got %v", status["storageQuota"])
+	}
+}
+
+func TestGuestClusterMetadata(t *testing.T) {
+	newListers := func(objs ...interface{}) (corelisters.PersistentVolumeLister, corelisters.PersistentVolumeClaimLister) {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, obj := range objs {
+			if err := indexer.Add(obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return corelisters.NewPersistentVolumeLister(indexer), corelisters.NewPersistentVolumeClaimLister(indexer)
+	}
+	// The guest PVC is bound to a guest PV whose volume is the supervisor PVC "gc-uid-pvc-1"
+	guestPV := getPersistentVolumeSpec("gc-uid-pvc-1", v1.PersistentVolumeReclaimDelete, nil, v1.VolumeBound, "guest-pvc")
+	guestPVC := getPersistentVolumeClaimSpec("guest-ns", map[string]string{"app": "db"}, guestPV.Name)
+	guestPVC.UID = "guest-pvc-uid"
+	supervisorPV := getPersistentVolumeSpec("vol-1", v1.PersistentVolumeReclaimDelete, nil, v1.VolumeBound, "gc-uid-pvc-1")
+	supervisorPVC := getPersistentVolumeClaimSpec("supervisor-ns", nil, supervisorPV.Name)
+	supervisorPVC.Name = "gc-uid-pvc-1"
+
+	supervisorClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	guest := &guestMetadataSyncer{
+		volumeMetadatas: supervisorClient.Resource(common.VolumeMetadataGVR).Namespace("supervisor-ns"),
+		clusterID:       "gc-uid",
+	}
+	guest.pvLister, guest.pvcLister = newListers(guestPV, guestPVC)
+	guest.pvcUpdated(guestPVC)
+	volumeMetadata, err := guest.volumeMetadatas.Get(string(guestPVC.UID), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updates []cnstypes.CnsVolumeMetadataUpdateSpec
+	supervisor := &MetadataSyncInformer{
+		cfg: &cnsconfig.Config{
+			VirtualCenter: map[string]*cnsconfig.VirtualCenterConfig{"vc": {User: "admin"}},
+		},
+		vcenter: &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc"}},
+		metadataUpdates: newMetadataBatcher(10, func(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+			updates = append(updates, specs...)
+			return nil
+		}),
+	}
+	supervisor.pvLister, supervisor.pvcLister = newListers(supervisorPV, supervisorPVC)
+	clusters := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, uid := range []string{"gc-uid", "gc-other"} {
+		cluster := &unstructured.Unstructured{}
+		cluster.SetNamespace("supervisor-ns")
+		cluster.SetName(uid)
+		cluster.SetUID(types.UID(uid))
+		if err := clusters.Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	supervisor.tanzuKubernetesClusterLister = cache.NewGenericLister(clusters, tanzuKubernetesClusterGVR.GroupResource())
+
+	// A guest cluster can not file metadata of the volumes of another guest cluster
+	spoofed := volumeMetadata.DeepCopy()
+	if err := unstructured.SetNestedField(spoofed.Object, "gc-other", "spec", "guestclusterid"); err != nil {
+		t.Fatal(err)
+	}
+	volumeMetadataUpdated(spoofed, false, supervisor)
+	supervisor.metadataUpdates.flush()
+	if len(updates) != 0 {
+		t.Fatalf("Expected no update for a CnsVolumeMetadata of another guest cluster, got %v", updates)
+	}
+
+	volumeMetadataUpdated(volumeMetadata, false, supervisor)
+	supervisor.metadataUpdates.flush()
+	if len(updates) != 1 || updates[0].VolumeId.Id != "vol-1" || updates[0].Metadata.ContainerCluster.ClusterId != "gc-uid" {
+		t.Fatalf("Expected an update of vol-1 for guest cluster gc-uid, got %v", updates)
+	}
+	entityMetadata := updates[0].Metadata.EntityMetadata[0].(*cnstypes.CnsKubernetesEntityMetadata)
+	if entityMetadata.EntityName != guestPVC.Name || entityMetadata.Namespace != "guest-ns" || len(entityMetadata.Labels) != 1 {
+		t.Fatalf("Expected the metadata of the guest PVC, got %+v", entityMetadata)
+	}
+
+	guest.deleted(guestPVC)
+	if _, err := guest.volumeMetadatas.Get(string(guestPVC.UID), metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected the CnsVolumeMetadata of the deleted PVC to be deleted")
+	}
+}
+
+func TestUpdateVolumeHealth(t *testing.T) {
+	pv := getPersistentVolumeSpec("vol-1", v1.PersistentVolumeReclaimDelete, nil, v1.VolumeBound, testPVCName)
+	pv.Spec.ClaimRef.Namespace = testNamespace
+	pvc := getPersistentVolumeClaimSpec(testNamespace, nil, pv.Name)
+	k8sclient := testclient.NewSimpleClientset(pvc)
+	recorder := record.NewFakeRecorder(10)
+	getHealth := func() string {
+		pvc, err := k8sclient.CoreV1().PersistentVolumeClaims(testNamespace).Get(testPVCName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pvc.Annotations[volumeHealthAnnotation]
+	}
+
+	// An accessible volume is annotated without an event
+	updateVolumeHealth(k8sclient, recorder, []*v1.PersistentVolume{pv}, map[string]string{"vol-1": volumeHealthAccessible})
+	if health := getHealth(); health != volumeHealthAccessible || len(recorder.Events) != 0 {
+		t.Fatalf("Expected the PVC to be annotated as accessible without events, got %q and %d events", health, len(recorder.Events))
+	}
+	// Transitions raise an event once
+	for i := 0; i < 2; i++ {
+		updateVolumeHealth(k8sclient, recorder, []*v1.PersistentVolume{pv}, map[string]string{"vol-1": volumeHealthInaccessible})
+	}
+	if health := getHealth(); health != volumeHealthInaccessible || len(recorder.Events) != 1 {
+		t.Fatalf("Expected the PVC to be annotated as inaccessible with 1 event, got %q and %d events", health, len(recorder.Events))
+	}
+	updateVolumeHealth(k8sclient, recorder, []*v1.PersistentVolume{pv}, map[string]string{"vol-1": volumeHealthAccessible})
+	if health := getHealth(); health != volumeHealthAccessible || len(recorder.Events) != 2 {
+		t.Fatalf("Expected the PVC to be annotated as accessible again with 2 events, got %q and %d events", health, len(recorder.Events))
+	}
+	// Volumes of unknown health are left alone
+	updateVolumeHealth(k8sclient, recorder, []*v1.PersistentVolume{pv}, map[string]string{})
+	if health := getHealth(); health != volumeHealthAccessible {
+		t.Fatalf("Expected the health of the PVC to be kept, got %q", health)
+	}
+}
+
+// getTestUpdateSpec returns an update spec of the PV entityName for volumeID
+func getTestUpdateSpec(volumeID string, entityName string) cnstypes.CnsVolumeMetadataUpdateSpec {
+	return cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: cnstypes.CnsVolumeId{Id: volumeID},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			EntityMetadata: []cnstypes.BaseCnsEntityMetadata{
+				cnsvsphere.GetCnsKubernetesEntityMetaData(entityName, nil, false, string(cnstypes.CnsKubernetesEntityTypePV), ""),
+			},
+		},
+	}
+}
+
+// getTestEntityName returns the entity name of a spec returned by getTestUpdateSpec
+func getTestEntityName(spec cnstypes.CnsVolumeMetadataUpdateSpec) string {
+	return spec.Metadata.EntityMetadata[0].GetCnsEntityMetadata().EntityName
+}
+
+func TestVolumeLocks(t *testing.T) {
+	var locks volumeLocks
+	unlockMetadataUpdate := locks.lockVolumes("vol-1", "vol-2")
+	// Other volumes are not blocked
+	locks.lockVolumes("vol-3")()
+	deleted := make(chan struct{})
+	go func() {
+		defer locks.lockVolumes("vol-2")()
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("Expected vol-2 not to be deleted while its metadata is updated")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlockMetadataUpdate()
+	select {
+	case <-deleted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected vol-2 to be deleted once its metadata is updated")
+	}
+}
@@ -18,9 +18,13 @@ package syncer
 
 import (
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
@@ -43,6 +47,34 @@ const (
 
 	// Env variable for FullSync interval
 	envFullSyncIntervalMinutes = "FULL_SYNC_INTERVAL_MINUTES"
+
+	// default interval for re-validating vCenter privileges
+	defaultPrivilegeCheckIntervalInMin = 10
+
+	// Env variable for privilege check interval
+	envPrivilegeCheckIntervalMinutes = "PRIVILEGE_CHECK_INTERVAL_MINUTES"
+
+	// default interval for checking the health of volumes
+	defaultVolumeHealthIntervalInMin = 5
+
+	// Env variable for volume health check interval
+	envVolumeHealthIntervalMinutes = "VOLUME_HEALTH_INTERVAL_MINUTES"
+
+	// Time for which the CNS volumes queried by the informer handlers are cached
+	volumeCacheTTL = 10 * time.Second
+
+	// Number of times a failed metadata update of a volume is retried before
+	// it is left to full sync
+	maxMetadataUpdateRetries = 5
+
+	// Event reason used when a metadata update of a volume is dropped after maxMetadataUpdateRetries
+	metadataUpdateFailedReason = "CnsMetadataUpdateFailed"
+
+	// Component name used when recording events from metadata syncer
+	syncerComponentName = "vsphere-csi-syncer"
+
+	// CNS query selection of the datastore URL of volumes, not defined by the vendored govmomi
+	querySelectionNameDatastoreURL = "DATASTORE_URL"
 )
 
 var (
@@ -91,4 +123,21 @@ type MetadataSyncInformer struct {
 	vcenter              *cnsvsphere.VirtualCenter
 	pvLister             corelisters.PersistentVolumeLister
 	pvcLister            corelisters.PersistentVolumeClaimLister
+	eventRecorder        record.EventRecorder
+	dynamicClient        dynamic.Interface
+	metadataUpdates      *metadataBatcher
+	volumes              *volumeCache
+	fullSyncInterval     time.Duration
+	labelFilter          *labelFilter
+	// Minimum age of orphan volumes deleted by cleanupOrphanVolumes, 0 if disabled
+	orphanVolumeCleanupAge    time.Duration
+	orphanVolumeCleanupDryRun bool
+	// All vCenters of the cluster ordered by host, vcenter is the first one
+	vcenters []*cnsvsphere.VirtualCenter
+	// Maps the IDs of volumes to the vCenter whose CNS has the volume
+	volumeHosts sync.Map
+	// Serializes the metadata updates and deletions of each volume
+	volumeLocks volumeLocks
+	// Lists the TanzuKubernetesClusters of supervisor namespaces, set with enable-guest-cluster-metadata
+	tanzuKubernetesClusterLister cache.GenericLister
 }
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// getVirtualCenters returns the vCenters of the cluster, ordered by host
+func (metadataSyncer *MetadataSyncInformer) getVirtualCenters() []*cnsvsphere.VirtualCenter {
+	if len(metadataSyncer.vcenters) == 0 {
+		return []*cnsvsphere.VirtualCenter{metadataSyncer.vcenter}
+	}
+	return metadataSyncer.vcenters
+}
+
+// getContainerCluster returns the container cluster clusterID with the user of the vCenter vc
+func (metadataSyncer *MetadataSyncInformer) getContainerCluster(clusterID string, vc *cnsvsphere.VirtualCenter) cnstypes.CnsContainerCluster {
+	return cnsvsphere.GetContainerCluster(clusterID, metadataSyncer.cfg.VirtualCenter[vc.Config.Host].User)
+}
+
+// queryVolume queries the volumes of queryFilter on all vCenters
+// The vCenter of each volume found is recorded for getVolumeVirtualCenter
+func (metadataSyncer *MetadataSyncInformer) queryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+	result := &cnstypes.CnsQueryResult{}
+	for _, vc := range metadataSyncer.getVirtualCenters() {
+		queryResult, err := volumes.GetManager(vc).QueryVolume(queryFilter)
+		if err != nil {
+			klog.Errorf("QueryVolume failed on vCenter %q. Err: %v", vc.Config.Host, err)
+			return nil, err
+		}
+		for _, vol := range queryResult.Volumes {
+			metadataSyncer.volumeHosts.Store(vol.VolumeId.Id, vc)
+		}
+		result.Volumes = append(result.Volumes, queryResult.Volumes...)
+	}
+	return result, nil
+}
+
+// getVolumeVirtualCenter returns the vCenter whose CNS has the volume volumeID, or the
+// first vCenter if no vCenter has the volume. With a single vCenter, no query is made.
+func (metadataSyncer *MetadataSyncInformer) getVolumeVirtualCenter(volumeID string) (*cnsvsphere.VirtualCenter, error) {
+	vcenters := metadataSyncer.getVirtualCenters()
+	if len(vcenters) == 1 {
+		return vcenters[0], nil
+	}
+	if vc, ok := metadataSyncer.volumeHosts.Load(volumeID); ok {
+		return vc.(*cnsvsphere.VirtualCenter), nil
+	}
+	if _, err := metadataSyncer.queryVolume(cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+	}); err != nil {
+		return nil, err
+	}
+	if vc, ok := metadataSyncer.volumeHosts.Load(volumeID); ok {
+		return vc.(*cnsvsphere.VirtualCenter), nil
+	}
+	return vcenters[0], nil
+}
+
+// createVolume registers the disk of createSpec as a CNS volume on the vCenter which has
+// the disk. The vCenters are tried in order, CNS fails to register disks it does not know.
+func (metadataSyncer *MetadataSyncInformer) createVolume(createSpec *cnstypes.CnsVolumeCreateSpec) error {
+	volumeID := createSpec.BackingObjectDetails.(*cnstypes.CnsBlockBackingDetails).BackingDiskId
+	var err error
+	for _, vc := range metadataSyncer.getVirtualCenters() {
+		spec := *createSpec
+		spec.Metadata.ContainerCluster = metadataSyncer.getContainerCluster(createSpec.Metadata.ContainerCluster.ClusterId, vc)
+		if _, err = volumes.GetManager(vc).CreateVolume(&spec); err == nil {
+			metadataSyncer.volumeHosts.Store(volumeID, vc)
+			return nil
+		}
+		klog.V(4).Infof("Failed to register disk %s on vCenter %q. Err: %v", volumeID, vc.Config.Host, err)
+	}
+	return err
+}
+
+// deleteVolume deletes the volume volumeID from the CNS of its vCenter, once no metadata
+// update of the volume is in progress
+func (metadataSyncer *MetadataSyncInformer) deleteVolume(volumeID string, deleteDisk bool) error {
+	unlock := metadataSyncer.volumeLocks.lockVolumes(volumeID)
+	defer unlock()
+	vc, err := metadataSyncer.getVolumeVirtualCenter(volumeID)
+	if err != nil {
+		return err
+	}
+	if err := volumes.GetManager(vc).DeleteVolume(volumeID, deleteDisk); err != nil {
+		return err
+	}
+	metadataSyncer.volumeHosts.Delete(volumeID)
+	return nil
+}
+
+// updateVolumesMetadata sends each metadata update in specs to the vCenter of its volume,
+// with the user of that vCenter, and returns the errors of the failed updates by volume ID.
+// The volumes are not deleted by deleteVolume until the updates are done.
+func (metadataSyncer *MetadataSyncInformer) updateVolumesMetadata(specs []cnstypes.CnsVolumeMetadataUpdateSpec) map[string]error {
+	var volumeIDs []string
+	for _, spec := range specs {
+		volumeIDs = append(volumeIDs, spec.VolumeId.Id)
+	}
+	unlock := metadataSyncer.volumeLocks.lockVolumes(volumeIDs...)
+	defer unlock()
+	results := make(map[string]error)
+	var vcenters []*cnsvsphere.VirtualCenter
+	specsByVC := make(map[*cnsvsphere.VirtualCenter][]cnstypes.CnsVolumeMetadataUpdateSpec)
+	for _, spec := range specs {
+		vc, err := metadataSyncer.getVolumeVirtualCenter(spec.VolumeId.Id)
+		if err != nil {
+			results[spec.VolumeId.Id] = err
+			continue
+		}
+		if _, ok := specsByVC[vc]; !ok {
+			vcenters = append(vcenters, vc)
+		}
+		spec.Metadata.ContainerCluster = metadataSyncer.getContainerCluster(spec.Metadata.ContainerCluster.ClusterId, vc)
+		specsByVC[vc] = append(specsByVC[vc], spec)
+	}
+	for _, vc := range vcenters {
+		for volumeID, err := range volumes.GetManager(vc).UpdateVolumesMetadata(specsByVC[vc]) {
+			results[volumeID] = err
+		}
+	}
+	return results
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/singleflight"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/klog"
+)
+
+// volumeCache caches the CNS volumes queried by the informer handlers for a short time,
+// so that the events of a PV in quick succession query CNS only once. Volumes which are
+// not found are cached as well. The volumes changed by the syncer are invalidated.
+// The lock is not held while CNS is queried, concurrent gets of the same volume share
+// a single query.
+type volumeCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]volumeCacheEntry
+	query   func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
+	queries singleflight.Group
+	// invalidations counts the calls of invalidate, the result of a query is not cached
+	// if volumes were invalidated while it ran
+	invalidations uint64
+}
+
+// volumeCacheEntry is a cached CNS volume, or a volume which is not found if found is false
+type volumeCacheEntry struct {
+	volume  cnstypes.CnsVolume
+	found   bool
+	expires time.Time
+}
+
+// newVolumeCache returns a volumeCache which caches the volumes returned by query for ttl
+func newVolumeCache(ttl time.Duration, query func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)) *volumeCache {
+	return &volumeCache{
+		ttl:     ttl,
+		entries: make(map[string]volumeCacheEntry),
+		query:   query,
+	}
+}
+
+// get returns the CNS volume volumeID and true, or false if the volume is not found in CNS
+func (c *volumeCache) get(volumeID string) (cnstypes.CnsVolume, bool, error) {
+	c.lock.Lock()
+	now := time.Now()
+	if entry, ok := c.entries[volumeID]; ok && now.Before(entry.expires) {
+		c.lock.Unlock()
+		klog.V(4).Infof("Using cached CNS volume %s, found: %t", volumeID, entry.found)
+		return entry.volume, entry.found, nil
+	}
+	// Expired entries are removed here rather than by a timer, as only few volumes
+	// are queried outside of full sync
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	c.lock.Unlock()
+	result, err := c.queries.Do(volumeID, func() (interface{}, error) {
+		c.lock.Lock()
+		invalidations := c.invalidations
+		c.lock.Unlock()
+		queryResult, err := c.query(cnstypes.CnsQueryFilter{
+			VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
+		})
+		if err != nil {
+			cnsFailures.WithLabelValues(cnsOperationQueryVolume).Inc()
+			return nil, err
+		}
+		entry := volumeCacheEntry{expires: time.Now().Add(c.ttl)}
+		if len(queryResult.Volumes) > 0 {
+			entry.volume = queryResult.Volumes[0]
+			entry.found = true
+		}
+		c.lock.Lock()
+		if invalidations == c.invalidations {
+			c.entries[volumeID] = entry
+		}
+		c.lock.Unlock()
+		return entry, nil
+	})
+	if err != nil {
+		return cnstypes.CnsVolume{}, false, err
+	}
+	entry := result.(volumeCacheEntry)
+	return entry.volume, entry.found, nil
+}
+
+// invalidate removes the cached volumes volumeIDs, which are changed in CNS
+func (c *volumeCache) invalidate(volumeIDs ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.invalidations++
+	for _, volumeID := range volumeIDs {
+		delete(c.entries, volumeID)
+	}
+}
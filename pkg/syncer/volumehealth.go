@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	// volumeHealthAnnotation is the PVC annotation with the health of its volume,
+	// volumeHealthAccessible or volumeHealthInaccessible
+	volumeHealthAnnotation   = "volumehealth.storage.kubernetes.io/health"
+	volumeHealthAccessible   = "accessible"
+	volumeHealthInaccessible = "inaccessible"
+
+	// Event reasons used when the health of a volume changes
+	volumeInaccessibleReason = "VolumeInaccessible"
+	volumeAccessibleReason   = "VolumeAccessible"
+
+	// Datastore accessibility status of a CNS volume whose datastore is accessible
+	cnsDatastoreAccessible = "accessible"
+	// Datastore accessibility status of a CNS volume whose datastore is not accessible
+	cnsDatastoreNotAccessible = "notAccessible"
+)
+
+// getVolumeHealthIntervalInMin returns the interval at which the health of volumes is checked
+// If environment variable VOLUME_HEALTH_INTERVAL_MINUTES is set and valid,
+// return the interval value read from environment variable
+// otherwise, use the default value 5 minutes
+func getVolumeHealthIntervalInMin() int {
+	volumeHealthIntervalInMin := defaultVolumeHealthIntervalInMin
+	if v := os.Getenv(envVolumeHealthIntervalMinutes); v != "" {
+		if value, err := strconv.Atoi(v); err == nil && value > 0 {
+			volumeHealthIntervalInMin = value
+			klog.V(2).Infof("VolumeHealth: volume health interval is set to %d minutes", volumeHealthIntervalInMin)
+		} else {
+			klog.Warningf("VolumeHealth: %s %s is invalid, will use the default interval", envVolumeHealthIntervalMinutes, v)
+		}
+	}
+	return volumeHealthIntervalInMin
+}
+
+// triggerVolumeHealthCheck reads the datastore accessibility of the volumes of this cluster
+// from CNS and records it in the volumeHealthAnnotation of their PVCs
+func triggerVolumeHealthCheck(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	klog.V(2).Infof("VolumeHealth: start")
+	cnsVolumes, err := queryAllVolumesInClusterWithSelection(metadataSyncer,
+		string(cnstypes.QuerySelectionNameTypeDataStoreAccessibility))
+	if err != nil {
+		klog.Warningf("VolumeHealth: failed to query volumes with err %v", err)
+		return
+	}
+	volumeHealth := make(map[string]string)
+	for _, vol := range cnsVolumes {
+		switch vol.DatastoreAccessibilityStatus {
+		case cnsDatastoreAccessible:
+			volumeHealth[vol.VolumeId.Id] = volumeHealthAccessible
+		case cnsDatastoreNotAccessible:
+			volumeHealth[vol.VolumeId.Id] = volumeHealthInaccessible
+		}
+	}
+	pvs, err := getPVsInBoundAvailableOrReleased(k8sclient)
+	if err != nil {
+		klog.Warningf("VolumeHealth: Failed to get PVs from kubernetes. Err: %v", err)
+		return
+	}
+	updateVolumeHealth(k8sclient, metadataSyncer.eventRecorder, pvs, volumeHealth)
+	klog.V(2).Infof("VolumeHealth: end")
+}
+
+// updateVolumeHealth sets the volumeHealthAnnotation of the PVCs of pvs to the health of their
+// volumes in volumeHealth, and raises an event on each PVC whose volume became inaccessible or
+// accessible again. Volumes of unknown health are skipped.
+func updateVolumeHealth(k8sclient clientset.Interface, recorder record.EventRecorder, pvs []*v1.PersistentVolume, volumeHealth map[string]string) {
+	for _, pv := range pvs {
+		health, ok := volumeHealth[pv.Spec.CSI.VolumeHandle]
+		if !ok || pv.Spec.ClaimRef == nil || pv.Status.Phase != v1.VolumeBound {
+			continue
+		}
+		pvcs := k8sclient.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace)
+		pvc, err := pvcs.Get(pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("VolumeHealth: failed to get PVC %s/%s. Err: %v", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, err)
+			continue
+		}
+		oldHealth := pvc.Annotations[volumeHealthAnnotation]
+		if oldHealth == health {
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{volumeHealthAnnotation: health},
+			},
+		})
+		if err != nil {
+			klog.Errorf("VolumeHealth: failed to build the patch of PVC %s/%s. Err: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		if _, err := pvcs.Patch(pvc.Name, types.MergePatchType, patch); err != nil {
+			klog.Errorf("VolumeHealth: failed to update the health of PVC %s/%s. Err: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		klog.V(2).Infof("VolumeHealth: volume %s of PVC %s/%s is %s", pv.Spec.CSI.VolumeHandle, pvc.Namespace, pvc.Name, health)
+		if health == volumeHealthInaccessible {
+			recorder.Event(pvc, v1.EventTypeWarning, volumeInaccessibleReason,
+				fmt.Sprintf("Volume %s is inaccessible, the datastore of the volume is not accessible", pv.Spec.CSI.VolumeHandle))
+		} else if oldHealth == volumeHealthInaccessible {
+			recorder.Event(pvc, v1.EventTypeNormal, volumeAccessibleReason,
+				fmt.Sprintf("Volume %s is accessible again", pv.Spec.CSI.VolumeHandle))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync"
+)
+
+// volumeLocks serializes the CNS operations of the syncer on each volume, so that a
+// volume is never deleted while its metadata is being updated. The zero value is ready
+// to use.
+type volumeLocks struct {
+	lock sync.Mutex
+	// locked maps the IDs of the locked volumes to a channel closed when they are unlocked
+	locked map[string]chan struct{}
+}
+
+// lockVolumes waits until none of volumeIDs is locked and locks them all at once, which
+// can not deadlock with other callers locking several volumes. It returns the function
+// which unlocks them.
+func (l *volumeLocks) lockVolumes(volumeIDs ...string) func() {
+	for {
+		l.lock.Lock()
+		var unlocked chan struct{}
+		for _, volumeID := range volumeIDs {
+			if ch, ok := l.locked[volumeID]; ok {
+				unlocked = ch
+				break
+			}
+		}
+		if unlocked == nil {
+			break
+		}
+		l.lock.Unlock()
+		<-unlocked
+	}
+	defer l.lock.Unlock()
+	if l.locked == nil {
+		l.locked = make(map[string]chan struct{})
+	}
+	unlocked := make(chan struct{})
+	for _, volumeID := range volumeIDs {
+		l.locked[volumeID] = unlocked
+	}
+	return func() {
+		l.lock.Lock()
+		for _, volumeID := range volumeIDs {
+			delete(l.locked, volumeID)
+		}
+		l.lock.Unlock()
+		close(unlocked)
+	}
+}
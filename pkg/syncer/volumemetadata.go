@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"strings"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// tanzuKubernetesClusterGVR identifies the TanzuKubernetesCluster custom resource of the
+// guest clusters in a supervisor namespace
+var tanzuKubernetesClusterGVR = schema.GroupVersionResource{
+	Group:    "run.tanzu.vmware.com",
+	Version:  "v1alpha1",
+	Resource: "tanzukubernetesclusters",
+}
+
+// watchVolumeMetadata sends the metadata of guest cluster objects in the CnsVolumeMetadatas of
+// all supervisor namespaces to CNS, until stopCh is closed
+func (metadataSyncer *MetadataSyncInformer) watchVolumeMetadata(stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(metadataSyncer.dynamicClient, 0)
+	// The guest clusters are known before the first CnsVolumeMetadata is handled
+	clusters := factory.ForResource(tanzuKubernetesClusterGVR)
+	clusters.Informer()
+	metadataSyncer.tanzuKubernetesClusterLister = clusters.Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	informer := factory.ForResource(common.VolumeMetadataGVR).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			volumeMetadataUpdated(obj, false, metadataSyncer)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			volumeMetadataUpdated(newObj, false, metadataSyncer)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			volumeMetadataUpdated(obj, true, metadataSyncer)
+		},
+	})
+	factory.Start(stopCh)
+}
+
+// getGuestClusterID returns the UID of the TanzuKubernetesCluster in namespace which owns the
+// supervisor PVC pvcName. The paravirtual CSI driver of a guest cluster prefixes the names of
+// the PVCs it creates with the UID of its TanzuKubernetesCluster.
+func (metadataSyncer *MetadataSyncInformer) getGuestClusterID(namespace string, pvcName string) (string, error) {
+	clusters, err := metadataSyncer.tanzuKubernetesClusterLister.ByNamespace(namespace).List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+	for _, cluster := range clusters {
+		clusterID := string(cluster.(*unstructured.Unstructured).GetUID())
+		if strings.HasPrefix(pvcName, clusterID+"-") {
+			return clusterID, nil
+		}
+	}
+	return "", fmt.Errorf("no TanzuKubernetesCluster in namespace %q owns PVC %q", namespace, pvcName)
+}
+
+// volumeMetadataUpdated queues an update of the volumes of a CnsVolumeMetadata with the
+// metadata of its guest object, or with its deletion if deleted is true. The metadata is
+// kept in CNS under the container cluster of the guest cluster which owns the volume.
+// The guest cluster ID of the resource, which any guest cluster of the namespace can set,
+// must match that cluster.
+func volumeMetadataUpdated(obj interface{}, deleted bool, metadataSyncer *MetadataSyncInformer) {
+	volumeMetadata, ok := obj.(*unstructured.Unstructured)
+	if volumeMetadata == nil || !ok {
+		klog.Warningf("VolumeMetadataUpdated: unrecognized object %+v", obj)
+		return
+	}
+	volumeNames, _, _ := unstructured.NestedStringSlice(volumeMetadata.Object, "spec", "volumenames")
+	guestClusterID, _, _ := unstructured.NestedString(volumeMetadata.Object, "spec", "guestclusterid")
+	entityType, _, _ := unstructured.NestedString(volumeMetadata.Object, "spec", "entitytype")
+	entityName, _, _ := unstructured.NestedString(volumeMetadata.Object, "spec", "entityname")
+	namespace, _, _ := unstructured.NestedString(volumeMetadata.Object, "spec", "namespace")
+	var labels map[string]string
+	if !deleted {
+		labels, _, _ = unstructured.NestedStringMap(volumeMetadata.Object, "spec", "labels")
+	}
+	for _, volumeName := range volumeNames {
+		// The volumes of guest clusters are the PVCs in their supervisor namespaces
+		pvc, err := metadataSyncer.pvcLister.PersistentVolumeClaims(volumeMetadata.GetNamespace()).Get(volumeName)
+		if err != nil || pvc.Spec.VolumeName == "" {
+			klog.Errorf("VolumeMetadataUpdated: Error getting bound PVC %s/%s of CnsVolumeMetadata %s with err: %v",
+				volumeMetadata.GetNamespace(), volumeName, volumeMetadata.GetName(), err)
+			continue
+		}
+		pv, err := metadataSyncer.pvLister.Get(pvc.Spec.VolumeName)
+		if err != nil {
+			klog.Errorf("VolumeMetadataUpdated: Error getting Persistent Volume for pvc %s in namespace %s with err: %v", pvc.Name, pvc.Namespace, err)
+			continue
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+			klog.V(3).Infof("VolumeMetadataUpdated: Not a Vsphere CSI Volume")
+			continue
+		}
+		clusterID, err := metadataSyncer.getGuestClusterID(pvc.Namespace, pvc.Name)
+		if err != nil {
+			klog.Errorf("VolumeMetadataUpdated: Error getting guest cluster of PVC %s/%s with err: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		if clusterID != guestClusterID {
+			klog.Warningf("VolumeMetadataUpdated: Ignoring CnsVolumeMetadata %s/%s of guest cluster %q for PVC %s of guest cluster %q",
+				volumeMetadata.GetNamespace(), volumeMetadata.GetName(), guestClusterID, pvc.Name, clusterID)
+			continue
+		}
+		entityMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(entityName, labels, deleted, entityType, namespace)
+		updateSpec := cnstypes.CnsVolumeMetadataUpdateSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: pv.Spec.CSI.VolumeHandle,
+			},
+			Metadata: cnstypes.CnsVolumeMetadata{
+				ContainerCluster: cnsvsphere.GetContainerCluster(clusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+				EntityMetadata:   []cnstypes.BaseCnsEntityMetadata{entityMetadata},
+			},
+		}
+		klog.V(4).Infof("VolumeMetadataUpdated: Queueing UpdateVolumeMetadata for volume %s", updateSpec.VolumeId.Id)
+		metadataSyncer.metadataUpdates.add(updateSpec)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"fmt"
+
+	"github.com/onsi/ginkgo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// The helpers in this file create and observe CnsNodeVMAttachment and
+// CnsVolumeMetadata custom resources directly through the dynamic client.
+// This allows the WCP-mode conflict and retry handling to be exercised
+// without deploying a full supervisor cluster. The CRDs are expected to be
+// registered in the cluster under test.
+
+var (
+	cnsNodeVMAttachmentGVR = schema.GroupVersionResource{
+		Group:    cnsCRDGroup,
+		Version:  cnsCRDVersion,
+		Resource: cnsNodeVMAttachmentResource,
+	}
+	cnsVolumeMetadataGVR = schema.GroupVersionResource{
+		Group:    cnsCRDGroup,
+		Version:  cnsCRDVersion,
+		Resource: cnsVolumeMetadataResource,
+	}
+)
+
+// getCnsNodeVMAttachmentSpec returns an unstructured CnsNodeVMAttachment
+// requesting volumeName to be attached to the node VM with nodeUUID
+func getCnsNodeVMAttachmentSpec(name string, namespace string, nodeUUID string, volumeName string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": cnsCRDGroup + "/" + cnsCRDVersion,
+			"kind":       cnsNodeVMAttachmentKind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"nodeuuid":   nodeUUID,
+				"volumename": volumeName,
+			},
+		},
+	}
+	return obj
+}
+
+// getCnsVolumeMetadataSpec returns an unstructured CnsVolumeMetadata for the
+// given guest cluster entity referencing volumeNames
+func getCnsVolumeMetadataSpec(name string, namespace string, guestClusterID string, entityType string,
+	entityName string, volumeNames []string, labels map[string]string) *unstructured.Unstructured {
+	names := make([]interface{}, 0, len(volumeNames))
+	for _, volumeName := range volumeNames {
+		names = append(names, volumeName)
+	}
+	entityLabels := make(map[string]interface{}, len(labels))
+	for k, v := range labels {
+		entityLabels[k] = v
+	}
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": cnsCRDGroup + "/" + cnsCRDVersion,
+			"kind":       cnsVolumeMetadataKind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"volumenames":    names,
+				"guestclusterid": guestClusterID,
+				"entitytype":     entityType,
+				"entityname":     entityName,
+				"labels":         entityLabels,
+			},
+		},
+	}
+	return obj
+}
+
+// createCnsNodeVMAttachment creates the specified CnsNodeVMAttachment
+func createCnsNodeVMAttachment(client dynamic.Interface, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	ginkgo.By(fmt.Sprintf("Creating CnsNodeVMAttachment %q in namespace %q", obj.GetName(), obj.GetNamespace()))
+	return client.Resource(cnsNodeVMAttachmentGVR).Namespace(obj.GetNamespace()).Create(obj, metav1.CreateOptions{})
+}
+
+// createCnsVolumeMetadata creates the specified CnsVolumeMetadata
+func createCnsVolumeMetadata(client dynamic.Interface, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	ginkgo.By(fmt.Sprintf("Creating CnsVolumeMetadata %q in namespace %q", obj.GetName(), obj.GetNamespace()))
+	return client.Resource(cnsVolumeMetadataGVR).Namespace(obj.GetNamespace()).Create(obj, metav1.CreateOptions{})
+}
+
+// deleteCnsNodeVMAttachment deletes the named CnsNodeVMAttachment, ignoring
+// the error if it is already gone
+func deleteCnsNodeVMAttachment(client dynamic.Interface, namespace string, name string) error {
+	ginkgo.By(fmt.Sprintf("Deleting CnsNodeVMAttachment %q in namespace %q", name, namespace))
+	err := client.Resource(cnsNodeVMAttachmentGVR).Namespace(namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteCnsVolumeMetadata deletes the named CnsVolumeMetadata, ignoring the
+// error if it is already gone
+func deleteCnsVolumeMetadata(client dynamic.Interface, namespace string, name string) error {
+	ginkgo.By(fmt.Sprintf("Deleting CnsVolumeMetadata %q in namespace %q", name, namespace))
+	err := client.Resource(cnsVolumeMetadataGVR).Namespace(namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// mutateCnsCRWithRetry fetches the latest version of the named custom resource,
+// applies mutateFn to it and updates it, retrying on conflicts with concurrent
+// writers such as the CNS operator
+func mutateCnsCRWithRetry(client dynamic.Interface, gvr schema.GroupVersionResource, namespace string, name string,
+	mutateFn func(obj *unstructured.Unstructured) error) (*unstructured.Unstructured, error) {
+	var updated *unstructured.Unstructured
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Resource(gvr).Namespace(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err = mutateFn(obj); err != nil {
+			return err
+		}
+		updated, err = client.Resource(gvr).Namespace(namespace).Update(obj, metav1.UpdateOptions{})
+		if err != nil && apierrors.IsConflict(err) {
+			framework.Logf("Conflict while updating %s %q in namespace %q, retrying", gvr.Resource, name, namespace)
+		}
+		return err
+	})
+	return updated, err
+}
+
+// updateCnsCRWithStaleVersion updates obj without refreshing it first. When
+// obj has been modified since it was read, the API server is expected to
+// reject the update with a conflict, which is returned to the caller.
+func updateCnsCRWithStaleVersion(client dynamic.Interface, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	_, err := client.Resource(gvr).Namespace(obj.GetNamespace()).Update(obj, metav1.UpdateOptions{})
+	if err == nil {
+		return fmt.Errorf("update of %s %q with stale resourceVersion %q succeeded, expected a conflict",
+			gvr.Resource, obj.GetName(), obj.GetResourceVersion())
+	}
+	if !apierrors.IsConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// setCnsNodeVMAttachmentStatus sets the status fields of the named
+// CnsNodeVMAttachment, mimicking the CNS operator in the supervisor cluster
+func setCnsNodeVMAttachmentStatus(client dynamic.Interface, namespace string, name string, attached bool, diskUUID string, attachErr string) (*unstructured.Unstructured, error) {
+	return mutateCnsCRWithRetry(client, cnsNodeVMAttachmentGVR, namespace, name, func(obj *unstructured.Unstructured) error {
+		status := map[string]interface{}{
+			"attached": attached,
+			"error":    attachErr,
+		}
+		if diskUUID != "" {
+			status["metadata"] = map[string]interface{}{
+				"diskUUID": diskUUID,
+			}
+		}
+		return unstructured.SetNestedMap(obj.Object, status, "status")
+	})
+}
+
+// setCnsVolumeMetadataLabels replaces the labels pushed by the named
+// CnsVolumeMetadata
+func setCnsVolumeMetadataLabels(client dynamic.Interface, namespace string, name string, labels map[string]string) (*unstructured.Unstructured, error) {
+	return mutateCnsCRWithRetry(client, cnsVolumeMetadataGVR, namespace, name, func(obj *unstructured.Unstructured) error {
+		return unstructured.SetNestedStringMap(obj.Object, labels, "spec", "labels")
+	})
+}
+
+// waitForCnsNodeVMAttachmentStatus waits until the named CnsNodeVMAttachment
+// reports the expected attached state and returns the final object
+func waitForCnsNodeVMAttachmentStatus(client dynamic.Interface, namespace string, name string, attached bool) (*unstructured.Unstructured, error) {
+	var obj *unstructured.Unstructured
+	err := wait.Poll(poll, pollTimeout, func() (bool, error) {
+		var err error
+		obj, err = client.Resource(cnsNodeVMAttachmentGVR).Namespace(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		isAttached, found, err := unstructured.NestedBool(obj.Object, "status", "attached")
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			return false, nil
+		}
+		if attachErr, _, _ := unstructured.NestedString(obj.Object, "status", "error"); attachErr != "" {
+			framework.Logf("CnsNodeVMAttachment %q in namespace %q reports error: %s", name, namespace, attachErr)
+		}
+		return isAttached == attached, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CnsNodeVMAttachment %q in namespace %q did not reach attached=%t. err: %v", name, namespace, attached, err)
+	}
+	return obj, nil
+}
+
+// waitForCnsVolumeMetadataDeleted waits until the named CnsVolumeMetadata is
+// removed, e.g. after its finalizers have been processed
+func waitForCnsVolumeMetadataDeleted(client dynamic.Interface, namespace string, name string) error {
+	err := wait.Poll(poll, pollTimeout, func() (bool, error) {
+		_, err := client.Resource(cnsVolumeMetadataGVR).Namespace(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("CnsVolumeMetadata %q in namespace %q was not deleted. err: %v", name, namespace, err)
+	}
+	return nil
+}
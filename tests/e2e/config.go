@@ -44,6 +44,8 @@ type e2eTestConfig struct {
 		InsecureFlag bool `gcfg:"insecure-flag"`
 		// Datacenter in which VMs are located.
 		Datacenters string `gcfg:"datacenters"`
+		// Maximum number of volumes returned by a single CNS query. Optional.
+		QueryLimit int `gcfg:"query-limit"`
 	}
 }
 
@@ -73,5 +75,11 @@ func readConfig(config io.Reader) (e2eTestConfig, error) {
 	}
 	var cfg e2eTestConfig
 	err := gcfg.ReadInto(&cfg, config)
-	return cfg, err
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Global.QueryLimit <= 0 {
+		cfg.Global.QueryLimit = defaultQueryLimit
+	}
+	return cfg, nil
 }
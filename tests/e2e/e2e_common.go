@@ -58,6 +58,13 @@ const (
 	execCommand                                = "/bin/df -T /mnt/volume1 | /bin/awk 'FNR == 2 {print $2}' > /mnt/volume1/fstype && while true ; do sleep 2 ; done"
 	kubeSystemNamespace                        = "kube-system"
 	vSphereCSIControllerPodNamePrefix          = "vsphere-csi-controller"
+	defaultQueryLimit                          = 100
+	cnsCRDGroup                                = "cns.vmware.com"
+	cnsCRDVersion                              = "v1alpha1"
+	cnsNodeVMAttachmentResource                = "cnsnodevmattachments"
+	cnsNodeVMAttachmentKind                    = "CnsNodeVmAttachment"
+	cnsVolumeMetadataResource                  = "cnsvolumemetadatas"
+	cnsVolumeMetadataKind                      = "CnsVolumeMetadata"
 )
 
 // GetAndExpectStringEnvVar parses a string from env variable
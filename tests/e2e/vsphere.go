@@ -63,7 +63,7 @@ func (vs *vSphere) queryCNSVolumeWithResult(fcdID string) (*cnstypes.CnsQueryRes
 		VolumeIds: volumeIds,
 		Cursor: &cnstypes.CnsCursor{
 			Offset: 0,
-			Limit:  100,
+			Limit:  int64(vs.Config.Global.QueryLimit),
 		},
 	}
 	req := cnstypes.CnsQueryVolume{